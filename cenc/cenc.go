@@ -0,0 +1,286 @@
+// Package cenc encrypts media samples with the ISO/IEC 23001-7 common encryption schemes:
+// cenc and cens with AES-CTR, cbc1 and cbcs with AES-CBC.
+package cenc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/Cooomma/widevine-proxy/pssh"
+)
+
+// KeySize is the size of common encryption keys, AES-128.
+const KeySize = 16
+
+// Subsample is a clear range followed by a protected range of a sample.
+type Subsample struct {
+	BytesOfClearData     uint16
+	BytesOfProtectedData uint32
+}
+
+// Pattern is the crypt:skip pattern of cens and cbcs, in 16 byte blocks. The zero Pattern encrypts
+// every block.
+type Pattern struct {
+	CryptByteBlock uint8
+	SkipByteBlock  uint8
+}
+
+// VideoPattern is the 1:9 pattern of video tracks.
+var VideoPattern = Pattern{CryptByteBlock: 1, SkipByteBlock: 9}
+
+// Encryptor encrypts the samples of a track with a key. Each sample gets the next IV, except with
+// cbcs, where every sample uses the constant IV.
+type Encryptor struct {
+	scheme  pssh.ProtectionScheme
+	block   cipher.Block
+	pattern Pattern
+	iv      []byte
+}
+
+// NewEncryptor creates an Encryptor of a scheme. The IV is 8 or 16 bytes for cenc and cens, 16 bytes
+// for cbc1, and the constant IV for cbcs; a random IV is picked when it is nil. The pattern only applies
+// to cens and cbcs.
+func NewEncryptor(scheme pssh.ProtectionScheme, key, iv []byte, pattern Pattern) (*Encryptor, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("cenc: key must be %d bytes, got %d", KeySize, len(key))
+	}
+	if err := checkPattern(scheme, pattern); err != nil {
+		return nil, err
+	}
+	if iv == nil {
+		iv = make([]byte, defaultIVSize(scheme))
+		if _, err := rand.Read(iv); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkIV(scheme, iv); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Encryptor{scheme: scheme, block: block, pattern: pattern, iv: append([]byte(nil), iv...)}, nil
+}
+
+// Scheme returns the protection scheme.
+func (e *Encryptor) Scheme() pssh.ProtectionScheme {
+	return e.scheme
+}
+
+// Pattern returns the crypt:skip pattern.
+func (e *Encryptor) Pattern() Pattern {
+	return e.pattern
+}
+
+// PerSampleIVSize returns the size of the IVs signaled for each sample, 0 with a constant IV.
+func (e *Encryptor) PerSampleIVSize() int {
+	if e.scheme == pssh.SchemeCBCS {
+		return 0
+	}
+	return len(e.iv)
+}
+
+// ConstantIV returns the IV of every sample with cbcs, nil otherwise.
+func (e *Encryptor) ConstantIV() []byte {
+	if e.scheme != pssh.SchemeCBCS {
+		return nil
+	}
+	return append([]byte(nil), e.iv...)
+}
+
+// EncryptSample encrypts a sample in place and returns the IV it was encrypted with. Without subsamples
+// the whole sample is protected. Trailing partial blocks of protected ranges are left clear with cens
+// and cbc1 full-sample encryption and with cbcs.
+func (e *Encryptor) EncryptSample(sample []byte, subsamples []Subsample) ([]byte, error) {
+	iv := append([]byte(nil), e.iv...)
+	protected, err := crypt(e.scheme, e.block, iv, e.pattern, sample, subsamples, true)
+	if err != nil {
+		return nil, err
+	}
+	e.advance(protected)
+	return iv, nil
+}
+
+// advance moves to the IV of the next sample: past the counter blocks used by a sample with a 16 byte
+// CTR IV, the next value otherwise.
+func (e *Encryptor) advance(protected int) {
+	switch {
+	case e.scheme == pssh.SchemeCBCS:
+	case len(e.iv) == 16 && (e.scheme == pssh.SchemeCENC || e.scheme == pssh.SchemeCENS):
+		addCounter(e.iv, uint64((protected+aes.BlockSize-1)/aes.BlockSize))
+	default:
+		addCounter(e.iv, 1)
+	}
+}
+
+// DecryptSample decrypts a sample encrypted with a scheme in place.
+func DecryptSample(scheme pssh.ProtectionScheme, key, iv []byte, pattern Pattern, sample []byte, subsamples []Subsample) error {
+	if len(key) != KeySize {
+		return fmt.Errorf("cenc: key must be %d bytes, got %d", KeySize, len(key))
+	}
+	if err := checkPattern(scheme, pattern); err != nil {
+		return err
+	}
+	if err := checkIV(scheme, iv); err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	_, err = crypt(scheme, block, iv, pattern, sample, subsamples, false)
+	return err
+}
+
+func defaultIVSize(scheme pssh.ProtectionScheme) int {
+	if scheme == pssh.SchemeCENC || scheme == pssh.SchemeCENS {
+		return 8
+	}
+	return 16
+}
+
+func checkIV(scheme pssh.ProtectionScheme, iv []byte) error {
+	switch {
+	case (scheme == pssh.SchemeCENC || scheme == pssh.SchemeCENS) && (len(iv) == 8 || len(iv) == 16):
+	case (scheme == pssh.SchemeCBC1 || scheme == pssh.SchemeCBCS) && len(iv) == 16:
+	default:
+		return fmt.Errorf("cenc: invalid %s IV size %d", scheme, len(iv))
+	}
+	return nil
+}
+
+func checkPattern(scheme pssh.ProtectionScheme, pattern Pattern) error {
+	switch scheme {
+	case pssh.SchemeCENC, pssh.SchemeCBC1:
+		if pattern != (Pattern{}) {
+			return fmt.Errorf("cenc: %s does not support pattern encryption", scheme)
+		}
+	case pssh.SchemeCENS, pssh.SchemeCBCS:
+		if pattern.CryptByteBlock > 15 || pattern.SkipByteBlock > 15 {
+			return fmt.Errorf("cenc: pattern %d:%d does not fit in 4 bits", pattern.CryptByteBlock, pattern.SkipByteBlock)
+		}
+		if pattern.CryptByteBlock == 0 && pattern.SkipByteBlock != 0 {
+			return fmt.Errorf("cenc: pattern %d:%d encrypts nothing", pattern.CryptByteBlock, pattern.SkipByteBlock)
+		}
+	default:
+		return fmt.Errorf("cenc: unsupported protection scheme %s", scheme)
+	}
+	return nil
+}
+
+// crypt encrypts or decrypts the protected ranges of a sample in place and returns their size.
+func crypt(scheme pssh.ProtectionScheme, block cipher.Block, iv []byte, pattern Pattern, sample []byte, subsamples []Subsample, encrypt bool) (int, error) {
+	ranges, err := protectedRanges(sample, subsamples)
+	if err != nil {
+		return 0, err
+	}
+
+	protected := 0
+	switch scheme {
+	case pssh.SchemeCENC, pssh.SchemeCENS:
+		// The key stream runs on across the protected ranges of a sample.
+		counter := make([]byte, aes.BlockSize)
+		copy(counter, iv)
+		stream := cipher.NewCTR(block, counter)
+		for _, r := range ranges {
+			if scheme == pssh.SchemeCENS && subsamples != nil && len(r)%aes.BlockSize != 0 {
+				return 0, fmt.Errorf("cenc: cens protected range of %d bytes is not a multiple of the block size", len(r))
+			}
+			protected += eachPatternBlock(r, pattern, func(b []byte) {
+				stream.XORKeyStream(b, b)
+			}, scheme == pssh.SchemeCENC)
+		}
+	case pssh.SchemeCBC1:
+		// The cipher block chain runs on across the protected ranges of a sample.
+		mode := cbcMode(block, iv, encrypt)
+		for i, r := range ranges {
+			if subsamples != nil && len(r)%aes.BlockSize != 0 {
+				return 0, fmt.Errorf("cenc: cbc1 protected range %d of %d bytes is not a multiple of the block size", i, len(r))
+			}
+			protected += eachPatternBlock(r, Pattern{}, func(b []byte) {
+				mode.CryptBlocks(b, b)
+			}, false)
+		}
+	case pssh.SchemeCBCS:
+		// Each protected range starts again from the constant IV.
+		for _, r := range ranges {
+			mode := cbcMode(block, iv, encrypt)
+			protected += eachPatternBlock(r, pattern, func(b []byte) {
+				mode.CryptBlocks(b, b)
+			}, false)
+		}
+	default:
+		return 0, fmt.Errorf("cenc: unsupported protection scheme %s", scheme)
+	}
+	return protected, nil
+}
+
+func cbcMode(block cipher.Block, iv []byte, encrypt bool) cipher.BlockMode {
+	if encrypt {
+		return cipher.NewCBCEncrypter(block, iv)
+	}
+	return cipher.NewCBCDecrypter(block, iv)
+}
+
+// eachPatternBlock calls f with the blocks of a protected range the pattern encrypts, in order, and
+// returns their size. A trailing partial block is passed on only when partial is set.
+func eachPatternBlock(r []byte, pattern Pattern, f func([]byte), partial bool) int {
+	cryptBlocks, skipBlocks := int(pattern.CryptByteBlock), int(pattern.SkipByteBlock)
+	if cryptBlocks == 0 {
+		cryptBlocks, skipBlocks = 1, 0
+	}
+	n := 0
+	for i := 0; i+aes.BlockSize <= len(r); {
+		for c := 0; c < cryptBlocks && i+aes.BlockSize <= len(r); c++ {
+			f(r[i : i+aes.BlockSize])
+			i += aes.BlockSize
+			n += aes.BlockSize
+		}
+		i += skipBlocks * aes.BlockSize
+	}
+	if rest := len(r) % aes.BlockSize; partial && rest != 0 {
+		f(r[len(r)-rest:])
+		n += rest
+	}
+	return n
+}
+
+// protectedRanges splits a sample into the protected ranges of its subsamples.
+func protectedRanges(sample []byte, subsamples []Subsample) ([][]byte, error) {
+	if subsamples == nil {
+		return [][]byte{sample}, nil
+	}
+	var ranges [][]byte
+	offset := 0
+	for _, s := range subsamples {
+		offset += int(s.BytesOfClearData)
+		end := offset + int(s.BytesOfProtectedData)
+		if end > len(sample) {
+			return nil, fmt.Errorf("cenc: subsamples cover %d bytes of a %d byte sample", end, len(sample))
+		}
+		ranges = append(ranges, sample[offset:end])
+		offset = end
+	}
+	if offset != len(sample) {
+		return nil, fmt.Errorf("cenc: subsamples cover %d bytes of a %d byte sample", offset, len(sample))
+	}
+	return ranges, nil
+}
+
+// addCounter adds n to the big-endian value of an 8 or 16 byte IV.
+func addCounter(iv []byte, n uint64) {
+	if len(iv) == 8 {
+		binary.BigEndian.PutUint64(iv, binary.BigEndian.Uint64(iv)+n)
+		return
+	}
+	low := binary.BigEndian.Uint64(iv[8:])
+	sum := low + n
+	binary.BigEndian.PutUint64(iv[8:], sum)
+	if sum < low {
+		binary.BigEndian.PutUint64(iv[:8], binary.BigEndian.Uint64(iv[:8])+1)
+	}
+}
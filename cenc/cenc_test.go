@@ -0,0 +1,192 @@
+package cenc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"testing"
+
+	"github.com/Cooomma/widevine-proxy/pssh"
+	"github.com/stretchr/testify/assert"
+)
+
+// NIST SP 800-38A, F.2.1 and F.5.1: AES-128 CBC and CTR.
+const (
+	testKey        = "2b7e151628aed2a6abf7158809cf4f3c"
+	testCBCIV      = "000102030405060708090a0b0c0d0e0f"
+	testCTRCounter = "f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"
+	testPlainText  = "6bc1bee22e409f96e93d7e117393172a" + "ae2d8a571e03ac9c9eb76fac45af8e51" +
+		"30c81c46a35ce411e5fbc1191a0a52ef" + "f69f2445df4f9b17ad2b417be66c3710"
+	testCBCCipherText = "7649abac8119b246cee98e9b12e9197d" + "5086cb9b507219ee95db113a917678b2" +
+		"73bed6b8e3c1743b7116e69e22229516" + "3ff1caa1681fac09120eca307586e1a7"
+	testCTRCipherText = "874d6191b620e3261bef6864990db6ce" + "9806f66b7970fdff8617187bb9fffdff" +
+		"5ae4df3edbd5d35e5b4f09020db03eab" + "1e031dda2fbe03d1792170a0f3009cee"
+)
+
+func decode(s string) []byte {
+	b, _ := hex.DecodeString(s)
+	return b
+}
+
+func encrypt(t *testing.T, scheme pssh.ProtectionScheme, iv string, pattern Pattern, sample []byte, subsamples []Subsample) []byte {
+	e, err := NewEncryptor(scheme, decode(testKey), decode(iv), pattern)
+	assert.NoError(t, err)
+	plain := sample
+	sample = append([]byte(nil), sample...)
+	sampleIV, err := e.EncryptSample(sample, subsamples)
+	assert.NoError(t, err)
+	assert.Equal(t, iv, hex.EncodeToString(sampleIV))
+
+	decrypted := append([]byte(nil), sample...)
+	assert.NoError(t, DecryptSample(scheme, decode(testKey), sampleIV, pattern, decrypted, subsamples))
+	assert.Equal(t, plain, decrypted)
+	return sample
+}
+
+func TestCENC(t *testing.T) {
+	plain := decode(testPlainText)
+	assert.Equal(t, testCTRCipherText, hex.EncodeToString(encrypt(t, pssh.SchemeCENC, testCTRCounter, Pattern{}, plain, nil)))
+
+	// The key stream runs on across subsamples, and partial blocks are encrypted.
+	sample := append([]byte("clear"), plain[:20]...)
+	sample = append(sample, []byte("more clear")...)
+	sample = append(sample, plain[20:]...)
+	got := encrypt(t, pssh.SchemeCENC, testCTRCounter, Pattern{}, sample, []Subsample{{5, 20}, {10, 44}})
+	assert.Equal(t, "clear", string(got[:5]))
+	assert.Equal(t, "more clear", string(got[25:35]))
+	assert.Equal(t, testCTRCipherText, hex.EncodeToString(append(got[5:25:25], got[35:]...)))
+
+	// An 8 byte IV is the high half of the counter.
+	iv := "0001020304050607"
+	block, _ := aes.NewCipher(decode(testKey))
+	want := make([]byte, len(plain))
+	cipher.NewCTR(block, decode(iv+"0000000000000000")).XORKeyStream(want, plain)
+	assert.Equal(t, want, encrypt(t, pssh.SchemeCENC, iv, Pattern{}, plain, nil))
+}
+
+func TestCENS(t *testing.T) {
+	plain := decode(testPlainText)
+	ctr := decode(testCTRCipherText)
+
+	// Skipped blocks do not use the key stream: the second encrypted block takes the second key block.
+	got := encrypt(t, pssh.SchemeCENS, testCTRCounter, Pattern{CryptByteBlock: 1, SkipByteBlock: 1}, plain, nil)
+	assert.Equal(t, ctr[:16], got[:16])
+	assert.Equal(t, plain[16:32], got[16:32])
+	keyStream := xor(ctr[16:32], plain[16:32])
+	assert.Equal(t, xor(plain[32:48], keyStream), got[32:48])
+	assert.Equal(t, plain[48:], got[48:])
+
+	// The trailing partial block of a full sample stays clear.
+	got = encrypt(t, pssh.SchemeCENS, testCTRCounter, Pattern{}, append(plain, "tail"...), nil)
+	assert.Equal(t, testCTRCipherText+hex.EncodeToString([]byte("tail")), hex.EncodeToString(got))
+
+	e, _ := NewEncryptor(pssh.SchemeCENS, decode(testKey), nil, VideoPattern)
+	_, err := e.EncryptSample(make([]byte, 20), []Subsample{{0, 20}})
+	assert.EqualError(t, err, "cenc: cens protected range of 20 bytes is not a multiple of the block size")
+}
+
+func TestCBC1(t *testing.T) {
+	plain := decode(testPlainText)
+
+	// The trailing partial block of a full sample stays clear.
+	got := encrypt(t, pssh.SchemeCBC1, testCBCIV, Pattern{}, append(plain, "tail"...), nil)
+	assert.Equal(t, testCBCCipherText+hex.EncodeToString([]byte("tail")), hex.EncodeToString(got))
+
+	// The chain runs on across subsamples.
+	sample := append([]byte("head"), plain[:32]...)
+	sample = append(sample, []byte("nal")...)
+	sample = append(sample, plain[32:]...)
+	got = encrypt(t, pssh.SchemeCBC1, testCBCIV, Pattern{}, sample, []Subsample{{4, 32}, {3, 32}})
+	assert.Equal(t, testCBCCipherText, hex.EncodeToString(append(got[4:36:36], got[39:]...)))
+
+	e, _ := NewEncryptor(pssh.SchemeCBC1, decode(testKey), nil, Pattern{})
+	_, err := e.EncryptSample(make([]byte, 20), []Subsample{{0, 20}})
+	assert.EqualError(t, err, "cenc: cbc1 protected range 0 of 20 bytes is not a multiple of the block size")
+}
+
+func TestCBCS(t *testing.T) {
+	plain := decode(testPlainText)
+	cbc := decode(testCBCCipherText)
+
+	// 1:9 encrypts the first block of each ten.
+	got := encrypt(t, pssh.SchemeCBCS, testCBCIV, VideoPattern, plain, nil)
+	assert.Equal(t, cbc[:16], got[:16])
+	assert.Equal(t, plain[16:], got[16:])
+
+	// Each subsample starts again from the constant IV, and partial blocks stay clear.
+	sample := append([]byte("nal"), plain[:20]...)
+	sample = append(sample, []byte("nal")...)
+	sample = append(sample, plain[:16]...)
+	got = encrypt(t, pssh.SchemeCBCS, testCBCIV, VideoPattern, sample, []Subsample{{3, 20}, {3, 16}})
+	assert.Equal(t, cbc[:16], got[3:19])
+	assert.Equal(t, plain[16:20], got[19:23])
+	assert.Equal(t, cbc[:16], got[26:])
+
+	// Encrypting every block is CBC over the whole blocks.
+	got = encrypt(t, pssh.SchemeCBCS, testCBCIV, Pattern{}, append(plain, 1, 2, 3), nil)
+	assert.Equal(t, testCBCCipherText+"010203", hex.EncodeToString(got))
+}
+
+func TestSampleIVs(t *testing.T) {
+	sample := make([]byte, 40)
+
+	// 8 byte IVs count samples.
+	e, err := NewEncryptor(pssh.SchemeCENC, decode(testKey), decode("00000000000000ff"), Pattern{})
+	assert.NoError(t, err)
+	assert.Equal(t, 8, e.PerSampleIVSize())
+	for _, want := range []string{"00000000000000ff", "0000000000000100", "0000000000000101"} {
+		iv, err := e.EncryptSample(append([]byte(nil), sample...), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, want, hex.EncodeToString(iv))
+	}
+
+	// 16 byte CTR IVs skip the counter blocks of each sample.
+	e, _ = NewEncryptor(pssh.SchemeCENC, decode(testKey), decode("0000000000000000fffffffffffffffe"), Pattern{})
+	for _, want := range []string{"0000000000000000fffffffffffffffe", "00000000000000010000000000000001"} {
+		iv, err := e.EncryptSample(append([]byte(nil), sample...), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, want, hex.EncodeToString(iv))
+	}
+
+	// cbcs signals a constant IV.
+	e, _ = NewEncryptor(pssh.SchemeCBCS, decode(testKey), decode(testCBCIV), VideoPattern)
+	assert.Equal(t, 0, e.PerSampleIVSize())
+	assert.Equal(t, decode(testCBCIV), e.ConstantIV())
+	for i := 0; i < 2; i++ {
+		iv, _ := e.EncryptSample(append([]byte(nil), sample...), nil)
+		assert.Equal(t, testCBCIV, hex.EncodeToString(iv))
+	}
+
+	// Random IVs have the size of the scheme.
+	e, _ = NewEncryptor(pssh.SchemeCBC1, decode(testKey), nil, Pattern{})
+	assert.Equal(t, 16, e.PerSampleIVSize())
+	assert.Nil(t, e.ConstantIV())
+}
+
+func TestEncryptorErrors(t *testing.T) {
+	key := decode(testKey)
+	_, err := NewEncryptor(pssh.SchemeCENC, key[:8], nil, Pattern{})
+	assert.EqualError(t, err, "cenc: key must be 16 bytes, got 8")
+	_, err = NewEncryptor(pssh.SchemeCBCS, key, decode("0001020304050607"), VideoPattern)
+	assert.EqualError(t, err, "cenc: invalid cbcs IV size 8")
+	_, err = NewEncryptor(pssh.SchemeCENC, key, nil, VideoPattern)
+	assert.EqualError(t, err, "cenc: cenc does not support pattern encryption")
+	_, err = NewEncryptor(pssh.SchemeCBCS, key, nil, Pattern{CryptByteBlock: 16, SkipByteBlock: 1})
+	assert.EqualError(t, err, "cenc: pattern 16:1 does not fit in 4 bits")
+	_, err = NewEncryptor(pssh.ProtectionScheme(0x61626364), key, nil, Pattern{})
+	assert.EqualError(t, err, "cenc: unsupported protection scheme abcd")
+
+	e, _ := NewEncryptor(pssh.SchemeCENC, key, nil, Pattern{})
+	_, err = e.EncryptSample(make([]byte, 10), []Subsample{{4, 4}})
+	assert.EqualError(t, err, "cenc: subsamples cover 8 bytes of a 10 byte sample")
+	_, err = e.EncryptSample(make([]byte, 10), []Subsample{{4, 10}})
+	assert.EqualError(t, err, "cenc: subsamples cover 14 bytes of a 10 byte sample")
+}
+
+func xor(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
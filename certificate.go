@@ -0,0 +1,283 @@
+package widevineproxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/Cooomma/widevine-proxy/internal/wire"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// DrmCertificateType is the type of a DRM certificate.
+type DrmCertificateType int
+
+// DRM certificate types.
+const (
+	DrmCertificateTypeRoot        DrmCertificateType = 0
+	DrmCertificateTypeDeviceModel DrmCertificateType = 1
+	DrmCertificateTypeDevice      DrmCertificateType = 2
+	DrmCertificateTypeService     DrmCertificateType = 3
+	DrmCertificateTypeProvisioner DrmCertificateType = 4
+)
+
+func (t DrmCertificateType) String() string {
+	switch t {
+	case DrmCertificateTypeRoot:
+		return "ROOT"
+	case DrmCertificateTypeDeviceModel:
+		return "DEVICE_MODEL"
+	case DrmCertificateTypeDevice:
+		return "DEVICE"
+	case DrmCertificateTypeService:
+		return "SERVICE"
+	case DrmCertificateTypeProvisioner:
+		return "PROVISIONER"
+	}
+	return fmt.Sprintf("DrmCertificateType(%d)", int(t))
+}
+
+// A chain longer than this is rejected rather than walked.
+const maxCertificateChainDepth = 5
+
+// DrmCertificate is a Widevine DRM certificate.
+type DrmCertificate struct {
+	Type         DrmCertificateType
+	SerialNumber []byte
+	CreationTime time.Time
+	PublicKey    *rsa.PublicKey
+	SystemID     uint32
+	ProviderID   string
+	// Raw is the encoded DrmCertificate the signature is computed over.
+	Raw []byte
+}
+
+// SignedDrmCertificate is a DRM certificate with its signature and the certificate chain of its signer.
+type SignedDrmCertificate struct {
+	Certificate   *DrmCertificate
+	Signature     []byte
+	HashAlgorithm crypto.Hash
+	// Signer is nil when the certificate is signed by the root.
+	Signer *SignedDrmCertificate
+	// Raw is the encoded SignedDrmCertificate.
+	Raw []byte
+}
+
+// ParseSignedDrmCertificate parses a SignedDrmCertificate, either bare or wrapped in the
+// SERVICE_CERTIFICATE SignedMessage the license server answers service certificate requests with.
+func ParseSignedDrmCertificate(b []byte) (*SignedDrmCertificate, error) {
+	// A SignedMessage starts with its varint type, a SignedDrmCertificate with the certificate bytes.
+	if num, typ, n := protowire.ConsumeTag(b); n > 0 && num == 1 && typ == protowire.VarintType {
+		sm, err := decodeSignedMessage(b)
+		if err != nil {
+			return nil, err
+		}
+		if sm.Type != MessageTypeServiceCertificate {
+			return nil, fmt.Errorf("signed message is not a service certificate: %s", sm.Type)
+		}
+		b = sm.Msg
+	}
+	return parseSignedDrmCertificate(b, 0)
+}
+
+func parseSignedDrmCertificate(b []byte, depth int) (*SignedDrmCertificate, error) {
+	if depth > maxCertificateChainDepth {
+		return nil, fmt.Errorf("certificate chain longer than %d", maxCertificateChainDepth)
+	}
+
+	c := &SignedDrmCertificate{HashAlgorithm: crypto.SHA1, Raw: b}
+	err := wire.Walk(b, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		var err error
+		switch num {
+		case 1:
+			c.Certificate, err = parseDrmCertificate(b)
+		case 2:
+			c.Signature = b
+		case 3:
+			c.Signer, err = parseSignedDrmCertificate(b, depth+1)
+		case 4:
+			c.HashAlgorithm, err = certificateHash(v)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decode signed certificate: %v", err)
+	}
+	if c.Certificate == nil {
+		return nil, fmt.Errorf("signed certificate has no certificate")
+	}
+	if len(c.Signature) == 0 {
+		return nil, fmt.Errorf("%s certificate %x is not signed", c.Certificate.Type, c.Certificate.SerialNumber)
+	}
+	return c, nil
+}
+
+func parseDrmCertificate(b []byte) (*DrmCertificate, error) {
+	c := &DrmCertificate{Raw: b}
+	var publicKey []byte
+	err := wire.Walk(b, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			c.Type = DrmCertificateType(v)
+		case 2:
+			c.SerialNumber = b
+		case 3:
+			c.CreationTime = time.Unix(int64(v), 0).UTC()
+		case 4:
+			publicKey = b
+		case 5:
+			c.SystemID = uint32(v)
+		case 7:
+			c.ProviderID = string(b)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decode certificate: %v", err)
+	}
+	if len(publicKey) == 0 {
+		return nil, fmt.Errorf("%s certificate %x has no public key", c.Type, c.SerialNumber)
+	}
+	if c.PublicKey, err = x509.ParsePKCS1PublicKey(publicKey); err != nil {
+		return nil, fmt.Errorf("%s certificate %x: public key: %v", c.Type, c.SerialNumber, err)
+	}
+	return c, nil
+}
+
+func certificateHash(v uint64) (crypto.Hash, error) {
+	switch v {
+	case 0, 1:
+		return crypto.SHA1, nil
+	case 2:
+		return crypto.SHA256, nil
+	case 3:
+		return crypto.SHA384, nil
+	}
+	return 0, fmt.Errorf("unknown hash algorithm %d", v)
+}
+
+// CheckSignature verifies an RSA-PSS signature made with the certificate's key.
+func (c *DrmCertificate) CheckSignature(hash crypto.Hash, msg, signature []byte) error {
+	var digest []byte
+	switch hash {
+	case crypto.SHA1:
+		sum := sha1.Sum(msg)
+		digest = sum[:]
+	case crypto.SHA256:
+		sum := sha256.Sum256(msg)
+		digest = sum[:]
+	case crypto.SHA384:
+		sum := sha512.Sum384(msg)
+		digest = sum[:]
+	default:
+		return fmt.Errorf("unsupported hash %v", hash)
+	}
+	return rsa.VerifyPSS(c.PublicKey, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+}
+
+// Verify checks the signature chain of the certificate up to root. The chain may end in
+// a copy of the root certificate or in a certificate signed by root.
+func (c *SignedDrmCertificate) Verify(root *DrmCertificate) error {
+	if root == nil {
+		return fmt.Errorf("no root certificate")
+	}
+	for cert := c; ; cert = cert.Signer {
+		signer := root
+		if cert.Signer != nil {
+			signer = cert.Signer.Certificate
+		}
+		if signer.Type == DrmCertificateTypeDevice || signer.Type == DrmCertificateTypeService {
+			return fmt.Errorf("%s certificate %x cannot sign certificates", signer.Type, signer.SerialNumber)
+		}
+		if err := signer.CheckSignature(cert.HashAlgorithm, cert.Certificate.Raw, cert.Signature); err != nil {
+			return fmt.Errorf("%s certificate %x: invalid signature: %v", cert.Certificate.Type, cert.Certificate.SerialNumber, err)
+		}
+		if cert.Signer == nil {
+			return nil
+		}
+		if signer.Type == DrmCertificateTypeRoot {
+			if !bytes.Equal(x509.MarshalPKCS1PublicKey(signer.PublicKey), x509.MarshalPKCS1PublicKey(root.PublicKey)) {
+				return fmt.Errorf("certificate chain ends in an untrusted root %x", signer.SerialNumber)
+			}
+			return nil
+		}
+	}
+}
+
+// VerifyServiceCertificate checks that the certificate is a service certificate of a provider
+// and that its signature chain leads to root.
+func (c *SignedDrmCertificate) VerifyServiceCertificate(root *DrmCertificate) error {
+	if c.Certificate.Type != DrmCertificateTypeService {
+		return fmt.Errorf("%s certificate %x is not a service certificate", c.Certificate.Type, c.Certificate.SerialNumber)
+	}
+	if c.Certificate.ProviderID == "" {
+		return fmt.Errorf("service certificate %x has no provider ID", c.Certificate.SerialNumber)
+	}
+	return c.Verify(root)
+}
+
+// SetServiceCertificate validates a service certificate against the RootCertificate and
+// serves it to service certificate requests from then on.
+func (wp *Proxy) SetServiceCertificate(cert []byte) error {
+	c, err := ParseSignedDrmCertificate(cert)
+	if err != nil {
+		return err
+	}
+	if err := c.VerifyServiceCertificate(wp.RootCertificate); err != nil {
+		return err
+	}
+	wp.serviceCertificateMu.Lock()
+	wp.ServiceCertificate = c
+	wp.serviceCertificateMu.Unlock()
+	wp.Logger.Infof("Service Certificate: %s, serial %s", c.Certificate.ProviderID, hex.EncodeToString(c.Certificate.SerialNumber))
+	return nil
+}
+
+// serviceCertificate returns the ServiceCertificate, which SetServiceCertificate may swap concurrently.
+func (wp *Proxy) serviceCertificate() *SignedDrmCertificate {
+	wp.serviceCertificateMu.RLock()
+	defer wp.serviceCertificateMu.RUnlock()
+	return wp.ServiceCertificate
+}
+
+// serviceCertificateResponse answers a service certificate request with the certificate.
+func (wp *Proxy) serviceCertificateResponse(c *SignedDrmCertificate) *LicenseResponse {
+	sm := &signedMessage{Type: MessageTypeServiceCertificate, Msg: c.Raw}
+	return &LicenseResponse{
+		Status:      "OK",
+		MessageType: MessageTypeServiceCertificate.String(),
+		License:     base64.StdEncoding.EncodeToString(sm.marshal()),
+	}
+}
+
+// checkServiceCertificate rejects a service certificate returned by the license service
+// that does not verify against the RootCertificate.
+func (wp *Proxy) checkServiceCertificate(lr *LicenseResponse) error {
+	b, err := base64.StdEncoding.DecodeString(lr.License)
+	if err != nil {
+		return fmt.Errorf("decode service certificate: %v", err)
+	}
+	c, err := ParseSignedDrmCertificate(b)
+	if err != nil {
+		return err
+	}
+	return c.VerifyServiceCertificate(wp.RootCertificate)
+}
+
+// isServiceCertificateRequest reports whether a base64 encoded challenge asks for the service certificate.
+func isServiceCertificateRequest(body string) bool {
+	b, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return false
+	}
+	sm, err := decodeSignedMessage(b)
+	return err == nil && sm.Type == MessageTypeServiceCertificateRequest
+}
@@ -0,0 +1,146 @@
+package widevineproxy
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/Cooomma/widevine-proxy/internal/wire"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func testCertificateKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	return key
+}
+
+// testSignedCertificate builds a SignedDrmCertificate signed by signerKey, chained to signer.
+func testSignedCertificate(t *testing.T, certType DrmCertificateType, serial string, key, signerKey *rsa.PrivateKey, signer []byte) []byte {
+	var cert []byte
+	cert = wire.AppendVarint(cert, 1, uint64(certType))
+	cert = wire.AppendBytes(cert, 2, []byte(serial))
+	cert = wire.AppendVarint(cert, 3, 1576117132)
+	cert = wire.AppendBytes(cert, 4, x509.MarshalPKCS1PublicKey(&key.PublicKey))
+	if certType == DrmCertificateTypeService {
+		cert = wire.AppendBytes(cert, 7, []byte("widevine_test"))
+	}
+
+	digest := sha1.Sum(cert)
+	signature, err := rsa.SignPSS(rand.Reader, signerKey, crypto.SHA1, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	assert.NoError(t, err)
+
+	var signed []byte
+	signed = wire.AppendBytes(signed, 1, cert)
+	signed = wire.AppendBytes(signed, 2, signature)
+	if signer != nil {
+		signed = wire.AppendBytes(signed, 3, signer)
+	}
+	return signed
+}
+
+func TestParseSignedDrmCertificate(t *testing.T) {
+	rootKey, serviceKey := testCertificateKey(t), testCertificateKey(t)
+	b := testSignedCertificate(t, DrmCertificateTypeService, "service", serviceKey, rootKey, nil)
+
+	c, err := ParseSignedDrmCertificate(b)
+	assert.NoError(t, err)
+	assert.Equal(t, DrmCertificateTypeService, c.Certificate.Type)
+	assert.Equal(t, []byte("service"), c.Certificate.SerialNumber)
+	assert.Equal(t, "widevine_test", c.Certificate.ProviderID)
+	assert.Equal(t, time.Date(2019, 12, 12, 2, 18, 52, 0, time.UTC), c.Certificate.CreationTime)
+	assert.Equal(t, &serviceKey.PublicKey, c.Certificate.PublicKey)
+	assert.Equal(t, crypto.SHA1, c.HashAlgorithm)
+	assert.Nil(t, c.Signer)
+
+	sm := &signedMessage{Type: MessageTypeServiceCertificate, Msg: b}
+	wrapped, err := ParseSignedDrmCertificate(sm.marshal())
+	assert.NoError(t, err)
+	assert.Equal(t, c, wrapped)
+
+	sm.Type = MessageTypeLicense
+	_, err = ParseSignedDrmCertificate(sm.marshal())
+	assert.EqualError(t, err, "signed message is not a service certificate: LICENSE")
+}
+
+func TestVerifyServiceCertificate(t *testing.T) {
+	rootKey, intermediateKey, serviceKey, otherKey := testCertificateKey(t), testCertificateKey(t), testCertificateKey(t), testCertificateKey(t)
+	rootCert := testSignedCertificate(t, DrmCertificateTypeRoot, "root", rootKey, rootKey, nil)
+	root, err := ParseSignedDrmCertificate(rootCert)
+	assert.NoError(t, err)
+
+	// Signed by the root directly.
+	c, _ := ParseSignedDrmCertificate(testSignedCertificate(t, DrmCertificateTypeService, "service", serviceKey, rootKey, nil))
+	assert.NoError(t, c.VerifyServiceCertificate(root.Certificate))
+
+	// Chain ending in a copy of the root.
+	c, _ = ParseSignedDrmCertificate(testSignedCertificate(t, DrmCertificateTypeService, "service", serviceKey, rootKey, rootCert))
+	assert.NoError(t, c.VerifyServiceCertificate(root.Certificate))
+
+	// Chain through a provisioner.
+	intermediate := testSignedCertificate(t, DrmCertificateTypeProvisioner, "provisioner", intermediateKey, rootKey, rootCert)
+	c, _ = ParseSignedDrmCertificate(testSignedCertificate(t, DrmCertificateTypeService, "service", serviceKey, intermediateKey, intermediate))
+	assert.NoError(t, c.VerifyServiceCertificate(root.Certificate))
+
+	// Signed by another key.
+	c, _ = ParseSignedDrmCertificate(testSignedCertificate(t, DrmCertificateTypeService, "service", serviceKey, otherKey, nil))
+	assert.Contains(t, c.VerifyServiceCertificate(root.Certificate).Error(), "SERVICE certificate 73657276696365: invalid signature")
+
+	// Chain ending in another root.
+	otherRoot := testSignedCertificate(t, DrmCertificateTypeRoot, "other", otherKey, otherKey, nil)
+	c, _ = ParseSignedDrmCertificate(testSignedCertificate(t, DrmCertificateTypeService, "service", serviceKey, otherKey, otherRoot))
+	assert.EqualError(t, c.VerifyServiceCertificate(root.Certificate), "certificate chain ends in an untrusted root 6f74686572")
+
+	// A service certificate cannot sign.
+	service := testSignedCertificate(t, DrmCertificateTypeService, "service", serviceKey, rootKey, nil)
+	c, _ = ParseSignedDrmCertificate(testSignedCertificate(t, DrmCertificateTypeService, "leaf", otherKey, serviceKey, service))
+	assert.EqualError(t, c.VerifyServiceCertificate(root.Certificate), "SERVICE certificate 73657276696365 cannot sign certificates")
+
+	// Not a service certificate.
+	assert.EqualError(t, root.VerifyServiceCertificate(root.Certificate), "ROOT certificate 726f6f74 is not a service certificate")
+	assert.EqualError(t, root.Verify(nil), "no root certificate")
+}
+
+func TestGetLicenseServiceCertificate(t *testing.T) {
+	rootKey, serviceKey := testCertificateKey(t), testCertificateKey(t)
+	root, _ := ParseSignedDrmCertificate(testSignedCertificate(t, DrmCertificateTypeRoot, "root", rootKey, rootKey, nil))
+	service := testSignedCertificate(t, DrmCertificateTypeService, "service", serviceKey, rootKey, nil)
+
+	wp := NewWidevineProxy(nil, nil, "widevine_test", nil, logrus.New())
+	assert.Error(t, wp.SetServiceCertificate(service))
+	wp.RootCertificate = root.Certificate
+	assert.Error(t, wp.SetServiceCertificate(testSignedCertificate(t, DrmCertificateTypeService, "service", serviceKey, serviceKey, nil)))
+	assert.NoError(t, wp.SetServiceCertificate(service))
+
+	request := (&signedMessage{Type: MessageTypeServiceCertificateRequest}).marshal()
+	lr, err := wp.GetLicense("", base64.StdEncoding.EncodeToString(request))
+	assert.NoError(t, err)
+	assert.Equal(t, "OK", lr.Status)
+	assert.Equal(t, "SERVICE_CERTIFICATE", lr.MessageType)
+
+	b, _ := base64.StdEncoding.DecodeString(lr.License)
+	c, err := ParseSignedDrmCertificate(b)
+	assert.NoError(t, err)
+	assert.Equal(t, service, c.Raw)
+
+	// The certificate can be swapped while serving.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			assert.NoError(t, wp.SetServiceCertificate(service))
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		lr, err := wp.GetLicense("", base64.StdEncoding.EncodeToString(request))
+		assert.NoError(t, err)
+		assert.Equal(t, "OK", lr.Status)
+	}
+	<-done
+}
@@ -0,0 +1,384 @@
+package widevineproxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Cooomma/widevine-proxy/internal/wire"
+	"github.com/Cooomma/widevine-proxy/pssh"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// MessageType is the type of a Widevine SignedMessage.
+type MessageType int
+
+// SignedMessage types.
+const (
+	MessageTypeLicenseRequest            MessageType = 1
+	MessageTypeLicense                   MessageType = 2
+	MessageTypeErrorResponse             MessageType = 3
+	MessageTypeServiceCertificateRequest MessageType = 4
+	MessageTypeServiceCertificate        MessageType = 5
+	MessageTypeSubLicense                MessageType = 6
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MessageTypeLicenseRequest:
+		return "LICENSE_REQUEST"
+	case MessageTypeLicense:
+		return "LICENSE"
+	case MessageTypeErrorResponse:
+		return "ERROR_RESPONSE"
+	case MessageTypeServiceCertificateRequest:
+		return "SERVICE_CERTIFICATE_REQUEST"
+	case MessageTypeServiceCertificate:
+		return "SERVICE_CERTIFICATE"
+	case MessageTypeSubLicense:
+		return "SUB_LICENSE"
+	}
+	return fmt.Sprintf("MessageType(%d)", int(t))
+}
+
+// RequestType is the type of a LicenseRequest.
+type RequestType int
+
+// LicenseRequest types.
+const (
+	RequestTypeNew     RequestType = 1
+	RequestTypeRenewal RequestType = 2
+	RequestTypeRelease RequestType = 3
+)
+
+func (t RequestType) String() string {
+	switch t {
+	case RequestTypeNew:
+		return "NEW"
+	case RequestTypeRenewal:
+		return "RENEWAL"
+	case RequestTypeRelease:
+		return "RELEASE"
+	}
+	return fmt.Sprintf("RequestType(%d)", int(t))
+}
+
+// LicenseType is the type of license a client asks for.
+type LicenseType int
+
+// License types.
+const (
+	LicenseTypeStreaming LicenseType = 1
+	LicenseTypeOffline   LicenseType = 2
+	LicenseTypeAutomatic LicenseType = 3
+)
+
+func (t LicenseType) String() string {
+	switch t {
+	case LicenseTypeStreaming:
+		return "STREAMING"
+	case LicenseTypeOffline:
+		return "OFFLINE"
+	case LicenseTypeAutomatic:
+		return "AUTOMATIC"
+	}
+	return fmt.Sprintf("LicenseType(%d)", int(t))
+}
+
+// ProtocolVersion is the license protocol version of a LicenseRequest.
+type ProtocolVersion int
+
+// Protocol versions.
+const (
+	ProtocolVersion20 ProtocolVersion = 20
+	ProtocolVersion21 ProtocolVersion = 21
+	ProtocolVersion22 ProtocolVersion = 22
+)
+
+func (v ProtocolVersion) String() string {
+	if v >= 20 {
+		return fmt.Sprintf("%d.%d", int(v)/10, int(v)%10)
+	}
+	return fmt.Sprintf("ProtocolVersion(%d)", int(v))
+}
+
+// Challenge is a Widevine license challenge decoded locally.
+type Challenge struct {
+	MessageType       MessageType
+	RequestType       RequestType
+	RequestTime       time.Time
+	ProtocolVersion   ProtocolVersion
+	LicenseType       LicenseType
+	RequestID         []byte
+	PSSH              [][]byte
+	KeyIDs            []KeyID
+	ContentID         []byte
+	ClientIDEncrypted bool
+	ClientID          *ClientIdentification
+	EncryptedClientID *EncryptedClientIdentification
+	Signature         []byte
+}
+
+// ClientIdentification identifies the device sending a challenge.
+type ClientIdentification struct {
+	Type                int
+	Token               []byte
+	ClientInfo          []ClientInfo
+	ProviderClientToken []byte
+	LicenseCounter      uint32
+	Capabilities        *ClientCapabilities
+}
+
+// ClientCapabilities are the capabilities the CDM reports.
+type ClientCapabilities struct {
+	ClientToken                bool
+	SessionToken               bool
+	VideoResolutionConstraints bool
+	MaxHDCPVersion             HDCPVersion
+	OEMCryptoAPIVersion        uint32
+	AntiRollbackUsageTable     bool
+	SRMVersion                 uint32
+	CanUpdateSRM               bool
+	ResourceRatingTier         uint32
+}
+
+// EncryptedClientIdentification is the client identification of a CDM in privacy mode,
+// encrypted to the provider's service certificate.
+type EncryptedClientIdentification struct {
+	ProviderID                     string
+	ServiceCertificateSerialNumber []byte
+	EncryptedClientID              []byte
+	EncryptedClientIDIV            []byte
+	EncryptedPrivacyKey            []byte
+}
+
+// signedMessage is the SignedMessage envelope of every license protocol message.
+type signedMessage struct {
+	Type       MessageType
+	Msg        []byte
+	Signature  []byte
+	SessionKey []byte
+}
+
+func decodeSignedMessage(b []byte) (*signedMessage, error) {
+	sm := &signedMessage{}
+	err := wire.Walk(b, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			sm.Type = MessageType(v)
+		case 2:
+			sm.Msg = b
+		case 3:
+			sm.Signature = b
+		case 4:
+			sm.SessionKey = b
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decode signed message: %v", err)
+	}
+	return sm, nil
+}
+
+func (sm *signedMessage) marshal() []byte {
+	var b []byte
+	b = wire.AppendVarint(b, 1, uint64(sm.Type))
+	b = wire.AppendBytes(b, 2, sm.Msg)
+	if len(sm.Signature) > 0 {
+		b = wire.AppendBytes(b, 3, sm.Signature)
+	}
+	if len(sm.SessionKey) > 0 {
+		b = wire.AppendBytes(b, 4, sm.SessionKey)
+	}
+	return b
+}
+
+// DecodeChallenge parses a license challenge, the SignedMessage protobuf a CDM sends
+// to the license server, without contacting Widevine.
+func DecodeChallenge(challenge []byte) (*Challenge, error) {
+	sm, err := decodeSignedMessage(challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Challenge{MessageType: sm.Type, Signature: sm.Signature}
+	switch c.MessageType {
+	case MessageTypeLicenseRequest:
+	case MessageTypeServiceCertificateRequest:
+		return c, nil
+	default:
+		return nil, fmt.Errorf("signed message is not a license request: %s", c.MessageType)
+	}
+
+	if err := c.decodeLicenseRequest(sm.Msg); err != nil {
+		return nil, fmt.Errorf("decode license request: %v", err)
+	}
+	return c, nil
+}
+
+func (c *Challenge) decodeLicenseRequest(msg []byte) error {
+	return wire.Walk(msg, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			id, err := decodeClientIdentification(b)
+			if err != nil {
+				return err
+			}
+			c.ClientID = id
+		case 2:
+			return c.decodeContentIdentification(b)
+		case 3:
+			c.RequestType = RequestType(v)
+		case 4:
+			c.RequestTime = time.Unix(int64(v), 0).UTC()
+		case 6:
+			c.ProtocolVersion = ProtocolVersion(v)
+		case 8:
+			c.ClientIDEncrypted = true
+			id, err := decodeEncryptedClientIdentification(b)
+			if err != nil {
+				return err
+			}
+			c.EncryptedClientID = id
+		}
+		return nil
+	})
+}
+
+func (c *Challenge) decodeContentIdentification(msg []byte) error {
+	return wire.Walk(msg, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		switch num {
+		// cenc_id_deprecated: bare WidevinePsshData.
+		case 1:
+			return wire.Walk(b, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+				switch num {
+				case 1:
+					return c.addPSSH(b)
+				case 2:
+					c.LicenseType = LicenseType(v)
+				case 3:
+					c.RequestID = b
+				}
+				return nil
+			})
+		// init_data: full PSSH box.
+		case 4:
+			return wire.Walk(b, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+				switch num {
+				case 2:
+					return c.addPSSH(b)
+				case 3:
+					c.LicenseType = LicenseType(v)
+				case 4:
+					c.RequestID = b
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+func (c *Challenge) addPSSH(b []byte) error {
+	c.PSSH = append(c.PSSH, b)
+
+	data, err := pssh.ParseWidevine(b)
+	if err != nil {
+		return err
+	}
+	for _, kid := range data.KeyIDs {
+		c.KeyIDs = append(c.KeyIDs, KeyID(kid))
+	}
+	if len(c.ContentID) == 0 {
+		c.ContentID = data.ContentID
+	}
+	return nil
+}
+
+func decodeClientIdentification(msg []byte) (*ClientIdentification, error) {
+	id := &ClientIdentification{}
+	err := wire.Walk(msg, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			id.Type = int(v)
+		case 2:
+			id.Token = b
+		case 3:
+			var info ClientInfo
+			err := wire.Walk(b, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+				switch num {
+				case 1:
+					info.Name = string(b)
+				case 2:
+					info.Value = string(b)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			id.ClientInfo = append(id.ClientInfo, info)
+		case 4:
+			id.ProviderClientToken = b
+		case 5:
+			id.LicenseCounter = uint32(v)
+		case 6:
+			caps := &ClientCapabilities{}
+			err := wire.Walk(b, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+				switch num {
+				case 1:
+					caps.ClientToken = v != 0
+				case 2:
+					caps.SessionToken = v != 0
+				case 3:
+					caps.VideoResolutionConstraints = v != 0
+				case 4:
+					caps.MaxHDCPVersion = HDCPVersion(v)
+				case 5:
+					caps.OEMCryptoAPIVersion = uint32(v)
+				case 6:
+					caps.AntiRollbackUsageTable = v != 0
+				case 7:
+					caps.SRMVersion = uint32(v)
+				case 8:
+					caps.CanUpdateSRM = v != 0
+				case 12:
+					caps.ResourceRatingTier = uint32(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			id.Capabilities = caps
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decode client identification: %v", err)
+	}
+	return id, nil
+}
+
+func decodeEncryptedClientIdentification(msg []byte) (*EncryptedClientIdentification, error) {
+	id := &EncryptedClientIdentification{}
+	err := wire.Walk(msg, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			id.ProviderID = string(b)
+		case 2:
+			id.ServiceCertificateSerialNumber = b
+		case 3:
+			id.EncryptedClientID = b
+		case 4:
+			id.EncryptedClientIDIV = b
+		case 5:
+			id.EncryptedPrivacyKey = b
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decode encrypted client identification: %v", err)
+	}
+	return id, nil
+}
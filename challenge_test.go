@@ -0,0 +1,80 @@
+package widevineproxy
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/Cooomma/widevine-proxy/internal/wire"
+	"github.com/Cooomma/widevine-proxy/pssh"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeChallenge(t *testing.T) {
+	b, _ := base64.StdEncoding.DecodeString(testLicenseChallenge)
+
+	c, err := DecodeChallenge(b)
+	assert.NoError(t, err)
+	assert.Equal(t, MessageTypeLicenseRequest, c.MessageType)
+	assert.Equal(t, RequestTypeNew, c.RequestType)
+	assert.Equal(t, LicenseTypeStreaming, c.LicenseType)
+	assert.Equal(t, ProtocolVersion21, c.ProtocolVersion)
+	assert.Equal(t, time.Date(2019, 12, 12, 2, 18, 52, 0, time.UTC), c.RequestTime)
+	assert.Equal(t, []byte("fkj3ljaSdfalkr3j"), c.ContentID)
+	assert.Len(t, c.PSSH, 1)
+	assert.Empty(t, c.KeyIDs)
+	assert.True(t, c.ClientIDEncrypted)
+	assert.Nil(t, c.ClientID)
+	assert.Equal(t, "staging.google.com", c.EncryptedClientID.ProviderID)
+	assert.Len(t, c.EncryptedClientID.EncryptedClientIDIV, 16)
+	assert.Len(t, c.Signature, 256)
+}
+
+func TestDecodeChallengeInitData(t *testing.T) {
+	kid := []byte("0123456789abcdef")
+	box, err := (&pssh.WidevineData{KeyIDs: [][]byte{kid}, ContentID: []byte("content")}).Box(0).Marshal()
+	assert.NoError(t, err)
+
+	var initData, contentID, clientInfo, clientID, request, challenge []byte
+	initData = wire.AppendVarint(initData, 1, 1)
+	initData = wire.AppendBytes(initData, 2, box)
+	initData = wire.AppendVarint(initData, 3, uint64(LicenseTypeOffline))
+	contentID = wire.AppendBytes(contentID, 4, initData)
+
+	clientInfo = wire.AppendBytes(clientInfo, 1, []byte("company_name"))
+	clientInfo = wire.AppendBytes(clientInfo, 2, []byte("Google"))
+	clientID = wire.AppendVarint(clientID, 1, 1)
+	clientID = wire.AppendBytes(clientID, 3, clientInfo)
+
+	request = wire.AppendBytes(request, 1, clientID)
+	request = wire.AppendBytes(request, 2, contentID)
+	request = wire.AppendVarint(request, 3, uint64(RequestTypeRenewal))
+	request = wire.AppendVarint(request, 6, uint64(ProtocolVersion22))
+	challenge = wire.AppendVarint(challenge, 1, uint64(MessageTypeLicenseRequest))
+	challenge = wire.AppendBytes(challenge, 2, request)
+
+	c, err := DecodeChallenge(challenge)
+	assert.NoError(t, err)
+	assert.Equal(t, RequestTypeRenewal, c.RequestType)
+	assert.Equal(t, LicenseTypeOffline, c.LicenseType)
+	assert.Equal(t, "2.2", c.ProtocolVersion.String())
+	assert.Equal(t, []KeyID{kid}, c.KeyIDs)
+	assert.Equal(t, []byte("content"), c.ContentID)
+	assert.False(t, c.ClientIDEncrypted)
+	assert.Equal(t, []ClientInfo{{Name: "company_name", Value: "Google"}}, c.ClientID.ClientInfo)
+}
+
+func TestDecodeChallengeInvalid(t *testing.T) {
+	_, err := DecodeChallenge([]byte{0x0a, 0xff})
+	assert.Error(t, err)
+
+	var license []byte
+	license = wire.AppendVarint(license, 1, uint64(MessageTypeLicense))
+	_, err = DecodeChallenge(license)
+	assert.Error(t, err)
+
+	// Service certificate request, "CAQ=".
+	c, err := DecodeChallenge([]byte{0x08, 0x04})
+	assert.NoError(t, err)
+	assert.Equal(t, MessageTypeServiceCertificateRequest, c.MessageType)
+}
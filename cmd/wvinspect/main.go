@@ -0,0 +1,268 @@
+// Command wvinspect decodes Widevine license challenges and licenses for support cases.
+//
+//	wvinspect [-key file] challenge [base64 | file | -]
+//	wvinspect license [base64 | file | -]
+//	wvinspect [-root file] certificate [base64 | file | -]
+//
+// The message is read as base64 from the argument, the named file, or stdin, and printed as JSON.
+// Key material is never decrypted. With -root, a base64 root certificate, the service certificate
+// chain is verified offline. With -key, the PEM service private key, the client identification of
+// privacy mode challenges is decrypted.
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	widevineproxy "github.com/Cooomma/widevine-proxy"
+)
+
+func main() {
+	rootFile := flag.String("root", "", "root certificate to verify service certificates against")
+	keyFile := flag.String("key", "", "service private key to decrypt privacy mode client identification")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 || len(args) > 2 {
+		usage()
+	}
+	if cmd := args[0]; cmd != "challenge" && cmd != "license" && cmd != "certificate" {
+		usage()
+	}
+	src := "-"
+	if len(args) == 2 {
+		src = args[1]
+	}
+	b, err := readMessage(src)
+	if err != nil {
+		fatal(err)
+	}
+
+	var out interface{}
+	switch args[0] {
+	case "challenge":
+		c, err := widevineproxy.DecodeChallenge(b)
+		if err != nil {
+			fatal(err)
+		}
+		if *keyFile != "" && c.EncryptedClientID != nil {
+			pemKey, err := ioutil.ReadFile(*keyFile)
+			if err != nil {
+				fatal(err)
+			}
+			key, err := widevineproxy.ParseServicePrivateKey(pemKey)
+			if err != nil {
+				fatal(err)
+			}
+			if err := c.DecryptClientID(key); err != nil {
+				fatal(err)
+			}
+		}
+		out = challengeReport(c)
+	case "license":
+		l, err := widevineproxy.DecodeLicense(b)
+		if err != nil {
+			fatal(err)
+		}
+		out = licenseReport(l)
+	case "certificate":
+		c, err := widevineproxy.ParseSignedDrmCertificate(b)
+		if err != nil {
+			fatal(err)
+		}
+		r := certificateReport(c)
+		if *rootFile != "" {
+			root, err := readRoot(*rootFile)
+			if err != nil {
+				fatal(err)
+			}
+			r["verified"] = true
+			if err := c.VerifyServiceCertificate(root); err != nil {
+				r["verified"] = false
+				r["verify_error"] = err.Error()
+			}
+		}
+		out = r
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: wvinspect [-root file] [-key file] challenge|license|certificate [base64 | file | -]")
+	os.Exit(2)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "wvinspect:", err)
+	os.Exit(1)
+}
+
+// readMessage reads a base64 message from stdin, a file, or the argument itself.
+func readMessage(src string) ([]byte, error) {
+	var data []byte
+	var err error
+	switch {
+	case src == "-":
+		data, err = ioutil.ReadAll(os.Stdin)
+	case fileExists(src):
+		data, err = ioutil.ReadFile(src)
+	default:
+		data = []byte(src)
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+	if err != nil {
+		return nil, fmt.Errorf("decode base64: %v", err)
+	}
+	return b, nil
+}
+
+func readRoot(name string) (*widevineproxy.DrmCertificate, error) {
+	b, err := readMessage(name)
+	if err != nil {
+		return nil, fmt.Errorf("root certificate: %v", err)
+	}
+	root, err := widevineproxy.ParseSignedDrmCertificate(b)
+	if err != nil {
+		return nil, fmt.Errorf("root certificate: %v", err)
+	}
+	return root.Certificate, nil
+}
+
+func fileExists(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && !info.IsDir()
+}
+
+type report map[string]interface{}
+
+func challengeReport(c *widevineproxy.Challenge) report {
+	r := report{
+		"message_type":        c.MessageType.String(),
+		"request_type":        c.RequestType.String(),
+		"license_type":        c.LicenseType.String(),
+		"protocol_version":    c.ProtocolVersion.String(),
+		"request_id":          hex.EncodeToString(c.RequestID),
+		"content_id":          string(c.ContentID),
+		"client_id_encrypted": c.ClientIDEncrypted,
+	}
+	if !c.RequestTime.IsZero() {
+		r["request_time"] = c.RequestTime
+	}
+	if len(c.KeyIDs) > 0 {
+		var kids []string
+		for _, kid := range c.KeyIDs {
+			kids = append(kids, kid.String())
+		}
+		r["key_ids"] = kids
+	}
+	if c.ClientID != nil {
+		client := report{
+			"make":            c.ClientID.Make(),
+			"model":           c.ClientID.Model(),
+			"system_id":       c.ClientID.SystemID(),
+			"client_info":     c.ClientID.ClientInfo,
+			"license_counter": c.ClientID.LicenseCounter,
+		}
+		if caps := c.ClientID.Capabilities; caps != nil {
+			client["max_hdcp_version"] = caps.MaxHDCPVersion.String()
+			client["oem_crypto_api_version"] = caps.OEMCryptoAPIVersion
+			client["resource_rating_tier"] = caps.ResourceRatingTier
+		}
+		r["client_id"] = client
+	}
+	if e := c.EncryptedClientID; e != nil {
+		r["encrypted_client_id"] = report{
+			"provider_id":                       e.ProviderID,
+			"service_certificate_serial_number": hex.EncodeToString(e.ServiceCertificateSerialNumber),
+		}
+	}
+	return r
+}
+
+func licenseReport(l *widevineproxy.License) report {
+	p := l.Policy
+	var keys []report
+	for _, key := range l.Keys {
+		k := report{
+			"key_id": key.ID.String(),
+			"type":   key.Type.String(),
+		}
+		if key.Level != 0 {
+			k["security_level"] = key.Level.String()
+		}
+		if key.RequiredProtection != nil {
+			k["required_protection"] = key.RequiredProtection
+		}
+		if key.RequestedProtection != nil {
+			k["requested_protection"] = key.RequestedProtection
+		}
+		if key.TrackLabel != "" {
+			k["track_label"] = key.TrackLabel
+		}
+		keys = append(keys, k)
+	}
+	r := report{
+		"id": report{
+			"request_id": hex.EncodeToString(l.ID.RequestID),
+			"session_id": hex.EncodeToString(l.ID.SessionID),
+			"type":       l.ID.Type.String(),
+			"version":    l.ID.Version,
+		},
+		"policy": report{
+			"can_play":                       p.CanPlay,
+			"can_persist":                    p.CanPersist,
+			"can_renew":                      p.CanRenew,
+			"rental_duration":                p.RentalDuration.String(),
+			"playback_duration":              p.PlaybackDuration.String(),
+			"license_duration":               p.LicenseDuration.String(),
+			"renewal_recovery_duration":      p.RenewalRecoveryDuration.String(),
+			"renewal_server_url":             p.RenewalServerURL,
+			"renewal_delay":                  p.RenewalDelay.String(),
+			"renewal_retry_interval":         p.RenewalRetryInterval.String(),
+			"renew_with_usage":               p.RenewWithUsage,
+			"always_include_client_id":       p.AlwaysIncludeClientID,
+			"play_start_grace_period":        p.PlayStartGracePeriod.String(),
+			"soft_enforce_playback_duration": p.SoftEnforcePlaybackDuration,
+			"soft_enforce_rental_duration":   p.SoftEnforceRentalDuration,
+		},
+		"keys": keys,
+	}
+	if !l.StartTime.IsZero() {
+		r["license_start_time"] = l.StartTime
+	}
+	if l.ProtectionScheme != 0 {
+		r["protection_scheme"] = l.ProtectionScheme.String()
+	}
+	return r
+}
+
+func certificateReport(c *widevineproxy.SignedDrmCertificate) report {
+	var chain []report
+	for cert := c; cert != nil; cert = cert.Signer {
+		chain = append(chain, report{
+			"type":          cert.Certificate.Type.String(),
+			"serial_number": hex.EncodeToString(cert.Certificate.SerialNumber),
+			"creation_time": cert.Certificate.CreationTime,
+			"provider_id":   cert.Certificate.ProviderID,
+			"system_id":     cert.Certificate.SystemID,
+			"public_key":    base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(cert.Certificate.PublicKey)),
+		})
+	}
+	return report{"chain": chain}
+}
@@ -0,0 +1,207 @@
+package widevineproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/Cooomma/widevine-proxy/pssh"
+)
+
+// Statuses of emulated content key responses.
+const (
+	contentKeyStatusOK              = "OK"
+	contentKeyStatusSignatureFailed = "SIGNATURE_FAILED"
+	contentKeyStatusInvalidRequest  = "INVALID_REQUEST"
+	contentKeyStatusInternalError   = "INTERNAL_ERROR"
+)
+
+// Content key requests are small; larger bodies are rejected.
+const maxContentKeyRequestSize = 1 << 20
+
+// ContentKeyHandler emulates the getcontentkey endpoint of Widevine Cloud, /cenc/getcontentkey/<provider>,
+// for packagers such as the Widevine key source of Shaka Packager. Requests are verified with the
+// credentials of their signer and answered with the keys of the proxy and their Widevine PSSH, in the
+// base64 response envelope of Widevine Cloud.
+//
+// Tracks get the content key spec of their track type, or the content key when there is none.
+// Key rotation is not supported.
+type ContentKeyHandler struct {
+	Proxy *Proxy
+	// Credentials are the signing credentials of each provider allowed to request keys.
+	Credentials map[string]ProviderCredentials
+	// InitData holds the PlayReady settings and the policy configuration of the keys.
+	// The DRM types and the protection scheme are the ones of the request.
+	InitData InitDataOptions
+}
+
+type contentKeyEnvelope struct {
+	Request   string `json:"request"`
+	Signature string `json:"signature"`
+	Signer    string `json:"signer"`
+}
+
+type contentKeyRequest struct {
+	ContentID string `json:"content_id"`
+	Tracks    []struct {
+		Type string `json:"type"`
+	} `json:"tracks"`
+	DRMTypes          []string        `json:"drm_types"`
+	Policy            string          `json:"policy"`
+	CryptoPeriodCount uint32          `json:"crypto_period_count"`
+	ProtectionScheme  json.RawMessage `json:"protection_scheme"`
+}
+
+func (h *ContentKeyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxContentKeyRequestSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxContentKeyRequestSize {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var envelope contentKeyEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		http.Error(w, "invalid request envelope", http.StatusBadRequest)
+		return
+	}
+
+	resp := h.contentKeys(r.Context(), path.Base(r.URL.Path), envelope)
+	if resp.Status != contentKeyStatusOK {
+		h.Proxy.Logger.WithField("signer", envelope.Signer).Errorf("Content Key Request Error: %s", resp.Status)
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"response": base64.StdEncoding.EncodeToString(b)})
+}
+
+// contentKeys answers a signed content key request of a provider.
+func (h *ContentKeyHandler) contentKeys(ctx context.Context, provider string, envelope contentKeyEnvelope) *ContentKeyResponse {
+	if envelope.Signer != provider {
+		return &ContentKeyResponse{Status: contentKeyStatusSignatureFailed}
+	}
+	request, err := base64.StdEncoding.DecodeString(envelope.Request)
+	if err != nil {
+		return &ContentKeyResponse{Status: contentKeyStatusInvalidRequest}
+	}
+	if err := h.verify(ctx, envelope.Signer, request, envelope.Signature); err != nil {
+		h.Proxy.Logger.WithField("error", err.Error()).Error("Content Key Signature Error")
+		return &ContentKeyResponse{Status: contentKeyStatusSignatureFailed}
+	}
+
+	var req contentKeyRequest
+	if err := json.Unmarshal(request, &req); err != nil {
+		return &ContentKeyResponse{Status: contentKeyStatusInvalidRequest}
+	}
+	contentID, err := base64.StdEncoding.DecodeString(req.ContentID)
+	if err != nil || len(contentID) == 0 || len(req.Tracks) == 0 || req.CryptoPeriodCount > 0 {
+		return &ContentKeyResponse{Status: contentKeyStatusInvalidRequest}
+	}
+	opts := h.InitData
+	opts.DRMTypes = req.DRMTypes
+	if len(opts.DRMTypes) == 0 {
+		opts.DRMTypes = []string{DRMTypeWidevine}
+	}
+	if opts.ProtectionScheme, err = parseRequestProtectionScheme(req.ProtectionScheme); err != nil {
+		return &ContentKeyResponse{Status: contentKeyStatusInvalidRequest}
+	}
+
+	resp := &ContentKeyResponse{Status: contentKeyStatusOK}
+	for _, drmType := range opts.DRMTypes {
+		var systemID pssh.SystemID
+		switch drmType {
+		case DRMTypeWidevine:
+			systemID = pssh.WidevineSystemID
+		case DRMTypePlayReady:
+			systemID = pssh.PlayReadySystemID
+		default:
+			return &ContentKeyResponse{Status: contentKeyStatusInvalidRequest}
+		}
+		resp.DRM = append(resp.DRM, drm{Type: drmType, SystemID: hex.EncodeToString(systemID[:])})
+	}
+
+	lookup := h.Proxy.trackKeys(ctx, string(contentID), opts.PolicyConfig)
+	for _, track := range req.Tracks {
+		key, err := lookup(track.Type)
+		if err != nil {
+			h.Proxy.Logger.WithField("error", err.Error()).Errorf("Content Key Error: %s", contentID)
+			return &ContentKeyResponse{Status: contentKeyStatusInternalError}
+		}
+		systems, err := h.Proxy.initDataSystems(string(contentID), []pssh.PlayReadyKey{{KeyID: key.KeyID, Key: key.Key}}, opts)
+		if err != nil {
+			h.Proxy.Logger.WithField("error", err.Error()).Errorf("Content Key PSSH Error: %s", contentID)
+			return &ContentKeyResponse{Status: contentKeyStatusInternalError}
+		}
+
+		t := tracks{
+			Type:  track.Type,
+			KeyID: base64.StdEncoding.EncodeToString(key.KeyID),
+			Key:   base64.StdEncoding.EncodeToString(key.Key),
+		}
+		for _, system := range systems {
+			t.PSSH = append(t.PSSH, trackPSSH{DRMType: system.DRMType, Data: base64.StdEncoding.EncodeToString(system.Data)})
+		}
+		resp.Tracks = append(resp.Tracks, t)
+	}
+	return resp
+}
+
+// verify checks the signature of a request: the AES-CBC encrypted SHA-1 of the request,
+// as built by GetContentKey.
+func (h *ContentKeyHandler) verify(ctx context.Context, signer string, request []byte, signature string) error {
+	credentials, ok := h.Credentials[signer]
+	if !ok {
+		return fmt.Errorf("unknown signer %q", signer)
+	}
+	if err := credentials.Validate(); err != nil {
+		return fmt.Errorf("signer %q: %v", signer, err)
+	}
+	got, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("signer %q: %v", signer, err)
+	}
+
+	want, err := AESSigner(credentials).Sign(ctx, request)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return fmt.Errorf("signer %q: signature mismatch", signer)
+	}
+	return nil
+}
+
+// parseRequestProtectionScheme parses the protection scheme of a request, either a four character
+// code in any case or its numeric value.
+func parseRequestProtectionScheme(b json.RawMessage) (pssh.ProtectionScheme, error) {
+	if len(b) == 0 || string(b) == "null" {
+		return 0, nil
+	}
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		return pssh.ParseProtectionScheme(strings.ToLower(name))
+	}
+	var n uint32
+	if err := json.Unmarshal(b, &n); err != nil {
+		return 0, fmt.Errorf("invalid protection scheme %s", b)
+	}
+	return pssh.ParseProtectionScheme(pssh.ProtectionScheme(n).String())
+}
@@ -0,0 +1,146 @@
+package widevineproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Cooomma/widevine-proxy/pssh"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// handlerTransport answers every request with a handler instead of the network.
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	t.handler.ServeHTTP(w, req)
+	return w.Result(), nil
+}
+
+func testContentKeyHandler(t *testing.T) (*ContentKeyHandler, *Proxy) {
+	key, _ := hex.DecodeString(testKey)
+	iv, _ := hex.DecodeString(testIV)
+	h := &ContentKeyHandler{
+		Proxy:       NewWidevineProxy(nil, nil, "widevine_test", FakeKeyGoverner{}, logrus.New()),
+		Credentials: map[string]ProviderCredentials{"widevine_test": {Key: key, IV: iv}},
+	}
+	packager := NewWidevineProxy(key, iv, "widevine_test", FakeKeyGoverner{}, logrus.New())
+	packager.httpCaller = &http.Client{Transport: handlerTransport{h}}
+	return h, packager
+}
+
+func TestContentKeyHandler(t *testing.T) {
+	_, packager := testContentKeyHandler(t)
+	kg := FakeKeyGoverner{}
+
+	resp, err := packager.GetContentKey("testing", Policy{
+		Tracks:           []string{"SD", "AUDIO"},
+		DRMTypes:         []string{DRMTypeWidevine, DRMTypePlayReady},
+		ProtectionScheme: pssh.SchemeCBCS,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "OK", resp.Status)
+	assert.Equal(t, []drm{
+		{Type: DRMTypeWidevine, SystemID: "edef8ba979d64acea3c827dcd51d21ed"},
+		{Type: DRMTypePlayReady, SystemID: "9a04f07998404286ab92e65be0885f95"},
+	}, resp.DRM)
+	assert.Len(t, resp.Tracks, 2)
+
+	// SD has a content key spec, AUDIO gets the content key.
+	sd, audio := resp.Tracks[0], resp.Tracks[1]
+	assert.Equal(t, "SD", sd.Type)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(kg.GenerateContentKeyID([]byte("testing"))), sd.KeyID)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(kg.GenerateContentKey([]byte("testing"))), sd.Key)
+	assert.Equal(t, "AUDIO", audio.Type)
+	assert.Equal(t, sd.Key, audio.Key)
+
+	assert.Len(t, sd.PSSH, 2)
+	b, err := base64.StdEncoding.DecodeString(sd.PSSH[0].Data)
+	assert.NoError(t, err)
+	data, err := pssh.UnmarshalWidevineData(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "widevine_test", data.Provider)
+	assert.Equal(t, []byte("testing"), data.ContentID)
+	assert.Equal(t, pssh.SchemeCBCS, data.ProtectionScheme)
+	assert.Equal(t, [][]byte{kg.GenerateContentKeyID([]byte("testing"))}, data.KeyIDs)
+
+	assert.NotNil(t, resp.PSSH)
+}
+
+func TestContentKeyHandlerSignature(t *testing.T) {
+	h, packager := testContentKeyHandler(t)
+
+	// A packager signing with other credentials is refused.
+	packager.PartnerRootKey = bytes.Repeat([]byte{1}, 32)
+	resp, err := packager.GetContentKey("testing", Policy{Tracks: []string{"SD"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "SIGNATURE_FAILED", resp.Status)
+	assert.Empty(t, resp.Tracks)
+
+	delete(h.Credentials, "widevine_test")
+	_, packager = testContentKeyHandler(t)
+	packager.httpCaller = &http.Client{Transport: handlerTransport{h}}
+	resp, err = packager.GetContentKey("testing", Policy{Tracks: []string{"SD"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "SIGNATURE_FAILED", resp.Status)
+}
+
+func TestContentKeyHandlerInvalidRequest(t *testing.T) {
+	h, packager := testContentKeyHandler(t)
+	postTo := func(target string, request map[string]interface{}) *ContentKeyResponse {
+		w := httptest.NewRecorder()
+		message, err := packager.buildCKMessage(context.Background(), request)
+		assert.NoError(t, err)
+		body, _ := json.Marshal(message)
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body)))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var envelope map[string]string
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&envelope))
+		b, _ := base64.StdEncoding.DecodeString(envelope["response"])
+		resp := &ContentKeyResponse{}
+		assert.NoError(t, json.Unmarshal(b, resp))
+		return resp
+	}
+	post := func(request map[string]interface{}) *ContentKeyResponse {
+		return postTo("/cenc/getcontentkey/widevine_test", request)
+	}
+
+	request := packager.setPolicy("testing", Policy{Tracks: []string{"SD"}})
+	request["protection_scheme"] = 0x63626373
+	assert.Equal(t, "OK", post(request).Status)
+
+	for _, edit := range []func(map[string]interface{}){
+		func(r map[string]interface{}) { delete(r, "tracks") },
+		func(r map[string]interface{}) { r["content_id"] = "" },
+		func(r map[string]interface{}) { r["drm_types"] = []string{"FAIRPLAY"} },
+		func(r map[string]interface{}) { r["protection_scheme"] = "ABCD" },
+		func(r map[string]interface{}) { r["crypto_period_count"] = 2 },
+	} {
+		request := packager.setPolicy("testing", Policy{Tracks: []string{"SD"}})
+		edit(request)
+		assert.Equal(t, "INVALID_REQUEST", post(request).Status, request)
+	}
+
+	h.Proxy.ContentKeyGenerator = FakeMissingKeyGoverner{}
+	request = packager.setPolicy("testing", Policy{Tracks: []string{"AUDIO"}})
+	assert.Equal(t, "INTERNAL_ERROR", post(request).Status)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/cenc/getcontentkey/widevine_test", bytes.NewReader([]byte("{"))))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// The signer must be the provider of the path.
+	h.Proxy.ContentKeyGenerator = FakeKeyGoverner{}
+	request = packager.setPolicy("testing", Policy{Tracks: []string{"SD"}})
+	assert.Equal(t, "SIGNATURE_FAILED", postTo("/cenc/getcontentkey/other", request).Status)
+}
@@ -0,0 +1,683 @@
+package widevineproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	"github.com/Cooomma/widevine-proxy/pssh"
+)
+
+// CPIXVersion is the DASH-IF CPIX version of exported documents.
+const CPIXVersion = "2.3"
+
+// CPIX namespaces and the algorithms of encrypted documents.
+const (
+	cpixNamespace    = "urn:dashif:org:cpix"
+	pskcNamespace    = "urn:ietf:params:xml:ns:keyprov:pskc"
+	xmlencNamespace  = "http://www.w3.org/2001/04/xmlenc#"
+	xmldsigNamespace = "http://www.w3.org/2000/09/xmldsig#"
+
+	cpixAES256CBC  = "http://www.w3.org/2001/04/xmlenc#aes256-cbc"
+	cpixRSAOAEP    = "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"
+	cpixHMACSHA512 = "http://www.w3.org/2001/04/xmldsig-more#hmac-sha512"
+)
+
+// cpixPrefixes are the prefixes of the CPIX namespaces in the document model.
+var cpixPrefixes = map[string]string{
+	cpixNamespace:    "cpix",
+	pskcNamespace:    "pskc",
+	xmlencNamespace:  "enc",
+	xmldsigNamespace: "ds",
+}
+
+// KeyStore stores imported keys, e.g. a SQLKeyStore.
+type KeyStore interface {
+	PutKey(ctx context.Context, contentID string, key StoredKey) error
+}
+
+// CPIXOptions configures exported CPIX documents.
+type CPIXOptions struct {
+	// InitData selects the DRM systems of the DRMSystemList and the common encryption scheme.
+	InitData InitDataOptions
+	// Recipients are the certificates the document key is encrypted to.
+	// Without recipients the content keys are exported in the clear.
+	Recipients []*x509.Certificate
+}
+
+// CPIXDocument is the content of an imported CPIX document.
+type CPIXDocument struct {
+	ContentID string
+	// Keys are the content keys, once for every track type of their usage rules.
+	// Keys without usage rules have an empty track type; the IV is nil without an explicit IV.
+	Keys []StoredKey
+}
+
+type cpix struct {
+	XMLName   xml.Name `xml:"cpix:CPIX"`
+	CPIXNS    string   `xml:"xmlns:cpix,attr,omitempty"`
+	PSKCNS    string   `xml:"xmlns:pskc,attr,omitempty"`
+	EncNS     string   `xml:"xmlns:enc,attr,omitempty"`
+	DSNS      string   `xml:"xmlns:ds,attr,omitempty"`
+	ContentID string   `xml:"contentId,attr,omitempty"`
+	Version   string   `xml:"version,attr,omitempty"`
+	// The optional lists are pointers, as empty a>b paths still write their parent element.
+	DeliveryData *cpixDeliveryDataList `xml:"cpix:DeliveryDataList"`
+	KeyPeriods   *cpixKeyPeriodList    `xml:"cpix:ContentKeyPeriodList"`
+	ContentKeys  []cpixContentKey      `xml:"cpix:ContentKeyList>cpix:ContentKey"`
+	DRMSystems   []cpixDRMSystem       `xml:"cpix:DRMSystemList>cpix:DRMSystem"`
+	UsageRules   *cpixUsageRuleList    `xml:"cpix:ContentKeyUsageRuleList"`
+}
+
+type cpixDeliveryDataList struct {
+	DeliveryData []cpixDeliveryData `xml:"cpix:DeliveryData"`
+}
+
+type cpixKeyPeriodList struct {
+	KeyPeriods []cpixAttributes `xml:"cpix:ContentKeyPeriod"`
+}
+
+type cpixUsageRuleList struct {
+	UsageRules []cpixUsageRule `xml:"cpix:ContentKeyUsageRule"`
+}
+
+type cpixDeliveryData struct {
+	Certificate string          `xml:"cpix:DeliveryKey>ds:X509Data>ds:X509Certificate"`
+	DocumentKey cpixDocumentKey `xml:"cpix:DocumentKey"`
+	MACMethod   cpixMACMethod   `xml:"cpix:MACMethod"`
+}
+
+type cpixDocumentKey struct {
+	Algorithm string             `xml:"Algorithm,attr"`
+	Value     cpixEncryptedValue `xml:"cpix:Data>pskc:Secret>pskc:EncryptedValue"`
+}
+
+type cpixMACMethod struct {
+	Algorithm string             `xml:"Algorithm,attr"`
+	Key       cpixEncryptedValue `xml:"cpix:Key"`
+}
+
+type cpixEncryptedValue struct {
+	Method      cpixAlgorithm `xml:"enc:EncryptionMethod"`
+	CipherValue string        `xml:"enc:CipherData>enc:CipherValue"`
+}
+
+type cpixAlgorithm struct {
+	Algorithm string `xml:"Algorithm,attr"`
+}
+
+type cpixContentKey struct {
+	KID                    string      `xml:"kid,attr"`
+	ExplicitIV             string      `xml:"explicitIV,attr,omitempty"`
+	CommonEncryptionScheme string      `xml:"commonEncryptionScheme,attr,omitempty"`
+	Secret                 *cpixSecret `xml:"cpix:Data>pskc:Secret"`
+}
+
+type cpixSecret struct {
+	PlainValue     string              `xml:"pskc:PlainValue,omitempty"`
+	EncryptedValue *cpixEncryptedValue `xml:"pskc:EncryptedValue"`
+	ValueMAC       string              `xml:"pskc:ValueMAC,omitempty"`
+}
+
+type cpixDRMSystem struct {
+	KID                                 string              `xml:"kid,attr"`
+	SystemID                            string              `xml:"systemId,attr"`
+	PSSH                                string              `xml:"cpix:PSSH,omitempty"`
+	ContentProtectionData               string              `xml:"cpix:ContentProtectionData,omitempty"`
+	SmoothStreamingProtectionHeaderData string              `xml:"cpix:SmoothStreamingProtectionHeaderData,omitempty"`
+	HLSSignalingData                    []cpixSignalingData `xml:"cpix:HLSSignalingData"`
+}
+
+type cpixSignalingData struct {
+	Playlist string `xml:"playlist,attr,omitempty"`
+	Data     string `xml:",chardata"`
+}
+
+type cpixUsageRule struct {
+	KID               string `xml:"kid,attr"`
+	IntendedTrackType string `xml:"intendedTrackType,attr,omitempty"`
+	// Filters are kept as they are, to be echoed in responses.
+	KeyPeriodFilters []cpixAttributes `xml:"cpix:KeyPeriodFilter"`
+	LabelFilters     []cpixAttributes `xml:"cpix:LabelFilter"`
+	VideoFilters     []cpixAttributes `xml:"cpix:VideoFilter"`
+	AudioFilters     []cpixAttributes `xml:"cpix:AudioFilter"`
+	BitrateFilters   []cpixAttributes `xml:"cpix:BitrateFilter"`
+}
+
+// cpixAttributes is an element of which only the attributes are used.
+type cpixAttributes struct {
+	Attrs []xml.Attr `xml:",any,attr"`
+}
+
+// ExportCPIX exports the content key specs of the KeyProvider as a CPIX document, with the
+// init data of the DRM systems of opts for every key. Without specs the content key is exported.
+// The keys are looked up with ctx.
+func (wp *Proxy) ExportCPIX(ctx context.Context, contentID string, opts CPIXOptions) ([]byte, error) {
+	cid := []byte(contentID)
+	specs, err := wp.contentKeySpecs(ctx, cid, opts.InitData.PolicyConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(specs) == 0 {
+		kid, err := wp.keys().ContentKeyID(ctx, cid)
+		if err != nil {
+			return nil, err
+		}
+		key, err := wp.keys().ContentKey(ctx, cid)
+		if err != nil {
+			return nil, err
+		}
+		iv, err := wp.keys().ContentIV(ctx, cid)
+		if err != nil {
+			return nil, err
+		}
+		specs = []ContentKeySpec{{
+			KeyID: base64.StdEncoding.EncodeToString(kid),
+			Key:   base64.StdEncoding.EncodeToString(key),
+			IV:    base64.StdEncoding.EncodeToString(iv),
+		}}
+	}
+
+	var keys []StoredKey
+	for _, spec := range specs {
+		if err := spec.Validate(); err != nil {
+			return nil, err
+		}
+		key := StoredKey{TrackType: spec.TrackType}
+		key.KeyID, _ = base64.StdEncoding.DecodeString(spec.KeyID)
+		key.Key, _ = base64.StdEncoding.DecodeString(spec.Key)
+		key.IV, _ = base64.StdEncoding.DecodeString(spec.IV)
+		keys = append(keys, key)
+	}
+
+	return wp.exportCPIX(contentID, keys, opts, func(key StoredKey) ([]ProtectionSystemData, error) {
+		return wp.initDataSystems(contentID, []pssh.PlayReadyKey{{KeyID: key.KeyID, Key: key.Key}}, opts.InitData)
+	})
+}
+
+// ExportCPIXFromResponse exports the tracks of a content key response as a CPIX document.
+// The pssh data of the response is kept; tracks without pssh data get the init data of the
+// DRM systems of opts.
+func (wp *Proxy) ExportCPIXFromResponse(contentID string, resp *ContentKeyResponse, opts CPIXOptions) ([]byte, error) {
+	var keys []StoredKey
+	psshData := make(map[string][]trackPSSH)
+	for _, track := range resp.Tracks {
+		kid, err := base64.StdEncoding.DecodeString(track.KeyID)
+		if err != nil || len(kid) != 16 {
+			return nil, fmt.Errorf("%s track: invalid key ID %q", track.Type, track.KeyID)
+		}
+		key, err := base64.StdEncoding.DecodeString(track.Key)
+		if err != nil || len(key) != 16 {
+			return nil, fmt.Errorf("%s track: invalid key", track.Type)
+		}
+		keys = append(keys, StoredKey{TrackType: track.Type, KeyID: kid, Key: key})
+		psshData[string(kid)] = append(psshData[string(kid)], track.PSSH...)
+	}
+
+	return wp.exportCPIX(contentID, keys, opts, func(key StoredKey) ([]ProtectionSystemData, error) {
+		if len(psshData[string(key.KeyID)]) == 0 {
+			return wp.initDataSystems(contentID, []pssh.PlayReadyKey{{KeyID: key.KeyID, Key: key.Key}}, opts.InitData)
+		}
+		var systems []ProtectionSystemData
+		for _, p := range psshData[string(key.KeyID)] {
+			data, err := base64.StdEncoding.DecodeString(p.Data)
+			if err != nil {
+				return nil, fmt.Errorf("decode %s pssh: %v", p.DRMType, err)
+			}
+			system, err := responseSystemData(p.DRMType, key.KeyID, data)
+			if err != nil {
+				return nil, err
+			}
+			systems = append(systems, system)
+		}
+		return systems, nil
+	})
+}
+
+// exportCPIX builds the document of the keys. Keys shared by several track types are
+// exported once, with a usage rule for each track type.
+func (wp *Proxy) exportCPIX(contentID string, keys []StoredKey, opts CPIXOptions, systems func(StoredKey) ([]ProtectionSystemData, error)) ([]byte, error) {
+	doc := newCPIX(contentID)
+	var documentKey, macKey []byte
+	if len(opts.Recipients) > 0 {
+		var err error
+		if documentKey, macKey, err = doc.addRecipients(opts.Recipients); err != nil {
+			return nil, err
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		kid := KeyID(key.KeyID).UUID()
+		if key.TrackType != "" {
+			if doc.UsageRules == nil {
+				doc.UsageRules = &cpixUsageRuleList{}
+			}
+			doc.UsageRules.UsageRules = append(doc.UsageRules.UsageRules, cpixUsageRule{KID: kid, IntendedTrackType: key.TrackType})
+		}
+		if seen[kid] {
+			continue
+		}
+		seen[kid] = true
+
+		contentKey, err := cpixContentKeyOf(key, opts.InitData.ProtectionScheme, documentKey, macKey)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", kid, err)
+		}
+		doc.ContentKeys = append(doc.ContentKeys, contentKey)
+
+		keySystems, err := systems(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", kid, err)
+		}
+		for _, system := range keySystems {
+			doc.DRMSystems = append(doc.DRMSystems, cpixDRMSystemOf(kid, system, opts.InitData.ProtectionScheme))
+		}
+	}
+
+	return doc.marshal()
+}
+
+func newCPIX(contentID string) *cpix {
+	return &cpix{
+		CPIXNS:    cpixNamespace,
+		PSKCNS:    pskcNamespace,
+		EncNS:     xmlencNamespace,
+		DSNS:      xmldsigNamespace,
+		ContentID: contentID,
+		Version:   CPIXVersion,
+	}
+}
+
+// decodeCPIX decodes a CPIX document whatever prefixes it declares.
+func decodeCPIX(b []byte) (*cpix, error) {
+	doc := &cpix{}
+	if err := xml.NewTokenDecoder(cpixTokens{xml.NewDecoder(bytes.NewReader(b))}).Decode(doc); err != nil {
+		return nil, fmt.Errorf("cpix: %v", err)
+	}
+	if doc.XMLName.Local != "cpix:CPIX" {
+		return nil, fmt.Errorf("cpix: not a CPIX document")
+	}
+	return doc, nil
+}
+
+func (doc *cpix) marshal() ([]byte, error) {
+	b, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+// cpixContentKeyOf returns the content key element of a key, encrypted with the document key when there is one.
+func cpixContentKeyOf(key StoredKey, scheme pssh.ProtectionScheme, documentKey, macKey []byte) (cpixContentKey, error) {
+	contentKey := cpixContentKey{KID: KeyID(key.KeyID).UUID()}
+	if scheme != 0 {
+		contentKey.CommonEncryptionScheme = scheme.String()
+	}
+	if len(key.IV) > 0 {
+		// An 8 bytes IV is the 16 bytes IV with a zero block counter.
+		iv := make([]byte, aes.BlockSize)
+		copy(iv, key.IV)
+		contentKey.ExplicitIV = base64.StdEncoding.EncodeToString(iv)
+	}
+	secret, err := cpixSecretOf(key.Key, documentKey, macKey)
+	if err != nil {
+		return contentKey, err
+	}
+	contentKey.Secret = secret
+	return contentKey, nil
+}
+
+// addRecipients encrypts a new document key to every recipient and returns it with the MAC key.
+func (doc *cpix) addRecipients(recipients []*x509.Certificate) ([]byte, []byte, error) {
+	documentKey := make([]byte, 32)
+	macKey := make([]byte, 64)
+	if _, err := rand.Read(documentKey); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(macKey); err != nil {
+		return nil, nil, err
+	}
+	encryptedMACKey, err := cpixEncrypt(documentKey, macKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	doc.DeliveryData = &cpixDeliveryDataList{}
+	for _, cert := range recipients {
+		pub, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, nil, fmt.Errorf("recipient %q: not an RSA key", cert.Subject.CommonName)
+		}
+		encryptedDocumentKey, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, documentKey, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("recipient %q: %v", cert.Subject.CommonName, err)
+		}
+		doc.DeliveryData.DeliveryData = append(doc.DeliveryData.DeliveryData, cpixDeliveryData{
+			Certificate: base64.StdEncoding.EncodeToString(cert.Raw),
+			DocumentKey: cpixDocumentKey{
+				Algorithm: cpixAES256CBC,
+				Value: cpixEncryptedValue{
+					Method:      cpixAlgorithm{Algorithm: cpixRSAOAEP},
+					CipherValue: base64.StdEncoding.EncodeToString(encryptedDocumentKey),
+				},
+			},
+			MACMethod: cpixMACMethod{
+				Algorithm: cpixHMACSHA512,
+				Key: cpixEncryptedValue{
+					Method:      cpixAlgorithm{Algorithm: cpixAES256CBC},
+					CipherValue: base64.StdEncoding.EncodeToString(encryptedMACKey),
+				},
+			},
+		})
+	}
+	return documentKey, macKey, nil
+}
+
+// cpixSecretOf returns the secret of a content key, encrypted with the document key when there is one.
+func cpixSecretOf(key, documentKey, macKey []byte) (*cpixSecret, error) {
+	if documentKey == nil {
+		return &cpixSecret{PlainValue: base64.StdEncoding.EncodeToString(key)}, nil
+	}
+	encrypted, err := cpixEncrypt(documentKey, key)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha512.New, macKey)
+	mac.Write(encrypted)
+	return &cpixSecret{
+		EncryptedValue: &cpixEncryptedValue{
+			Method:      cpixAlgorithm{Algorithm: cpixAES256CBC},
+			CipherValue: base64.StdEncoding.EncodeToString(encrypted),
+		},
+		ValueMAC: base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+	}, nil
+}
+
+// cpixDRMSystemOf signals a DRM system of a key for DASH, Smooth Streaming and, for Widevine, HLS.
+func cpixDRMSystemOf(kid string, system ProtectionSystemData, scheme pssh.ProtectionScheme) cpixDRMSystem {
+	psshData := base64.StdEncoding.EncodeToString(system.PSSH)
+	protectionData := "<cenc:pssh>" + psshData + "</cenc:pssh>"
+	drmSystem := cpixDRMSystem{KID: kid, SystemID: system.SystemID.String(), PSSH: psshData}
+
+	switch system.SystemID {
+	case pssh.PlayReadySystemID:
+		pro := base64.StdEncoding.EncodeToString(system.Data)
+		protectionData += "<mspr:pro>" + pro + "</mspr:pro>"
+		drmSystem.SmoothStreamingProtectionHeaderData = pro
+	case pssh.WidevineSystemID:
+		key := HLSKey{Method: HLSMethodSampleAESCTR, PSSH: system.PSSH}
+		if len(system.KeyIDs) > 0 {
+			key.KeyID = system.KeyIDs[0]
+		}
+		if scheme == pssh.SchemeCBCS || scheme == pssh.SchemeCBC1 {
+			key.Method = HLSMethodSampleAES
+		}
+		drmSystem.HLSSignalingData = []cpixSignalingData{
+			{Playlist: "media", Data: base64.StdEncoding.EncodeToString([]byte(key.KeyTag()))},
+			{Playlist: "master", Data: base64.StdEncoding.EncodeToString([]byte(key.SessionKeyTag()))},
+		}
+	}
+	drmSystem.ContentProtectionData = base64.StdEncoding.EncodeToString([]byte(protectionData))
+	return drmSystem
+}
+
+// ParseCPIX parses a CPIX document. Content keys encrypted with a document key are decrypted
+// with the private key of one of its recipients, which may be nil for documents in the clear.
+func ParseCPIX(b []byte, key *rsa.PrivateKey) (*CPIXDocument, error) {
+	doc, err := decodeCPIX(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var documentKey, macKey []byte
+	rules := make(map[string][]string)
+	if doc.UsageRules != nil {
+		for _, rule := range doc.UsageRules.UsageRules {
+			kid := strings.ToLower(rule.KID)
+			rules[kid] = append(rules[kid], rule.IntendedTrackType)
+		}
+	}
+
+	result := &CPIXDocument{ContentID: doc.ContentID}
+	for _, contentKey := range doc.ContentKeys {
+		kid, err := parseCPIXKeyID(contentKey.KID)
+		if err != nil {
+			return nil, fmt.Errorf("cpix: %v", err)
+		}
+		if contentKey.Secret == nil {
+			return nil, fmt.Errorf("cpix: key %s has no value", contentKey.KID)
+		}
+
+		var value []byte
+		if contentKey.Secret.EncryptedValue != nil {
+			if documentKey == nil {
+				if documentKey, macKey, err = doc.documentKey(key); err != nil {
+					return nil, fmt.Errorf("cpix: %v", err)
+				}
+			}
+			value, err = contentKey.Secret.decrypt(documentKey, macKey)
+		} else {
+			value, err = base64.StdEncoding.DecodeString(contentKey.Secret.PlainValue)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cpix: key %s: %v", contentKey.KID, err)
+		}
+		if len(value) != 16 {
+			return nil, fmt.Errorf("cpix: key %s must be 16 bytes, got %d", contentKey.KID, len(value))
+		}
+
+		var iv []byte
+		if contentKey.ExplicitIV != "" {
+			if iv, err = base64.StdEncoding.DecodeString(contentKey.ExplicitIV); err != nil || len(iv) != aes.BlockSize {
+				return nil, fmt.Errorf("cpix: key %s: explicit IV must be 16 bytes", contentKey.KID)
+			}
+		}
+
+		trackTypes := rules[KeyID(kid).UUID()]
+		if len(trackTypes) == 0 {
+			trackTypes = []string{""}
+		}
+		for _, trackType := range trackTypes {
+			result.Keys = append(result.Keys, StoredKey{TrackType: trackType, KeyID: kid, Key: value, IV: iv})
+		}
+	}
+	return result, nil
+}
+
+// ImportCPIX parses a CPIX document and stores its keys under its content ID.
+// Keys without an explicit IV are stored with a random one.
+func ImportCPIX(ctx context.Context, store KeyStore, b []byte, key *rsa.PrivateKey) (*CPIXDocument, error) {
+	doc, err := ParseCPIX(b, key)
+	if err != nil {
+		return nil, err
+	}
+	if doc.ContentID == "" {
+		return nil, fmt.Errorf("cpix: no content ID")
+	}
+
+	seen := make(map[string]bool)
+	for _, k := range doc.Keys {
+		if seen[k.TrackType] {
+			return nil, fmt.Errorf("cpix: more than one key for track type %q", k.TrackType)
+		}
+		seen[k.TrackType] = true
+	}
+
+	for _, k := range doc.Keys {
+		if k.IV == nil {
+			k.IV = make([]byte, aes.BlockSize)
+			if _, err := rand.Read(k.IV); err != nil {
+				return nil, err
+			}
+		}
+		if err := store.PutKey(ctx, doc.ContentID, k); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// documentKey decrypts the document and MAC keys of the delivery data of the private key.
+func (doc *cpix) documentKey(key *rsa.PrivateKey) ([]byte, []byte, error) {
+	if key == nil {
+		return nil, nil, fmt.Errorf("content keys are encrypted and no private key is set")
+	}
+	if doc.DeliveryData == nil {
+		return nil, nil, fmt.Errorf("no delivery data")
+	}
+	for _, data := range doc.DeliveryData.DeliveryData {
+		der, err := base64.StdEncoding.DecodeString(data.Certificate)
+		if err != nil {
+			continue
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			continue
+		}
+		if pub, ok := cert.PublicKey.(*rsa.PublicKey); !ok || !pub.Equal(&key.PublicKey) {
+			continue
+		}
+
+		if data.DocumentKey.Algorithm != cpixAES256CBC || data.DocumentKey.Value.Method.Algorithm != cpixRSAOAEP {
+			return nil, nil, fmt.Errorf("unsupported document key algorithm")
+		}
+		if data.MACMethod.Algorithm != cpixHMACSHA512 || data.MACMethod.Key.Method.Algorithm != cpixAES256CBC {
+			return nil, nil, fmt.Errorf("unsupported MAC algorithm")
+		}
+		encrypted, err := base64.StdEncoding.DecodeString(data.DocumentKey.Value.CipherValue)
+		if err != nil {
+			return nil, nil, fmt.Errorf("document key: %v", err)
+		}
+		documentKey, err := rsa.DecryptOAEP(sha1.New(), nil, key, encrypted, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decrypt document key: %v", err)
+		}
+		if len(documentKey) != 32 {
+			return nil, nil, fmt.Errorf("document key must be 32 bytes, got %d", len(documentKey))
+		}
+		encrypted, err = base64.StdEncoding.DecodeString(data.MACMethod.Key.CipherValue)
+		if err != nil {
+			return nil, nil, fmt.Errorf("MAC key: %v", err)
+		}
+		macKey, err := cpixDecrypt(documentKey, encrypted)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decrypt MAC key: %v", err)
+		}
+		return documentKey, macKey, nil
+	}
+	return nil, nil, fmt.Errorf("no delivery data for the private key")
+}
+
+// decrypt checks the MAC of an encrypted secret and decrypts it.
+func (s *cpixSecret) decrypt(documentKey, macKey []byte) ([]byte, error) {
+	if s.EncryptedValue.Method.Algorithm != cpixAES256CBC {
+		return nil, fmt.Errorf("unsupported encryption algorithm %q", s.EncryptedValue.Method.Algorithm)
+	}
+	encrypted, err := base64.StdEncoding.DecodeString(s.EncryptedValue.CipherValue)
+	if err != nil {
+		return nil, err
+	}
+	valueMAC, err := base64.StdEncoding.DecodeString(s.ValueMAC)
+	if err != nil || len(valueMAC) == 0 {
+		return nil, fmt.Errorf("missing value MAC")
+	}
+	mac := hmac.New(sha512.New, macKey)
+	mac.Write(encrypted)
+	if !hmac.Equal(mac.Sum(nil), valueMAC) {
+		return nil, fmt.Errorf("value MAC mismatch")
+	}
+	return cpixDecrypt(documentKey, encrypted)
+}
+
+// cpixEncrypt encrypts with AES-256-CBC as in XML Encryption: a random IV followed by the
+// padded cipher text.
+func cpixEncrypt(key, plainText []byte) ([]byte, error) {
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	cipherText, err := AESCBCEncrypt(key, iv, plainText)
+	if err != nil {
+		return nil, err
+	}
+	return append(iv, cipherText...), nil
+}
+
+// cpixDecrypt decrypts a cpixEncrypt cipher text.
+func cpixDecrypt(key, b []byte) ([]byte, error) {
+	if len(b) < 2*aes.BlockSize {
+		return nil, fmt.Errorf("cipher text is not a multiple of the block size")
+	}
+	plainText, err := AESCBCDecryptBlocks(key, b[:aes.BlockSize], b[aes.BlockSize:])
+	if err != nil {
+		return nil, err
+	}
+	return xmlEncUnpad(plainText)
+}
+
+// xmlEncUnpad removes the padding of XML Encryption, which only defines the last padding byte: unlike
+// PKCS#7, the other padding bytes are arbitrary. The length is checked in constant time.
+func xmlEncUnpad(b []byte) ([]byte, error) {
+	n := int(b[len(b)-1])
+	if subtle.ConstantTimeLessOrEq(1, n)&subtle.ConstantTimeLessOrEq(n, aes.BlockSize) != 1 {
+		return nil, errInvalidPadding
+	}
+	return b[:len(b)-n], nil
+}
+
+// parseCPIXKeyID parses a key ID in UUID form.
+func parseCPIXKeyID(s string) ([]byte, error) {
+	kid, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(kid) != 16 {
+		return nil, fmt.Errorf("invalid key ID %q", s)
+	}
+	return kid, nil
+}
+
+// cpixTokens renames the elements of the CPIX namespaces with the prefixes of the document model,
+// so documents decode whatever prefixes they declare.
+type cpixTokens struct {
+	d *xml.Decoder
+}
+
+func (r cpixTokens) Token() (xml.Token, error) {
+	tok, err := r.d.Token()
+	switch t := tok.(type) {
+	case xml.StartElement:
+		t.Name = cpixName(t.Name)
+		var attrs []xml.Attr
+		for _, attr := range t.Attr {
+			if attr.Name.Space != "xmlns" && attr.Name.Local != "xmlns" {
+				attrs = append(attrs, attr)
+			}
+		}
+		t.Attr = attrs
+		return t, err
+	case xml.EndElement:
+		t.Name = cpixName(t.Name)
+		return t, err
+	}
+	return tok, err
+}
+
+func cpixName(name xml.Name) xml.Name {
+	if prefix, ok := cpixPrefixes[name.Space]; ok {
+		return xml.Name{Local: prefix + ":" + name.Local}
+	}
+	return xml.Name{Local: name.Local}
+}
@@ -0,0 +1,248 @@
+package widevineproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cooomma/widevine-proxy/pssh"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func testRecipientCertificate(t *testing.T, key *rsa.PrivateKey) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "packager"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert
+}
+
+func TestExportCPIX(t *testing.T) {
+	kg := FakeKeyGoverner{}
+	wp := NewWidevineProxy(nil, nil, "widevine_test", kg, logrus.New())
+
+	b, err := wp.ExportCPIX(context.Background(), "testing", CPIXOptions{InitData: InitDataOptions{
+		DRMTypes:         []string{DRMTypeWidevine, DRMTypePlayReady},
+		ProtectionScheme: pssh.SchemeCBCS,
+	}})
+	assert.NoError(t, err)
+	doc := string(b)
+	assert.Contains(t, doc, `<cpix:CPIX xmlns:cpix="urn:dashif:org:cpix"`)
+	assert.Contains(t, doc, `contentId="testing" version="2.3"`)
+	assert.Contains(t, doc, `commonEncryptionScheme="cbcs"`)
+	assert.Contains(t, doc, `systemId="edef8ba9-79d6-4ace-a3c8-27dcd51d21ed"`)
+	assert.Contains(t, doc, `systemId="9a04f079-9840-4286-ab92-e65be0885f95"`)
+	assert.Contains(t, doc, `<cpix:ContentKeyUsageRule kid="`+KeyID(kg.GenerateContentKeyID([]byte("testing"))).UUID()+`" intendedTrackType="SD">`)
+	assert.Contains(t, doc, "<cpix:SmoothStreamingProtectionHeaderData>")
+	assert.Contains(t, doc, `<cpix:HLSSignalingData playlist="media">`)
+
+	parsed, err := ParseCPIX(b, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "testing", parsed.ContentID)
+	assert.Equal(t, []StoredKey{{
+		TrackType: "SD",
+		KeyID:     kg.GenerateContentKeyID([]byte("testing")),
+		Key:       kg.GenerateContentKey([]byte("testing")),
+		IV:        kg.GenerateContentIV([]byte("testing")),
+	}}, parsed.Keys)
+
+	// The media playlist signaling is a Widevine key tag for cbcs.
+	start := strings.Index(doc, `<cpix:HLSSignalingData playlist="media">`) + len(`<cpix:HLSSignalingData playlist="media">`)
+	tag, err := base64.StdEncoding.DecodeString(doc[start : start+strings.Index(doc[start:], "<")])
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(tag), "#EXT-X-KEY:METHOD=SAMPLE-AES,"))
+}
+
+func TestExportCPIXWithoutSpecs(t *testing.T) {
+	kg := FakeKeyGovernerWithoutSpecs{}
+	wp := NewWidevineProxy(nil, nil, "widevine_test", kg, logrus.New())
+
+	b, err := wp.ExportCPIX(context.Background(), "testing", CPIXOptions{InitData: InitDataOptions{DRMTypes: []string{DRMTypeWidevine}}})
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "ContentKeyUsageRule")
+
+	parsed, err := ParseCPIX(b, nil)
+	assert.NoError(t, err)
+	assert.Len(t, parsed.Keys, 1)
+	assert.Equal(t, "", parsed.Keys[0].TrackType)
+	assert.Equal(t, kg.GenerateContentKey([]byte("testing")), parsed.Keys[0].Key)
+
+	wp = NewWidevineProxy(nil, nil, "widevine_test", FakeMalformedKeyGoverner{}, logrus.New())
+	_, err = wp.ExportCPIX(context.Background(), "testing", CPIXOptions{})
+	assert.Error(t, err)
+
+	// The content key is checked like the specs.
+	wp = NewWidevineProxy(nil, nil, "widevine_test", FakeShortKeyGoverner{}, logrus.New())
+	_, err = wp.ExportCPIX(context.Background(), "testing", CPIXOptions{})
+	assert.EqualError(t, err, "content key: invalid key ID \"AAECAwQFBgc=\"")
+}
+
+// FakeShortKeyGoverner has a content key ID of 8 bytes and no specs.
+type FakeShortKeyGoverner struct {
+	FakeKeyGovernerWithoutSpecs
+}
+
+func (FakeShortKeyGoverner) GenerateContentKeyID(contentID []byte) []byte {
+	return []byte{0, 1, 2, 3, 4, 5, 6, 7}
+}
+
+func TestExportCPIXFromResponse(t *testing.T) {
+	kid := bytes.Repeat([]byte{1}, 16)
+	key := bytes.Repeat([]byte{2}, 16)
+	resp := &ContentKeyResponse{Tracks: []tracks{
+		{Type: "SD", KeyID: base64.StdEncoding.EncodeToString(kid), Key: base64.StdEncoding.EncodeToString(key)},
+		{Type: "HD", KeyID: base64.StdEncoding.EncodeToString(kid), Key: base64.StdEncoding.EncodeToString(key)},
+	}}
+	wp := NewWidevineProxy(nil, nil, "widevine_test", FakeKeyGoverner{}, logrus.New())
+
+	b, err := wp.ExportCPIXFromResponse("testing", resp, CPIXOptions{InitData: InitDataOptions{DRMTypes: []string{DRMTypeWidevine}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(b), "<cpix:ContentKey "))
+	assert.Equal(t, 2, strings.Count(string(b), "<cpix:ContentKeyUsageRule "))
+
+	parsed, err := ParseCPIX(b, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []StoredKey{
+		{TrackType: "SD", KeyID: kid, Key: key},
+		{TrackType: "HD", KeyID: kid, Key: key},
+	}, parsed.Keys)
+
+	resp.Tracks[0].Key = "short"
+	_, err = wp.ExportCPIXFromResponse("testing", resp, CPIXOptions{})
+	assert.Error(t, err)
+}
+
+func TestCPIXDocumentKey(t *testing.T) {
+	recipientKey, otherKey := testCertificateKey(t), testCertificateKey(t)
+	kg := FakeKeyGoverner{}
+	wp := NewWidevineProxy(nil, nil, "widevine_test", kg, logrus.New())
+
+	b, err := wp.ExportCPIX(context.Background(), "testing", CPIXOptions{
+		InitData:   InitDataOptions{DRMTypes: []string{DRMTypeWidevine}},
+		Recipients: []*x509.Certificate{testRecipientCertificate(t, otherKey), testRecipientCertificate(t, recipientKey)},
+	})
+	assert.NoError(t, err)
+	doc := string(b)
+	assert.NotContains(t, doc, "PlainValue")
+	assert.NotContains(t, doc, base64.StdEncoding.EncodeToString(kg.GenerateContentKey([]byte("testing"))))
+	assert.Equal(t, 2, strings.Count(doc, "<cpix:DeliveryData>"))
+
+	parsed, err := ParseCPIX(b, recipientKey)
+	assert.NoError(t, err)
+	assert.Equal(t, kg.GenerateContentKey([]byte("testing")), parsed.Keys[0].Key)
+
+	_, err = ParseCPIX(b, nil)
+	assert.Error(t, err)
+	_, err = ParseCPIX(b, testCertificateKey(t))
+	assert.Error(t, err)
+
+	// A tampered value MAC is rejected.
+	start := strings.Index(doc, "<pskc:ValueMAC>") + len("<pskc:ValueMAC>")
+	tampered := doc[:start] + "AAAA" + doc[start+4:]
+	_, err = ParseCPIX([]byte(tampered), recipientKey)
+	assert.Error(t, err)
+}
+
+func TestCPIXEncrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	b, err := cpixEncrypt(key, []byte("0123456789abcdef"))
+	assert.NoError(t, err)
+	assert.Len(t, b, 3*16)
+	plainText, err := cpixDecrypt(key, b)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("0123456789abcdef"), plainText)
+
+	// XML Encryption only defines the last padding byte.
+	iv := bytes.Repeat([]byte{1}, 16)
+	cipherText, err := AESCBCEncryptBlocks(key, iv, append([]byte("key"), 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 13))
+	assert.NoError(t, err)
+	plainText, err = cpixDecrypt(key, append(iv, cipherText...))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("key"), plainText)
+
+	for _, last := range []byte{0, 17} {
+		cipherText, err := AESCBCEncryptBlocks(key, iv, append(bytes.Repeat([]byte{1}, 15), last))
+		assert.NoError(t, err)
+		_, err = cpixDecrypt(key, append(iv, cipherText...))
+		assert.EqualError(t, err, "invalid padding")
+	}
+	_, err = cpixDecrypt(key, b[:16])
+	assert.Error(t, err)
+	_, err = cpixDecrypt(key, b[:40])
+	assert.Error(t, err)
+}
+
+func TestParseCPIXNamespaces(t *testing.T) {
+	// Any prefix, or none, may be declared for the CPIX namespaces.
+	doc := `<?xml version="1.0" encoding="UTF-8"?>
+<CPIX xmlns="urn:dashif:org:cpix" xmlns:p="urn:ietf:params:xml:ns:keyprov:pskc" contentId="movie">
+  <ContentKeyList>
+    <ContentKey kid="00010203-0405-0607-0809-0A0B0C0D0E0F" explicitIV="ICEiIyQlJicoKSorLC0uLw==">
+      <Data><p:Secret><p:PlainValue>EBESExQVFhcYGRobHB0eHw==</p:PlainValue></p:Secret></Data>
+    </ContentKey>
+  </ContentKeyList>
+  <ContentKeyUsageRuleList>
+    <ContentKeyUsageRule kid="00010203-0405-0607-0809-0a0b0c0d0e0f" intendedTrackType="AUDIO"/>
+  </ContentKeyUsageRuleList>
+</CPIX>`
+	parsed, err := ParseCPIX([]byte(doc), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "movie", parsed.ContentID)
+	assert.Len(t, parsed.Keys, 1)
+	assert.Equal(t, "AUDIO", parsed.Keys[0].TrackType)
+	assert.Equal(t, "000102030405060708090a0b0c0d0e0f", KeyID(parsed.Keys[0].KeyID).String())
+	assert.Len(t, parsed.Keys[0].IV, 16)
+
+	_, err = ParseCPIX([]byte(`<MPD xmlns="urn:mpeg:dash:schema:mpd:2011"/>`), nil)
+	assert.Error(t, err)
+	_, err = ParseCPIX([]byte(strings.Replace(doc, "EBESExQVFhcYGRobHB0eHw==", "EBES", 1)), nil)
+	assert.Error(t, err)
+}
+
+func TestImportCPIX(t *testing.T) {
+	store, cleanup := testSQLKeyStore(t)
+	defer cleanup()
+	ctx := context.Background()
+	recipientKey := testCertificateKey(t)
+
+	kg := FakeKeyGoverner{}
+	wp := NewWidevineProxy(nil, nil, "widevine_test", kg, logrus.New())
+	b, err := wp.ExportCPIX(ctx, "testing", CPIXOptions{Recipients: []*x509.Certificate{testRecipientCertificate(t, recipientKey)}})
+	assert.NoError(t, err)
+
+	_, err = ImportCPIX(ctx, store, b, recipientKey)
+	assert.NoError(t, err)
+	key, err := store.Key(ctx, "testing", "SD")
+	assert.NoError(t, err)
+	assert.Equal(t, kg.GenerateContentKey([]byte("testing")), key.Key)
+	assert.Equal(t, kg.GenerateContentIV([]byte("testing")), key.IV)
+
+	// The store gets a random IV for keys without an explicit IV.
+	doc := strings.Replace(string(b), `contentId="testing"`, `contentId="other"`, 1)
+	doc = strings.Replace(doc, `explicitIV="`+base64.StdEncoding.EncodeToString(key.IV)+`"`, "", 1)
+	doc = strings.Replace(doc, KeyID(key.KeyID).UUID(), "00000000-0000-0000-0000-000000000001", -1)
+	_, err = ImportCPIX(ctx, store, []byte(doc), recipientKey)
+	assert.NoError(t, err)
+	key, err = store.Key(ctx, "other", "SD")
+	assert.NoError(t, err)
+	assert.Len(t, key.IV, 16)
+
+	doc = strings.Replace(string(b), `contentId="testing" `, "", 1)
+	_, err = ImportCPIX(ctx, store, []byte(doc), recipientKey)
+	assert.Error(t, err)
+}
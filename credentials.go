@@ -0,0 +1,347 @@
+package widevineproxy
+
+import (
+	"context"
+	"crypto/aes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// licenseStatusSignatureFailed is the status of license requests Widevine Cloud could not verify.
+const licenseStatusSignatureFailed = "SIGNATURE_FAILED"
+
+// Provider credentials are an AES-256 key and a 16 byte IV.
+const (
+	providerKeySize = 32
+	providerIVSize  = aes.BlockSize
+)
+
+// Provider names are the lowercase names Widevine assigns, e.g. widevine_test.
+var providerNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// ProviderCredentials are the AES key and IV a provider signs its requests with.
+type ProviderCredentials struct {
+	Key []byte
+	IV  []byte
+}
+
+// Validate checks the credentials are an AES-256 key and a 16 byte IV.
+func (c ProviderCredentials) Validate() error {
+	if len(c.Key) != providerKeySize {
+		return fmt.Errorf("key must be %d bytes (AES-256), got %d", providerKeySize, len(c.Key))
+	}
+	if len(c.IV) != providerIVSize {
+		return fmt.Errorf("IV must be %d bytes, got %d", providerIVSize, len(c.IV))
+	}
+	return nil
+}
+
+// ValidateProvider checks a provider name is lowercase letters, digits, '_' and '-'.
+func ValidateProvider(provider string) error {
+	if !providerNamePattern.MatchString(provider) {
+		return fmt.Errorf("invalid provider name %q: want lowercase letters, digits, '_' and '-'", provider)
+	}
+	return nil
+}
+
+// CredentialSource locates the key and IV of provider credentials. Each is read from its file when set,
+// or else from its environment variable, hex or base64 encoded.
+type CredentialSource struct {
+	KeyFile string
+	IVFile  string
+	KeyEnv  string
+	IVEnv   string
+}
+
+// LoadProviderCredentials reads and validates provider credentials.
+func LoadProviderCredentials(src CredentialSource) (ProviderCredentials, error) {
+	key, err := readCredential("key", src.KeyFile, src.KeyEnv)
+	if err != nil {
+		return ProviderCredentials{}, err
+	}
+	iv, err := readCredential("IV", src.IVFile, src.IVEnv)
+	if err != nil {
+		return ProviderCredentials{}, err
+	}
+	credentials := ProviderCredentials{Key: key, IV: iv}
+	if err := credentials.Validate(); err != nil {
+		return ProviderCredentials{}, err
+	}
+	return credentials, nil
+}
+
+func readCredential(name, file, env string) ([]byte, error) {
+	var value string
+	switch {
+	case file != "":
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		value = string(b)
+	case env != "":
+		v, ok := os.LookupEnv(env)
+		if !ok {
+			return nil, fmt.Errorf("%s: environment variable %s is not set", name, env)
+		}
+		value = v
+	default:
+		return nil, fmt.Errorf("%s: no file or environment variable", name)
+	}
+	b, err := decodeCredential(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return b, nil
+}
+
+// decodeCredential decodes a hex or base64 key or IV. Hex is tried first: padded base64 of 16 or
+// 32 bytes is never valid hex.
+func decodeCredential(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, fmt.Errorf("empty value")
+	}
+	if b, err := hex.DecodeString(s); err == nil {
+		return b, nil
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(s); err == nil {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("neither hex nor base64")
+}
+
+// FallbackSigner is a Signer that can also sign with the credentials preceding the active ones,
+// for requests Widevine refuses while a new signing key is being rolled out.
+type FallbackSigner interface {
+	Signer
+	SignPrevious(ctx context.Context, message []byte) ([]byte, error)
+}
+
+// CredentialFile is the JSON file of a CredentialSet. Keys and IVs are hex or base64 encoded.
+type CredentialFile struct {
+	Active      uint32                `json:"active"`
+	Credentials []CredentialFileEntry `json:"credentials"`
+}
+
+// CredentialFileEntry is a version of the credentials in a CredentialFile.
+type CredentialFileEntry struct {
+	Version uint32 `json:"version"`
+	Key     string `json:"key"`
+	IV      string `json:"iv"`
+}
+
+// CredentialSet holds the versioned signing credentials of a provider. Requests are signed with the
+// active version; when Widevine refuses the signature during a rotation, the proxy signs again with
+// the version before it. A CredentialSet is a FallbackSigner.
+type CredentialSet struct {
+	path   string
+	poller *filePoller
+
+	mu       sync.RWMutex
+	active   uint32
+	versions map[uint32]ProviderCredentials
+}
+
+// NewCredentialSet creates a CredentialSet from credentials by version.
+func NewCredentialSet(active uint32, versions map[uint32]ProviderCredentials) (*CredentialSet, error) {
+	cs := &CredentialSet{}
+	if err := cs.set(active, versions); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// LoadCredentialSet loads the CredentialFile at path. Reloads are logged to logger, or to the
+// standard logger when it is nil.
+func LoadCredentialSet(path string, logger *logrus.Logger) (*CredentialSet, error) {
+	cs := &CredentialSet{path: path}
+	cs.poller = newFilePoller(path, "Credential File", logger, cs.Reload)
+	if err := cs.Reload(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+func (cs *CredentialSet) set(active uint32, versions map[uint32]ProviderCredentials) error {
+	checked := make(map[uint32]ProviderCredentials)
+	for version, credentials := range versions {
+		if err := credentials.Validate(); err != nil {
+			return fmt.Errorf("credentials %d: %v", version, err)
+		}
+		checked[version] = credentials
+	}
+	if _, ok := checked[active]; !ok {
+		return fmt.Errorf("no credentials for active version %d", active)
+	}
+
+	cs.mu.Lock()
+	cs.active, cs.versions = active, checked
+	cs.mu.Unlock()
+	return nil
+}
+
+// Reload reads the credential file again. The credentials in use are kept when the file is invalid.
+func (cs *CredentialSet) Reload() error {
+	if cs.path == "" {
+		return fmt.Errorf("credential set has no file")
+	}
+	info, err := os.Stat(cs.path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(cs.path)
+	if err != nil {
+		return err
+	}
+
+	var file CredentialFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return fmt.Errorf("%s: %v", cs.path, err)
+	}
+	versions := make(map[uint32]ProviderCredentials)
+	for _, entry := range file.Credentials {
+		if _, ok := versions[entry.Version]; ok {
+			return fmt.Errorf("%s: duplicate credentials %d", cs.path, entry.Version)
+		}
+		key, err := decodeCredential(entry.Key)
+		if err != nil {
+			return fmt.Errorf("%s: credentials %d: key: %v", cs.path, entry.Version, err)
+		}
+		iv, err := decodeCredential(entry.IV)
+		if err != nil {
+			return fmt.Errorf("%s: credentials %d: IV: %v", cs.path, entry.Version, err)
+		}
+		versions[entry.Version] = ProviderCredentials{Key: key, IV: iv}
+	}
+	if err := cs.set(file.Active, versions); err != nil {
+		return fmt.Errorf("%s: %v", cs.path, err)
+	}
+
+	cs.poller.loaded(info)
+	return nil
+}
+
+// Watch polls the credential file every interval and reloads it when it changes, until Close.
+func (cs *CredentialSet) Watch(interval time.Duration) {
+	if cs.poller != nil {
+		cs.poller.watch(interval)
+	}
+}
+
+// Close stops watching the credential file.
+func (cs *CredentialSet) Close() {
+	if cs.poller != nil {
+		cs.poller.close()
+	}
+}
+
+// Active returns the version requests are signed with.
+func (cs *CredentialSet) Active() uint32 {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.active
+}
+
+// Credentials returns the credentials of a version.
+func (cs *CredentialSet) Credentials(version uint32) (ProviderCredentials, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	credentials, ok := cs.versions[version]
+	return credentials, ok
+}
+
+// Previous returns the highest version below the active one.
+func (cs *CredentialSet) Previous() (uint32, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.previous()
+}
+
+// previous is Previous with cs.mu held.
+func (cs *CredentialSet) previous() (uint32, bool) {
+	previous, found := uint32(0), false
+	for version := range cs.versions {
+		if version < cs.active && (!found || version > previous) {
+			previous, found = version, true
+		}
+	}
+	return previous, found
+}
+
+// Sign signs the message with the active credentials.
+func (cs *CredentialSet) Sign(ctx context.Context, message []byte) ([]byte, error) {
+	// The active version and its credentials are read together, so a reload cannot come between them.
+	cs.mu.RLock()
+	credentials := cs.versions[cs.active]
+	cs.mu.RUnlock()
+	return AESSigner(credentials).Sign(ctx, message)
+}
+
+// SignPrevious signs the message with the credentials before the active ones.
+func (cs *CredentialSet) SignPrevious(ctx context.Context, message []byte) ([]byte, error) {
+	cs.mu.RLock()
+	active := cs.active
+	version, ok := cs.previous()
+	credentials := cs.versions[version]
+	cs.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no credentials before version %d", active)
+	}
+	return AESSigner(credentials).Sign(ctx, message)
+}
+
+// signPrevious signs a request again with the previous credentials of a FallbackSigner.
+// It reports false when the Signer has no previous credentials.
+func (wp *Proxy) signPrevious(ctx context.Context, postBody map[string]interface{}) (map[string]interface{}, bool) {
+	signer, ok := wp.signer().(FallbackSigner)
+	if !ok {
+		return nil, false
+	}
+	request, _ := postBody["request"].(string)
+	message, err := base64.StdEncoding.DecodeString(request)
+	if err != nil {
+		return nil, false
+	}
+	sign, err := signer.SignPrevious(ctx, message)
+	if err != nil {
+		wp.Logger.WithField("error", err.Error()).Debug("Previous Credentials Unavailable")
+		return nil, false
+	}
+
+	resigned := make(map[string]interface{}, len(postBody))
+	for k, v := range postBody {
+		resigned[k] = v
+	}
+	resigned["signature"] = sign
+	return resigned, true
+}
+
+// retryWithPreviousCredentials sends a signed request with post, which reports whether Widevine
+// refused the signature. While a new signing key rolls out, Widevine may still expect the previous
+// one, so a refused request is signed again with the previous credentials and sent once more.
+func (wp *Proxy) retryWithPreviousCredentials(ctx context.Context, postBody map[string]interface{}, post func(map[string]interface{}) (signatureFailed bool, err error)) error {
+	signatureFailed, err := post(postBody)
+	if err != nil || !signatureFailed {
+		return err
+	}
+	resigned, ok := wp.signPrevious(ctx, postBody)
+	if !ok {
+		return nil
+	}
+	wp.Logger.Warn("Signature Failed, Retrying With Previous Credentials")
+	_, err = post(resigned)
+	return err
+}
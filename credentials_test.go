@@ -0,0 +1,225 @@
+package widevineproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const testRotatedKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func testCredentialFile(active uint32) string {
+	file := CredentialFile{
+		Active: active,
+		Credentials: []CredentialFileEntry{
+			{Version: 1, Key: testKey, IV: testIV},
+			{Version: 2, Key: testRotatedKey, IV: testIV},
+		},
+	}
+	b, _ := json.Marshal(file)
+	return string(b)
+}
+
+func testCredentialSet(t *testing.T, active uint32) *CredentialSet {
+	key, _ := hex.DecodeString(testKey)
+	rotated, _ := hex.DecodeString(testRotatedKey)
+	iv, _ := hex.DecodeString(testIV)
+	cs, err := NewCredentialSet(active, map[uint32]ProviderCredentials{
+		1: {Key: key, IV: iv},
+		2: {Key: rotated, IV: iv},
+	})
+	assert.NoError(t, err)
+	return cs
+}
+
+func TestCredentialSet(t *testing.T) {
+	key, _ := hex.DecodeString(testKey)
+	iv, _ := hex.DecodeString(testIV)
+	ctx := context.Background()
+	message := []byte(`{"isTest":true,"test":"testing","test2":"testing2","test3":"testing3"}`)
+
+	cs := testCredentialSet(t, 2)
+	previous, ok := cs.Previous()
+	assert.True(t, ok)
+	assert.Equal(t, uint32(1), previous)
+
+	sign, err := cs.SignPrevious(ctx, message)
+	assert.NoError(t, err)
+	assert.Equal(t, "ga80QzRuUM+jnPcoR6UWs5TXrTQ2VgeYiu0FoqCNRH4=", base64.StdEncoding.EncodeToString(sign))
+	sign, err = cs.Sign(ctx, message)
+	assert.NoError(t, err)
+	assert.NotEqual(t, "ga80QzRuUM+jnPcoR6UWs5TXrTQ2VgeYiu0FoqCNRH4=", base64.StdEncoding.EncodeToString(sign))
+
+	_, err = testCredentialSet(t, 1).SignPrevious(ctx, message)
+	assert.EqualError(t, err, "no credentials before version 1")
+
+	_, err = NewCredentialSet(3, map[uint32]ProviderCredentials{1: {Key: key, IV: iv}})
+	assert.EqualError(t, err, "no credentials for active version 3")
+	_, err = NewCredentialSet(1, map[uint32]ProviderCredentials{1: {Key: key[:10], IV: iv}})
+	assert.EqualError(t, err, "credentials 1: key must be 32 bytes (AES-256), got 10")
+	_, err = NewCredentialSet(1, map[uint32]ProviderCredentials{1: {Key: key, IV: iv[:8]}})
+	assert.EqualError(t, err, "credentials 1: IV must be 16 bytes, got 8")
+}
+
+func TestCredentialSetSignDuringReload(t *testing.T) {
+	key, _ := hex.DecodeString(testKey)
+	iv, _ := hex.DecodeString(testIV)
+	ctx := context.Background()
+
+	// Each reload drops the version active before it.
+	cs := testCredentialSet(t, 2)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			active := uint32(i%2*2 + 3)
+			assert.NoError(t, cs.set(active, map[uint32]ProviderCredentials{active - 1: {Key: key, IV: iv}, active: {Key: key, IV: iv}}))
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		_, err := cs.Sign(ctx, []byte("message"))
+		assert.NoError(t, err)
+		_, err = cs.SignPrevious(ctx, []byte("message"))
+		assert.NoError(t, err)
+	}
+	<-done
+}
+
+func TestCredentialSetWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Without a logger, reloads are logged to the standard logger.
+	path := writeKeyFile(t, dir, "credentials.json", testCredentialFile(1))
+	cs, err := LoadCredentialSet(path, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), cs.Active())
+	cs.Watch(10 * time.Millisecond)
+	defer cs.Close()
+
+	// An invalid file keeps the credentials in use.
+	writeKeyFile(t, dir, "credentials.json", `{"active":3,"credentials":[{"version":3,"key":"00","iv":"00"}]}`)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, uint32(1), cs.Active())
+	assert.Error(t, cs.Reload())
+
+	writeKeyFile(t, dir, "credentials.json", testCredentialFile(2))
+	for i := 0; i < 100 && cs.Active() != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, uint32(2), cs.Active())
+
+	_, err = LoadCredentialSet(writeKeyFile(t, dir, "duplicate.json", `{"active":1,"credentials":[{"version":1,"key":"`+testKey+`","iv":"`+testIV+`"},{"version":1,"key":"`+testKey+`","iv":"`+testIV+`"}]}`), logrus.New())
+	assert.EqualError(t, err, filepath.Join(dir, "duplicate.json")+": duplicate credentials 1")
+}
+
+// oldCredentialsLicenseServer stands in for Widevine Cloud before it learns the rotated key.
+type oldCredentialsLicenseServer struct {
+	requests int
+}
+
+func (s *oldCredentialsLicenseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.requests++
+	var envelope struct {
+		Request   string `json:"request"`
+		Signature []byte `json:"signature"`
+	}
+	json.NewDecoder(r.Body).Decode(&envelope)
+	request, _ := base64.StdEncoding.DecodeString(envelope.Request)
+
+	key, _ := hex.DecodeString(testKey)
+	iv, _ := hex.DecodeString(testIV)
+	want, _ := AESSigner{Key: key, IV: iv}.Sign(r.Context(), request)
+	status := "OK"
+	if string(want) != string(envelope.Signature) {
+		status = licenseStatusSignatureFailed
+	}
+	json.NewEncoder(w).Encode(LicenseResponse{Status: status})
+}
+
+func TestCredentialRotation(t *testing.T) {
+	// Licenses are signed again with the previous credentials Widevine still expects.
+	server := &oldCredentialsLicenseServer{}
+	wp := NewWidevineProxy(nil, nil, "widevine_test", FakeKeyGoverner{}, logrus.New())
+	wp.httpCaller = &http.Client{Transport: handlerTransport{server}}
+	wp.Signer = testCredentialSet(t, 2)
+
+	lr, err := wp.GetLicenseContext(context.Background(), "testing", "CAE=")
+	assert.NoError(t, err)
+	assert.Equal(t, "OK", lr.Status)
+	assert.Equal(t, 2, server.requests)
+
+	// Without previous credentials the refusal is returned as is.
+	server.requests = 0
+	key, _ := hex.DecodeString(testRotatedKey)
+	iv, _ := hex.DecodeString(testIV)
+	wp.Signer = AESSigner{Key: key, IV: iv}
+	lr, err = wp.GetLicenseContext(context.Background(), "testing", "CAE=")
+	assert.NoError(t, err)
+	assert.Equal(t, licenseStatusSignatureFailed, lr.Status)
+	assert.Equal(t, 1, server.requests)
+
+	// Content key requests fall back the same way.
+	h, packager := testContentKeyHandler(t)
+	packager.Signer = testCredentialSet(t, 2)
+	resp, err := packager.GetContentKey("testing", Policy{Tracks: []string{"SD"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "OK", resp.Status)
+
+	h.Credentials["widevine_test"] = ProviderCredentials{Key: key, IV: iv}
+	packager.Signer = testCredentialSet(t, 1)
+	resp, err = packager.GetContentKey("testing", Policy{Tracks: []string{"SD"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "SIGNATURE_FAILED", resp.Status)
+}
+
+func TestLoadProviderCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	key, _ := hex.DecodeString(testKey)
+	iv, _ := hex.DecodeString(testIV)
+
+	os.Setenv("WIDEVINE_PROXY_TEST_IV", base64.StdEncoding.EncodeToString(iv))
+	defer os.Unsetenv("WIDEVINE_PROXY_TEST_IV")
+	credentials, err := LoadProviderCredentials(CredentialSource{
+		KeyFile: writeKeyFile(t, dir, "key", testKey+"\n"),
+		IVEnv:   "WIDEVINE_PROXY_TEST_IV",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ProviderCredentials{Key: key, IV: iv}, credentials)
+
+	_, err = LoadProviderCredentials(CredentialSource{KeyFile: writeKeyFile(t, dir, "short", testIV), IVEnv: "WIDEVINE_PROXY_TEST_IV"})
+	assert.EqualError(t, err, "key must be 32 bytes (AES-256), got 16")
+	_, err = LoadProviderCredentials(CredentialSource{KeyFile: writeKeyFile(t, dir, "garbage", "not a key!"), IVEnv: "WIDEVINE_PROXY_TEST_IV"})
+	assert.EqualError(t, err, "key: neither hex nor base64")
+	_, err = LoadProviderCredentials(CredentialSource{KeyEnv: "WIDEVINE_PROXY_TEST_IV", IVEnv: "WIDEVINE_PROXY_TEST_UNSET"})
+	assert.EqualError(t, err, "IV: environment variable WIDEVINE_PROXY_TEST_UNSET is not set")
+	_, err = LoadProviderCredentials(CredentialSource{})
+	assert.EqualError(t, err, "key: no file or environment variable")
+}
+
+func TestNewWidevineProxyWithCredentials(t *testing.T) {
+	key, _ := hex.DecodeString(testKey)
+	iv, _ := hex.DecodeString(testIV)
+
+	wp, err := NewWidevineProxyWithCredentials(ProviderCredentials{Key: key, IV: iv}, "widevine_test", FakeKeyGoverner{}, logrus.New())
+	assert.NoError(t, err)
+	assert.Equal(t, key, wp.PartnerRootKey)
+
+	_, err = NewWidevineProxyWithCredentials(ProviderCredentials{Key: key[:16], IV: iv}, "widevine_test", FakeKeyGoverner{}, logrus.New())
+	assert.EqualError(t, err, "provider widevine_test: key must be 32 bytes (AES-256), got 16")
+	_, err = NewWidevineProxyWithCredentials(ProviderCredentials{Key: key, IV: iv}, "Widevine Test", FakeKeyGoverner{}, logrus.New())
+	assert.EqualError(t, err, `invalid provider name "Widevine Test": want lowercase letters, digits, '_' and '-'`)
+}
@@ -4,53 +4,95 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+	"fmt"
 )
 
+var errInvalidPadding = errors.New("invalid padding")
+
+// PKCS5Padding pads the data to a multiple of the block size with PKCS#7 padding. Block-aligned data
+// gets a whole block of padding, so the padding is always unambiguous.
 func PKCS5Padding(ciphertext []byte, blockSize int) []byte {
 	padding := blockSize - len(ciphertext)%blockSize
-	padtext := bytes.Repeat([]byte{byte(padding)}, padding)
-	return append(ciphertext, padtext...)
+	padded := make([]byte, len(ciphertext), len(ciphertext)+padding)
+	copy(padded, ciphertext)
+	return append(padded, bytes.Repeat([]byte{byte(padding)}, padding)...)
 }
 
-func PKCS5UnPadding(origData []byte) []byte {
-	return origData[:(len(origData) - int(origData[len(origData)-1]))]
+// PKCS5UnPadding removes the PKCS#7 padding of AES blocks.
+func PKCS5UnPadding(origData []byte) ([]byte, error) {
+	return pkcs7Unpad(origData, aes.BlockSize)
 }
 
-// AESCBCEncrypt is given key, iv to encrypt the plainText in AES CBC way.
-func AESCBCEncrypt(key, iv, plainText []byte) ([]byte, error) {
+// pkcs7Unpad removes PKCS#7 padding. Every byte of the last block is checked whatever the padding
+// length, so the time taken does not tell how the padding was wrong.
+func pkcs7Unpad(b []byte, blockSize int) ([]byte, error) {
+	if len(b) == 0 || len(b)%blockSize != 0 {
+		return nil, errInvalidPadding
+	}
+	n := int(b[len(b)-1])
+	good := subtle.ConstantTimeLessOrEq(1, n) & subtle.ConstantTimeLessOrEq(n, blockSize)
+	for i := 0; i < blockSize; i++ {
+		inPadding := subtle.ConstantTimeLessOrEq(i+1, n)
+		matches := subtle.ConstantTimeByteEq(b[len(b)-1-i], byte(n))
+		good &= (1 ^ inPadding) | matches
+	}
+	if good != 1 {
+		return nil, errInvalidPadding
+	}
+	return b[:len(b)-n], nil
+}
+
+func newCBCBlock(key, iv []byte) (cipher.Block, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-
-	mode := cipher.NewCBCEncrypter(block, iv)
-	if len(plainText)%aes.BlockSize != 0 {
-		plainText = PKCS5Padding(plainText, block.BlockSize())
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("IV must be %d bytes, got %d", aes.BlockSize, len(iv))
 	}
-	ciphertext := make([]byte, len(plainText))
-	mode.CryptBlocks(ciphertext, plainText)
-
-	return ciphertext, nil
+	return block, nil
+}
 
+// AESCBCEncrypt is given key, iv to encrypt the plainText in AES CBC way, with PKCS#7 padding.
+func AESCBCEncrypt(key, iv, plainText []byte) ([]byte, error) {
+	return AESCBCEncryptBlocks(key, iv, PKCS5Padding(plainText, aes.BlockSize))
 }
 
-// AESCBCDecrypt is given key, iv to decrypt the cipherText in AES CBC way.
+// AESCBCDecrypt is given key, iv to decrypt the cipherText in AES CBC way, and removes its PKCS#7 padding.
 func AESCBCDecrypt(key, iv, cipherText []byte) ([]byte, error) {
-
-	if len(cipherText) == 0 {
-		panic("ciphertext can't be plain")
+	plainText, err := AESCBCDecryptBlocks(key, iv, cipherText)
+	if err != nil {
+		return nil, err
 	}
+	return pkcs7Unpad(plainText, aes.BlockSize)
+}
 
-	block, err := aes.NewCipher(key)
+// AESCBCEncryptBlocks encrypts whole blocks in AES CBC way without padding, as Widevine wraps keys.
+func AESCBCEncryptBlocks(key, iv, plainText []byte) ([]byte, error) {
+	block, err := newCBCBlock(key, iv)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if len(plainText)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("plain text is not a multiple of the block size")
 	}
+	cipherText := make([]byte, len(plainText))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(cipherText, plainText)
+	return cipherText, nil
+}
 
-	mode := cipher.NewCBCDecrypter(block, iv)
-	plainText := make([]byte, len(cipherText))
-	mode.CryptBlocks(plainText, cipherText)
-	if len(cipherText)%aes.BlockSize == 0 {
-		return plainText, nil
+// AESCBCDecryptBlocks decrypts whole blocks in AES CBC way without removing padding.
+func AESCBCDecryptBlocks(key, iv, cipherText []byte) ([]byte, error) {
+	block, err := newCBCBlock(key, iv)
+	if err != nil {
+		return nil, err
 	}
-	return PKCS5UnPadding(plainText), nil
+	if len(cipherText) == 0 || len(cipherText)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("cipher text is not a multiple of the block size")
+	}
+	plainText := make([]byte, len(cipherText))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plainText, cipherText)
+	return plainText, nil
 }
@@ -1,6 +1,7 @@
 package widevineproxy
 
 import (
+	"bytes"
 	"encoding/hex"
 	"testing"
 
@@ -23,3 +24,73 @@ func TestCBCEncryptAndDecrypt(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, []byte(plainText), decryptedPlainText)
 }
+
+func TestCBCPadding(t *testing.T) {
+	key, _ := hex.DecodeString(testKey)
+	iv, _ := hex.DecodeString(testIV)
+
+	// Block-aligned plain text gets a whole block of padding.
+	block := []byte("0123456789abcdef")
+	crypted, err := AESCBCEncrypt(key, iv, block)
+	assert.NoError(t, err)
+	assert.Len(t, crypted, 32)
+	plain, err := AESCBCDecryptBlocks(key, iv, crypted)
+	assert.NoError(t, err)
+	assert.Equal(t, append([]byte("0123456789abcdef"), bytes.Repeat([]byte{16}, 16)...), plain)
+
+	// Without padding the blocks are encrypted as they are.
+	crypted, err = AESCBCEncryptBlocks(key, iv, block)
+	assert.NoError(t, err)
+	assert.Len(t, crypted, 16)
+	_, err = AESCBCDecrypt(key, iv, crypted)
+	assert.EqualError(t, err, "invalid padding")
+	_, err = AESCBCEncryptBlocks(key, iv, []byte("short"))
+	assert.Error(t, err)
+
+	// Padding leaves the caller's slice alone.
+	buf := make([]byte, 5, 16)
+	PKCS5Padding(buf, 16)
+	assert.Equal(t, make([]byte, 16), buf[:16])
+}
+
+func TestCBCInvalidInput(t *testing.T) {
+	key, _ := hex.DecodeString(testKey)
+	iv, _ := hex.DecodeString(testIV)
+
+	// Bad keys, IVs and cipher texts are errors rather than panics.
+	_, err := AESCBCEncrypt(key[:10], iv, []byte("plain"))
+	assert.EqualError(t, err, "crypto/aes: invalid key size 10")
+	_, err = AESCBCEncrypt(key, iv[:8], []byte("plain"))
+	assert.EqualError(t, err, "IV must be 16 bytes, got 8")
+	_, err = AESCBCDecrypt(key[:10], iv, make([]byte, 16))
+	assert.Error(t, err)
+	_, err = AESCBCDecrypt(key, iv, nil)
+	assert.EqualError(t, err, "cipher text is not a multiple of the block size")
+	_, err = AESCBCDecrypt(key, iv, make([]byte, 20))
+	assert.EqualError(t, err, "cipher text is not a multiple of the block size")
+
+	_, err = PKCS5UnPadding([]byte{1, 2, 3})
+	assert.Error(t, err)
+}
+
+func TestPKCS7Unpad(t *testing.T) {
+	b, err := pkcs7Unpad(append([]byte("0123456789abc"), 3, 3, 3), 16)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("0123456789abc"), b)
+
+	b, err = pkcs7Unpad(append([]byte("0123456789abcdef"), bytes.Repeat([]byte{16}, 16)...), 16)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("0123456789abcdef"), b)
+
+	for _, padded := range [][]byte{
+		nil,
+		append([]byte("0123456789abc"), 1, 3, 3),
+		append([]byte("0123456789abcde"), 0),
+		append([]byte("0123456789abcde"), 17),
+		[]byte("0123456789"),
+		append([]byte("0123456789abcdef"), bytes.Repeat([]byte{16}, 15)...),
+	} {
+		_, err := pkcs7Unpad(padded, 16)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,423 @@
+package widevineproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Cooomma/widevine-proxy/pssh"
+)
+
+// DASH namespaces used by ContentProtection elements.
+const (
+	cencNamespace   = "urn:mpeg:cenc:2013"
+	dashifNamespace = "https://dashif.org/CPS"
+	msprNamespace   = "urn:microsoft:playready"
+)
+
+// ContentProtection is a DASH-IF ContentProtection element.
+type ContentProtection struct {
+	XMLName     xml.Name `xml:"ContentProtection"`
+	SchemeIDURI string   `xml:"schemeIdUri,attr"`
+	Value       string   `xml:"value,attr,omitempty"`
+	DefaultKID  string   `xml:"cenc:default_KID,attr,omitempty"`
+	PSSH        string   `xml:"cenc:pssh,omitempty"`
+	PRO         string   `xml:"mspr:pro,omitempty"`
+	LicenseURL  string   `xml:"dashif:laurl,omitempty"`
+}
+
+// AdaptationSet holds the attributes of an MPD AdaptationSet used to pick its track type.
+// Missing attributes are taken from its Representations.
+type AdaptationSet struct {
+	ContentType string
+	MimeType    string
+	Height      int
+}
+
+// DASHOptions configures the generated ContentProtection elements.
+type DASHOptions struct {
+	// LicenseURL is signalled with dashif:laurl in the Widevine element.
+	LicenseURL string
+	// InitData selects the DRM systems and scheme for ContentProtectionFromKeys.
+	// Its protection scheme is also the value of the mp4protection element, cenc by default.
+	InitData InitDataOptions
+	// TrackType maps an adaptation set to a Widevine track type. By default audio
+	// adaptation sets are AUDIO and video ones are SD, HD, UHD1 or UHD2 by height.
+	TrackType func(as AdaptationSet) string
+}
+
+// ContentProtectionFromResponse builds the ContentProtection elements of each track type
+// of a content key response.
+func ContentProtectionFromResponse(resp *ContentKeyResponse, opts DASHOptions) (map[string][]ContentProtection, error) {
+	elements := make(map[string][]ContentProtection)
+	for _, track := range resp.Tracks {
+		kid, err := base64.StdEncoding.DecodeString(track.KeyID)
+		if err != nil || len(kid) != 16 {
+			return nil, fmt.Errorf("%s track: invalid key ID %q", track.Type, track.KeyID)
+		}
+
+		var systems []ProtectionSystemData
+		for _, p := range track.PSSH {
+			data, err := base64.StdEncoding.DecodeString(p.Data)
+			if err != nil {
+				return nil, fmt.Errorf("%s track: decode %s pssh: %v", track.Type, p.DRMType, err)
+			}
+			system, err := responseSystemData(p.DRMType, kid, data)
+			if err != nil {
+				return nil, fmt.Errorf("%s track: %v", track.Type, err)
+			}
+			systems = append(systems, system)
+		}
+		if len(track.PSSH) == 0 {
+			system, err := responseSystemData(DRMTypeWidevine, kid, (&pssh.WidevineData{KeyIDs: [][]byte{kid}}).Marshal())
+			if err != nil {
+				return nil, err
+			}
+			systems = append(systems, system)
+		}
+		elements[track.Type] = contentProtection(kid, systems, opts)
+	}
+	return elements, nil
+}
+
+// responseSystemData wraps the pssh data of a content key response in a pssh box
+// unless Widevine already returned a full box.
+func responseSystemData(drmType string, kid, data []byte) (ProtectionSystemData, error) {
+	system := ProtectionSystemData{DRMType: drmType, KeyIDs: [][]byte{kid}, Data: data}
+	box := &pssh.Box{Data: data}
+	if pssh.IsBox(data) {
+		parsed, err := pssh.Parse(data)
+		if err != nil {
+			return system, err
+		}
+		box = parsed
+		system.Data = parsed.Data
+	} else {
+		switch drmType {
+		case DRMTypeWidevine:
+			box.SystemID = pssh.WidevineSystemID
+		case DRMTypePlayReady:
+			box.SystemID = pssh.PlayReadySystemID
+		default:
+			return system, fmt.Errorf("unsupported DRM type %q", drmType)
+		}
+	}
+
+	b, err := box.Marshal()
+	if err != nil {
+		return system, err
+	}
+	system.SystemID = box.SystemID
+	system.PSSH = b
+	return system, nil
+}
+
+// ContentProtectionFromKeys builds the ContentProtection elements of each track type from
+// the content key specs of the KeyGoverner. Without specs, the elements of the content key ID
+// are returned under the empty track type, which applies to every adaptation set.
+func (wp *Proxy) ContentProtectionFromKeys(contentID string, opts DASHOptions) (map[string][]ContentProtection, error) {
+	return wp.ContentProtectionFromKeysContext(context.Background(), contentID, opts)
+}
+
+// ContentProtectionFromKeysContext is ContentProtectionFromKeys with a context for the key lookups.
+func (wp *Proxy) ContentProtectionFromKeysContext(ctx context.Context, contentID string, opts DASHOptions) (map[string][]ContentProtection, error) {
+	specs, err := wp.contentKeySpecs(ctx, []byte(contentID), opts.InitData.PolicyConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	elements := make(map[string][]ContentProtection)
+	if len(specs) == 0 {
+		keys, err := wp.initDataKeys(ctx, contentID, opts.InitData.PolicyConfig)
+		if err != nil {
+			return nil, err
+		}
+		systems, err := wp.initDataSystems(contentID, keys, opts.InitData)
+		if err != nil {
+			return nil, err
+		}
+		elements[""] = contentProtection(keys[0].KeyID, systems, opts)
+		return elements, nil
+	}
+
+	for _, spec := range specs {
+		if err := spec.Validate(); err != nil {
+			return nil, err
+		}
+		kid, _ := base64.StdEncoding.DecodeString(spec.KeyID)
+		key, _ := base64.StdEncoding.DecodeString(spec.Key)
+		systems, err := wp.initDataSystems(contentID, []pssh.PlayReadyKey{{KeyID: kid, Key: key}}, opts.InitData)
+		if err != nil {
+			return nil, fmt.Errorf("%s track: %v", spec.TrackType, err)
+		}
+		elements[spec.TrackType] = contentProtection(kid, systems, opts)
+	}
+	return elements, nil
+}
+
+func contentProtection(kid []byte, systems []ProtectionSystemData, opts DASHOptions) []ContentProtection {
+	scheme := opts.InitData.ProtectionScheme
+	if scheme == 0 {
+		scheme = pssh.SchemeCENC
+	}
+	elements := []ContentProtection{
+		{
+			SchemeIDURI: "urn:mpeg:dash:mp4protection:2011",
+			Value:       scheme.String(),
+			DefaultKID:  KeyID(kid).UUID(),
+		},
+	}
+	for _, system := range systems {
+		element := ContentProtection{
+			SchemeIDURI: "urn:uuid:" + system.SystemID.String(),
+			PSSH:        base64.StdEncoding.EncodeToString(system.PSSH),
+		}
+		switch system.SystemID {
+		case pssh.WidevineSystemID:
+			element.Value = "Widevine"
+			element.LicenseURL = opts.LicenseURL
+		case pssh.PlayReadySystemID:
+			element.Value = "MSPR 2.0"
+			element.PRO = base64.StdEncoding.EncodeToString(system.Data)
+			element.LicenseURL = opts.InitData.PlayReadyLicenseURL
+		}
+		elements = append(elements, element)
+	}
+	return elements
+}
+
+// defaultTrackType maps audio adaptation sets to AUDIO and video ones to a track type by height.
+func defaultTrackType(as AdaptationSet) string {
+	contentType := as.ContentType
+	if contentType == "" {
+		contentType = strings.SplitN(as.MimeType, "/", 2)[0]
+	}
+	switch contentType {
+	case "audio":
+		return "AUDIO"
+	case "video":
+		switch {
+		case as.Height <= 576:
+			return "SD"
+		case as.Height <= 1080:
+			return "HD"
+		case as.Height <= 2160:
+			return "UHD1"
+		}
+		return "UHD2"
+	}
+	return ""
+}
+
+// adaptationSet is an AdaptationSet located in an MPD document.
+type adaptationSet struct {
+	attrs AdaptationSet
+	// insertAt is the offset right after the AdaptationSet start tag.
+	insertAt int64
+	indent   string
+	// existing are the byte ranges of the ContentProtection children.
+	existing [][2]int64
+}
+
+// InjectContentProtection inserts the ContentProtection elements into every audio and video
+// AdaptationSet of an MPD document, replacing the ContentProtection elements already present.
+// The rest of the document is kept byte for byte, apart from the namespace declarations
+// added to the MPD element.
+func InjectContentProtection(mpd []byte, elements map[string][]ContentProtection, opts DASHOptions) ([]byte, error) {
+	trackType := opts.TrackType
+	if trackType == nil {
+		trackType = defaultTrackType
+	}
+
+	sets, mpdEnd, namespaces, err := scanMPD(mpd)
+	if err != nil {
+		return nil, err
+	}
+
+	var edits []mpdEdit
+	var missing []string
+	for prefix, ns := range map[string]string{"cenc": cencNamespace, "dashif": dashifNamespace, "mspr": msprNamespace} {
+		if _, ok := namespaces[prefix]; !ok {
+			missing = append(missing, fmt.Sprintf(` xmlns:%s="%s"`, prefix, ns))
+		}
+	}
+	if len(missing) > 0 {
+		// Sorted for a stable output.
+		sort.Strings(missing)
+		edits = append(edits, mpdEdit{start: mpdEnd, end: mpdEnd, text: strings.Join(missing, "")})
+	}
+
+	for _, set := range sets {
+		t := trackType(set.attrs)
+		if t == "" {
+			continue
+		}
+		cps, ok := elements[t]
+		if !ok {
+			cps, ok = elements[""]
+		}
+		if !ok {
+			return nil, fmt.Errorf("no ContentProtection elements for %s track", t)
+		}
+
+		var text bytes.Buffer
+		for _, cp := range cps {
+			b, err := xml.MarshalIndent(cp, set.indent, "  ")
+			if err != nil {
+				return nil, err
+			}
+			if set.indent != "" {
+				text.WriteString("\n")
+			}
+			text.Write(b)
+		}
+		edits = append(edits, mpdEdit{start: set.insertAt, end: set.insertAt, text: text.String()})
+
+		for _, r := range set.existing {
+			start := r[0]
+			// Drop the indentation in front of the removed element as well.
+			for start > 0 && (mpd[start-1] == ' ' || mpd[start-1] == '\t') {
+				start--
+			}
+			if start > 0 && mpd[start-1] == '\n' {
+				start--
+			}
+			edits = append(edits, mpdEdit{start: start, end: r[1]})
+		}
+	}
+	return applyEdits(mpd, edits), nil
+}
+
+type mpdEdit struct {
+	start, end int64
+	text       string
+}
+
+// scanMPD locates the AdaptationSet elements, the offset of the closing '>' of the MPD
+// start tag and the namespace prefixes the MPD element declares.
+func scanMPD(mpd []byte) ([]*adaptationSet, int64, map[string]string, error) {
+	d := xml.NewDecoder(bytes.NewReader(mpd))
+	var sets []*adaptationSet
+	var current *adaptationSet
+	var mpdEnd int64 = -1
+	namespaces := make(map[string]string)
+	var cpStart int64 = -1
+	depth, setDepth := 0, 0
+
+	for {
+		start := d.InputOffset()
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("parse MPD: %v", err)
+		}
+		end := d.InputOffset()
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			selfClosing := bytes.HasSuffix(mpd[start:end], []byte("/>"))
+			switch {
+			case t.Name.Local == "MPD" && mpdEnd < 0:
+				mpdEnd = end - 1
+				if selfClosing {
+					mpdEnd--
+				}
+				for _, attr := range t.Attr {
+					if attr.Name.Space == "xmlns" {
+						namespaces[attr.Name.Local] = attr.Value
+					}
+				}
+			case t.Name.Local == "AdaptationSet" && !selfClosing:
+				current = &adaptationSet{attrs: adaptationSetAttrs(t, AdaptationSet{}), insertAt: end}
+				current.indent = childIndent(mpd, start)
+				sets = append(sets, current)
+				setDepth = depth
+			case current != nil && depth == setDepth+1 && t.Name.Local == "ContentProtection":
+				cpStart = start
+			case current != nil && depth == setDepth+1 && t.Name.Local == "Representation":
+				current.attrs = adaptationSetAttrs(t, current.attrs)
+			}
+			// RawToken does not report an end element for self closing tags.
+			if selfClosing {
+				depth--
+				if cpStart >= 0 && depth == setDepth {
+					current.existing = append(current.existing, [2]int64{cpStart, end})
+					cpStart = -1
+				}
+			}
+		case xml.EndElement:
+			depth--
+			switch {
+			case current != nil && cpStart >= 0 && depth == setDepth && t.Name.Local == "ContentProtection":
+				current.existing = append(current.existing, [2]int64{cpStart, end})
+				cpStart = -1
+			case current != nil && depth == setDepth-1 && t.Name.Local == "AdaptationSet":
+				current = nil
+			}
+		}
+	}
+	if mpdEnd < 0 {
+		return nil, 0, nil, fmt.Errorf("parse MPD: no MPD element")
+	}
+	return sets, mpdEnd, namespaces, nil
+}
+
+// adaptationSetAttrs fills the attributes missing in as from the element attributes.
+func adaptationSetAttrs(el xml.StartElement, as AdaptationSet) AdaptationSet {
+	for _, attr := range el.Attr {
+		switch attr.Name.Local {
+		case "contentType":
+			if as.ContentType == "" {
+				as.ContentType = attr.Value
+			}
+		case "mimeType":
+			if as.MimeType == "" {
+				as.MimeType = attr.Value
+			}
+		case "maxHeight", "height":
+			if h, err := strconv.Atoi(attr.Value); err == nil && h > as.Height {
+				as.Height = h
+			}
+		}
+	}
+	return as
+}
+
+// childIndent returns the indentation for children of the element starting at offset,
+// or an empty string when the document is not indented.
+func childIndent(doc []byte, offset int64) string {
+	lineStart := bytes.LastIndexByte(doc[:offset], '\n')
+	if lineStart < 0 {
+		return ""
+	}
+	indent := doc[lineStart+1 : offset]
+	if len(bytes.TrimLeft(indent, " \t")) > 0 {
+		return ""
+	}
+	return string(indent) + "  "
+}
+
+func applyEdits(doc []byte, edits []mpdEdit) []byte {
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var out bytes.Buffer
+	var pos int64
+	for _, e := range edits {
+		if e.start < pos {
+			continue
+		}
+		out.Write(doc[pos:e.start])
+		out.WriteString(e.text)
+		pos = e.end
+	}
+	out.Write(doc[pos:])
+	return out.Bytes()
+}
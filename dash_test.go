@@ -0,0 +1,135 @@
+package widevineproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/Cooomma/widevine-proxy/pssh"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const testMPD = `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" xmlns:cenc="urn:mpeg:cenc:2013" type="static">
+  <Period id="0">
+    <AdaptationSet id="0" mimeType="video/mp4" maxHeight="1080">
+      <ContentProtection schemeIdUri="urn:mpeg:dash:mp4protection:2011" value="cenc"/>
+      <Representation id="v0" height="1080" bandwidth="5000000"/>
+    </AdaptationSet>
+    <AdaptationSet id="1" contentType="audio">
+      <Representation id="a0" mimeType="audio/mp4" bandwidth="128000"/>
+    </AdaptationSet>
+    <AdaptationSet id="2" contentType="text">
+      <Representation id="t0" mimeType="text/vtt"/>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+
+func testContentKeyResponse() *ContentKeyResponse {
+	widevineData := base64.StdEncoding.EncodeToString((&pssh.WidevineData{KeyIDs: [][]byte{make([]byte, 16)}}).Marshal())
+	return &ContentKeyResponse{
+		Status: "OK",
+		Tracks: []tracks{
+			{Type: "HD", KeyID: "AAECAwQFBgcICQoLDA0ODw==", PSSH: []trackPSSH{{DRMType: "WIDEVINE", Data: widevineData}}},
+			{Type: "AUDIO", KeyID: "EBESExQVFhcYGRobHB0eHw=="},
+		},
+	}
+}
+
+func TestContentProtectionFromResponse(t *testing.T) {
+	elements, err := ContentProtectionFromResponse(testContentKeyResponse(), DASHOptions{LicenseURL: "https://license.example.com/"})
+	assert.NoError(t, err)
+	assert.Len(t, elements, 2)
+
+	hd := elements["HD"]
+	assert.Len(t, hd, 2)
+	assert.Equal(t, "urn:mpeg:dash:mp4protection:2011", hd[0].SchemeIDURI)
+	assert.Equal(t, "cenc", hd[0].Value)
+	assert.Equal(t, "00010203-0405-0607-0809-0a0b0c0d0e0f", hd[0].DefaultKID)
+	assert.Equal(t, "urn:uuid:edef8ba9-79d6-4ace-a3c8-27dcd51d21ed", hd[1].SchemeIDURI)
+	assert.Equal(t, "https://license.example.com/", hd[1].LicenseURL)
+
+	b, _ := base64.StdEncoding.DecodeString(hd[1].PSSH)
+	box, err := pssh.Parse(b)
+	assert.NoError(t, err)
+	assert.Equal(t, pssh.WidevineSystemID, box.SystemID)
+
+	out, err := xml.Marshal(hd[1])
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), `<ContentProtection schemeIdUri="urn:uuid:edef8ba9-79d6-4ace-a3c8-27dcd51d21ed" value="Widevine"><cenc:pssh>`))
+	assert.Contains(t, string(out), `<dashif:laurl>https://license.example.com/</dashif:laurl>`)
+
+	// Tracks without PSSH get a Widevine PSSH of their key ID.
+	audio := elements["AUDIO"]
+	b, _ = base64.StdEncoding.DecodeString(audio[1].PSSH)
+	data, err := pssh.ParseWidevine(b)
+	assert.NoError(t, err)
+	assert.Len(t, data.KeyIDs, 1)
+}
+
+func TestContentProtectionFromKeys(t *testing.T) {
+	wv := NewWidevineProxy(nil, nil, "widevine_test", FakeMultiKeyGoverner{}, logrus.New())
+
+	elements, err := wv.ContentProtectionFromKeys("testing", DASHOptions{
+		InitData: InitDataOptions{ProtectionScheme: pssh.SchemeCBCS, DRMTypes: []string{DRMTypeWidevine, DRMTypePlayReady}},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, elements, 3)
+
+	sd := elements["SD"]
+	assert.Len(t, sd, 3)
+	assert.Equal(t, "cbcs", sd[0].Value)
+	assert.Equal(t, "urn:uuid:9a04f079-9840-4286-ab92-e65be0885f95", sd[2].SchemeIDURI)
+	assert.NotEmpty(t, sd[2].PRO)
+}
+
+func TestContentProtectionFromKeysContext(t *testing.T) {
+	wv := NewWidevineProxy(nil, nil, "widevine_test", nil, logrus.New())
+	wv.KeyProvider = contextKeyProvider{KeyGovernerProvider{FakeMultiKeyGoverner{}}}
+
+	elements, err := wv.ContentProtectionFromKeysContext(context.Background(), "testing", DASHOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, elements, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = wv.ContentProtectionFromKeysContext(ctx, "testing", DASHOptions{})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestInjectContentProtection(t *testing.T) {
+	elements, err := ContentProtectionFromResponse(testContentKeyResponse(), DASHOptions{})
+	assert.NoError(t, err)
+
+	out, err := InjectContentProtection([]byte(testMPD), elements, DASHOptions{})
+	assert.NoError(t, err)
+	mpd := string(out)
+
+	assert.Contains(t, mpd, `<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" xmlns:cenc="urn:mpeg:cenc:2013" type="static" xmlns:dashif="https://dashif.org/CPS" xmlns:mspr="urn:microsoft:playready">`)
+	assert.Contains(t, mpd, "<AdaptationSet id=\"0\" mimeType=\"video/mp4\" maxHeight=\"1080\">\n"+
+		"      <ContentProtection schemeIdUri=\"urn:mpeg:dash:mp4protection:2011\" value=\"cenc\" cenc:default_KID=\"00010203-0405-0607-0809-0a0b0c0d0e0f\"></ContentProtection>\n"+
+		"      <ContentProtection schemeIdUri=\"urn:uuid:edef8ba9-79d6-4ace-a3c8-27dcd51d21ed\" value=\"Widevine\">\n"+
+		"        <cenc:pssh>")
+	assert.Contains(t, mpd, "cenc:default_KID=\"10111213-1415-1617-1819-1a1b1c1d1e1f\"")
+	assert.Equal(t, 4, strings.Count(mpd, "<ContentProtection "))
+	assert.Contains(t, mpd, "<AdaptationSet id=\"2\" contentType=\"text\">\n      <Representation id=\"t0\"")
+
+	// The output is well formed and injecting again replaces the elements.
+	var doc struct{}
+	assert.NoError(t, xml.Unmarshal(out, &doc))
+	again, err := InjectContentProtection(out, elements, DASHOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, mpd, string(again))
+}
+
+func TestInjectContentProtectionMissingTrack(t *testing.T) {
+	elements := map[string][]ContentProtection{"SD": {{SchemeIDURI: "urn:mpeg:dash:mp4protection:2011"}}}
+	_, err := InjectContentProtection([]byte(testMPD), elements, DASHOptions{})
+	assert.Error(t, err)
+
+	_, err = InjectContentProtection([]byte("<Period/>"), elements, DASHOptions{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,151 @@
+package widevineproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+)
+
+// Domain separation labels of the derived values.
+const (
+	derivedKeyLabel   = "widevine-proxy content key"
+	derivedKeyIDLabel = "widevine-proxy key id"
+	derivedIVLabel    = "widevine-proxy iv"
+)
+
+var derivedKeySalt = []byte("widevine-proxy derived keys")
+
+// DerivedKeyGoverner is a KeyGoverner deriving keys, key IDs and IVs from a master secret with
+// HKDF-SHA256 instead of storing them. The same content ID, track type and crypto period always
+// derive the same key under the same master secret.
+//
+// Master secrets are versioned: new content derives from the Current secret, while ContentVersion
+// pins older content to the secret it was packaged with, so it still resolves after a rotation.
+type DerivedKeyGoverner struct {
+	Current uint32
+	// ContentVersion returns the master secret version of a content, or 0 for the current one.
+	ContentVersion func(contentID []byte) uint32
+	// TrackTypes are the tracks keys are derived for by GenerateContentKeySpec.
+	TrackTypes []string
+
+	secrets map[uint32][]byte
+}
+
+// NewDerivedKeyGoverner creates a DerivedKeyGoverner from master secrets by version.
+// Master secrets are at least 32 bytes.
+func NewDerivedKeyGoverner(current uint32, secrets map[uint32][]byte, trackTypes []string) (*DerivedKeyGoverner, error) {
+	kg := &DerivedKeyGoverner{Current: current, TrackTypes: trackTypes, secrets: make(map[uint32][]byte)}
+	for version, secret := range secrets {
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("master secret %d must be at least 32 bytes, got %d", version, len(secret))
+		}
+		kg.secrets[version] = append([]byte{}, secret...)
+	}
+	if _, ok := kg.secrets[current]; !ok {
+		return nil, fmt.Errorf("no master secret for current version %d", current)
+	}
+	return kg, nil
+}
+
+// DeriveKey derives the key ID, key and IV of a track and crypto period of the content.
+// The content key has an empty track type; content without key rotation uses crypto period 0.
+func (kg *DerivedKeyGoverner) DeriveKey(contentID []byte, trackType string, cryptoPeriodIndex uint32) (StoredKey, error) {
+	version := kg.Current
+	if kg.ContentVersion != nil {
+		if v := kg.ContentVersion(contentID); v != 0 {
+			version = v
+		}
+	}
+	secret, ok := kg.secrets[version]
+	if !ok {
+		return StoredKey{}, fmt.Errorf("no master secret for version %d", version)
+	}
+
+	prk := hkdfExtract(derivedKeySalt, secret)
+	info := derivedKeyInfo(contentID, trackType, cryptoPeriodIndex)
+	return StoredKey{
+		TrackType: trackType,
+		KeyID:     hkdfExpand(prk, append([]byte(derivedKeyIDLabel), info...), 16),
+		Key:       hkdfExpand(prk, append([]byte(derivedKeyLabel), info...), 16),
+		IV:        hkdfExpand(prk, append([]byte(derivedIVLabel), info...), 16),
+	}, nil
+}
+
+// derivedKeyInfo encodes the inputs unambiguously: a zero byte ends the label,
+// and the variable length fields are length prefixed.
+func derivedKeyInfo(contentID []byte, trackType string, cryptoPeriodIndex uint32) []byte {
+	info := []byte{0}
+	info = appendLengthPrefixed(info, contentID)
+	info = appendLengthPrefixed(info, []byte(trackType))
+	var period [4]byte
+	binary.BigEndian.PutUint32(period[:], cryptoPeriodIndex)
+	return append(info, period[:]...)
+}
+
+func appendLengthPrefixed(b, v []byte) []byte {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(v)))
+	return append(append(b, n[:]...), v...)
+}
+
+func (kg *DerivedKeyGoverner) contentKey(contentID []byte) StoredKey {
+	// Errors only come from an unknown master secret version, which leaves the key empty.
+	key, _ := kg.DeriveKey(contentID, "", 0)
+	return key
+}
+
+// GenerateContentKeyID derives the key ID of the content key.
+func (kg *DerivedKeyGoverner) GenerateContentKeyID(contentID []byte) []byte {
+	return kg.contentKey(contentID).KeyID
+}
+
+// GenerateContentKey derives the content key.
+func (kg *DerivedKeyGoverner) GenerateContentKey(contentID []byte) []byte {
+	return kg.contentKey(contentID).Key
+}
+
+// GenerateContentIV derives the IV of the content key.
+func (kg *DerivedKeyGoverner) GenerateContentIV(contentID []byte) []byte {
+	return kg.contentKey(contentID).IV
+}
+
+// GenerateContentKeySpec derives the keys of the TrackTypes of the content.
+func (kg *DerivedKeyGoverner) GenerateContentKeySpec(contentID []byte, policyConfig map[string]string) (*[]ContentKeySpec, error) {
+	specs := []ContentKeySpec{}
+	for _, trackType := range kg.TrackTypes {
+		key, err := kg.DeriveKey(contentID, trackType, 0)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, ContentKeySpec{
+			KeyID:     base64.StdEncoding.EncodeToString(key.KeyID),
+			Key:       base64.StdEncoding.EncodeToString(key.Key),
+			IV:        base64.StdEncoding.EncodeToString(key.IV),
+			TrackType: trackType,
+		})
+	}
+	return &specs, nil
+}
+
+// hkdfExtract is HKDF-Extract of RFC 5869 with SHA-256.
+func hkdfExtract(salt, secret []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(secret)
+	return mac.Sum(nil)
+}
+
+// hkdfExpand is HKDF-Expand of RFC 5869 with SHA-256, for up to 255 blocks of output.
+func hkdfExpand(prk, info []byte, length int) []byte {
+	var out, t []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{counter})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:length]
+}
@@ -0,0 +1,72 @@
+package widevineproxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHKDF(t *testing.T) {
+	// RFC 5869, test case 1.
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+
+	prk := hkdfExtract(salt, ikm)
+	assert.Equal(t, "077709362c2e32df0ddc3f0dc47bba6390b6c73bb50f9c3122ec844ad7c2b3e5", hex.EncodeToString(prk))
+	assert.Equal(t, "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865",
+		hex.EncodeToString(hkdfExpand(prk, info, 42)))
+}
+
+func TestDerivedKeyGoverner(t *testing.T) {
+	secrets := map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32), 2: bytes.Repeat([]byte{2}, 32)}
+	kg, err := NewDerivedKeyGoverner(1, secrets, []string{"SD", "HD"})
+	assert.NoError(t, err)
+
+	cid := []byte("movie")
+	key := kg.GenerateContentKey(cid)
+	assert.Len(t, key, 16)
+	assert.Len(t, kg.GenerateContentKeyID(cid), 16)
+	assert.Len(t, kg.GenerateContentIV(cid), 16)
+	assert.Equal(t, key, kg.GenerateContentKey(cid))
+	assert.NotEqual(t, key, kg.GenerateContentKey([]byte("movie2")))
+	assert.NotEqual(t, key, kg.GenerateContentKeyID(cid))
+
+	// Every input separates the derivations.
+	sd, _ := kg.DeriveKey(cid, "SD", 0)
+	sdPeriod, _ := kg.DeriveKey(cid, "SD", 1)
+	hd, _ := kg.DeriveKey(cid, "HD", 0)
+	assert.NotEqual(t, sd.Key, sdPeriod.Key)
+	assert.NotEqual(t, sd.Key, hd.Key)
+	a, _ := kg.DeriveKey([]byte("ab"), "c", 0)
+	b, _ := kg.DeriveKey([]byte("a"), "bc", 0)
+	assert.NotEqual(t, a.Key, b.Key)
+
+	specs, err := kg.GenerateContentKeySpec(cid, nil)
+	assert.NoError(t, err)
+	assert.Len(t, *specs, 2)
+	assert.Equal(t, "SD", (*specs)[0].TrackType)
+
+	// Rotation keeps pinned content on its secret.
+	kg.Current = 2
+	assert.NotEqual(t, key, kg.GenerateContentKey(cid))
+	kg.ContentVersion = func(contentID []byte) uint32 {
+		if string(contentID) == "movie" {
+			return 1
+		}
+		return 0
+	}
+	assert.Equal(t, key, kg.GenerateContentKey(cid))
+
+	kg.Current = 3
+	assert.Nil(t, kg.GenerateContentKey([]byte("new")))
+	_, err = kg.GenerateContentKeySpec([]byte("new"), nil)
+	assert.EqualError(t, err, "no master secret for version 3")
+
+	_, err = NewDerivedKeyGoverner(1, map[uint32][]byte{1: []byte("short")}, nil)
+	assert.EqualError(t, err, "master secret 1 must be at least 32 bytes, got 5")
+	_, err = NewDerivedKeyGoverner(3, secrets, nil)
+	assert.EqualError(t, err, "no master secret for current version 3")
+}
@@ -0,0 +1,161 @@
+package widevineproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"math"
+
+	"github.com/Cooomma/widevine-proxy/pssh"
+)
+
+// Key types of a ContentKeySpec.
+const (
+	KeyTypeContent     = "CONTENT"
+	KeyTypeEntitlement = "ENTITLEMENT"
+)
+
+// EntitlementKeyGoverner is a KeyGoverner for live channels with key rotation.
+// The license carries the entitlement key while the content key of each crypto period
+// rides in the stream's PSSH, wrapped by the entitlement key. Licenses only carry the
+// entitlement key of a content when its content key specs hold it, with KeyTypeEntitlement;
+// the other contents of the KeyGoverner are licensed with their content keys.
+type EntitlementKeyGoverner interface {
+	KeyGoverner
+	GenerateEntitlementKeyID(contentID []byte) []byte
+	GenerateEntitlementKey(contentID []byte) []byte
+	GenerateCryptoPeriodKeyID(contentID []byte, cryptoPeriodIndex uint32) []byte
+	GenerateCryptoPeriodKey(contentID []byte, cryptoPeriodIndex uint32) []byte
+}
+
+// EntitlementKeyProvider is a KeyProvider for live channels with key rotation, the context-aware
+// successor of EntitlementKeyGoverner.
+type EntitlementKeyProvider interface {
+	KeyProvider
+	EntitlementKeyID(ctx context.Context, contentID []byte) ([]byte, error)
+	EntitlementKey(ctx context.Context, contentID []byte) ([]byte, error)
+	CryptoPeriodKeyID(ctx context.Context, contentID []byte, cryptoPeriodIndex uint32) ([]byte, error)
+	CryptoPeriodKey(ctx context.Context, contentID []byte, cryptoPeriodIndex uint32) ([]byte, error)
+}
+
+// EntitlementKeySpec returns the content key spec of an entitlement key, to be returned with the content key
+// specs of a live channel so its licenses carry the entitlement key instead of content keys.
+func EntitlementKeySpec(keyID, key []byte) ContentKeySpec {
+	return ContentKeySpec{
+		KeyID:   base64.StdEncoding.EncodeToString(keyID),
+		Key:     base64.StdEncoding.EncodeToString(key),
+		KeyType: KeyTypeEntitlement,
+	}
+}
+
+// entitlementKeyGovernerProvider adapts an EntitlementKeyGoverner to an EntitlementKeyProvider.
+type entitlementKeyGovernerProvider struct {
+	KeyGovernerProvider
+	kg EntitlementKeyGoverner
+}
+
+func (p entitlementKeyGovernerProvider) EntitlementKeyID(ctx context.Context, contentID []byte) ([]byte, error) {
+	return nonEmpty("entitlement key ID", contentID, p.kg.GenerateEntitlementKeyID(contentID))
+}
+
+func (p entitlementKeyGovernerProvider) EntitlementKey(ctx context.Context, contentID []byte) ([]byte, error) {
+	return nonEmpty("entitlement key", contentID, p.kg.GenerateEntitlementKey(contentID))
+}
+
+func (p entitlementKeyGovernerProvider) CryptoPeriodKeyID(ctx context.Context, contentID []byte, cryptoPeriodIndex uint32) ([]byte, error) {
+	return nonEmpty(fmt.Sprintf("crypto period %d key ID", cryptoPeriodIndex), contentID, p.kg.GenerateCryptoPeriodKeyID(contentID, cryptoPeriodIndex))
+}
+
+func (p entitlementKeyGovernerProvider) CryptoPeriodKey(ctx context.Context, contentID []byte, cryptoPeriodIndex uint32) ([]byte, error) {
+	return nonEmpty(fmt.Sprintf("crypto period %d key", cryptoPeriodIndex), contentID, p.kg.GenerateCryptoPeriodKey(contentID, cryptoPeriodIndex))
+}
+
+// entitlementKeys returns the entitlement keys the PSSH of crypto periods are built with: its KeyProvider
+// when set, else its ContentKeyGenerator. ok is false when they do not support entitlement keys.
+func (wp *Proxy) entitlementKeys() (p EntitlementKeyProvider, ok bool) {
+	if wp.KeyProvider != nil {
+		p, ok = wp.KeyProvider.(EntitlementKeyProvider)
+		return p, ok
+	}
+	if kg, ok := wp.ContentKeyGenerator.(EntitlementKeyGoverner); ok {
+		return entitlementKeyGovernerProvider{KeyGovernerProvider{KeyGoverner: kg}, kg}, true
+	}
+	return nil, false
+}
+
+// BuildEntitledPSSH builds the Widevine PSSH data of count crypto periods starting at firstIndex.
+// Each crypto period key is wrapped by the entitlement key of the content.
+// See EntitlementKeySpec for the key spec licensing them.
+func (wp *Proxy) BuildEntitledPSSH(contentID string, firstIndex, count uint32) ([][]byte, error) {
+	return wp.BuildEntitledPSSHContext(context.Background(), contentID, firstIndex, count)
+}
+
+// BuildEntitledPSSHContext is BuildEntitledPSSH with a context for the key lookups.
+func (wp *Proxy) BuildEntitledPSSHContext(ctx context.Context, contentID string, firstIndex, count uint32) ([][]byte, error) {
+	keys, ok := wp.entitlementKeys()
+	if !ok {
+		return nil, fmt.Errorf("key governer does not support entitlement keys")
+	}
+	if count > 0 && count-1 > math.MaxUint32-firstIndex {
+		return nil, fmt.Errorf("%d crypto periods from %d run past the last crypto period index", count, firstIndex)
+	}
+
+	cid := []byte(contentID)
+	entitlementKeyID, err := keys.EntitlementKeyID(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	entitlementKey, err := keys.EntitlementKey(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	if len(entitlementKey) != pssh.DefaultEntitlementKeySize {
+		return nil, fmt.Errorf("entitlement key must be %d bytes, got %d", pssh.DefaultEntitlementKeySize, len(entitlementKey))
+	}
+
+	var psshs [][]byte
+	for offset := uint32(0); offset < count; offset++ {
+		index := firstIndex + offset
+		key, err := keys.CryptoPeriodKey(ctx, cid, index)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != 16 {
+			return nil, fmt.Errorf("crypto period %d: content key must be 16 bytes, got %d", index, len(key))
+		}
+
+		iv := make([]byte, 16)
+		if _, err := rand.Read(iv); err != nil {
+			return nil, err
+		}
+		// Entitled keys are wrapped without padding.
+		wrapped, err := AESCBCEncryptBlocks(entitlementKey, iv, key)
+		if err != nil {
+			return nil, err
+		}
+
+		keyID, err := keys.CryptoPeriodKeyID(ctx, cid, index)
+		if err != nil {
+			return nil, err
+		}
+		data := &pssh.WidevineData{
+			KeyIDs:            [][]byte{keyID},
+			ContentID:         cid,
+			CryptoPeriodIndex: index,
+			Type:              pssh.TypeEntitledKey,
+			EntitledKeys: []pssh.EntitledKey{
+				{
+					EntitlementKeyID:   entitlementKeyID,
+					KeyID:              keyID,
+					Key:                wrapped,
+					IV:                 iv,
+					EntitlementKeySize: pssh.DefaultEntitlementKeySize,
+				},
+			},
+		}
+		wp.Logger.Debugf("Entitled PSSH: content %s, crypto period %d", contentID, index)
+		psshs = append(psshs, data.Marshal())
+	}
+	return psshs, nil
+}
@@ -0,0 +1,170 @@
+package widevineproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/Cooomma/widevine-proxy/pssh"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type FakeEntitlementKeyGoverner struct {
+	FakeKeyGoverner
+}
+
+func (FakeEntitlementKeyGoverner) GenerateEntitlementKeyID(contentID []byte) []byte {
+	return bytes.Repeat([]byte{0xee}, 16)
+}
+
+func (FakeEntitlementKeyGoverner) GenerateEntitlementKey(contentID []byte) []byte {
+	h := sha256.Sum256(contentID)
+	return h[:]
+}
+
+// GenerateContentKeySpec licenses live channels with their entitlement key and other contents with content keys.
+func (kg FakeEntitlementKeyGoverner) GenerateContentKeySpec(contentID []byte, policyConfig map[string]string) (*[]ContentKeySpec, error) {
+	if !strings.HasPrefix(string(contentID), "live-") {
+		return kg.FakeKeyGoverner.GenerateContentKeySpec(contentID, policyConfig)
+	}
+	return &[]ContentKeySpec{EntitlementKeySpec(kg.GenerateEntitlementKeyID(contentID), kg.GenerateEntitlementKey(contentID))}, nil
+}
+
+func (FakeEntitlementKeyGoverner) GenerateCryptoPeriodKeyID(contentID []byte, cryptoPeriodIndex uint32) []byte {
+	kid := make([]byte, 16)
+	binary.BigEndian.PutUint32(kid[12:], cryptoPeriodIndex)
+	return kid
+}
+
+func (FakeEntitlementKeyGoverner) GenerateCryptoPeriodKey(contentID []byte, cryptoPeriodIndex uint32) []byte {
+	return bytes.Repeat([]byte{byte(cryptoPeriodIndex)}, 16)
+}
+
+func TestBuildEntitledPSSH(t *testing.T) {
+	key, _ := hex.DecodeString(testKey)
+	iv, _ := hex.DecodeString(testIV)
+	kg := FakeEntitlementKeyGoverner{}
+	wv := NewWidevineProxy(key, iv, "widevine_test", kg, logrus.New())
+
+	psshs, err := wv.BuildEntitledPSSH("live-channel", 10, 3)
+	assert.NoError(t, err)
+	assert.Len(t, psshs, 3)
+
+	for i, b := range psshs {
+		index := uint32(10 + i)
+		data, err := pssh.UnmarshalWidevineData(b)
+		assert.NoError(t, err)
+		assert.Equal(t, pssh.TypeEntitledKey, data.Type)
+		assert.Equal(t, index, data.CryptoPeriodIndex)
+		assert.Equal(t, []byte("live-channel"), data.ContentID)
+		assert.Len(t, data.EntitledKeys, 1)
+
+		ek := data.EntitledKeys[0]
+		assert.Equal(t, kg.GenerateEntitlementKeyID(nil), ek.EntitlementKeyID)
+		assert.Equal(t, kg.GenerateCryptoPeriodKeyID(nil, index), ek.KeyID)
+		assert.Equal(t, uint32(32), ek.EntitlementKeySize)
+
+		contentKey, err := AESCBCDecryptBlocks(kg.GenerateEntitlementKey([]byte("live-channel")), ek.IV, ek.Key)
+		assert.NoError(t, err)
+		assert.Equal(t, kg.GenerateCryptoPeriodKey(nil, index), contentKey)
+	}
+}
+
+func TestBuildEntitledPSSHUnsupported(t *testing.T) {
+	key, _ := hex.DecodeString(testKey)
+	iv, _ := hex.DecodeString(testIV)
+	wv := NewWidevineProxy(key, iv, "widevine_test", FakeKeyGoverner{}, logrus.New())
+
+	_, err := wv.BuildEntitledPSSH("live-channel", 0, 1)
+	assert.Error(t, err)
+}
+
+func TestBuildEntitledPSSHLastCryptoPeriods(t *testing.T) {
+	wv := NewWidevineProxy(nil, nil, "widevine_test", FakeEntitlementKeyGoverner{}, logrus.New())
+
+	psshs, err := wv.BuildEntitledPSSH("live-channel", math.MaxUint32-1, 2)
+	assert.NoError(t, err)
+	assert.Len(t, psshs, 2)
+	data, err := pssh.UnmarshalWidevineData(psshs[1])
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(math.MaxUint32), data.CryptoPeriodIndex)
+
+	_, err = wv.BuildEntitledPSSH("live-channel", math.MaxUint32-1, 3)
+	assert.EqualError(t, err, "3 crypto periods from 4294967294 run past the last crypto period index")
+}
+
+func TestEntitlementLicenseMessage(t *testing.T) {
+	key, _ := hex.DecodeString(testKey)
+	iv, _ := hex.DecodeString(testIV)
+	kg := FakeEntitlementKeyGoverner{}
+	wv := NewWidevineProxy(key, iv, "widevine_test", kg, logrus.New())
+
+	postBody, err := wv.buildLicenseMessage(context.Background(), "live-channel", testLicenseChallenge)
+	assert.NoError(t, err)
+
+	b, err := base64.StdEncoding.DecodeString(postBody["request"].(string))
+	assert.NoError(t, err)
+	var msg LicenseMessage
+	assert.NoError(t, json.Unmarshal(b, &msg))
+	assert.Len(t, msg.ContentKeySpecs, 1)
+	assert.Equal(t, KeyTypeEntitlement, msg.ContentKeySpecs[0].KeyType)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(kg.GenerateEntitlementKeyID(nil)), msg.ContentKeySpecs[0].KeyID)
+
+	// Other contents of the same KeyGoverner are licensed with their content keys.
+	postBody, err = wv.buildLicenseMessage(context.Background(), "vod-movie", testLicenseChallenge)
+	assert.NoError(t, err)
+	b, err = base64.StdEncoding.DecodeString(postBody["request"].(string))
+	assert.NoError(t, err)
+	msg = LicenseMessage{}
+	assert.NoError(t, json.Unmarshal(b, &msg))
+	assert.Len(t, msg.ContentKeySpecs, 1)
+	assert.Equal(t, "", msg.ContentKeySpecs[0].KeyType)
+	assert.Equal(t, "SD", msg.ContentKeySpecs[0].TrackType)
+
+	// Entitlement keys do not encrypt samples.
+	systems, err := wv.InitData("live-channel", InitDataOptions{DRMTypes: []string{DRMTypeWidevine}})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{kg.GenerateContentKeyID([]byte("live-channel"))}, systems[0].KeyIDs)
+}
+
+func TestEntitlementKeyProvider(t *testing.T) {
+	key, _ := hex.DecodeString(testKey)
+	iv, _ := hex.DecodeString(testIV)
+	kg := FakeEntitlementKeyGoverner{}
+	wv := NewWidevineProxy(key, iv, "widevine_test", FakeKeyGoverner{}, logrus.New())
+
+	// A KeyProvider replaces the ContentKeyGenerator for entitlement keys too.
+	wv.KeyProvider = KeyGovernerProvider{KeyGoverner: kg}
+	_, err := wv.BuildEntitledPSSH("live-channel", 0, 1)
+	assert.EqualError(t, err, "key governer does not support entitlement keys")
+
+	wv.KeyProvider = entitlementKeyGovernerProvider{KeyGovernerProvider{KeyGoverner: kg}, kg}
+	psshs, err := wv.BuildEntitledPSSHContext(context.Background(), "live-channel", 0, 1)
+	assert.NoError(t, err)
+	assert.Len(t, psshs, 1)
+
+	specs, err := wv.licenseKeySpecs(context.Background(), []byte("live-channel"))
+	assert.NoError(t, err)
+	assert.Len(t, specs, 1)
+	assert.Equal(t, KeyTypeEntitlement, specs[0].KeyType)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(kg.GenerateEntitlementKeyID(nil)), specs[0].KeyID)
+}
+
+func TestSetPolicyCryptoPeriod(t *testing.T) {
+	wv := NewWidevineProxy(nil, nil, "widevine_test", FakeKeyGoverner{}, logrus.New())
+
+	p := wv.setPolicy("live-channel", Policy{Tracks: []string{"SD"}})
+	assert.NotContains(t, p, "crypto_period_count")
+
+	p = wv.setPolicy("live-channel", Policy{Tracks: []string{"SD"}, CryptoPeriodIndex: 5, CryptoPeriodCount: 2})
+	assert.Equal(t, uint32(5), p["first_crypto_period_index"])
+	assert.Equal(t, uint32(2), p["crypto_period_count"])
+}
@@ -0,0 +1,223 @@
+package widevineproxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+)
+
+// EnvelopeAlgorithm is the algorithm wrapping content keys with a key-encryption key.
+type EnvelopeAlgorithm byte
+
+// Envelope algorithms.
+const (
+	// EnvelopeAESKeyWrap is AES Key Wrap, RFC 3394.
+	EnvelopeAESKeyWrap EnvelopeAlgorithm = 1
+	// EnvelopeAESGCM is AES-GCM with a random nonce.
+	EnvelopeAESGCM EnvelopeAlgorithm = 2
+)
+
+func (a EnvelopeAlgorithm) String() string {
+	switch a {
+	case EnvelopeAESKeyWrap:
+		return "AES-KW"
+	case EnvelopeAESGCM:
+		return "AES-GCM"
+	}
+	return fmt.Sprintf("EnvelopeAlgorithm(%d)", byte(a))
+}
+
+// Wrapped keys start with the KEK version and the algorithm.
+const envelopeHeaderSize = 5
+
+var keyWrapIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+// Envelope wraps content keys at rest with versioned key-encryption keys (KEKs).
+// New keys are wrapped with the current KEK; keys wrapped with an older KEK stay readable
+// as long as that KEK is kept, until they are re-wrapped. Wrapped keys are bound to their key ID:
+// AES-GCM authenticates it with the header, AES Key Wrap wraps it after the key, so a wrapped key
+// swapped to another key ID fails to unwrap.
+type Envelope struct {
+	Algorithm EnvelopeAlgorithm
+	Current   uint32
+	keks      map[uint32][]byte
+}
+
+// NewEnvelope creates an envelope from KEKs by version. Version 0 is reserved for unwrapped keys.
+func NewEnvelope(algorithm EnvelopeAlgorithm, current uint32, keks map[uint32][]byte) (*Envelope, error) {
+	if algorithm != EnvelopeAESKeyWrap && algorithm != EnvelopeAESGCM {
+		return nil, fmt.Errorf("unknown envelope algorithm %d", algorithm)
+	}
+	e := &Envelope{Algorithm: algorithm, Current: current, keks: make(map[uint32][]byte)}
+	for version, kek := range keks {
+		if version == 0 {
+			return nil, fmt.Errorf("KEK version 0 is reserved")
+		}
+		if len(kek) != 16 && len(kek) != 24 && len(kek) != 32 {
+			return nil, fmt.Errorf("KEK %d must be 16, 24 or 32 bytes, got %d", version, len(kek))
+		}
+		e.keks[version] = append([]byte{}, kek...)
+	}
+	if _, ok := e.keks[current]; !ok {
+		return nil, fmt.Errorf("no KEK for current version %d", current)
+	}
+	return e, nil
+}
+
+// Wrap wraps the key of keyID with the current KEK.
+func (e *Envelope) Wrap(key, keyID []byte) ([]byte, error) {
+	header := make([]byte, envelopeHeaderSize)
+	binary.BigEndian.PutUint32(header, e.Current)
+	header[4] = byte(e.Algorithm)
+
+	kek := e.keks[e.Current]
+	switch e.Algorithm {
+	case EnvelopeAESKeyWrap:
+		wrapped, err := AESKeyWrap(kek, append(append([]byte{}, key...), keyID...))
+		if err != nil {
+			return nil, err
+		}
+		return append(header, wrapped...), nil
+	case EnvelopeAESGCM:
+		gcm, err := newGCM(kek)
+		if err != nil {
+			return nil, err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		out := append(header, nonce...)
+		return gcm.Seal(out, nonce, key, append(header, keyID...)), nil
+	}
+	return nil, fmt.Errorf("unknown envelope algorithm %d", e.Algorithm)
+}
+
+// Unwrap unwraps the key of keyID wrapped with any KEK of the envelope.
+func (e *Envelope) Unwrap(wrapped, keyID []byte) ([]byte, error) {
+	version, err := WrappedKeyVersion(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	kek, ok := e.keks[version]
+	if !ok {
+		return nil, fmt.Errorf("no KEK for version %d", version)
+	}
+	header, payload := wrapped[:envelopeHeaderSize], wrapped[envelopeHeaderSize:]
+	switch EnvelopeAlgorithm(header[4]) {
+	case EnvelopeAESKeyWrap:
+		key, err := AESKeyUnwrap(kek, payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) <= len(keyID) || subtle.ConstantTimeCompare(key[len(key)-len(keyID):], keyID) != 1 {
+			return nil, fmt.Errorf("unwrap key: key ID mismatch")
+		}
+		return key[:len(key)-len(keyID)], nil
+	case EnvelopeAESGCM:
+		gcm, err := newGCM(kek)
+		if err != nil {
+			return nil, err
+		}
+		if len(payload) < gcm.NonceSize()+gcm.Overhead() {
+			return nil, fmt.Errorf("wrapped key too short")
+		}
+		aad := append(append([]byte{}, header...), keyID...)
+		key, err := gcm.Open(nil, payload[:gcm.NonceSize()], payload[gcm.NonceSize():], aad)
+		if err != nil {
+			return nil, fmt.Errorf("unwrap key: %v", err)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown envelope algorithm %d", header[4])
+}
+
+// Rewrap re-wraps the key of keyID with the current KEK.
+func (e *Envelope) Rewrap(wrapped, keyID []byte) ([]byte, error) {
+	key, err := e.Unwrap(wrapped, keyID)
+	if err != nil {
+		return nil, err
+	}
+	return e.Wrap(key, keyID)
+}
+
+// WrappedKeyVersion returns the version of the KEK a key is wrapped with.
+func WrappedKeyVersion(wrapped []byte) (uint32, error) {
+	if len(wrapped) <= envelopeHeaderSize {
+		return 0, fmt.Errorf("wrapped key too short")
+	}
+	return binary.BigEndian.Uint32(wrapped), nil
+}
+
+func newGCM(kek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// AESKeyWrap wraps a key of at least 16 bytes, a multiple of 8, as specified in RFC 3394.
+func AESKeyWrap(kek, key []byte) ([]byte, error) {
+	if len(key) < 16 || len(key)%8 != 0 {
+		return nil, fmt.Errorf("key wrap: key must be a multiple of 8 bytes and at least 16, got %d", len(key))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(key) / 8
+	out := make([]byte, 8+len(key))
+	copy(out, keyWrapIV)
+	copy(out[8:], key)
+
+	b := make([]byte, aes.BlockSize)
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b, out[:8])
+			copy(b[8:], out[8*i:8*i+8])
+			block.Encrypt(b, b)
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(out, binary.BigEndian.Uint64(b)^t)
+			copy(out[8*i:], b[8:])
+		}
+	}
+	return out, nil
+}
+
+// AESKeyUnwrap unwraps a key wrapped as specified in RFC 3394 and checks its integrity.
+func AESKeyUnwrap(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 24 || len(wrapped)%8 != 0 {
+		return nil, fmt.Errorf("key unwrap: wrapped key must be a multiple of 8 bytes and at least 24, got %d", len(wrapped))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(wrapped)/8 - 1
+	a := make([]byte, 8)
+	copy(a, wrapped)
+	key := make([]byte, len(wrapped)-8)
+	copy(key, wrapped[8:])
+
+	b := make([]byte, aes.BlockSize)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(b, binary.BigEndian.Uint64(a)^t)
+			copy(b[8:], key[8*(i-1):8*i])
+			block.Decrypt(b, b)
+			copy(a, b[:8])
+			copy(key[8*(i-1):], b[8:])
+		}
+	}
+	if subtle.ConstantTimeCompare(a, keyWrapIV) != 1 {
+		return nil, fmt.Errorf("key unwrap: integrity check failed")
+	}
+	return key, nil
+}
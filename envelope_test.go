@@ -0,0 +1,147 @@
+package widevineproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAESKeyWrap(t *testing.T) {
+	// RFC 3394, 4.1 and 4.6.
+	for _, v := range []struct{ kek, key, wrapped string }{
+		{"000102030405060708090a0b0c0d0e0f", "00112233445566778899aabbccddeeff",
+			"1fa68b0a8112b447aef34bd8fb5a7b829d3e862371d2cfe5"},
+		{"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f", "00112233445566778899aabbccddeeff000102030405060708090a0b0c0d0e0f",
+			"28c9f404c4b810f4cbccb35cfb87f8263f5786e2d80ed326cbc7f0e71a99f43bfb988b9b7a02dd21"},
+	} {
+		kek, _ := hex.DecodeString(v.kek)
+		key, _ := hex.DecodeString(v.key)
+
+		wrapped, err := AESKeyWrap(kek, key)
+		assert.NoError(t, err)
+		assert.Equal(t, v.wrapped, hex.EncodeToString(wrapped))
+
+		unwrapped, err := AESKeyUnwrap(kek, wrapped)
+		assert.NoError(t, err)
+		assert.Equal(t, key, unwrapped)
+
+		wrapped[len(wrapped)-1] ^= 1
+		_, err = AESKeyUnwrap(kek, wrapped)
+		assert.EqualError(t, err, "key unwrap: integrity check failed")
+	}
+
+	_, err := AESKeyWrap(make([]byte, 16), make([]byte, 12))
+	assert.Error(t, err)
+	_, err = AESKeyUnwrap(make([]byte, 16), make([]byte, 16))
+	assert.Error(t, err)
+}
+
+func TestEnvelope(t *testing.T) {
+	key, keyID := []byte("0123456789abcdef"), bytes.Repeat([]byte{0xab}, 16)
+	keks := map[uint32][]byte{1: bytes.Repeat([]byte{1}, 16), 2: bytes.Repeat([]byte{2}, 32)}
+
+	for _, algorithm := range []EnvelopeAlgorithm{EnvelopeAESKeyWrap, EnvelopeAESGCM} {
+		e, err := NewEnvelope(algorithm, 1, keks)
+		assert.NoError(t, err)
+
+		wrapped, err := e.Wrap(key, keyID)
+		assert.NoError(t, err, algorithm.String())
+		assert.False(t, bytes.Contains(wrapped, key), algorithm.String())
+		version, err := WrappedKeyVersion(wrapped)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(1), version)
+
+		unwrapped, err := e.Unwrap(wrapped, keyID)
+		assert.NoError(t, err, algorithm.String())
+		assert.Equal(t, key, unwrapped, algorithm.String())
+
+		// Rotation: the new envelope still reads version 1 keys.
+		rotated, err := NewEnvelope(algorithm, 2, keks)
+		assert.NoError(t, err)
+		rewrapped, err := rotated.Rewrap(wrapped, keyID)
+		assert.NoError(t, err)
+		version, _ = WrappedKeyVersion(rewrapped)
+		assert.Equal(t, uint32(2), version)
+		unwrapped, err = rotated.Unwrap(rewrapped, keyID)
+		assert.NoError(t, err)
+		assert.Equal(t, key, unwrapped)
+
+		// Retired KEK.
+		retired, _ := NewEnvelope(algorithm, 2, map[uint32][]byte{2: keks[2]})
+		_, err = retired.Unwrap(wrapped, keyID)
+		assert.EqualError(t, err, "no KEK for version 1", algorithm.String())
+
+		// A wrapped key does not unwrap under another key ID.
+		_, err = e.Unwrap(wrapped, bytes.Repeat([]byte{0xcd}, 16))
+		assert.Error(t, err, algorithm.String())
+
+		wrapped[len(wrapped)-1] ^= 1
+		_, err = e.Unwrap(wrapped, keyID)
+		assert.Error(t, err, algorithm.String())
+	}
+
+	_, err := NewEnvelope(EnvelopeAESGCM, 3, keks)
+	assert.EqualError(t, err, "no KEK for current version 3")
+	_, err = NewEnvelope(EnvelopeAESGCM, 0, map[uint32][]byte{0: keks[1]})
+	assert.EqualError(t, err, "KEK version 0 is reserved")
+	_, err = NewEnvelope(EnvelopeAESGCM, 1, map[uint32][]byte{1: []byte("short")})
+	assert.EqualError(t, err, "KEK 1 must be 16, 24 or 32 bytes, got 5")
+}
+
+func TestSQLKeyStoreEnvelope(t *testing.T) {
+	store, cleanup := testSQLKeyStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	keks := map[uint32][]byte{1: bytes.Repeat([]byte{1}, 16), 2: bytes.Repeat([]byte{2}, 16)}
+	plain := StoredKey{TrackType: "SD", KeyID: []byte("plain-0123456789"), Key: []byte("plain-key-012345"), IV: []byte("01234567")}
+	assert.NoError(t, store.PutKey(ctx, "movie", plain))
+
+	store.Envelope, _ = NewEnvelope(EnvelopeAESKeyWrap, 1, keks)
+	wrapped := StoredKey{TrackType: "HD", KeyID: []byte("wrapped-01234567"), Key: []byte("wrapped-key-0123"), IV: []byte("01234567")}
+	assert.NoError(t, store.PutKey(ctx, "movie", wrapped))
+
+	var raw []byte
+	var version uint32
+	assert.NoError(t, store.db.QueryRow(`SELECT content_key, kek_version FROM content_keys WHERE key_id = ?`, wrapped.KeyID).Scan(&raw, &version))
+	assert.Equal(t, uint32(1), version)
+	assert.NotEqual(t, wrapped.Key, raw)
+
+	got, err := store.Key(ctx, "movie", "HD")
+	assert.NoError(t, err)
+	assert.Equal(t, wrapped.Key, got.Key)
+
+	// Rotate to KEK 2, wrapping the plain key as well.
+	store.Envelope, _ = NewEnvelope(EnvelopeAESGCM, 2, keks)
+	n, err := store.RewrapKeys(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	n, err = store.RewrapKeys(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	store.Envelope, _ = NewEnvelope(EnvelopeAESGCM, 2, map[uint32][]byte{2: keks[2]})
+	keys, err := store.Keys(ctx, "movie")
+	assert.NoError(t, err)
+	assert.Equal(t, []StoredKey{wrapped, plain}, keys)
+
+	// A store still on KEK 1 leaves the keys of KEK 2 alone.
+	store.Envelope, _ = NewEnvelope(EnvelopeAESGCM, 1, keks)
+	n, err = store.RewrapKeys(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// A wrapped key copied to another row does not unwrap.
+	assert.NoError(t, store.db.QueryRow(`SELECT content_key FROM content_keys WHERE key_id = ?`, wrapped.KeyID).Scan(&raw))
+	_, err = store.db.Exec(`UPDATE content_keys SET content_key = ? WHERE key_id = ?`, raw, plain.KeyID)
+	assert.NoError(t, err)
+	_, err = store.Key(ctx, "movie", "SD")
+	assert.Error(t, err)
+
+	store.Envelope = nil
+	_, err = store.Key(ctx, "movie", "SD")
+	assert.Contains(t, err.Error(), "key is wrapped with KEK 2 but the store has no envelope")
+}
@@ -0,0 +1,236 @@
+package widevineproxy
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FileKey is the key of a content or a track in a key file. Values are hex encoded.
+type FileKey struct {
+	TrackType string `json:"track_type,omitempty"`
+	KeyID     string `json:"key_id"`
+	Key       string `json:"key"`
+	IV        string `json:"iv"`
+}
+
+// FileContent is the entry of a content in a JSON key file.
+type FileContent struct {
+	FileKey
+	Tracks []FileKey `json:"tracks,omitempty"`
+}
+
+type fileContentKeys struct {
+	keyID, key, iv []byte
+	specs          []ContentKeySpec
+}
+
+// FileKeyGoverner is a KeyGoverner serving the keys of a JSON or CSV file, keyed by content ID.
+//
+// A JSON file maps content IDs to a FileContent. A CSV file has the columns
+// content_id, track_type, key_id, key, iv; the row without track type holds the content key,
+// and without one the first row of the content does. Keys and key IDs are 16 bytes, IVs 8 or 16 bytes.
+type FileKeyGoverner struct {
+	path   string
+	poller *filePoller
+
+	mu       sync.RWMutex
+	contents map[string]fileContentKeys
+}
+
+// NewFileKeyGoverner loads the key file at path. The format follows the .json or .csv extension.
+// Reloads are logged to logger, or to the standard logger when it is nil.
+func NewFileKeyGoverner(path string, logger *logrus.Logger) (*FileKeyGoverner, error) {
+	kg := &FileKeyGoverner{path: path}
+	kg.poller = newFilePoller(path, "Key File", logger, kg.Reload)
+	if err := kg.Reload(); err != nil {
+		return nil, err
+	}
+	return kg, nil
+}
+
+// Reload reads the key file again. The keys in use are kept when the file is invalid.
+func (kg *FileKeyGoverner) Reload() error {
+	info, err := os.Stat(kg.path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(kg.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var contents map[string]fileContentKeys
+	switch strings.ToLower(filepath.Ext(kg.path)) {
+	case ".json":
+		contents, err = readJSONKeys(f)
+	case ".csv":
+		contents, err = readCSVKeys(f)
+	default:
+		err = fmt.Errorf("unsupported key file format %q", filepath.Ext(kg.path))
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", kg.path, err)
+	}
+
+	kg.mu.Lock()
+	kg.contents = contents
+	kg.mu.Unlock()
+	kg.poller.loaded(info)
+	return nil
+}
+
+// Watch polls the key file every interval and reloads it when it changes, until Close.
+func (kg *FileKeyGoverner) Watch(interval time.Duration) {
+	kg.poller.watch(interval)
+}
+
+// Close stops watching the key file.
+func (kg *FileKeyGoverner) Close() {
+	kg.poller.close()
+}
+
+func (kg *FileKeyGoverner) content(contentID []byte) (fileContentKeys, bool) {
+	kg.mu.RLock()
+	defer kg.mu.RUnlock()
+	c, ok := kg.contents[string(contentID)]
+	return c, ok
+}
+
+// GenerateContentKeyID returns the key ID of the content, or nil for an unknown content.
+func (kg *FileKeyGoverner) GenerateContentKeyID(contentID []byte) []byte {
+	c, _ := kg.content(contentID)
+	return c.keyID
+}
+
+// GenerateContentKey returns the key of the content, or nil for an unknown content.
+func (kg *FileKeyGoverner) GenerateContentKey(contentID []byte) []byte {
+	c, _ := kg.content(contentID)
+	return c.key
+}
+
+// GenerateContentIV returns the IV of the content, or nil for an unknown content.
+func (kg *FileKeyGoverner) GenerateContentIV(contentID []byte) []byte {
+	c, _ := kg.content(contentID)
+	return c.iv
+}
+
+// GenerateContentKeySpec returns the per-track keys of the content.
+func (kg *FileKeyGoverner) GenerateContentKeySpec(contentID []byte, policyConfig map[string]string) (*[]ContentKeySpec, error) {
+	c, ok := kg.content(contentID)
+	if !ok {
+		return nil, fmt.Errorf("unknown content %q", contentID)
+	}
+	specs := append([]ContentKeySpec{}, c.specs...)
+	return &specs, nil
+}
+
+func readJSONKeys(r io.Reader) (map[string]fileContentKeys, error) {
+	var file map[string]FileContent
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, err
+	}
+
+	contents := make(map[string]fileContentKeys)
+	for contentID, content := range file {
+		c, err := parseFileKeys(content.FileKey, content.Tracks)
+		if err != nil {
+			return nil, fmt.Errorf("content %q: %v", contentID, err)
+		}
+		contents[contentID] = c
+	}
+	return contents, nil
+}
+
+func readCSVKeys(r io.Reader) (map[string]fileContentKeys, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) > 0 && records[0][0] == "content_id" {
+		records = records[1:]
+	}
+
+	var order []string
+	rows := make(map[string][]FileKey)
+	for i, record := range records {
+		if len(record) != 5 {
+			return nil, fmt.Errorf("line %d: want 5 columns, got %d", i+1, len(record))
+		}
+		contentID := record[0]
+		if _, ok := rows[contentID]; !ok {
+			order = append(order, contentID)
+		}
+		rows[contentID] = append(rows[contentID], FileKey{TrackType: record[1], KeyID: record[2], Key: record[3], IV: record[4]})
+	}
+
+	contents := make(map[string]fileContentKeys)
+	for _, contentID := range order {
+		keys := rows[contentID]
+		contentKey := keys[0]
+		var tracks []FileKey
+		for _, key := range keys {
+			if key.TrackType == "" {
+				contentKey = key
+			} else {
+				tracks = append(tracks, key)
+			}
+		}
+		c, err := parseFileKeys(contentKey, tracks)
+		if err != nil {
+			return nil, fmt.Errorf("content %q: %v", contentID, err)
+		}
+		contents[contentID] = c
+	}
+	return contents, nil
+}
+
+func parseFileKeys(content FileKey, tracks []FileKey) (fileContentKeys, error) {
+	var c fileContentKeys
+	var err error
+	if c.keyID, c.key, c.iv, err = parseFileKey(content); err != nil {
+		return c, err
+	}
+	for _, track := range tracks {
+		if track.TrackType == "" {
+			return c, fmt.Errorf("track without track type")
+		}
+		keyID, key, iv, err := parseFileKey(track)
+		if err != nil {
+			return c, fmt.Errorf("%s track: %v", track.TrackType, err)
+		}
+		c.specs = append(c.specs, ContentKeySpec{
+			KeyID:     base64.StdEncoding.EncodeToString(keyID),
+			Key:       base64.StdEncoding.EncodeToString(key),
+			IV:        base64.StdEncoding.EncodeToString(iv),
+			TrackType: track.TrackType,
+		})
+	}
+	return c, nil
+}
+
+func parseFileKey(k FileKey) (keyID, key, iv []byte, err error) {
+	if keyID, err = hex.DecodeString(k.KeyID); err != nil || len(keyID) != 16 {
+		return nil, nil, nil, fmt.Errorf("key ID must be 16 hex encoded bytes, got %q", k.KeyID)
+	}
+	if key, err = hex.DecodeString(k.Key); err != nil || len(key) != 16 {
+		return nil, nil, nil, fmt.Errorf("key must be 16 hex encoded bytes")
+	}
+	if iv, err = hex.DecodeString(k.IV); err != nil || (len(iv) != 8 && len(iv) != 16) {
+		return nil, nil, nil, fmt.Errorf("IV must be 8 or 16 hex encoded bytes, got %q", k.IV)
+	}
+	return keyID, key, iv, nil
+}
@@ -0,0 +1,116 @@
+package widevineproxy
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const testKeyFileJSON = `{
+  "movie": {
+    "key_id": "000102030405060708090a0b0c0d0e0f",
+    "key": "101112131415161718191a1b1c1d1e1f",
+    "iv": "2021222324252627",
+    "tracks": [
+      {"track_type": "SD", "key_id": "303132333435363738393a3b3c3d3e3f", "key": "404142434445464748494a4b4c4d4e4f", "iv": "505152535455565758595a5b5c5d5e5f"},
+      {"track_type": "AUDIO", "key_id": "606162636465666768696a6b6c6d6e6f", "key": "707172737475767778797a7b7c7d7e7f", "iv": "8081828384858687"}
+    ]
+  }
+}`
+
+const testKeyFileCSV = `content_id,track_type,key_id,key,iv
+movie,SD,303132333435363738393a3b3c3d3e3f,404142434445464748494a4b4c4d4e4f,505152535455565758595a5b5c5d5e5f
+movie,,000102030405060708090a0b0c0d0e0f,101112131415161718191a1b1c1d1e1f,2021222324252627
+movie,AUDIO,606162636465666768696a6b6c6d6e6f,707172737475767778797a7b7c7d7e7f,8081828384858687
+`
+
+func writeKeyFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestFileKeyGoverner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"keys.json", "keys.csv"} {
+		content := testKeyFileJSON
+		if filepath.Ext(name) == ".csv" {
+			content = testKeyFileCSV
+		}
+		kg, err := NewFileKeyGoverner(writeKeyFile(t, dir, name, content), logrus.New())
+		assert.NoError(t, err, name)
+
+		assert.Equal(t, "000102030405060708090a0b0c0d0e0f", hex.EncodeToString(kg.GenerateContentKeyID([]byte("movie"))), name)
+		assert.Equal(t, "101112131415161718191a1b1c1d1e1f", hex.EncodeToString(kg.GenerateContentKey([]byte("movie"))), name)
+		assert.Equal(t, "2021222324252627", hex.EncodeToString(kg.GenerateContentIV([]byte("movie"))), name)
+		assert.Nil(t, kg.GenerateContentKey([]byte("unknown")), name)
+
+		specs, err := kg.GenerateContentKeySpec([]byte("movie"), nil)
+		assert.NoError(t, err, name)
+		assert.Len(t, *specs, 2, name)
+		assert.Equal(t, "SD", (*specs)[0].TrackType, name)
+		kid, _ := base64.StdEncoding.DecodeString((*specs)[0].KeyID)
+		assert.Equal(t, "303132333435363738393a3b3c3d3e3f", hex.EncodeToString(kid), name)
+		assert.Equal(t, "AUDIO", (*specs)[1].TrackType, name)
+
+		_, err = kg.GenerateContentKeySpec([]byte("unknown"), nil)
+		assert.EqualError(t, err, `unknown content "unknown"`, name)
+	}
+}
+
+func TestFileKeyGovernerValidation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for content, msg := range map[string]string{
+		"movie,,0001,101112131415161718191a1b1c1d1e1f,2021222324252627\n":                                            `content "movie": key ID must be 16 hex encoded bytes, got "0001"`,
+		"movie,,000102030405060708090a0b0c0d0e0f,1011,2021222324252627\n":                                            `content "movie": key must be 16 hex encoded bytes`,
+		"movie,,000102030405060708090a0b0c0d0e0f,101112131415161718191a1b1c1d1e1f,202122\n":                          `content "movie": IV must be 8 or 16 hex encoded bytes, got "202122"`,
+		"movie,SD,000102030405060708090a0b0c0d0e0f,101112131415161718191a1b1c1d1e1f,2021222324252627,extra\n":        "line 1: want 5 columns, got 6",
+		"movie,,000102030405060708090a0b0c0d0e0f,101112131415161718191a1b1c1d1e1f,2021222324252627\nmovie,SD,00,,\n": `content "movie": SD track: key ID must be 16 hex encoded bytes, got "00"`,
+	} {
+		path := writeKeyFile(t, dir, "keys.csv", content)
+		_, err := NewFileKeyGoverner(path, logrus.New())
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), msg)
+		}
+	}
+
+	_, err = NewFileKeyGoverner(writeKeyFile(t, dir, "keys.txt", ""), logrus.New())
+	assert.EqualError(t, err, filepath.Join(dir, "keys.txt")+`: unsupported key file format ".txt"`)
+}
+
+func TestFileKeyGovernerWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Reloads are logged to the standard logger without one.
+	path := writeKeyFile(t, dir, "keys.csv", testKeyFileCSV)
+	kg, err := NewFileKeyGoverner(path, nil)
+	assert.NoError(t, err)
+	kg.Watch(10 * time.Millisecond)
+	defer kg.Close()
+
+	// An invalid file keeps the keys in use.
+	writeKeyFile(t, dir, "keys.csv", "movie,,00,,\n")
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "101112131415161718191a1b1c1d1e1f", hex.EncodeToString(kg.GenerateContentKey([]byte("movie"))))
+
+	writeKeyFile(t, dir, "keys.csv", "movie,,000102030405060708090a0b0c0d0e0f,ffffffffffffffffffffffffffffffff,2021222324252627\n")
+	for i := 0; i < 100 && hex.EncodeToString(kg.GenerateContentKey([]byte("movie"))) != "ffffffffffffffffffffffffffffffff"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "ffffffffffffffffffffffffffffffff", hex.EncodeToString(kg.GenerateContentKey([]byte("movie"))))
+}
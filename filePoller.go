@@ -0,0 +1,89 @@
+package widevineproxy
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// filePoller watches the file of a FileKeyGoverner or a CredentialSet and reloads it when its
+// modification time or size changes.
+type filePoller struct {
+	path   string
+	name   string
+	logger *logrus.Logger
+	reload func() error
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// newFilePoller creates a poller reloading the file at path with reload. Reloads are logged to
+// logger as name, or to the standard logger when it is nil.
+func newFilePoller(path, name string, logger *logrus.Logger, reload func() error) *filePoller {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	return &filePoller{path: path, name: name, logger: logger, reload: reload}
+}
+
+// loaded records the stat of the file a reload read.
+func (p *filePoller) loaded(info os.FileInfo) {
+	p.mu.Lock()
+	p.modTime, p.size = info.ModTime(), info.Size()
+	p.mu.Unlock()
+}
+
+// watch polls the file every interval until close.
+func (p *filePoller) watch(interval time.Duration) {
+	p.mu.Lock()
+	if p.stop != nil {
+		p.mu.Unlock()
+		return
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	p.stop, p.done = stop, done
+	modTime, size := p.modTime, p.size
+	p.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				// An invalid file is reported once, not on every poll.
+				info, err := os.Stat(p.path)
+				if err != nil || (info.ModTime().Equal(modTime) && info.Size() == size) {
+					continue
+				}
+				modTime, size = info.ModTime(), info.Size()
+				if err := p.reload(); err != nil {
+					p.logger.WithField("error", err.Error()).Errorf("%s Reload Error", p.name)
+					continue
+				}
+				p.logger.Infof("%s Reloaded: %s", p.name, p.path)
+			}
+		}
+	}()
+}
+
+// close stops watching the file.
+func (p *filePoller) close() {
+	p.mu.Lock()
+	stop, done := p.stop, p.done
+	p.stop = nil
+	p.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
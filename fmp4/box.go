@@ -0,0 +1,192 @@
+package fmp4
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// box is an ISO BMFF box. Containers hold their children after a fixed header kept in data,
+// other boxes their whole payload in data.
+type box struct {
+	typ      string
+	data     []byte
+	children []*box
+	// offset is the offset of the box in the bytes it was parsed from.
+	offset int
+	size   int
+}
+
+// containers are the boxes parsed into children, with the size of their fixed header.
+// Sample entries are parsed by parseSampleEntries.
+var containers = map[string]int{
+	"moov": 0, "trak": 0, "mdia": 0, "minf": 0, "stbl": 0, "mvex": 0,
+	"moof": 0, "traf": 0, "sinf": 0, "schi": 0,
+	"stsd": 8,
+}
+
+// parseBoxes parses a sequence of boxes. Offsets are relative to base.
+func parseBoxes(b []byte, base int) ([]*box, error) {
+	var boxes []*box
+	for i := 0; i < len(b); {
+		if len(b)-i < 8 {
+			return nil, fmt.Errorf("fmp4: truncated box header at %d", base+i)
+		}
+		size := int(binary.BigEndian.Uint32(b[i:]))
+		typ := string(b[i+4 : i+8])
+		header := 8
+		switch size {
+		case 0:
+			size = len(b) - i
+		case 1:
+			if len(b)-i < 16 {
+				return nil, fmt.Errorf("fmp4: truncated %s box at %d", typ, base+i)
+			}
+			large := binary.BigEndian.Uint64(b[i+8:])
+			if large > uint64(len(b)-i) {
+				return nil, fmt.Errorf("fmp4: %s box at %d overruns its parent", typ, base+i)
+			}
+			size, header = int(large), 16
+		}
+		if size < header || size > len(b)-i {
+			return nil, fmt.Errorf("fmp4: %s box at %d has invalid size %d", typ, base+i, size)
+		}
+
+		bx := &box{typ: typ, offset: base + i, size: size}
+		payload := b[i+header : i+size]
+		if fixed, ok := containers[typ]; ok {
+			if len(payload) < fixed {
+				return nil, fmt.Errorf("fmp4: truncated %s box at %d", typ, base+i)
+			}
+			bx.data = payload[:fixed]
+			children, err := parseBoxes(payload[fixed:], base+i+header+fixed)
+			if err != nil {
+				return nil, err
+			}
+			bx.children = children
+		} else {
+			bx.data = payload
+		}
+		boxes = append(boxes, bx)
+		i += size
+	}
+	return boxes, nil
+}
+
+// isContainer reports whether the box is written from its children.
+func (bx *box) isContainer() bool {
+	if _, ok := containers[bx.typ]; ok {
+		return true
+	}
+	return bx.children != nil
+}
+
+// len returns the size of the box as written.
+func (bx *box) len() int {
+	n := len(bx.data)
+	if bx.isContainer() {
+		for _, child := range bx.children {
+			n += child.len()
+		}
+	}
+	if int64(n)+8 > 0xffffffff {
+		return n + 16
+	}
+	return n + 8
+}
+
+// append writes the box to b.
+func (bx *box) append(b []byte) []byte {
+	size := bx.len()
+	if int64(size) > 0xffffffff {
+		b = appendUint32(b, 1)
+		b = append(b, bx.typ...)
+		b = appendUint64(b, uint64(size))
+	} else {
+		b = appendUint32(b, uint32(size))
+		b = append(b, bx.typ...)
+	}
+	b = append(b, bx.data...)
+	if bx.isContainer() {
+		for _, child := range bx.children {
+			b = child.append(b)
+		}
+	}
+	return b
+}
+
+// child returns the first child of a type.
+func (bx *box) child(typ string) *box {
+	for _, child := range bx.children {
+		if child.typ == typ {
+			return child
+		}
+	}
+	return nil
+}
+
+// childrenOf returns the children of a type.
+func (bx *box) childrenOf(typ string) []*box {
+	var boxes []*box
+	for _, child := range bx.children {
+		if child.typ == typ {
+			boxes = append(boxes, child)
+		}
+	}
+	return boxes
+}
+
+// path returns the descendant at a path of box types.
+func (bx *box) path(types ...string) *box {
+	for _, typ := range types {
+		if bx = bx.child(typ); bx == nil {
+			return nil
+		}
+	}
+	return bx
+}
+
+// fullBox returns a box with the version and flags of a full box before its payload.
+func fullBox(typ string, version uint8, flags uint32, payload []byte) *box {
+	data := appendUint32(nil, uint32(version)<<24|flags&0xffffff)
+	return &box{typ: typ, data: append(data, payload...)}
+}
+
+// versionAndFlags returns the version and flags of a full box.
+func (bx *box) versionAndFlags() (uint8, uint32, error) {
+	if len(bx.data) < 4 {
+		return 0, 0, fmt.Errorf("fmp4: truncated %s box", bx.typ)
+	}
+	v := binary.BigEndian.Uint32(bx.data)
+	return uint8(v >> 24), v & 0xffffff, nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
+
+// offsetOf returns the offset of a descendant in the written box.
+func (bx *box) offsetOf(target *box) (int, bool) {
+	if bx == target {
+		return 0, true
+	}
+	offset := 8
+	if int64(bx.len()) > 0xffffffff {
+		offset = 16
+	}
+	offset += len(bx.data)
+	for _, child := range bx.children {
+		if o, ok := child.offsetOf(target); ok {
+			return offset + o, true
+		}
+		offset += child.len()
+	}
+	return 0, false
+}
@@ -0,0 +1,472 @@
+// Package fmp4 encrypts fragmented MP4 init and media segments with common encryption.
+// Init segments get the protection scheme of their tracks, sinf boxes with frma, schm and tenc, and
+// the PSSH boxes of the DRM systems. Media segments get their samples encrypted in place and the senc,
+// saiz and saio boxes of their sample IVs and subsamples. AVC and HEVC samples are encrypted by NAL
+// unit, other samples whole.
+//
+// Slice headers are not parsed, so video is not encrypted with cbcs, which keeps them in the clear.
+package fmp4
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/Cooomma/widevine-proxy/cenc"
+	"github.com/Cooomma/widevine-proxy/pssh"
+)
+
+// Flags of senc boxes.
+const sencUseSubsamples = 0x000002
+
+// Key is the key of a track.
+type Key struct {
+	KeyID []byte
+	Key   []byte
+	// IV is the first IV of the track, or the constant IV with cbcs. A random IV is used when it is nil,
+	// which keeps the IVs of encryptors sharing a key apart.
+	IV []byte
+}
+
+// Track is a track of an init segment.
+type Track struct {
+	ID uint32
+	// Handler is the handler type of the track, e.g. "vide" or "soun".
+	Handler string
+	// Format is the format of its first sample entry, e.g. "avc1" or "mp4a".
+	Format string
+}
+
+// Options are the options of an Encryptor.
+type Options struct {
+	// Scheme is the protection scheme, cenc by default. Video is pattern encrypted 1:9 with cens and cbcs.
+	Scheme pssh.ProtectionScheme
+	// Keys returns the key of a track, or nil to leave the track clear.
+	Keys func(track Track) (*Key, error)
+	// PSSH are the PSSH boxes added to init segments.
+	PSSH [][]byte
+}
+
+// Encryptor encrypts the init segment and then the media segments of a presentation, in order:
+// the IVs of a track run on from one segment to the next. An Encryptor encrypts a single init segment.
+type Encryptor struct {
+	opts   Options
+	pssh   []*box
+	tracks map[uint32]*track
+	// defaultSampleSizes are the default sample sizes of the trex boxes of the init segment.
+	defaultSampleSizes map[uint32]uint32
+}
+
+type track struct {
+	enc *cenc.Encryptor
+	// nalLengthSize is the size of the NAL unit lengths of AVC and HEVC samples, 0 for other samples.
+	nalLengthSize int
+	hevc          bool
+}
+
+// NewEncryptor creates an Encryptor.
+func NewEncryptor(opts Options) (*Encryptor, error) {
+	switch opts.Scheme {
+	case 0:
+		opts.Scheme = pssh.SchemeCENC
+	case pssh.SchemeCENC, pssh.SchemeCENS, pssh.SchemeCBC1, pssh.SchemeCBCS:
+	default:
+		return nil, fmt.Errorf("fmp4: unsupported protection scheme %s", opts.Scheme)
+	}
+	if opts.Keys == nil {
+		return nil, fmt.Errorf("fmp4: no keys")
+	}
+	e := &Encryptor{opts: opts}
+	for _, b := range opts.PSSH {
+		boxes, err := parseBoxes(b, 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(boxes) != 1 || boxes[0].typ != "pssh" {
+			return nil, fmt.Errorf("fmp4: PSSH is not a pssh box")
+		}
+		e.pssh = append(e.pssh, boxes[0])
+	}
+	return e, nil
+}
+
+// EncryptInit returns the encrypted init segment, with the tracks the Keys return a key for
+// protected. It fails once an init segment has been encrypted, as that would restart the IVs.
+func (e *Encryptor) EncryptInit(init []byte) ([]byte, error) {
+	if e.tracks != nil {
+		return nil, fmt.Errorf("fmp4: init segment already encrypted")
+	}
+	boxes, err := parseBoxes(init, 0)
+	if err != nil {
+		return nil, err
+	}
+	var moov *box
+	for _, bx := range boxes {
+		if bx.typ == "moov" {
+			moov = bx
+		}
+	}
+	if moov == nil {
+		return nil, fmt.Errorf("fmp4: no moov box")
+	}
+
+	tracks := make(map[uint32]*track)
+	defaultSampleSizes := make(map[uint32]uint32)
+	if mvex := moov.child("mvex"); mvex != nil {
+		for _, trex := range mvex.childrenOf("trex") {
+			if len(trex.data) < 24 {
+				return nil, fmt.Errorf("fmp4: truncated trex box")
+			}
+			defaultSampleSizes[binary.BigEndian.Uint32(trex.data[4:])] = binary.BigEndian.Uint32(trex.data[16:])
+		}
+	}
+
+	for _, trak := range moov.childrenOf("trak") {
+		if err := e.protectTrack(trak, tracks); err != nil {
+			return nil, err
+		}
+	}
+	moov.children = append(moov.children, e.pssh...)
+	e.tracks, e.defaultSampleSizes = tracks, defaultSampleSizes
+
+	var out []byte
+	for _, bx := range boxes {
+		out = bx.append(out)
+	}
+	return out, nil
+}
+
+func (e *Encryptor) protectTrack(trak *box, tracks map[uint32]*track) error {
+	tkhd := trak.child("tkhd")
+	hdlr := trak.path("mdia", "hdlr")
+	stsd := trak.path("mdia", "minf", "stbl", "stsd")
+	if tkhd == nil || hdlr == nil || stsd == nil || len(stsd.children) == 0 {
+		return fmt.Errorf("fmp4: incomplete trak box")
+	}
+	version, _, err := tkhd.versionAndFlags()
+	if err != nil {
+		return err
+	}
+	idOffset := 12
+	if version == 1 {
+		idOffset = 20
+	}
+	if len(tkhd.data) < idOffset+4 || len(hdlr.data) < 12 {
+		return fmt.Errorf("fmp4: truncated trak box")
+	}
+	t := Track{
+		ID:      binary.BigEndian.Uint32(tkhd.data[idOffset:]),
+		Handler: string(hdlr.data[8:12]),
+		Format:  stsd.children[0].typ,
+	}
+
+	key, err := e.opts.Keys(t)
+	if err != nil {
+		return fmt.Errorf("fmp4: track %d: %v", t.ID, err)
+	}
+	if key == nil {
+		return nil
+	}
+	if len(key.KeyID) != 16 {
+		return fmt.Errorf("fmp4: track %d: key ID must be 16 bytes, got %d", t.ID, len(key.KeyID))
+	}
+	var pattern cenc.Pattern
+	switch t.Handler {
+	case "vide":
+		if e.opts.Scheme == pssh.SchemeCBCS {
+			return fmt.Errorf("fmp4: track %d: cannot encrypt video with cbcs, which keeps slice headers clear", t.ID)
+		}
+		if e.opts.Scheme == pssh.SchemeCENS {
+			pattern = cenc.VideoPattern
+		}
+	case "soun":
+	default:
+		return fmt.Errorf("fmp4: track %d: cannot encrypt %q tracks", t.ID, t.Handler)
+	}
+	enc, err := cenc.NewEncryptor(e.opts.Scheme, key.Key, key.IV, pattern)
+	if err != nil {
+		return fmt.Errorf("fmp4: track %d: %v", t.ID, err)
+	}
+
+	tr := &track{enc: enc}
+	for _, entry := range stsd.children {
+		if err := tr.protectSampleEntry(entry, t.Handler, key.KeyID); err != nil {
+			return fmt.Errorf("fmp4: track %d: %v", t.ID, err)
+		}
+	}
+	tracks[t.ID] = tr
+	return nil
+}
+
+// protectSampleEntry turns a sample entry into an encv or enca entry of its format.
+func (t *track) protectSampleEntry(entry *box, handler string, keyID []byte) error {
+	format := entry.typ
+	if format == "encv" || format == "enca" {
+		return fmt.Errorf("already encrypted")
+	}
+
+	// The fields of visual and audio sample entries precede their boxes.
+	fields := 78
+	if handler == "soun" {
+		fields = 28
+		if len(entry.data) >= 10 {
+			switch binary.BigEndian.Uint16(entry.data[8:]) {
+			case 1:
+				fields += 16
+			case 2:
+				fields += 36
+			}
+		}
+	}
+	if len(entry.data) < fields {
+		return fmt.Errorf("truncated %s sample entry", format)
+	}
+	children, err := parseBoxes(entry.data[fields:], 0)
+	if err != nil {
+		return err
+	}
+	entry.data, entry.children = entry.data[:fields:fields], children
+
+	if handler == "vide" {
+		switch format {
+		case "avc1", "avc3":
+			config := entry.child("avcC")
+			if config == nil || len(config.data) < 5 {
+				return fmt.Errorf("%s sample entry without avcC", format)
+			}
+			t.nalLengthSize, t.hevc = int(config.data[4]&3)+1, false
+		case "hvc1", "hev1":
+			config := entry.child("hvcC")
+			if config == nil || len(config.data) < 22 {
+				return fmt.Errorf("%s sample entry without hvcC", format)
+			}
+			t.nalLengthSize, t.hevc = int(config.data[21]&3)+1, true
+		default:
+			return fmt.Errorf("unsupported video format %s", format)
+		}
+		entry.typ = "encv"
+	} else {
+		entry.typ = "enca"
+	}
+	entry.children = append(entry.children, t.sinf(format, keyID))
+	return nil
+}
+
+// sinf returns the protection scheme information of the track.
+func (t *track) sinf(format string, keyID []byte) *box {
+	scheme := t.enc.Scheme()
+	version := uint8(0)
+	tenc := []byte{0, 0}
+	if scheme == pssh.SchemeCENS || scheme == pssh.SchemeCBCS {
+		pattern := t.enc.Pattern()
+		version, tenc[1] = 1, pattern.CryptByteBlock<<4|pattern.SkipByteBlock
+	}
+	tenc = append(tenc, 1, byte(t.enc.PerSampleIVSize()))
+	tenc = append(tenc, keyID...)
+	if iv := t.enc.ConstantIV(); iv != nil {
+		tenc = append(append(tenc, byte(len(iv))), iv...)
+	}
+
+	return &box{typ: "sinf", children: []*box{
+		{typ: "frma", data: []byte(format)},
+		fullBox("schm", 0, 0, appendUint32(appendUint32(nil, uint32(scheme)), 0x00010000)),
+		{typ: "schi", children: []*box{fullBox("tenc", version, 0, tenc)}},
+	}}
+}
+
+// EncryptSegment returns the encrypted media segment. The segment is left as it is.
+func (e *Encryptor) EncryptSegment(segment []byte) ([]byte, error) {
+	if e.tracks == nil {
+		return nil, fmt.Errorf("fmp4: no init segment")
+	}
+	boxes, err := parseBoxes(segment, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	data := append([]byte(nil), segment...)
+	var out []byte
+	for _, bx := range boxes {
+		switch bx.typ {
+		case "sidx":
+			return nil, fmt.Errorf("fmp4: segments with a sidx box are not supported")
+		case "moof":
+			if out, err = e.encryptFragment(out, bx, data); err != nil {
+				return nil, err
+			}
+		default:
+			out = append(out, data[bx.offset:bx.offset+bx.size]...)
+		}
+	}
+	return out, nil
+}
+
+// fragmentRun is a track run of a fragment and the offset of its samples in the segment.
+type fragmentRun struct {
+	box   *box
+	trun  *trun
+	start int
+}
+
+// encryptFragment encrypts the samples of a movie fragment in data and appends the fragment with
+// their encryption boxes to out. Data offsets are rewritten relative to the fragment, which grows.
+func (e *Encryptor) encryptFragment(out []byte, moof *box, data []byte) ([]byte, error) {
+	var runs []fragmentRun
+	var sampleInfos []*box
+	previousEnd := moof.offset
+	for i, traf := range moof.childrenOf("traf") {
+		tfhdBox := traf.child("tfhd")
+		if tfhdBox == nil {
+			return nil, fmt.Errorf("fmp4: traf box without tfhd")
+		}
+		header, err := parseTfhd(tfhdBox)
+		if err != nil {
+			return nil, err
+		}
+		if header.flags&tfhdBaseDataOffset != 0 {
+			return nil, fmt.Errorf("fmp4: track %d: explicit base data offsets are not supported", header.trackID)
+		}
+		if traf.child("senc") != nil || traf.child("saiz") != nil {
+			return nil, fmt.Errorf("fmp4: track %d: already encrypted", header.trackID)
+		}
+		base := previousEnd
+		if i == 0 || header.flags&tfhdDefaultBaseIsMoof != 0 {
+			base = moof.offset
+		}
+		defaultSize, ok := e.defaultSampleSizes[header.trackID]
+		if header.flags&tfhdDefaultSampleSize != 0 {
+			defaultSize, ok = header.defaultSampleSize, true
+		}
+
+		t := e.tracks[header.trackID]
+		var ivs [][]byte
+		var subsamples [][]cenc.Subsample
+		position := base
+		for _, trunBox := range traf.childrenOf("trun") {
+			r, err := parseTrun(trunBox)
+			if err != nil {
+				return nil, err
+			}
+			if r.flags&trunDataOffset != 0 {
+				position = base + int(r.dataOffset)
+			}
+			runs = append(runs, fragmentRun{box: trunBox, trun: r, start: position})
+
+			for _, s := range r.samples {
+				size := s.size
+				if r.flags&trunSampleSize == 0 {
+					if !ok {
+						return nil, fmt.Errorf("fmp4: track %d: no sample size", header.trackID)
+					}
+					size = defaultSize
+				}
+				if position < 0 || int64(position)+int64(size) > int64(len(data)) {
+					return nil, fmt.Errorf("fmp4: track %d: sample outside the segment", header.trackID)
+				}
+				if t != nil {
+					iv, subs, err := t.encryptSample(data[position : position+int(size)])
+					if err != nil {
+						return nil, fmt.Errorf("fmp4: track %d: %v", header.trackID, err)
+					}
+					ivs, subsamples = append(ivs, iv), append(subsamples, subs)
+				}
+				position += int(size)
+			}
+		}
+		previousEnd = position
+
+		flags := appendUint32(nil, uint32(tfhdBox.data[0])<<24|header.flags|tfhdDefaultBaseIsMoof)
+		tfhdBox.data = append(flags, tfhdBox.data[4:]...)
+		if t != nil {
+			saiz, saio, senc, err := t.sampleEncryptionBoxes(ivs, subsamples)
+			if err != nil {
+				return nil, fmt.Errorf("fmp4: track %d: %v", header.trackID, err)
+			}
+			traf.children = append(traf.children, saiz, saio, senc)
+			sampleInfos = append(sampleInfos, saio, senc)
+		}
+	}
+
+	// Sizes are known once every run has a data offset; the offsets then follow from them.
+	for _, run := range runs {
+		run.trun.flags |= trunDataOffset
+		run.box.data = run.trun.marshal()
+	}
+	shift := moof.len() - moof.size
+	for _, run := range runs {
+		offset := int64(run.start) + int64(shift) - int64(moof.offset)
+		if offset > 0x7fffffff {
+			return nil, fmt.Errorf("fmp4: data offset %d out of range", offset)
+		}
+		run.trun.dataOffset = int32(offset)
+		run.box.data = run.trun.marshal()
+	}
+	for i := 0; i < len(sampleInfos); i += 2 {
+		saio, senc := sampleInfos[i], sampleInfos[i+1]
+		offset, _ := moof.offsetOf(senc)
+		// The sample information starts after the header, version, flags and sample count of senc.
+		saio.data = fullBox("saio", 0, 0, appendUint32(appendUint32(nil, 1), uint32(offset+16))).data
+	}
+	return moof.append(out), nil
+}
+
+// encryptSample encrypts a sample in place and returns its IV and subsamples.
+func (t *track) encryptSample(sample []byte) ([]byte, []cenc.Subsample, error) {
+	var subsamples []cenc.Subsample
+	if t.nalLengthSize > 0 {
+		var err error
+		if subsamples, err = nalSubsamples(sample, t.nalLengthSize, t.hevc); err != nil {
+			return nil, nil, err
+		}
+	}
+	iv, err := t.enc.EncryptSample(sample, subsamples)
+	if err != nil {
+		return nil, nil, err
+	}
+	return iv, subsamples, nil
+}
+
+// sampleEncryptionBoxes returns the saiz, saio and senc boxes of the samples of a track fragment.
+// The saio offset is set once the fragment is laid out.
+func (t *track) sampleEncryptionBoxes(ivs [][]byte, subsamples [][]cenc.Subsample) (*box, *box, *box, error) {
+	ivSize := t.enc.PerSampleIVSize()
+	var flags uint32
+	if t.nalLengthSize > 0 {
+		flags = sencUseSubsamples
+	}
+
+	senc := appendUint32(nil, uint32(len(ivs)))
+	sizes := make([]byte, len(ivs))
+	for i, iv := range ivs {
+		size := ivSize
+		if ivSize > 0 {
+			senc = append(senc, iv...)
+		}
+		if flags&sencUseSubsamples != 0 {
+			senc = appendUint16(senc, uint16(len(subsamples[i])))
+			for _, s := range subsamples[i] {
+				senc = appendUint32(appendUint16(senc, s.BytesOfClearData), s.BytesOfProtectedData)
+			}
+			size += 2 + 6*len(subsamples[i])
+		}
+		if size > 0xff || len(subsamples[i]) > 0xffff {
+			return nil, nil, nil, fmt.Errorf("sample %d has too many subsamples", i)
+		}
+		sizes[i] = byte(size)
+	}
+
+	// Sizes are listed only when they differ.
+	uniform := true
+	for _, size := range sizes {
+		uniform = uniform && size == sizes[0]
+	}
+	saiz := []byte{0}
+	if uniform && len(sizes) > 0 {
+		saiz[0] = sizes[0]
+	}
+	saiz = appendUint32(saiz, uint32(len(sizes)))
+	if !uniform {
+		saiz = append(saiz, sizes...)
+	}
+
+	return fullBox("saiz", 0, 0, saiz), fullBox("saio", 0, 0, appendUint32(appendUint32(nil, 1), 0)), fullBox("senc", 0, flags, senc), nil
+}
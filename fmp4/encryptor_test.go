@@ -0,0 +1,335 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/Cooomma/widevine-proxy/cenc"
+	"github.com/Cooomma/widevine-proxy/pssh"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testVideoKey   = Key{KeyID: bytes.Repeat([]byte{1}, 16), Key: bytes.Repeat([]byte{2}, 16), IV: bytes.Repeat([]byte{3}, 16)}
+	testAudioKey   = Key{KeyID: bytes.Repeat([]byte{4}, 16), Key: bytes.Repeat([]byte{5}, 16), IV: bytes.Repeat([]byte{6}, 16)}
+	testPSSH, _    = (&pssh.Box{SystemID: pssh.WidevineSystemID, Data: []byte{0x22, 0x02, 'i', 'd'}}).Marshal()
+	testVideoTrack = uint32(1)
+	testAudioTrack = uint32(2)
+)
+
+func testTrak(id uint32, handler string, entry *box) *box {
+	tkhd := fullBox("tkhd", 0, 3, append(appendUint32(make([]byte, 8), id), make([]byte, 68)...))
+	hdlr := fullBox("hdlr", 0, 0, append(append(make([]byte, 4), handler...), make([]byte, 13)...))
+	stsd := &box{typ: "stsd", data: appendUint32(make([]byte, 4), 1), children: []*box{entry}}
+	return &box{typ: "trak", children: []*box{tkhd, {typ: "mdia", children: []*box{
+		fullBox("mdhd", 0, 0, make([]byte, 20)),
+		hdlr,
+		{typ: "minf", children: []*box{{typ: "stbl", children: []*box{stsd}}}},
+	}}}}
+}
+
+func testTrex(id, defaultSize uint32) *box {
+	b := appendUint32(appendUint32(appendUint32(nil, id), 1), 0)
+	return fullBox("trex", 0, 0, appendUint32(appendUint32(b, defaultSize), 0))
+}
+
+// testInit is an init segment of an AVC video track and an AAC audio track of 100 byte samples.
+func testInit() []byte {
+	avc1 := &box{typ: "avc1", data: make([]byte, 78), children: []*box{{typ: "avcC", data: []byte{1, 0x64, 0, 0x1f, 0xff, 0xe0, 0}}}}
+	mp4a := &box{typ: "mp4a", data: make([]byte, 28), children: []*box{fullBox("esds", 0, 0, []byte{3, 0})}}
+	moov := &box{typ: "moov", children: []*box{
+		fullBox("mvhd", 0, 0, make([]byte, 96)),
+		testTrak(testVideoTrack, "vide", avc1),
+		testTrak(testAudioTrack, "soun", mp4a),
+		{typ: "mvex", children: []*box{testTrex(testVideoTrack, 0), testTrex(testAudioTrack, 100)}},
+	}}
+	ftyp := &box{typ: "ftyp", data: []byte("iso6\x00\x00\x00\x00iso6")}
+	return moov.append(ftyp.append(nil))
+}
+
+func nalUnit(header byte, size int) []byte {
+	nal := appendUint32(nil, uint32(size))
+	nal = append(nal, header)
+	for i := 1; i < size; i++ {
+		nal = append(nal, byte(i))
+	}
+	return nal
+}
+
+// testSegment is a media segment of two video samples and two audio samples. The audio
+// fragment has neither a data offset nor default-base-is-moof: its data follows the video data.
+func testSegment() ([]byte, [][]byte) {
+	samples := [][]byte{
+		append(nalUnit(0x09, 2), nalUnit(0x65, 101)...),
+		nalUnit(0x41, 41),
+		bytes.Repeat([]byte{0xaa}, 100),
+		bytes.Repeat([]byte{0xbb}, 100),
+	}
+
+	videoRun := &trun{flags: trunDataOffset | trunSampleSize, samples: []trunSample{{size: uint32(len(samples[0]))}, {size: uint32(len(samples[1]))}}}
+	videoTrun := &box{typ: "trun"}
+	moof := &box{typ: "moof", children: []*box{
+		fullBox("mfhd", 0, 0, appendUint32(nil, 1)),
+		{typ: "traf", children: []*box{
+			fullBox("tfhd", 0, tfhdDefaultBaseIsMoof, appendUint32(nil, testVideoTrack)),
+			fullBox("tfdt", 0, 0, appendUint32(nil, 0)),
+			videoTrun,
+		}},
+		{typ: "traf", children: []*box{
+			fullBox("tfhd", 0, 0, appendUint32(nil, testAudioTrack)),
+			{typ: "trun", data: (&trun{samples: make([]trunSample, 2)}).marshal()},
+		}},
+	}}
+	videoTrun.data = videoRun.marshal()
+	videoRun.dataOffset = int32(moof.len() + 8)
+	videoTrun.data = videoRun.marshal()
+
+	mdat := &box{typ: "mdat", data: bytes.Join(samples, nil)}
+	styp := &box{typ: "styp", data: []byte("msdh\x00\x00\x00\x00msdh")}
+	return mdat.append(moof.append(styp.append(nil))), samples
+}
+
+func testEncryptor(t *testing.T, scheme pssh.ProtectionScheme) *Encryptor {
+	e, err := NewEncryptor(Options{
+		Scheme: scheme,
+		Keys: func(track Track) (*Key, error) {
+			if track.Handler == "vide" {
+				return &testVideoKey, nil
+			}
+			return &testAudioKey, nil
+		},
+		PSSH: [][]byte{testPSSH},
+	})
+	assert.NoError(t, err)
+	return e
+}
+
+// sampleEntry returns the first sample entry of a track of an encrypted init segment.
+func sampleEntry(t *testing.T, moov *box, id uint32) *box {
+	for _, trak := range moov.childrenOf("trak") {
+		if binary.BigEndian.Uint32(trak.child("tkhd").data[12:]) != id {
+			continue
+		}
+		entry := trak.path("mdia", "minf", "stbl", "stsd").children[0]
+		fields := 78
+		if entry.typ == "enca" {
+			fields = 28
+		}
+		children, err := parseBoxes(entry.data[fields:], 0)
+		assert.NoError(t, err)
+		entry.children = children
+		return entry
+	}
+	return nil
+}
+
+func TestEncryptInit(t *testing.T) {
+	for _, tc := range []struct {
+		scheme pssh.ProtectionScheme
+		tenc   string
+	}{
+		{pssh.SchemeCENC, "00000000" + "0000" + "0110" + hex.EncodeToString(testVideoKey.KeyID)},
+		{pssh.SchemeCENS, "01000000" + "0019" + "0110" + hex.EncodeToString(testVideoKey.KeyID)},
+	} {
+		init := testInit()
+		original := append([]byte(nil), init...)
+		e := testEncryptor(t, tc.scheme)
+		var tracks []Track
+		keys := e.opts.Keys
+		e.opts.Keys = func(track Track) (*Key, error) {
+			tracks = append(tracks, track)
+			return keys(track)
+		}
+		encrypted, err := e.EncryptInit(init)
+		assert.NoError(t, err, tc.scheme.String())
+		assert.Equal(t, original, init)
+		assert.Equal(t, []Track{{ID: testVideoTrack, Handler: "vide", Format: "avc1"}, {ID: testAudioTrack, Handler: "soun", Format: "mp4a"}}, tracks)
+
+		boxes, err := parseBoxes(encrypted, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "ftyp", boxes[0].typ)
+		moov := boxes[1]
+		psshBox := moov.child("pssh")
+		assert.NotNil(t, psshBox)
+		assert.Equal(t, testPSSH, psshBox.append(nil))
+
+		video := sampleEntry(t, moov, testVideoTrack)
+		assert.Equal(t, "encv", video.typ)
+		assert.NotNil(t, video.child("avcC"))
+		sinf := video.child("sinf")
+		assert.Equal(t, "avc1", string(sinf.child("frma").data))
+		assert.Equal(t, "00000000"+hex.EncodeToString([]byte(tc.scheme.String()))+"00010000", hex.EncodeToString(sinf.child("schm").data))
+		assert.Equal(t, tc.tenc, hex.EncodeToString(sinf.path("schi", "tenc").data), tc.scheme.String())
+
+		audio := sampleEntry(t, moov, testAudioTrack)
+		assert.Equal(t, "enca", audio.typ)
+		assert.Equal(t, "mp4a", string(audio.child("sinf").child("frma").data))
+	}
+}
+
+func TestEncryptSegment(t *testing.T) {
+	for _, scheme := range []pssh.ProtectionScheme{pssh.SchemeCENC, pssh.SchemeCENS, pssh.SchemeCBC1} {
+		e := testEncryptor(t, scheme)
+		_, err := e.EncryptInit(testInit())
+		assert.NoError(t, err)
+
+		for segment := 0; segment < 2; segment++ {
+			clear, samples := testSegment()
+			original := append([]byte(nil), clear...)
+			encrypted, err := e.EncryptSegment(clear)
+			assert.NoError(t, err, scheme.String())
+			assert.Equal(t, original, clear)
+			// Each fragment gains saiz, saio and senc boxes, and the audio run a data offset.
+			assert.Len(t, encrypted, len(clear)+2*(17+20)+4+sencSize(scheme), scheme.String())
+
+			decrypted := decryptSegment(t, scheme, encrypted)
+			assert.Equal(t, samples, decrypted, scheme.String())
+			assert.NotEqual(t, samples[1][5:], encrypted[len(encrypted)-200-len(samples[1])+5:len(encrypted)-200], scheme.String())
+		}
+	}
+}
+
+// sencSize is the size of the senc boxes of testSegment: two video samples of a subsample each,
+// and two audio samples, with the 16 byte IVs of the test keys.
+func sencSize(scheme pssh.ProtectionScheme) int {
+	return 2*(16) + 2*16 + (2 + 6) + (2 + 6) + 2*16
+}
+
+// decryptSegment decrypts the samples of an encrypted testSegment with their senc boxes.
+func decryptSegment(t *testing.T, scheme pssh.ProtectionScheme, segment []byte) [][]byte {
+	boxes, err := parseBoxes(segment, 0)
+	assert.NoError(t, err)
+	var moof *box
+	for _, bx := range boxes {
+		if bx.typ == "moof" {
+			moof = bx
+		}
+	}
+
+	var samples [][]byte
+	for _, traf := range moof.childrenOf("traf") {
+		header, err := parseTfhd(traf.child("tfhd"))
+		assert.NoError(t, err)
+		assert.NotZero(t, header.flags&tfhdDefaultBaseIsMoof)
+		r, err := parseTrun(traf.child("trun"))
+		assert.NoError(t, err)
+
+		key, pattern, ivSize := testVideoKey, cenc.Pattern{}, 16
+		if header.trackID == testAudioTrack {
+			key = testAudioKey
+		} else if scheme == pssh.SchemeCENS {
+			pattern = cenc.VideoPattern
+		}
+
+		// saio points at the sample information of senc, whose sizes saiz lists.
+		senc := traf.child("senc")
+		_, flags, _ := senc.versionAndFlags()
+		saio := traf.child("saio")
+		offset := int(binary.BigEndian.Uint32(saio.data[8:]))
+		info := segment[moof.offset+offset:]
+		assert.Equal(t, senc.data[8:], info[:len(senc.data)-8])
+		assert.Equal(t, uint32(len(r.samples)), binary.BigEndian.Uint32(traf.child("saiz").data[5:]))
+
+		position := moof.offset + int(r.dataOffset)
+		for _, s := range r.samples {
+			size := int(s.size)
+			if r.flags&trunSampleSize == 0 {
+				size = 100
+			}
+			iv := key.IV
+			if ivSize > 0 {
+				iv, info = info[:ivSize], info[ivSize:]
+			}
+			var subsamples []cenc.Subsample
+			if flags&sencUseSubsamples != 0 {
+				count := int(binary.BigEndian.Uint16(info))
+				info = info[2:]
+				subsamples = []cenc.Subsample{}
+				for i := 0; i < count; i++ {
+					subsamples = append(subsamples, cenc.Subsample{BytesOfClearData: binary.BigEndian.Uint16(info), BytesOfProtectedData: binary.BigEndian.Uint32(info[2:])})
+					info = info[6:]
+				}
+			}
+			sample := append([]byte(nil), segment[position:position+size]...)
+			assert.NoError(t, cenc.DecryptSample(scheme, key.Key, iv, pattern, sample, subsamples))
+			samples = append(samples, sample)
+			position += size
+		}
+	}
+	return samples
+}
+
+func TestEncryptCBCS(t *testing.T) {
+	// Video would need its slice headers clear.
+	_, err := testEncryptor(t, pssh.SchemeCBCS).EncryptInit(testInit())
+	assert.EqualError(t, err, "fmp4: track 1: cannot encrypt video with cbcs, which keeps slice headers clear")
+
+	// Audio is encrypted with the constant IV of the key.
+	e := testEncryptor(t, pssh.SchemeCBCS)
+	e.opts.Keys = func(track Track) (*Key, error) {
+		if track.Handler == "vide" {
+			return nil, nil
+		}
+		return &testAudioKey, nil
+	}
+	encrypted, err := e.EncryptInit(testInit())
+	assert.NoError(t, err)
+	boxes, err := parseBoxes(encrypted, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "avc1", sampleEntry(t, boxes[1], testVideoTrack).typ)
+	audio := sampleEntry(t, boxes[1], testAudioTrack)
+	assert.Equal(t, "01000000"+"0000"+"0100"+hex.EncodeToString(testAudioKey.KeyID)+"10"+hex.EncodeToString(testAudioKey.IV),
+		hex.EncodeToString(audio.child("sinf").path("schi", "tenc").data))
+	segment, _ := testSegment()
+	_, err = e.EncryptSegment(segment)
+	assert.NoError(t, err)
+}
+
+func TestNALSubsamples(t *testing.T) {
+	// Non-VCL NAL units stay clear; slices are protected in whole blocks after their header.
+	sample := append(nalUnit(0x09, 2), nalUnit(0x06, 20)...)
+	sample = append(sample, nalUnit(0x65, 101)...)
+	sample = append(sample, nalUnit(0x0c, 3)...)
+	subsamples, err := nalSubsamples(sample, 4, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []cenc.Subsample{{BytesOfClearData: 6 + 24 + 4 + 5, BytesOfProtectedData: 96}, {BytesOfClearData: 7}}, subsamples)
+
+	// HEVC NAL unit headers are two bytes; clear runs beyond 16 bits are split.
+	sample = append(nalUnit(0x40, 70000), nalUnit(0x26, 34)...)
+	subsamples, err = nalSubsamples(sample, 4, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []cenc.Subsample{{BytesOfClearData: 0xffff}, {BytesOfClearData: 70004 - 0xffff + 4 + 2, BytesOfProtectedData: 32}}, subsamples)
+
+	_, err = nalSubsamples(append(nalUnit(0x65, 20), 0, 0), 4, false)
+	assert.EqualError(t, err, "fmp4: truncated NAL unit length at 24")
+	_, err = nalSubsamples(nalUnit(0x65, 20)[:10], 4, false)
+	assert.EqualError(t, err, "fmp4: invalid NAL unit size 20 at 0")
+}
+
+func TestEncryptorErrors(t *testing.T) {
+	_, err := NewEncryptor(Options{Scheme: pssh.ProtectionScheme(0x61626364), Keys: func(Track) (*Key, error) { return nil, nil }})
+	assert.EqualError(t, err, "fmp4: unsupported protection scheme abcd")
+	_, err = NewEncryptor(Options{})
+	assert.EqualError(t, err, "fmp4: no keys")
+
+	e := testEncryptor(t, pssh.SchemeCENC)
+	segment, _ := testSegment()
+	_, err = e.EncryptSegment(segment)
+	assert.EqualError(t, err, "fmp4: no init segment")
+
+	init, err := e.EncryptInit(testInit())
+	assert.NoError(t, err)
+	_, err = e.EncryptInit(testInit())
+	assert.EqualError(t, err, "fmp4: init segment already encrypted")
+	_, err = testEncryptor(t, pssh.SchemeCENC).EncryptInit(init)
+	assert.EqualError(t, err, "fmp4: track 1: already encrypted")
+
+	e = testEncryptor(t, pssh.SchemeCENC)
+	e.opts.Keys = func(Track) (*Key, error) { return &Key{KeyID: []byte{1}, Key: testVideoKey.Key}, nil }
+	_, err = e.EncryptInit(testInit())
+	assert.EqualError(t, err, "fmp4: track 1: key ID must be 16 bytes, got 1")
+	_, err = e.EncryptSegment(segment)
+	assert.EqualError(t, err, "fmp4: no init segment")
+}
@@ -0,0 +1,163 @@
+package fmp4
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Flags of tfhd boxes.
+const (
+	tfhdBaseDataOffset         = 0x000001
+	tfhdSampleDescriptionIndex = 0x000002
+	tfhdDefaultSampleDuration  = 0x000008
+	tfhdDefaultSampleSize      = 0x000010
+	tfhdDefaultSampleFlags     = 0x000020
+	tfhdDefaultBaseIsMoof      = 0x020000
+)
+
+// Flags of trun boxes.
+const (
+	trunDataOffset       = 0x000001
+	trunFirstSampleFlags = 0x000004
+	trunSampleDuration   = 0x000100
+	trunSampleSize       = 0x000200
+	trunSampleFlags      = 0x000400
+	trunSampleCTO        = 0x000800
+)
+
+// tfhd is a track fragment header.
+type tfhd struct {
+	flags   uint32
+	trackID uint32
+	// defaultSampleSize is set with tfhdDefaultSampleSize.
+	defaultSampleSize uint32
+}
+
+func parseTfhd(bx *box) (*tfhd, error) {
+	_, flags, err := bx.versionAndFlags()
+	if err != nil {
+		return nil, err
+	}
+	b := bx.data[4:]
+	if len(b) < 4 {
+		return nil, fmt.Errorf("fmp4: truncated tfhd box")
+	}
+	h := &tfhd{flags: flags, trackID: binary.BigEndian.Uint32(b)}
+	offset := 4
+	if flags&tfhdBaseDataOffset != 0 {
+		offset += 8
+	}
+	if flags&tfhdSampleDescriptionIndex != 0 {
+		offset += 4
+	}
+	if flags&tfhdDefaultSampleDuration != 0 {
+		offset += 4
+	}
+	if flags&tfhdDefaultSampleSize != 0 {
+		if len(b) < offset+4 {
+			return nil, fmt.Errorf("fmp4: truncated tfhd box")
+		}
+		h.defaultSampleSize = binary.BigEndian.Uint32(b[offset:])
+	}
+	return h, nil
+}
+
+// trun is a track fragment run.
+type trun struct {
+	version          uint8
+	flags            uint32
+	dataOffset       int32
+	firstSampleFlags uint32
+	samples          []trunSample
+}
+
+type trunSample struct {
+	duration uint32
+	size     uint32
+	flags    uint32
+	cto      uint32
+}
+
+func parseTrun(bx *box) (*trun, error) {
+	version, flags, err := bx.versionAndFlags()
+	if err != nil {
+		return nil, err
+	}
+	b := bx.data[4:]
+	if len(b) < 4 {
+		return nil, fmt.Errorf("fmp4: truncated trun box")
+	}
+	r := &trun{version: version, flags: flags}
+	count := int(binary.BigEndian.Uint32(b))
+	b = b[4:]
+
+	next := func() (uint32, error) {
+		if len(b) < 4 {
+			return 0, fmt.Errorf("fmp4: truncated trun box")
+		}
+		v := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		return v, nil
+	}
+	if flags&trunDataOffset != 0 {
+		v, err := next()
+		if err != nil {
+			return nil, err
+		}
+		r.dataOffset = int32(v)
+	}
+	if flags&trunFirstSampleFlags != 0 {
+		if r.firstSampleFlags, err = next(); err != nil {
+			return nil, err
+		}
+	}
+
+	fields := 0
+	for _, flag := range []uint32{trunSampleDuration, trunSampleSize, trunSampleFlags, trunSampleCTO} {
+		if flags&flag != 0 {
+			fields++
+		}
+	}
+	if count*fields*4 > len(b) {
+		return nil, fmt.Errorf("fmp4: truncated trun box")
+	}
+	r.samples = make([]trunSample, count)
+	for i := range r.samples {
+		s := &r.samples[i]
+		for _, field := range []struct {
+			flag uint32
+			v    *uint32
+		}{{trunSampleDuration, &s.duration}, {trunSampleSize, &s.size}, {trunSampleFlags, &s.flags}, {trunSampleCTO, &s.cto}} {
+			if flags&field.flag != 0 {
+				*field.v, _ = next()
+			}
+		}
+	}
+	return r, nil
+}
+
+func (r *trun) marshal() []byte {
+	b := appendUint32(nil, uint32(r.version)<<24|r.flags)
+	b = appendUint32(b, uint32(len(r.samples)))
+	if r.flags&trunDataOffset != 0 {
+		b = appendUint32(b, uint32(r.dataOffset))
+	}
+	if r.flags&trunFirstSampleFlags != 0 {
+		b = appendUint32(b, r.firstSampleFlags)
+	}
+	for _, s := range r.samples {
+		if r.flags&trunSampleDuration != 0 {
+			b = appendUint32(b, s.duration)
+		}
+		if r.flags&trunSampleSize != 0 {
+			b = appendUint32(b, s.size)
+		}
+		if r.flags&trunSampleFlags != 0 {
+			b = appendUint32(b, s.flags)
+		}
+		if r.flags&trunSampleCTO != 0 {
+			b = appendUint32(b, s.cto)
+		}
+	}
+	return b
+}
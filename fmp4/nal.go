@@ -0,0 +1,67 @@
+package fmp4
+
+import (
+	"fmt"
+
+	"github.com/Cooomma/widevine-proxy/cenc"
+)
+
+// nalSubsamples maps the NAL units of an AVC or HEVC sample to subsamples. Non-VCL NAL units stay
+// clear; VCL NAL units are protected after their NAL unit header, with the leading remainder of the
+// block size clear so protected ranges are whole blocks. Slice headers are not parsed: they may be
+// protected, which cenc, cbc1 and cens allow but cbcs does not.
+func nalSubsamples(sample []byte, lengthSize int, hevc bool) ([]cenc.Subsample, error) {
+	headerSize := 1
+	if hevc {
+		headerSize = 2
+	}
+
+	var subsamples []cenc.Subsample
+	clear := 0
+	for i := 0; i < len(sample); {
+		if len(sample)-i < lengthSize {
+			return nil, fmt.Errorf("fmp4: truncated NAL unit length at %d", i)
+		}
+		n := 0
+		for _, b := range sample[i : i+lengthSize] {
+			n = n<<8 | int(b)
+		}
+		i += lengthSize
+		if n < headerSize || n > len(sample)-i {
+			return nil, fmt.Errorf("fmp4: invalid NAL unit size %d at %d", n, i-lengthSize)
+		}
+
+		protected := 0
+		if isVCL(sample[i], hevc) {
+			protected = (n - headerSize) / 16 * 16
+		}
+		clear += lengthSize + n - protected
+		if protected > 0 {
+			subsamples = appendSubsample(subsamples, clear, protected)
+			clear = 0
+		}
+		i += n
+	}
+	if clear > 0 {
+		subsamples = appendSubsample(subsamples, clear, 0)
+	}
+	return subsamples, nil
+}
+
+// appendSubsample appends a subsample, spilling clear bytes beyond 16 bits into subsamples of their own.
+func appendSubsample(subsamples []cenc.Subsample, clear, protected int) []cenc.Subsample {
+	for clear > 0xffff {
+		subsamples = append(subsamples, cenc.Subsample{BytesOfClearData: 0xffff})
+		clear -= 0xffff
+	}
+	return append(subsamples, cenc.Subsample{BytesOfClearData: uint16(clear), BytesOfProtectedData: uint32(protected)})
+}
+
+// isVCL reports whether a NAL unit header is the one of a coded slice.
+func isVCL(header byte, hevc bool) bool {
+	if hevc {
+		return (header>>1)&0x3f < 32
+	}
+	t := header & 0x1f
+	return t >= 1 && t <= 5
+}
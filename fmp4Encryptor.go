@@ -0,0 +1,70 @@
+package widevineproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+
+	"github.com/Cooomma/widevine-proxy/fmp4"
+	"github.com/Cooomma/widevine-proxy/pssh"
+)
+
+// FMP4Encryptor creates an encryptor of the fragmented MP4 segments of a title with the keys of the proxy,
+// e.g. to package test assets without an external packager. Video tracks get the key of videoTrackType and
+// audio tracks the AUDIO key: the content key spec of the track type, or the content key when there is none.
+// Init segments carry the PSSH of the DRM types of opts, with its protection scheme, cenc by default. The IVs
+// are random but with cbcs, which uses the IV of the key as constant IV and only encrypts audio.
+func (wp *Proxy) FMP4Encryptor(ctx context.Context, contentID, videoTrackType string, opts InitDataOptions) (*fmp4.Encryptor, error) {
+	if opts.ProtectionScheme == 0 {
+		opts.ProtectionScheme = pssh.SchemeCENC
+	}
+	lookup := wp.trackKeys(ctx, contentID, opts.PolicyConfig)
+	video, err := lookup(videoTrackType)
+	if err != nil {
+		return nil, err
+	}
+	audio, err := lookup("AUDIO")
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []pssh.PlayReadyKey{{KeyID: video.KeyID, Key: video.Key}}
+	if !bytes.Equal(audio.KeyID, video.KeyID) {
+		keys = append(keys, pssh.PlayReadyKey{KeyID: audio.KeyID, Key: audio.Key})
+	}
+	systems, err := wp.initDataSystems(contentID, keys, opts)
+	if err != nil {
+		return nil, err
+	}
+	var boxes [][]byte
+	for _, system := range systems {
+		boxes = append(boxes, system.PSSH)
+	}
+
+	return fmp4.NewEncryptor(fmp4.Options{
+		Scheme: opts.ProtectionScheme,
+		Keys: func(track fmp4.Track) (*fmp4.Key, error) {
+			switch track.Handler {
+			case "vide":
+				return fmp4KeyOf(video, opts.ProtectionScheme), nil
+			case "soun":
+				return fmp4KeyOf(audio, opts.ProtectionScheme), nil
+			}
+			return nil, nil
+		},
+		PSSH: boxes,
+	})
+}
+
+// fmp4KeyOf converts a stored key. The stored IV is fixed per content, so it is only used as the constant IV
+// of cbcs: each encryptor starts from a random IV otherwise, lest renditions and re-runs sharing the key
+// repeat the counters, and thus the keystream, of cenc and cens.
+func fmp4KeyOf(key StoredKey, scheme pssh.ProtectionScheme) *fmp4.Key {
+	k := &fmp4.Key{KeyID: key.KeyID, Key: key.Key}
+	if scheme == pssh.SchemeCBCS && len(key.IV) > 0 {
+		// An 8 bytes IV is the 16 bytes IV with a zero block counter.
+		k.IV = make([]byte, aes.BlockSize)
+		copy(k.IV, key.IV)
+	}
+	return k
+}
@@ -0,0 +1,91 @@
+package widevineproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Cooomma/widevine-proxy/pssh"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func mp4Box(typ string, payload ...[]byte) []byte {
+	b := make([]byte, 8)
+	copy(b[4:], typ)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+// testAudioInit is an init segment of a single AAC audio track.
+func testAudioInit() []byte {
+	mp4a := mp4Box("mp4a", make([]byte, 28), mp4Box("esds", make([]byte, 4), []byte{3, 0}))
+	stsd := mp4Box("stsd", []byte{0, 0, 0, 0, 0, 0, 0, 1}, mp4a)
+	hdlr := mp4Box("hdlr", make([]byte, 8), []byte("soun"), make([]byte, 13))
+	trak := mp4Box("trak",
+		mp4Box("tkhd", []byte{0, 0, 0, 3}, make([]byte, 8), []byte{0, 0, 0, 1}, make([]byte, 68)),
+		mp4Box("mdia", mp4Box("mdhd", make([]byte, 24)), hdlr, mp4Box("minf", mp4Box("stbl", stsd))))
+	trex := mp4Box("trex", make([]byte, 4), []byte{0, 0, 0, 1, 0, 0, 0, 1}, make([]byte, 12))
+	moov := mp4Box("moov", mp4Box("mvhd", make([]byte, 100)), trak, mp4Box("mvex", trex))
+	return append(mp4Box("ftyp", []byte("iso6\x00\x00\x00\x00iso6")), moov...)
+}
+
+func TestFMP4Encryptor(t *testing.T) {
+	wp := NewWidevineProxy(nil, nil, "widevine_test", FakeMultiKeyGoverner{}, logrus.New())
+
+	e, err := wp.FMP4Encryptor(context.Background(), "testing", "HD", InitDataOptions{DRMTypes: []string{DRMTypeWidevine}})
+	assert.NoError(t, err)
+	init, err := e.EncryptInit(testAudioInit())
+	assert.NoError(t, err)
+
+	// The audio track is keyed by the AUDIO spec and the PSSH lists the keys of both tracks.
+	kid, _ := base64.StdEncoding.DecodeString("AAECAwQFBgcICQoLDA0ODw==")
+	assert.True(t, bytes.Contains(init, []byte("enca")))
+	assert.True(t, bytes.Contains(init, []byte("schm\x00\x00\x00\x00cenc")))
+	assert.True(t, bytes.Contains(init, kid))
+
+	i := bytes.Index(init, []byte("pssh"))
+	if !assert.True(t, i >= 4) {
+		return
+	}
+	data, err := pssh.ParseWidevine(init[i-4:])
+	assert.NoError(t, err)
+	hdKID, _ := base64.StdEncoding.DecodeString("EBESExQVFhcYGRobHB0eHw==")
+	assert.Equal(t, [][]byte{hdKID, kid}, data.KeyIDs)
+	assert.Equal(t, pssh.SchemeCENC, data.ProtectionScheme)
+}
+
+func TestFMP4KeyOf(t *testing.T) {
+	iv := bytes.Repeat([]byte{3}, 16)
+	key := StoredKey{KeyID: bytes.Repeat([]byte{1}, 16), Key: bytes.Repeat([]byte{2}, 16), IV: iv}
+	for _, scheme := range []pssh.ProtectionScheme{pssh.SchemeCENC, pssh.SchemeCENS, pssh.SchemeCBC1} {
+		assert.Nil(t, fmp4KeyOf(key, scheme).IV, scheme.String())
+	}
+	assert.Equal(t, iv, fmp4KeyOf(key, pssh.SchemeCBCS).IV)
+
+	// 8 bytes IVs get a zero block counter.
+	key.IV = bytes.Repeat([]byte{3}, 8)
+	assert.Equal(t, append(bytes.Repeat([]byte{3}, 8), make([]byte, 8)...), fmp4KeyOf(key, pssh.SchemeCBCS).IV)
+}
+
+func TestFMP4EncryptorShortIV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The content key of the key file has an 8 bytes IV.
+	kg, err := NewFileKeyGoverner(writeKeyFile(t, dir, "keys.csv", testKeyFileCSV), logrus.New())
+	assert.NoError(t, err)
+	wp := NewWidevineProxy(nil, nil, "widevine_test", kg, logrus.New())
+	enc, err := wp.FMP4Encryptor(context.Background(), "movie", "HD", InitDataOptions{ProtectionScheme: pssh.SchemeCBCS})
+	assert.NoError(t, err)
+	_, err = enc.EncryptInit(testAudioInit())
+	assert.NoError(t, err)
+}
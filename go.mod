@@ -3,9 +3,11 @@ module github.com/Cooomma/widevine-proxy
 go 1.15
 
 require (
-	github.com/alfg/widevine v0.0.0-20191212022158-f3729a5b2b43
-	github.com/golang/protobuf v1.4.3
+	github.com/go-sql-driver/mysql v1.6.0
+	github.com/lib/pq v1.10.0
 	github.com/mattn/go-colorable v0.1.8
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/sirupsen/logrus v1.7.0
 	github.com/stretchr/testify v1.2.2
+	google.golang.org/protobuf v1.23.0
 )
@@ -0,0 +1,182 @@
+package widevineproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Cooomma/widevine-proxy/pssh"
+)
+
+// WidevineKeyFormat is the KEYFORMAT of Widevine HLS key tags.
+const WidevineKeyFormat = "urn:uuid:edef8ba9-79d6-4ace-a3c8-27dcd51d21ed"
+
+// HLS encryption methods.
+const (
+	HLSMethodSampleAES    = "SAMPLE-AES"
+	HLSMethodSampleAESCTR = "SAMPLE-AES-CTR"
+)
+
+// KEYFORMAT needs EXT-X-VERSION 5.
+const hlsKeyFormatVersion = 5
+
+// HLSKey is a Widevine key of an HLS playlist.
+type HLSKey struct {
+	// Method is SAMPLE-AES for cbcs and SAMPLE-AES-CTR for cenc content.
+	Method string
+	KeyID  []byte
+	// PSSH is the Widevine pssh box carried in the data URI.
+	PSSH []byte
+}
+
+// Attributes returns the attribute list of the key tag.
+func (k HLSKey) Attributes() string {
+	method := k.Method
+	if method == "" {
+		method = HLSMethodSampleAES
+	}
+	attrs := []string{
+		"METHOD=" + method,
+		`URI="data:text/plain;base64,` + base64.StdEncoding.EncodeToString(k.PSSH) + `"`,
+	}
+	if len(k.KeyID) > 0 {
+		attrs = append(attrs, "KEYID=0x"+strings.ToUpper(hex.EncodeToString(k.KeyID)))
+	}
+	attrs = append(attrs, `KEYFORMAT="`+WidevineKeyFormat+`"`, `KEYFORMATVERSIONS="1"`)
+	return strings.Join(attrs, ",")
+}
+
+// KeyTag returns the EXT-X-KEY tag of a media playlist.
+func (k HLSKey) KeyTag() string {
+	return "#EXT-X-KEY:" + k.Attributes()
+}
+
+// SessionKeyTag returns the EXT-X-SESSION-KEY tag of a master playlist.
+func (k HLSKey) SessionKeyTag() string {
+	return "#EXT-X-SESSION-KEY:" + k.Attributes()
+}
+
+// HLSKeysFromResponse builds the Widevine key of each track type of a content key response.
+func HLSKeysFromResponse(resp *ContentKeyResponse, method string) (map[string]HLSKey, error) {
+	keys := make(map[string]HLSKey)
+	for _, track := range resp.Tracks {
+		kid, err := base64.StdEncoding.DecodeString(track.KeyID)
+		if err != nil || len(kid) != 16 {
+			return nil, fmt.Errorf("%s track: invalid key ID %q", track.Type, track.KeyID)
+		}
+
+		data := (&pssh.WidevineData{KeyIDs: [][]byte{kid}}).Marshal()
+		for _, p := range track.PSSH {
+			if p.DRMType == DRMTypeWidevine {
+				if data, err = base64.StdEncoding.DecodeString(p.Data); err != nil {
+					return nil, fmt.Errorf("%s track: decode pssh: %v", track.Type, err)
+				}
+			}
+		}
+		system, err := responseSystemData(DRMTypeWidevine, kid, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s track: %v", track.Type, err)
+		}
+		keys[track.Type] = HLSKey{Method: method, KeyID: kid, PSSH: system.PSSH}
+	}
+	return keys, nil
+}
+
+// RewriteMediaPlaylist inserts the Widevine EXT-X-KEY tag in front of the first segment of
+// a media playlist, replacing any Widevine key tag already present.
+func RewriteMediaPlaylist(playlist []byte, key HLSKey) ([]byte, error) {
+	lines, newline, err := playlistLines(playlist)
+	if err != nil {
+		return nil, err
+	}
+	if hasTag(lines, "#EXT-X-STREAM-INF") {
+		return nil, fmt.Errorf("not a media playlist")
+	}
+	return rewritePlaylist(lines, newline, "#EXT-X-KEY:", []string{key.KeyTag()},
+		"#EXT-X-KEY:", "#EXT-X-MAP:", "#EXTINF:", "#EXT-X-BYTERANGE:", "#EXT-X-PART:", "#EXT-X-ENDLIST"), nil
+}
+
+// RewriteMasterPlaylist inserts the Widevine EXT-X-SESSION-KEY tags in front of the variant
+// streams of a master playlist, replacing any Widevine session key tag already present.
+func RewriteMasterPlaylist(playlist []byte, keys []HLSKey) ([]byte, error) {
+	lines, newline, err := playlistLines(playlist)
+	if err != nil {
+		return nil, err
+	}
+	if !hasTag(lines, "#EXT-X-STREAM-INF") {
+		return nil, fmt.Errorf("not a master playlist")
+	}
+
+	var tags []string
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		// Tracks sharing a key share the session key tag.
+		if tag := key.SessionKeyTag(); !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return rewritePlaylist(lines, newline, "#EXT-X-SESSION-KEY:", tags,
+		"#EXT-X-SESSION-KEY:", "#EXT-X-MEDIA:", "#EXT-X-STREAM-INF:", "#EXT-X-I-FRAME-STREAM-INF:"), nil
+}
+
+func playlistLines(playlist []byte) ([]string, string, error) {
+	newline := "\n"
+	if bytes.Contains(playlist, []byte("\r\n")) {
+		newline = "\r\n"
+	}
+	lines := strings.Split(strings.TrimRight(string(playlist), "\r\n"), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	if lines[0] != "#EXTM3U" {
+		return nil, "", fmt.Errorf("not an m3u8 playlist")
+	}
+	return lines, newline, nil
+}
+
+func hasTag(lines []string, tag string) bool {
+	for _, line := range lines {
+		if strings.HasPrefix(line, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewritePlaylist drops the Widevine tags of the given kind and inserts tags in front of the
+// first line starting with one of before, raising EXT-X-VERSION to what KEYFORMAT needs.
+func rewritePlaylist(lines []string, newline, kind string, tags []string, before ...string) []byte {
+	out := []string{lines[0]}
+	if !hasTag(lines, "#EXT-X-VERSION:") {
+		out = append(out, "#EXT-X-VERSION:"+strconv.Itoa(hlsKeyFormatVersion))
+	}
+	inserted := false
+	for _, line := range lines[1:] {
+		if strings.HasPrefix(line, kind) && strings.Contains(line, `KEYFORMAT="`+WidevineKeyFormat+`"`) {
+			continue
+		}
+		if strings.HasPrefix(line, "#EXT-X-VERSION:") {
+			if v, err := strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-VERSION:")); err == nil && v < hlsKeyFormatVersion {
+				line = "#EXT-X-VERSION:" + strconv.Itoa(hlsKeyFormatVersion)
+			}
+		}
+		if !inserted {
+			for _, prefix := range before {
+				if strings.HasPrefix(line, prefix) {
+					out = append(out, tags...)
+					inserted = true
+					break
+				}
+			}
+		}
+		out = append(out, line)
+	}
+	if !inserted {
+		out = append(out, tags...)
+	}
+	return []byte(strings.Join(out, newline) + newline)
+}
@@ -0,0 +1,102 @@
+package widevineproxy
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/Cooomma/widevine-proxy/pssh"
+	"github.com/stretchr/testify/assert"
+)
+
+const testMediaPlaylist = `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:6
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:6.000,
+segment-1.m4s
+#EXTINF:6.000,
+segment-2.m4s
+#EXT-X-ENDLIST
+`
+
+const testMasterPlaylist = "#EXTM3U\r\n" +
+	"#EXT-X-VERSION:6\r\n" +
+	"#EXT-X-INDEPENDENT-SEGMENTS\r\n" +
+	"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"en\",URI=\"audio.m3u8\"\r\n" +
+	"#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080,AUDIO=\"audio\"\r\n" +
+	"video.m3u8\r\n"
+
+func TestHLSKey(t *testing.T) {
+	keys, err := HLSKeysFromResponse(testContentKeyResponse(), HLSMethodSampleAESCTR)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+
+	hd := keys["HD"]
+	box, err := pssh.Parse(hd.PSSH)
+	assert.NoError(t, err)
+	assert.Equal(t, pssh.WidevineSystemID, box.SystemID)
+
+	assert.Equal(t, `#EXT-X-KEY:METHOD=SAMPLE-AES-CTR,URI="data:text/plain;base64,`+base64.StdEncoding.EncodeToString(hd.PSSH)+
+		`",KEYID=0x000102030405060708090A0B0C0D0E0F,KEYFORMAT="urn:uuid:edef8ba9-79d6-4ace-a3c8-27dcd51d21ed",KEYFORMATVERSIONS="1"`, hd.KeyTag())
+	assert.True(t, strings.HasPrefix(hd.SessionKeyTag(), "#EXT-X-SESSION-KEY:METHOD=SAMPLE-AES-CTR,"))
+	assert.True(t, strings.HasPrefix(HLSKey{}.KeyTag(), "#EXT-X-KEY:METHOD=SAMPLE-AES,"))
+}
+
+func TestRewriteMediaPlaylist(t *testing.T) {
+	keys, _ := HLSKeysFromResponse(testContentKeyResponse(), "")
+
+	out, err := RewriteMediaPlaylist([]byte(testMediaPlaylist), keys["HD"])
+	assert.NoError(t, err)
+	assert.Equal(t, "#EXTM3U\n"+
+		"#EXT-X-VERSION:5\n"+
+		"#EXT-X-TARGETDURATION:6\n"+
+		"#EXT-X-PLAYLIST-TYPE:VOD\n"+
+		keys["HD"].KeyTag()+"\n"+
+		"#EXT-X-MAP:URI=\"init.mp4\"\n"+
+		"#EXTINF:6.000,\n"+
+		"segment-1.m4s\n"+
+		"#EXTINF:6.000,\n"+
+		"segment-2.m4s\n"+
+		"#EXT-X-ENDLIST\n", string(out))
+
+	// Rewriting again replaces the Widevine key.
+	again, err := RewriteMediaPlaylist(out, keys["AUDIO"])
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(again), "#EXT-X-KEY:"))
+	assert.Contains(t, string(again), keys["AUDIO"].KeyTag())
+
+	_, err = RewriteMediaPlaylist([]byte(testMasterPlaylist), keys["HD"])
+	assert.Error(t, err)
+	_, err = RewriteMediaPlaylist([]byte("segment-1.m4s\n"), keys["HD"])
+	assert.Error(t, err)
+}
+
+func TestRewriteMasterPlaylist(t *testing.T) {
+	keys, _ := HLSKeysFromResponse(testContentKeyResponse(), "")
+
+	out, err := RewriteMasterPlaylist([]byte(testMasterPlaylist), []HLSKey{keys["HD"], keys["AUDIO"], keys["HD"]})
+	assert.NoError(t, err)
+	assert.Equal(t, "#EXTM3U\r\n"+
+		"#EXT-X-VERSION:6\r\n"+
+		"#EXT-X-INDEPENDENT-SEGMENTS\r\n"+
+		keys["HD"].SessionKeyTag()+"\r\n"+
+		keys["AUDIO"].SessionKeyTag()+"\r\n"+
+		"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"en\",URI=\"audio.m3u8\"\r\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080,AUDIO=\"audio\"\r\n"+
+		"video.m3u8\r\n", string(out))
+
+	again, err := RewriteMasterPlaylist(out, []HLSKey{keys["HD"], keys["AUDIO"]})
+	assert.NoError(t, err)
+	assert.Equal(t, string(out), string(again))
+
+	_, err = RewriteMasterPlaylist([]byte(testMediaPlaylist), nil)
+	assert.Error(t, err)
+}
+
+func TestRewritePlaylistWithoutVersion(t *testing.T) {
+	out, err := RewriteMediaPlaylist([]byte("#EXTM3U\n#EXTINF:6.000,\nsegment-1.ts\n"), HLSKey{})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "#EXTM3U\n#EXT-X-VERSION:5\n#EXT-X-KEY:"))
+}
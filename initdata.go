@@ -0,0 +1,154 @@
+package widevineproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/Cooomma/widevine-proxy/pssh"
+)
+
+// DRM types, as named in content key requests.
+const (
+	DRMTypeWidevine  = "WIDEVINE"
+	DRMTypePlayReady = "PLAYREADY"
+	DRMTypeCommon    = "COMMON"
+)
+
+// ProtectionSystemData is the init data of one DRM system for a title.
+type ProtectionSystemData struct {
+	DRMType  string
+	SystemID pssh.SystemID
+	KeyIDs   [][]byte
+	// PSSH is the encoded pssh box.
+	PSSH []byte
+	// Data is the protection system specific data of the box,
+	// e.g. the PlayReady Header Object for the DASH mspr:pro element.
+	Data []byte
+}
+
+// InitDataOptions selects the init data generated by InitData.
+type InitDataOptions struct {
+	// DRMTypes defaults to Widevine, PlayReady and Common.
+	DRMTypes         []string
+	ProtectionScheme pssh.ProtectionScheme
+	PolicyConfig     map[string]string
+
+	PlayReadyVersion    pssh.PlayReadyVersion
+	PlayReadyLicenseURL string
+}
+
+// InitData generates the protection system data of every requested DRM system for a title
+// from the key IDs of the KeyGoverner. The key IDs are the ones of the content key specs,
+// or the content key ID when the KeyGoverner has no specs for the content.
+func (wp *Proxy) InitData(contentID string, opts InitDataOptions) ([]ProtectionSystemData, error) {
+	return wp.InitDataContext(context.Background(), contentID, opts)
+}
+
+// InitDataContext is InitData with a context for the key lookups.
+func (wp *Proxy) InitDataContext(ctx context.Context, contentID string, opts InitDataOptions) ([]ProtectionSystemData, error) {
+	keys, err := wp.initDataKeys(ctx, contentID, opts.PolicyConfig)
+	if err != nil {
+		return nil, err
+	}
+	return wp.initDataSystems(contentID, keys, opts)
+}
+
+func (wp *Proxy) initDataSystems(contentID string, keys []pssh.PlayReadyKey, opts InitDataOptions) ([]ProtectionSystemData, error) {
+	var keyIDs [][]byte
+	for _, key := range keys {
+		keyIDs = append(keyIDs, key.KeyID)
+	}
+
+	drmTypes := opts.DRMTypes
+	if len(drmTypes) == 0 {
+		drmTypes = []string{DRMTypeWidevine, DRMTypePlayReady, DRMTypeCommon}
+	}
+
+	var systems []ProtectionSystemData
+	for _, drmType := range drmTypes {
+		var box *pssh.Box
+		switch drmType {
+		case DRMTypeWidevine:
+			data := &pssh.WidevineData{
+				KeyIDs:           keyIDs,
+				Provider:         wp.Provider,
+				ContentID:        []byte(contentID),
+				ProtectionScheme: opts.ProtectionScheme,
+			}
+			box = data.Box(0)
+		case DRMTypePlayReady:
+			header := &pssh.PlayReadyHeader{
+				Version:    opts.PlayReadyVersion,
+				Keys:       append([]pssh.PlayReadyKey{}, keys...),
+				LicenseURL: opts.PlayReadyLicenseURL,
+			}
+			if opts.ProtectionScheme == pssh.SchemeCBCS || opts.ProtectionScheme == pssh.SchemeCBC1 {
+				for i := range header.Keys {
+					header.Keys[i].Algorithm = pssh.PlayReadyAESCBC
+				}
+			}
+			var err error
+			box, err = header.Box(0)
+			if err != nil {
+				return nil, fmt.Errorf("playready: %v", err)
+			}
+		case DRMTypeCommon:
+			box = pssh.CommonBox(keyIDs)
+		default:
+			return nil, fmt.Errorf("unsupported DRM type %q", drmType)
+		}
+
+		b, err := box.Marshal()
+		if err != nil {
+			return nil, fmt.Errorf("%s pssh: %v", drmType, err)
+		}
+		systems = append(systems, ProtectionSystemData{
+			DRMType:  drmType,
+			SystemID: box.SystemID,
+			KeyIDs:   keyIDs,
+			PSSH:     b,
+			Data:     box.Data,
+		})
+	}
+	return systems, nil
+}
+
+func (wp *Proxy) initDataKeys(ctx context.Context, contentID string, policyConfig map[string]string) ([]pssh.PlayReadyKey, error) {
+	cid := []byte(contentID)
+	specs, err := wp.contentKeySpecs(ctx, cid, policyConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(specs) == 0 {
+		kid, err := wp.keys().ContentKeyID(ctx, cid)
+		if err != nil {
+			return nil, err
+		}
+		if len(kid) != 16 {
+			return nil, fmt.Errorf("content key ID must be 16 bytes, got %d", len(kid))
+		}
+		key, err := wp.keys().ContentKey(ctx, cid)
+		if err != nil {
+			return nil, err
+		}
+		return []pssh.PlayReadyKey{{KeyID: kid, Key: key}}, nil
+	}
+
+	var keys []pssh.PlayReadyKey
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		if seen[spec.KeyID] {
+			continue
+		}
+		seen[spec.KeyID] = true
+		if err := spec.Validate(); err != nil {
+			return nil, err
+		}
+		kid, _ := base64.StdEncoding.DecodeString(spec.KeyID)
+		key, _ := base64.StdEncoding.DecodeString(spec.Key)
+		keys = append(keys, pssh.PlayReadyKey{KeyID: kid, Key: key})
+	}
+	return keys, nil
+}
@@ -0,0 +1,105 @@
+package widevineproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/Cooomma/widevine-proxy/pssh"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type FakeMultiKeyGoverner struct {
+	FakeKeyGoverner
+}
+
+func (FakeMultiKeyGoverner) GenerateContentKeySpec(contentID []byte, policyConfig map[string]string) (*[]ContentKeySpec, error) {
+	cks := []ContentKeySpec{
+		{KeyID: "AAECAwQFBgcICQoLDA0ODw==", Key: "ASNFZ4mrze8BI0VniavN7w==", TrackType: "SD"},
+		{KeyID: "EBESExQVFhcYGRobHB0eHw==", Key: "ASNFZ4mrze8BI0VniavN7w==", TrackType: "HD"},
+		{KeyID: "AAECAwQFBgcICQoLDA0ODw==", Key: "ASNFZ4mrze8BI0VniavN7w==", TrackType: "AUDIO"},
+	}
+	return &cks, nil
+}
+
+func TestInitData(t *testing.T) {
+	wv := NewWidevineProxy(nil, nil, "widevine_test", FakeMultiKeyGoverner{}, logrus.New())
+
+	systems, err := wv.InitData("testing", InitDataOptions{
+		ProtectionScheme:    pssh.SchemeCBCS,
+		PlayReadyLicenseURL: "https://pr.example.com/rightsmanager.asmx",
+	})
+	assert.NoError(t, err)
+	assert.Len(t, systems, 3)
+
+	kid1, _ := base64.StdEncoding.DecodeString("AAECAwQFBgcICQoLDA0ODw==")
+	kid2, _ := base64.StdEncoding.DecodeString("EBESExQVFhcYGRobHB0eHw==")
+	for _, system := range systems {
+		assert.Equal(t, [][]byte{kid1, kid2}, system.KeyIDs)
+		box, err := pssh.Parse(system.PSSH)
+		assert.NoError(t, err)
+		assert.Equal(t, system.SystemID, box.SystemID)
+		assert.True(t, bytes.Equal(system.Data, box.Data))
+	}
+
+	assert.Equal(t, DRMTypeWidevine, systems[0].DRMType)
+	data, err := pssh.ParseWidevine(systems[0].PSSH)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{kid1, kid2}, data.KeyIDs)
+	assert.Equal(t, pssh.SchemeCBCS, data.ProtectionScheme)
+	assert.Equal(t, "widevine_test", data.Provider)
+
+	assert.Equal(t, DRMTypePlayReady, systems[1].DRMType)
+	assert.Equal(t, pssh.PlayReadySystemID, systems[1].SystemID)
+	header, _ := (&pssh.PlayReadyHeader{
+		Keys:       []pssh.PlayReadyKey{{KeyID: kid1, Algorithm: pssh.PlayReadyAESCBC}, {KeyID: kid2, Algorithm: pssh.PlayReadyAESCBC}},
+		LicenseURL: "https://pr.example.com/rightsmanager.asmx",
+	}).Object()
+	assert.Equal(t, header, systems[1].Data)
+
+	assert.Equal(t, DRMTypeCommon, systems[2].DRMType)
+	assert.Equal(t, pssh.CommonSystemID, systems[2].SystemID)
+}
+
+func TestInitDataContentKeyID(t *testing.T) {
+	kg := FakeKeyGovernerWithoutSpecs{}
+	wv := NewWidevineProxy(nil, nil, "widevine_test", kg, logrus.New())
+
+	systems, err := wv.InitData("testing", InitDataOptions{DRMTypes: []string{DRMTypeCommon}})
+	assert.NoError(t, err)
+	assert.Len(t, systems, 1)
+	assert.Equal(t, [][]byte{kg.GenerateContentKeyID([]byte("testing"))}, systems[0].KeyIDs)
+
+	_, err = wv.InitData("testing", InitDataOptions{DRMTypes: []string{"FAIRPLAY"}})
+	assert.Error(t, err)
+}
+
+func TestInitDataContext(t *testing.T) {
+	wv := NewWidevineProxy(nil, nil, "widevine_test", nil, logrus.New())
+	wv.KeyProvider = contextKeyProvider{KeyGovernerProvider{FakeKeyGovernerWithoutSpecs{}}}
+
+	systems, err := wv.InitDataContext(context.Background(), "testing", InitDataOptions{DRMTypes: []string{DRMTypeCommon}})
+	assert.NoError(t, err)
+	assert.Len(t, systems, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = wv.InitDataContext(ctx, "testing", InitDataOptions{})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestInitDataInvalidKeyID(t *testing.T) {
+	wv := NewWidevineProxy(nil, nil, "widevine_test", FakeMalformedKeyGoverner{}, logrus.New())
+	_, err := wv.InitData("testing", InitDataOptions{})
+	assert.Error(t, err)
+}
+
+type FakeKeyGovernerWithoutSpecs struct {
+	FakeKeyGoverner
+}
+
+func (FakeKeyGovernerWithoutSpecs) GenerateContentKeySpec(contentID []byte, policyConfig map[string]string) (*[]ContentKeySpec, error) {
+	return nil, nil
+}
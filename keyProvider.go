@@ -0,0 +1,161 @@
+package widevineproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+)
+
+// KeyProvider supplies content keys like a KeyGoverner, with a context for the lookup
+// and an error when a key cannot be provided.
+type KeyProvider interface {
+	ContentKeyID(ctx context.Context, contentID []byte) ([]byte, error)
+	ContentKey(ctx context.Context, contentID []byte) ([]byte, error)
+	ContentIV(ctx context.Context, contentID []byte) ([]byte, error)
+	ContentKeySpecs(ctx context.Context, contentID []byte, policyConfig map[string]string) ([]ContentKeySpec, error)
+}
+
+// KeyGovernerProvider adapts a KeyGoverner to a KeyProvider. A nil key from the KeyGoverner is an error.
+type KeyGovernerProvider struct {
+	KeyGoverner KeyGoverner
+}
+
+// ContentKeyID returns the content key ID of the KeyGoverner.
+func (p KeyGovernerProvider) ContentKeyID(ctx context.Context, contentID []byte) ([]byte, error) {
+	return nonEmpty("content key ID", contentID, p.KeyGoverner.GenerateContentKeyID(contentID))
+}
+
+// ContentKey returns the content key of the KeyGoverner.
+func (p KeyGovernerProvider) ContentKey(ctx context.Context, contentID []byte) ([]byte, error) {
+	return nonEmpty("content key", contentID, p.KeyGoverner.GenerateContentKey(contentID))
+}
+
+// ContentIV returns the content IV of the KeyGoverner.
+func (p KeyGovernerProvider) ContentIV(ctx context.Context, contentID []byte) ([]byte, error) {
+	return nonEmpty("content IV", contentID, p.KeyGoverner.GenerateContentIV(contentID))
+}
+
+// ContentKeySpecs returns the content key specs of the KeyGoverner.
+func (p KeyGovernerProvider) ContentKeySpecs(ctx context.Context, contentID []byte, policyConfig map[string]string) ([]ContentKeySpec, error) {
+	specs, err := p.KeyGoverner.GenerateContentKeySpec(contentID, policyConfig)
+	if err != nil || specs == nil {
+		return nil, err
+	}
+	return *specs, nil
+}
+
+func nonEmpty(name string, contentID, b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("no %s for content %q", name, contentID)
+	}
+	return b, nil
+}
+
+// keys returns the KeyProvider of the proxy, adapting the ContentKeyGenerator when none is set.
+func (wp *Proxy) keys() KeyProvider {
+	if wp.KeyProvider != nil {
+		return wp.KeyProvider
+	}
+	return KeyGovernerProvider{KeyGoverner: wp.ContentKeyGenerator}
+}
+
+// contentKeySpecs returns the content key specs of the content that encrypt samples, leaving out
+// its entitlement keys: those only license the crypto period keys of key rotation.
+func (wp *Proxy) contentKeySpecs(ctx context.Context, contentID []byte, policyConfig map[string]string) ([]ContentKeySpec, error) {
+	specs, err := wp.keys().ContentKeySpecs(ctx, contentID, policyConfig)
+	if err != nil {
+		return nil, err
+	}
+	var contentSpecs []ContentKeySpec
+	for _, spec := range specs {
+		if spec.KeyType != KeyTypeEntitlement {
+			contentSpecs = append(contentSpecs, spec)
+		}
+	}
+	return contentSpecs, nil
+}
+
+// trackKeys returns a lookup of the key of a track type of the content: the content key spec
+// of the track type, or the content key when there is none. The specs and the content key are
+// only asked for once, and the content key only when needed.
+func (wp *Proxy) trackKeys(ctx context.Context, contentID string, policyConfig map[string]string) func(trackType string) (StoredKey, error) {
+	var specs []ContentKeySpec
+	var contentKey *StoredKey
+	specsLoaded := false
+	cid := []byte(contentID)
+
+	return func(trackType string) (StoredKey, error) {
+		if !specsLoaded {
+			var err error
+			if specs, err = wp.contentKeySpecs(ctx, cid, policyConfig); err != nil {
+				return StoredKey{}, err
+			}
+			specsLoaded = true
+		}
+		for _, spec := range specs {
+			if spec.TrackType != trackType || trackType == "" {
+				continue
+			}
+			if err := spec.Validate(); err != nil {
+				return StoredKey{}, err
+			}
+			key := StoredKey{TrackType: trackType}
+			key.KeyID, _ = base64.StdEncoding.DecodeString(spec.KeyID)
+			key.Key, _ = base64.StdEncoding.DecodeString(spec.Key)
+			key.IV, _ = base64.StdEncoding.DecodeString(spec.IV)
+			return key, nil
+		}
+
+		if contentKey == nil {
+			kid, err := wp.keys().ContentKeyID(ctx, cid)
+			if err != nil {
+				return StoredKey{}, err
+			}
+			key, err := wp.keys().ContentKey(ctx, cid)
+			if err != nil {
+				return StoredKey{}, err
+			}
+			iv, err := wp.keys().ContentIV(ctx, cid)
+			if err != nil {
+				return StoredKey{}, err
+			}
+			if len(kid) != 16 || len(key) != 16 {
+				return StoredKey{}, fmt.Errorf("content key and key ID must be 16 bytes, got %d and %d", len(key), len(kid))
+			}
+			contentKey = &StoredKey{KeyID: kid, Key: key, IV: iv}
+		}
+		key := *contentKey
+		key.TrackType = trackType
+		return key, nil
+	}
+}
+
+// Validate checks that the key ID and key of the spec are 16 bytes and the IV, when set, 8 or 16 bytes.
+func (spec ContentKeySpec) Validate() error {
+	name := spec.TrackType + " track"
+	if spec.TrackType == "" {
+		name = "content key"
+	}
+	kid, err := base64.StdEncoding.DecodeString(spec.KeyID)
+	if err != nil || len(kid) != 16 {
+		return fmt.Errorf("%s: invalid key ID %q", name, spec.KeyID)
+	}
+	key, err := base64.StdEncoding.DecodeString(spec.Key)
+	if err != nil {
+		return fmt.Errorf("%s: invalid key: %v", name, err)
+	}
+	size := 16
+	if spec.KeyType == KeyTypeEntitlement {
+		size = 32
+	}
+	if len(key) != size {
+		return fmt.Errorf("%s: key must be %d bytes, got %d", name, size, len(key))
+	}
+	if spec.IV != "" {
+		iv, err := base64.StdEncoding.DecodeString(spec.IV)
+		if err != nil || (len(iv) != 8 && len(iv) != 16) {
+			return fmt.Errorf("%s: IV must be 8 or 16 bytes", name)
+		}
+	}
+	return nil
+}
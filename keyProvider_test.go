@@ -0,0 +1,147 @@
+package widevineproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// FakeMalformedKeyGoverner returns specs that are not base64 encoded keys.
+type FakeMalformedKeyGoverner struct {
+	FakeKeyGoverner
+}
+
+func (FakeMalformedKeyGoverner) GenerateContentKeySpec(contentID []byte, policyConfig map[string]string) (*[]ContentKeySpec, error) {
+	return &[]ContentKeySpec{{KeyID: "base64EncodedString", Key: "base64EncodedString", IV: "base64EncodedString", TrackType: "SD"}}, nil
+}
+
+// FakeMissingKeyGoverner fails its lookups silently, like a KeyGoverner losing its key store.
+type FakeMissingKeyGoverner struct {
+	FakeKeyGoverner
+}
+
+func (FakeMissingKeyGoverner) GenerateContentKey(contentID []byte) []byte {
+	return nil
+}
+
+func (FakeMissingKeyGoverner) GenerateContentKeySpec(contentID []byte, policyConfig map[string]string) (*[]ContentKeySpec, error) {
+	return nil, nil
+}
+
+// contextKeyProvider fails its lookups once their context is done, like a key store honoring deadlines.
+type contextKeyProvider struct {
+	KeyGovernerProvider
+}
+
+func (p contextKeyProvider) ContentKeyID(ctx context.Context, contentID []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return p.KeyGovernerProvider.ContentKeyID(ctx, contentID)
+}
+
+func (p contextKeyProvider) ContentKeySpecs(ctx context.Context, contentID []byte, policyConfig map[string]string) ([]ContentKeySpec, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return p.KeyGovernerProvider.ContentKeySpecs(ctx, contentID, policyConfig)
+}
+
+type fakeKeyProvider struct {
+	KeyGovernerProvider
+	err error
+}
+
+func (p fakeKeyProvider) ContentKey(ctx context.Context, contentID []byte) ([]byte, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return []byte("0123456789abcdef"), nil
+}
+
+func TestKeyGovernerProvider(t *testing.T) {
+	p := KeyGovernerProvider{KeyGoverner: FakeKeyGoverner{}}
+	ctx := context.Background()
+
+	key, err := p.ContentKey(ctx, []byte("testing"))
+	assert.NoError(t, err)
+	assert.Equal(t, FakeKeyGoverner{}.GenerateContentKey([]byte("testing")), key)
+
+	specs, err := p.ContentKeySpecs(ctx, []byte("testing"), nil)
+	assert.NoError(t, err)
+	assert.Len(t, specs, 1)
+
+	p = KeyGovernerProvider{KeyGoverner: FakeMissingKeyGoverner{}}
+	_, err = p.ContentKey(ctx, []byte("testing"))
+	assert.EqualError(t, err, `no content key for content "testing"`)
+
+	p = KeyGovernerProvider{KeyGoverner: FakeKeyGovernerWithoutSpecs{}}
+	specs, err = p.ContentKeySpecs(ctx, []byte("testing"), nil)
+	assert.NoError(t, err)
+	assert.Empty(t, specs)
+}
+
+func TestContentKeySpecValidate(t *testing.T) {
+	b64 := func(n int) string { return base64.StdEncoding.EncodeToString(make([]byte, n)) }
+
+	assert.NoError(t, ContentKeySpec{KeyID: b64(16), Key: b64(16), IV: b64(16), TrackType: "SD"}.Validate())
+	assert.NoError(t, ContentKeySpec{KeyID: b64(16), Key: b64(16), IV: b64(8)}.Validate())
+	assert.NoError(t, ContentKeySpec{KeyID: b64(16), Key: b64(32), KeyType: KeyTypeEntitlement}.Validate())
+
+	assert.EqualError(t, ContentKeySpec{KeyID: b64(16), TrackType: "HD"}.Validate(), "HD track: key must be 16 bytes, got 0")
+	assert.EqualError(t, ContentKeySpec{KeyID: b64(16), Key: b64(16), KeyType: KeyTypeEntitlement}.Validate(), "content key: key must be 32 bytes, got 16")
+	assert.EqualError(t, ContentKeySpec{KeyID: b64(8), Key: b64(16)}.Validate(), `content key: invalid key ID "AAAAAAAAAAA="`)
+	assert.EqualError(t, ContentKeySpec{KeyID: b64(16), Key: b64(16), IV: b64(12)}.Validate(), "content key: IV must be 8 or 16 bytes")
+	assert.Error(t, ContentKeySpec{KeyID: b64(16), Key: "base64EncodedString"}.Validate())
+}
+
+func TestBuildLicenseMessageRefusesMissingKey(t *testing.T) {
+	wp := NewWidevineProxy(nil, nil, "widevine_test", FakeMissingKeyGoverner{}, logrus.New())
+	_, err := wp.buildLicenseMessage(context.Background(), "testing", "")
+	assert.EqualError(t, err, `no content key for content "testing"`)
+
+	_, err = wp.GetLicense("testing", "")
+	assert.Error(t, err)
+}
+
+func TestLicenseKeySpecs(t *testing.T) {
+	wp := NewWidevineProxy(nil, nil, "widevine_test", FakeMultiKeyGoverner{}, logrus.New())
+	ctx := context.Background()
+
+	// Licenses carry the key IDs the proxy hands packagers.
+	specs, err := wp.licenseKeySpecs(ctx, []byte("testing"))
+	assert.NoError(t, err)
+	expected, _ := FakeMultiKeyGoverner{}.GenerateContentKeySpec([]byte("testing"), nil)
+	assert.Equal(t, *expected, specs)
+
+	wp.ContentKeyGenerator = FakeKeyGovernerWithoutSpecs{}
+	specs, err = wp.licenseKeySpecs(ctx, []byte("testing"))
+	assert.NoError(t, err)
+	lookup := wp.trackKeys(ctx, "testing", nil)
+	key, err := lookup("SD")
+	assert.NoError(t, err)
+	assert.Equal(t, []ContentKeySpec{{
+		KeyID: base64.StdEncoding.EncodeToString(key.KeyID),
+		Key:   base64.StdEncoding.EncodeToString(key.Key),
+	}}, specs)
+}
+
+func TestBuildLicenseMessageKeyProvider(t *testing.T) {
+	key, _ := hex.DecodeString(testKey)
+	iv, _ := hex.DecodeString(testIV)
+	wp := NewWidevineProxy(key, iv, "widevine_test", FakeMissingKeyGoverner{}, logrus.New())
+	wp.KeyProvider = fakeKeyProvider{KeyGovernerProvider: KeyGovernerProvider{KeyGoverner: FakeKeyGovernerWithoutSpecs{}}}
+
+	msg, err := wp.buildLicenseMessage(context.Background(), "testing", "")
+	assert.NoError(t, err)
+	assert.NotNil(t, msg)
+
+	wp.KeyProvider = fakeKeyProvider{KeyGovernerProvider: KeyGovernerProvider{KeyGoverner: FakeKeyGovernerWithoutSpecs{}}, err: errors.New("key store unavailable")}
+	_, err = wp.buildLicenseMessage(context.Background(), "testing", "")
+	assert.EqualError(t, err, "key store unavailable")
+}
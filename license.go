@@ -0,0 +1,323 @@
+package widevineproxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/Cooomma/widevine-proxy/internal/wire"
+	"github.com/Cooomma/widevine-proxy/pssh"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// KeyContainerType is the type of a license key container, unrelated to the KeyType of a ContentKeySpec.
+type KeyContainerType int
+
+// Key container types.
+const (
+	KeyContainerSigning         KeyContainerType = 1
+	KeyContainerContent         KeyContainerType = 2
+	KeyContainerKeyControl      KeyContainerType = 3
+	KeyContainerOperatorSession KeyContainerType = 4
+	KeyContainerEntitlement     KeyContainerType = 5
+	KeyContainerOEMContent      KeyContainerType = 6
+)
+
+func (t KeyContainerType) String() string {
+	switch t {
+	case KeyContainerSigning:
+		return "SIGNING"
+	case KeyContainerContent:
+		return "CONTENT"
+	case KeyContainerKeyControl:
+		return "KEY_CONTROL"
+	case KeyContainerOperatorSession:
+		return "OPERATOR_SESSION"
+	case KeyContainerEntitlement:
+		return "ENTITLEMENT"
+	case KeyContainerOEMContent:
+		return "OEM_CONTENT"
+	}
+	return fmt.Sprintf("KeyContainerType(%d)", int(t))
+}
+
+// SecurityLevel is the robustness a key requires from the CDM.
+type SecurityLevel int
+
+// Security levels.
+const (
+	SecurityLevelSWSecureCrypto SecurityLevel = 1
+	SecurityLevelSWSecureDecode SecurityLevel = 2
+	SecurityLevelHWSecureCrypto SecurityLevel = 3
+	SecurityLevelHWSecureDecode SecurityLevel = 4
+	SecurityLevelHWSecureAll    SecurityLevel = 5
+)
+
+func (l SecurityLevel) String() string {
+	switch l {
+	case SecurityLevelSWSecureCrypto:
+		return "SW_SECURE_CRYPTO"
+	case SecurityLevelSWSecureDecode:
+		return "SW_SECURE_DECODE"
+	case SecurityLevelHWSecureCrypto:
+		return "HW_SECURE_CRYPTO"
+	case SecurityLevelHWSecureDecode:
+		return "HW_SECURE_DECODE"
+	case SecurityLevelHWSecureAll:
+		return "HW_SECURE_ALL"
+	}
+	return fmt.Sprintf("SecurityLevel(%d)", int(l))
+}
+
+// HDCPVersion is an HDCP version of the output protection.
+type HDCPVersion int
+
+// HDCP versions.
+const (
+	HDCPNone            HDCPVersion = 0
+	HDCPV1              HDCPVersion = 1
+	HDCPV2              HDCPVersion = 2
+	HDCPV21             HDCPVersion = 3
+	HDCPV22             HDCPVersion = 4
+	HDCPV23             HDCPVersion = 5
+	HDCPNoDigitalOutput HDCPVersion = 0xff
+)
+
+func (v HDCPVersion) String() string {
+	switch v {
+	case HDCPNone:
+		return "HDCP_NONE"
+	case HDCPV1:
+		return "HDCP_V1"
+	case HDCPV2:
+		return "HDCP_V2"
+	case HDCPV21:
+		return "HDCP_V2_1"
+	case HDCPV22:
+		return "HDCP_V2_2"
+	case HDCPV23:
+		return "HDCP_V2_3"
+	case HDCPNoDigitalOutput:
+		return "HDCP_NO_DIGITAL_OUTPUT"
+	}
+	return fmt.Sprintf("HDCPVersion(%d)", int(v))
+}
+
+// License is a Widevine license decoded locally. Key material stays encrypted and is not exposed.
+type License struct {
+	ID               LicenseIdentification
+	Policy           LicensePolicy
+	Keys             []KeyContainer
+	StartTime        time.Time
+	ProtectionScheme pssh.ProtectionScheme
+	Signature        []byte
+}
+
+// LicenseIdentification identifies a license.
+type LicenseIdentification struct {
+	RequestID            []byte
+	SessionID            []byte
+	PurchaseID           []byte
+	Type                 LicenseType
+	Version              int32
+	ProviderSessionToken []byte
+}
+
+// LicensePolicy is the playback policy of a license.
+type LicensePolicy struct {
+	CanPlay                     bool
+	CanPersist                  bool
+	CanRenew                    bool
+	RentalDuration              time.Duration
+	PlaybackDuration            time.Duration
+	LicenseDuration             time.Duration
+	RenewalRecoveryDuration     time.Duration
+	RenewalServerURL            string
+	RenewalDelay                time.Duration
+	RenewalRetryInterval        time.Duration
+	RenewWithUsage              bool
+	AlwaysIncludeClientID       bool
+	PlayStartGracePeriod        time.Duration
+	SoftEnforcePlaybackDuration bool
+	SoftEnforceRentalDuration   bool
+}
+
+// KeyContainer is a key of a license, without its key material.
+type KeyContainer struct {
+	ID                  KeyID
+	Type                KeyContainerType
+	Level               SecurityLevel
+	RequiredProtection  *OutputProtection
+	RequestedProtection *OutputProtection
+	TrackLabel          string
+}
+
+// DecodeLicense decodes the license of the response.
+func (lr *LicenseResponse) DecodeLicense() (*License, error) {
+	b, err := base64.StdEncoding.DecodeString(lr.License)
+	if err != nil {
+		return nil, fmt.Errorf("decode license: %v", err)
+	}
+	return DecodeLicense(b)
+}
+
+// DecodeLicense parses a license, the SignedMessage protobuf the license server returns to the CDM.
+func DecodeLicense(license []byte) (*License, error) {
+	sm, err := decodeSignedMessage(license)
+	if err != nil {
+		return nil, err
+	}
+	if sm.Type != MessageTypeLicense {
+		return nil, fmt.Errorf("signed message is not a license: %s", sm.Type)
+	}
+
+	l := &License{Signature: sm.Signature}
+	err = wire.Walk(sm.Msg, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			return l.ID.decode(b)
+		case 2:
+			return l.Policy.decode(b)
+		case 3:
+			var key KeyContainer
+			if err := key.decode(b); err != nil {
+				return err
+			}
+			l.Keys = append(l.Keys, key)
+		case 4:
+			l.StartTime = time.Unix(int64(v), 0).UTC()
+		case 7:
+			l.ProtectionScheme = pssh.ProtectionScheme(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decode license: %v", err)
+	}
+	return l, nil
+}
+
+// ContentKeys returns the content key containers of the license.
+func (l *License) ContentKeys() []KeyContainer {
+	var keys []KeyContainer
+	for _, key := range l.Keys {
+		if key.Type == KeyContainerContent {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (id *LicenseIdentification) decode(msg []byte) error {
+	return wire.Walk(msg, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			id.RequestID = b
+		case 2:
+			id.SessionID = b
+		case 3:
+			id.PurchaseID = b
+		case 4:
+			id.Type = LicenseType(v)
+		case 5:
+			id.Version = int32(v)
+		case 6:
+			id.ProviderSessionToken = b
+		}
+		return nil
+	})
+}
+
+func (p *LicensePolicy) decode(msg []byte) error {
+	seconds := func(v uint64) time.Duration {
+		return time.Duration(int64(v)) * time.Second
+	}
+	return wire.Walk(msg, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			p.CanPlay = v != 0
+		case 2:
+			p.CanPersist = v != 0
+		case 3:
+			p.CanRenew = v != 0
+		case 4:
+			p.RentalDuration = seconds(v)
+		case 5:
+			p.PlaybackDuration = seconds(v)
+		case 6:
+			p.LicenseDuration = seconds(v)
+		case 7:
+			p.RenewalRecoveryDuration = seconds(v)
+		case 8:
+			p.RenewalServerURL = string(b)
+		case 9:
+			p.RenewalDelay = seconds(v)
+		case 10:
+			p.RenewalRetryInterval = seconds(v)
+		case 11:
+			p.RenewWithUsage = v != 0
+		case 12:
+			p.AlwaysIncludeClientID = v != 0
+		case 13:
+			p.PlayStartGracePeriod = seconds(v)
+		case 14:
+			p.SoftEnforcePlaybackDuration = v != 0
+		case 15:
+			p.SoftEnforceRentalDuration = v != 0
+		}
+		return nil
+	})
+}
+
+func (k *KeyContainer) decode(msg []byte) error {
+	return wire.Walk(msg, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		var err error
+		switch num {
+		case 1:
+			k.ID = b
+		case 4:
+			k.Type = KeyContainerType(v)
+		case 5:
+			k.Level = SecurityLevel(v)
+		case 6:
+			k.RequiredProtection, err = decodeOutputProtection(b)
+		case 7:
+			k.RequestedProtection, err = decodeOutputProtection(b)
+		case 12:
+			k.TrackLabel = string(b)
+		}
+		return err
+	})
+}
+
+func decodeOutputProtection(msg []byte) (*OutputProtection, error) {
+	op := &OutputProtection{HDCP: HDCPNone.String()}
+	err := wire.Walk(msg, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			op.HDCP = HDCPVersion(v).String()
+		case 2:
+			op.CGMSFlags = cgmsName(v)
+		case 4:
+			op.DisableAnalogOutput = v != 0
+		case 5:
+			op.DisableDigitalOutput = v != 0
+		}
+		return nil
+	})
+	return op, err
+}
+
+func cgmsName(v uint64) string {
+	switch v {
+	case 0:
+		return "COPY_FREE"
+	case 2:
+		return "COPY_ONCE"
+	case 3:
+		return "COPY_NEVER"
+	case 42:
+		return "CGMS_NONE"
+	}
+	return fmt.Sprintf("CGMS(%d)", v)
+}
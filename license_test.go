@@ -0,0 +1,101 @@
+package widevineproxy
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/Cooomma/widevine-proxy/internal/wire"
+	"github.com/Cooomma/widevine-proxy/pssh"
+	"github.com/stretchr/testify/assert"
+)
+
+func testLicense() []byte {
+	var id, policy, protection, signingKey, contentKey, license, signed []byte
+	id = wire.AppendBytes(id, 1, []byte("request"))
+	id = wire.AppendBytes(id, 2, []byte("session"))
+	id = wire.AppendVarint(id, 4, uint64(LicenseTypeOffline))
+	id = wire.AppendVarint(id, 5, 1)
+
+	policy = wire.AppendVarint(policy, 1, 1)
+	policy = wire.AppendVarint(policy, 2, 1)
+	policy = wire.AppendVarint(policy, 3, 1)
+	policy = wire.AppendVarint(policy, 4, 86400)
+	policy = wire.AppendVarint(policy, 5, 7200)
+	policy = wire.AppendVarint(policy, 6, 604800)
+	policy = wire.AppendBytes(policy, 8, []byte("https://license.example.com/renew"))
+	policy = wire.AppendVarint(policy, 9, 300)
+
+	protection = wire.AppendVarint(protection, 1, uint64(HDCPV22))
+	protection = wire.AppendVarint(protection, 2, 3)
+
+	signingKey = wire.AppendBytes(signingKey, 1, []byte("signing"))
+	signingKey = wire.AppendBytes(signingKey, 3, make([]byte, 80))
+	signingKey = wire.AppendVarint(signingKey, 4, uint64(KeyContainerSigning))
+
+	contentKey = wire.AppendBytes(contentKey, 1, []byte("0123456789abcdef"))
+	contentKey = wire.AppendBytes(contentKey, 2, make([]byte, 16))
+	contentKey = wire.AppendBytes(contentKey, 3, make([]byte, 32))
+	contentKey = wire.AppendVarint(contentKey, 4, uint64(KeyContainerContent))
+	contentKey = wire.AppendVarint(contentKey, 5, uint64(SecurityLevelHWSecureAll))
+	contentKey = wire.AppendBytes(contentKey, 6, protection)
+	contentKey = wire.AppendBytes(contentKey, 12, []byte("HD"))
+
+	license = wire.AppendBytes(license, 1, id)
+	license = wire.AppendBytes(license, 2, policy)
+	license = wire.AppendBytes(license, 3, signingKey)
+	license = wire.AppendBytes(license, 3, contentKey)
+	license = wire.AppendVarint(license, 4, 1576117132)
+	license = wire.AppendVarint(license, 7, uint64(pssh.SchemeCBCS))
+
+	signed = wire.AppendVarint(signed, 1, uint64(MessageTypeLicense))
+	signed = wire.AppendBytes(signed, 2, license)
+	signed = wire.AppendBytes(signed, 3, []byte("signature"))
+	return signed
+}
+
+func TestDecodeLicense(t *testing.T) {
+	lr := &LicenseResponse{License: base64.StdEncoding.EncodeToString(testLicense())}
+
+	l, err := lr.DecodeLicense()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("request"), l.ID.RequestID)
+	assert.Equal(t, []byte("session"), l.ID.SessionID)
+	assert.Equal(t, LicenseTypeOffline, l.ID.Type)
+	assert.Equal(t, int32(1), l.ID.Version)
+
+	assert.True(t, l.Policy.CanPlay)
+	assert.True(t, l.Policy.CanPersist)
+	assert.True(t, l.Policy.CanRenew)
+	assert.Equal(t, 24*time.Hour, l.Policy.RentalDuration)
+	assert.Equal(t, 2*time.Hour, l.Policy.PlaybackDuration)
+	assert.Equal(t, 7*24*time.Hour, l.Policy.LicenseDuration)
+	assert.Equal(t, "https://license.example.com/renew", l.Policy.RenewalServerURL)
+	assert.Equal(t, 5*time.Minute, l.Policy.RenewalDelay)
+
+	assert.Len(t, l.Keys, 2)
+	assert.Equal(t, KeyContainerSigning, l.Keys[0].Type)
+	keys := l.ContentKeys()
+	assert.Len(t, keys, 1)
+	assert.Equal(t, "30313233343536373839616263646566", keys[0].ID.String())
+	assert.Equal(t, "HW_SECURE_ALL", keys[0].Level.String())
+	assert.Equal(t, "HD", keys[0].TrackLabel)
+	assert.Equal(t, &OutputProtection{HDCP: "HDCP_V2_2", CGMSFlags: "COPY_NEVER"}, keys[0].RequiredProtection)
+	assert.Nil(t, keys[0].RequestedProtection)
+
+	assert.Equal(t, time.Date(2019, 12, 12, 2, 18, 52, 0, time.UTC), l.StartTime)
+	assert.Equal(t, pssh.SchemeCBCS, l.ProtectionScheme)
+	assert.Equal(t, []byte("signature"), l.Signature)
+}
+
+func TestDecodeLicenseErrors(t *testing.T) {
+	b, _ := base64.StdEncoding.DecodeString(testLicenseChallenge)
+	_, err := DecodeLicense(b)
+	assert.EqualError(t, err, "signed message is not a license: LICENSE_REQUEST")
+
+	_, err = DecodeLicense([]byte{0x12, 0x05, 0x01})
+	assert.Error(t, err)
+
+	_, err = (&LicenseResponse{License: "%"}).DecodeLicense()
+	assert.Error(t, err)
+}
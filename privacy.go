@@ -0,0 +1,140 @@
+package widevineproxy
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+)
+
+// ParseServicePrivateKey parses the PEM encoded RSA private key of the service certificate,
+// in PKCS #1 or PKCS #8 form.
+func ParseServicePrivateKey(b []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("service private key: no PEM block")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("service private key: %v", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("service private key: not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// Decrypt decrypts the client identification with the private key of the service certificate
+// it was encrypted to. The privacy key is RSA-OAEP wrapped, the client identification AES-CBC encrypted.
+func (e *EncryptedClientIdentification) Decrypt(key *rsa.PrivateKey) (*ClientIdentification, error) {
+	privacyKey, err := rsa.DecryptOAEP(sha1.New(), nil, key, e.EncryptedPrivacyKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt privacy key: %v", err)
+	}
+	if len(privacyKey) != 16 {
+		return nil, fmt.Errorf("privacy key must be 16 bytes, got %d", len(privacyKey))
+	}
+	if len(e.EncryptedClientIDIV) != aes.BlockSize {
+		return nil, fmt.Errorf("client identification IV must be %d bytes, got %d", aes.BlockSize, len(e.EncryptedClientIDIV))
+	}
+	if len(e.EncryptedClientID) == 0 || len(e.EncryptedClientID)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("encrypted client identification is not a multiple of the block size")
+	}
+
+	plainText, err := AESCBCDecrypt(privacyKey, e.EncryptedClientIDIV, e.EncryptedClientID)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt client identification: %v", err)
+	}
+	return decodeClientIdentification(plainText)
+}
+
+// DecryptClientID decrypts the client identification of a privacy mode challenge into ClientID.
+func (c *Challenge) DecryptClientID(key *rsa.PrivateKey) error {
+	if c.EncryptedClientID == nil {
+		return fmt.Errorf("client identification is not encrypted")
+	}
+	id, err := c.EncryptedClientID.Decrypt(key)
+	if err != nil {
+		return err
+	}
+	c.ClientID = id
+	return nil
+}
+
+// InspectChallenge decodes a base64 encoded challenge. With a ServicePrivateKey configured,
+// the client identification of privacy mode challenges is decrypted as well.
+func (wp *Proxy) InspectChallenge(body string) (*Challenge, error) {
+	b, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return nil, fmt.Errorf("decode challenge: %v", err)
+	}
+	c, err := DecodeChallenge(b)
+	if err != nil {
+		return nil, err
+	}
+	if c.EncryptedClientID == nil || wp.ServicePrivateKey == nil {
+		return c, nil
+	}
+
+	if serviceCertificate := wp.serviceCertificate(); serviceCertificate != nil {
+		serial := serviceCertificate.Certificate.SerialNumber
+		if !bytes.Equal(c.EncryptedClientID.ServiceCertificateSerialNumber, serial) {
+			return nil, fmt.Errorf("client identification is encrypted to service certificate %x, not %x",
+				c.EncryptedClientID.ServiceCertificateSerialNumber, serial)
+		}
+	}
+	if err := c.DecryptClientID(wp.ServicePrivateKey); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Info returns the value of a client info entry, e.g. company_name or model_name.
+func (id *ClientIdentification) Info(name string) string {
+	for _, info := range id.ClientInfo {
+		if info.Name == name {
+			return info.Value
+		}
+	}
+	return ""
+}
+
+// Make returns the device make the CDM reports.
+func (id *ClientIdentification) Make() string {
+	return id.Info("company_name")
+}
+
+// Model returns the device model the CDM reports.
+func (id *ClientIdentification) Model() string {
+	return id.Info("model_name")
+}
+
+// DeviceCertificate parses the DRM device certificate chain carried as the client token.
+func (id *ClientIdentification) DeviceCertificate() (*SignedDrmCertificate, error) {
+	if len(id.Token) == 0 {
+		return nil, fmt.Errorf("client identification has no token")
+	}
+	return parseSignedDrmCertificate(id.Token, 0)
+}
+
+// SystemID returns the Widevine system ID of the device certificate chain, or 0 when unknown.
+func (id *ClientIdentification) SystemID() uint32 {
+	cert, err := id.DeviceCertificate()
+	if err != nil {
+		return 0
+	}
+	for ; cert != nil; cert = cert.Signer {
+		if cert.Certificate.SystemID != 0 {
+			return cert.Certificate.SystemID
+		}
+	}
+	return 0
+}
@@ -0,0 +1,109 @@
+package widevineproxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+
+	"github.com/Cooomma/widevine-proxy/internal/wire"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// testPrivacyChallenge builds a challenge whose client identification is encrypted to serviceKey.
+func testPrivacyChallenge(t *testing.T, serviceKey *rsa.PrivateKey, serial []byte) string {
+	var cert, token, clientInfo, model, caps, clientID []byte
+	cert = wire.AppendVarint(cert, 1, uint64(DrmCertificateTypeDevice))
+	cert = wire.AppendBytes(cert, 2, []byte("device"))
+	cert = wire.AppendBytes(cert, 4, x509.MarshalPKCS1PublicKey(&serviceKey.PublicKey))
+	cert = wire.AppendVarint(cert, 5, 4464)
+	token = wire.AppendBytes(token, 1, cert)
+	token = wire.AppendBytes(token, 2, []byte("signature"))
+
+	clientInfo = wire.AppendBytes(clientInfo, 1, []byte("company_name"))
+	clientInfo = wire.AppendBytes(clientInfo, 2, []byte("Google"))
+	model = wire.AppendBytes(model, 1, []byte("model_name"))
+	model = wire.AppendBytes(model, 2, []byte("Pixel"))
+	caps = wire.AppendVarint(caps, 4, uint64(HDCPV23))
+	caps = wire.AppendVarint(caps, 5, 16)
+
+	clientID = wire.AppendVarint(clientID, 1, 1)
+	clientID = wire.AppendBytes(clientID, 2, token)
+	clientID = wire.AppendBytes(clientID, 3, clientInfo)
+	clientID = wire.AppendBytes(clientID, 3, model)
+	clientID = wire.AppendBytes(clientID, 6, caps)
+
+	privacyKey := make([]byte, 16)
+	iv := make([]byte, 16)
+	rand.Read(privacyKey)
+	rand.Read(iv)
+	block, _ := aes.NewCipher(privacyKey)
+	padded := PKCS5Padding(clientID, aes.BlockSize)
+	encrypted := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, padded)
+	wrapped, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, &serviceKey.PublicKey, privacyKey, nil)
+	assert.NoError(t, err)
+
+	var encryptedID, request []byte
+	encryptedID = wire.AppendBytes(encryptedID, 1, []byte("widevine_test"))
+	encryptedID = wire.AppendBytes(encryptedID, 2, serial)
+	encryptedID = wire.AppendBytes(encryptedID, 3, encrypted)
+	encryptedID = wire.AppendBytes(encryptedID, 4, iv)
+	encryptedID = wire.AppendBytes(encryptedID, 5, wrapped)
+	request = wire.AppendBytes(request, 8, encryptedID)
+	request = wire.AppendVarint(request, 3, uint64(RequestTypeNew))
+
+	sm := &signedMessage{Type: MessageTypeLicenseRequest, Msg: request}
+	return base64.StdEncoding.EncodeToString(sm.marshal())
+}
+
+func TestInspectChallengeDecryptsClientID(t *testing.T) {
+	serviceKey := testCertificateKey(t)
+	body := testPrivacyChallenge(t, serviceKey, []byte("service"))
+
+	wp := NewWidevineProxy(nil, nil, "widevine_test", nil, logrus.New())
+	c, err := wp.InspectChallenge(body)
+	assert.NoError(t, err)
+	assert.True(t, c.ClientIDEncrypted)
+	assert.Nil(t, c.ClientID)
+
+	wp.ServicePrivateKey = serviceKey
+	c, err = wp.InspectChallenge(body)
+	assert.NoError(t, err)
+	assert.Equal(t, "Google", c.ClientID.Make())
+	assert.Equal(t, "Pixel", c.ClientID.Model())
+	assert.Equal(t, uint32(4464), c.ClientID.SystemID())
+	assert.Equal(t, HDCPV23, c.ClientID.Capabilities.MaxHDCPVersion)
+	assert.Equal(t, uint32(16), c.ClientID.Capabilities.OEMCryptoAPIVersion)
+
+	wp.ServiceCertificate = &SignedDrmCertificate{Certificate: &DrmCertificate{SerialNumber: []byte("other")}}
+	_, err = wp.InspectChallenge(body)
+	assert.EqualError(t, err, "client identification is encrypted to service certificate 73657276696365, not 6f74686572")
+
+	wp.ServiceCertificate = nil
+	wp.ServicePrivateKey = testCertificateKey(t)
+	_, err = wp.InspectChallenge(body)
+	assert.Error(t, err)
+}
+
+func TestParseServicePrivateKey(t *testing.T) {
+	key := testCertificateKey(t)
+
+	parsed, err := ParseServicePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	assert.NoError(t, err)
+	assert.True(t, key.Equal(parsed))
+
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(key)
+	parsed, err = ParseServicePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}))
+	assert.NoError(t, err)
+	assert.True(t, key.Equal(parsed))
+
+	_, err = ParseServicePrivateKey([]byte("not a key"))
+	assert.EqualError(t, err, "service private key: no PEM block")
+}
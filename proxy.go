@@ -2,10 +2,11 @@ package widevineproxy
 
 import (
 	"bytes"
-	"crypto/md5"
-	"crypto/sha1"
+	"context"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -18,7 +19,7 @@ type LicenseResponse struct {
 	StatusMessage              string             `json:"status_message"`
 	License                    string             `json:"license"`
 	LicenseMetadata            LicenseMetadata    `json:"license_metadata"`
-	SupportedTracks            []interface{}      `json:"supported_tracks"`
+	SupportedTracks            []SupportedTrack   `json:"supported_tracks"`
 	Make                       string             `json:"make"`
 	Model                      string             `json:"model"`
 	SecurityLevel              int64              `json:"security_level"`
@@ -54,8 +55,41 @@ type LicenseMetadata struct {
 }
 
 type PsshData struct {
-	KeyID     []interface{} `json:"key_id"`
-	ContentID string        `json:"content_id"`
+	KeyID     []KeyID `json:"key_id"`
+	ContentID string  `json:"content_id"`
+}
+
+// SupportedTrack is a track the license server granted a key for.
+type SupportedTrack struct {
+	Type                     string           `json:"type"`
+	KeyID                    KeyID            `json:"key_id"`
+	SecurityLevel            int64            `json:"security_level"`
+	RequiredOutputProtection OutputProtection `json:"required_output_protection"`
+}
+
+// OutputProtection is the output protection required for a track.
+type OutputProtection struct {
+	HDCP                 string `json:"hdcp"`
+	CGMSFlags            string `json:"cgms_flags"`
+	DisableAnalogOutput  bool   `json:"disable_analog_output"`
+	DisableDigitalOutput bool   `json:"disable_digital_output"`
+}
+
+// KeyID is a 16 bytes key identifier, base64 encoded in JSON.
+type KeyID []byte
+
+// String returns the key ID in hex.
+func (k KeyID) String() string {
+	return hex.EncodeToString(k)
+}
+
+// UUID returns the key ID in the canonical 8-4-4-4-12 UUID form.
+func (k KeyID) UUID() string {
+	if len(k) != 16 {
+		return k.String()
+	}
+	h := hex.EncodeToString(k)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
 }
 
 type ServiceVersionInfo struct {
@@ -91,21 +125,66 @@ type ContentKeySpec struct {
 	Key       string `json:"key"`
 	IV        string `json:"iv"`
 	TrackType string `json:"track_type"`
+	KeyType   string `json:"key_type,omitempty"`
 }
 
 // GetLicense creates a license request used with a proxy server.
+// An empty contentID is resolved from the challenge's PSSH, see ResolveContentID.
+// Service certificate requests are answered with the ServiceCertificate when one is set,
+// and service certificates from Widevine are verified against the RootCertificate when one is set.
 func (wp *Proxy) GetLicense(contentID string, body string) (*LicenseResponse, error) {
-	msg, err := wp.buildLicenseMessage(contentID, body)
+	return wp.GetLicenseContext(context.Background(), contentID, body)
+}
+
+// GetLicenseContext is GetLicense with a context for the key lookup and the license request.
+func (wp *Proxy) GetLicenseContext(ctx context.Context, contentID string, body string) (*LicenseResponse, error) {
+	serviceCertificateRequest := isServiceCertificateRequest(body)
+	if serviceCertificate := wp.serviceCertificate(); serviceCertificateRequest && serviceCertificate != nil {
+		return wp.serviceCertificateResponse(serviceCertificate), nil
+	}
+	if contentID == "" && !serviceCertificateRequest {
+		resolved, err := wp.ResolveContentID(body)
+		if err != nil {
+			wp.Logger.WithField("error", err.Error()).Error("Resolve Content ID Error")
+			return nil, err
+		}
+		contentID = resolved
+	}
+
+	msg, err := wp.buildLicenseMessage(ctx, contentID, body)
 	if err != nil {
 		return nil, err
 	}
 
+	var lr *LicenseResponse
+	err = wp.retryWithPreviousCredentials(ctx, msg, func(msg map[string]interface{}) (bool, error) {
+		var err error
+		lr, err = wp.postLicense(ctx, msg)
+		return err == nil && lr.Status == licenseStatusSignatureFailed, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serviceCertificateRequest && wp.RootCertificate != nil && lr.License != "" {
+		if err := wp.checkServiceCertificate(lr); err != nil {
+			wp.Logger.WithField("error", err.Error()).Error("Service Certificate Verification Error")
+			return nil, err
+		}
+	}
+	return lr, nil
+}
+
+// postLicense sends a signed license request to Widevine Cloud.
+func (wp *Proxy) postLicense(ctx context.Context, msg map[string]interface{}) (*LicenseResponse, error) {
 	payload, err := json.Marshal(msg)
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", getCloudLicenseServiceURL(wp.Provider, "license"), bytes.NewBuffer(payload))
+	req, err := http.NewRequestWithContext(ctx, "POST", getCloudLicenseServiceURL(wp.Provider, "license"), bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Add("Content-Type", "application/json")
 	response, err := wp.httpCaller.Do(req)
 	if err != nil {
@@ -122,29 +201,65 @@ func (wp *Proxy) GetLicense(contentID string, body string) (*LicenseResponse, er
 		return nil, err
 	}
 	return &lr, nil
+}
 
+// KeyedTracks returns the supported tracks the device actually received a key for.
+func (lr *LicenseResponse) KeyedTracks() []SupportedTrack {
+	var tracks []SupportedTrack
+	for _, track := range lr.SupportedTracks {
+		if len(track.KeyID) > 0 {
+			tracks = append(tracks, track)
+		}
+	}
+	return tracks
+}
+
+// KeyedTrackTypes returns the distinct track types (SD, HD, AUDIO, ...) the device received keys for.
+func (lr *LicenseResponse) KeyedTrackTypes() []string {
+	var types []string
+	seen := make(map[string]bool)
+	for _, track := range lr.KeyedTracks() {
+		if !seen[track.Type] {
+			seen[track.Type] = true
+			types = append(types, track.Type)
+		}
+	}
+	return types
+}
+
+// HasKeyForTrack reports whether the device received a key for the given track type.
+func (lr *LicenseResponse) HasKeyForTrack(trackType string) bool {
+	for _, track := range lr.KeyedTracks() {
+		if strings.EqualFold(track.Type, trackType) {
+			return true
+		}
+	}
+	return false
 }
 
-func (wp *Proxy) buildLicenseMessage(contentID string, body string) (map[string]interface{}, error) {
+func (wp *Proxy) buildLicenseMessage(ctx context.Context, contentID string, body string) (map[string]interface{}, error) {
 	wp.Logger.Debugf("Content ID: %s", contentID)
 	enc := base64.StdEncoding.EncodeToString([]byte(contentID))
-	contentKey := wp.ContentKeyGenerator.GenerateContentKey([]byte(contentID))
 
-	m := md5.New()
-	m.Write(contentKey)
-	contentKeyID := m.Sum(nil)
+	keySpecs, err := wp.licenseKeySpecs(ctx, []byte(contentID))
+	if err != nil {
+		wp.Logger.WithField("error", err.Error()).Error("Content Key Error")
+		return nil, err
+	}
+	// Never sign a license request for a missing or malformed key.
+	for _, keySpec := range keySpecs {
+		if err := keySpec.Validate(); err != nil {
+			wp.Logger.WithField("error", err.Error()).Error("Content Key Error")
+			return nil, fmt.Errorf("content %q: %v", contentID, err)
+		}
+	}
 
 	message := &LicenseMessage{
 		Payload:           body,
 		ContentID:         enc,
 		Provider:          wp.Provider,
 		AllowedTrackTypes: "SD_UHD1",
-		ContentKeySpecs: []ContentKeySpec{
-			{
-				Key:   base64.StdEncoding.EncodeToString(contentKey),
-				KeyID: base64.StdEncoding.EncodeToString(contentKeyID),
-			},
-		},
+		ContentKeySpecs:   keySpecs,
 	}
 
 	jsonMessage, _ := json.Marshal(message)
@@ -152,7 +267,7 @@ func (wp *Proxy) buildLicenseMessage(contentID string, body string) (map[string]
 	wp.Logger.Debugf("License Message: %s", b64message)
 
 	// Create signature and postBody.
-	sign, err := wp.generateSignature(jsonMessage)
+	sign, err := wp.generateSignature(ctx, jsonMessage)
 	if err != nil {
 		wp.Logger.WithField("error", err.Error()).Error("Signature Error")
 		return nil, err
@@ -165,6 +280,28 @@ func (wp *Proxy) buildLicenseMessage(contentID string, body string) (map[string]
 	return postBody, nil
 }
 
+// licenseKeySpecs returns the keys of a license, with the key IDs the proxy hands packagers: the content key
+// specs of the content, or its content key when there are none. A live channel with key rotation has a spec
+// of KeyTypeEntitlement, so its license carries the entitlement key of the crypto period keys in its PSSH.
+func (wp *Proxy) licenseKeySpecs(ctx context.Context, contentID []byte) ([]ContentKeySpec, error) {
+	specs, err := wp.keys().ContentKeySpecs(ctx, contentID, nil)
+	if err != nil || len(specs) > 0 {
+		return specs, err
+	}
+	kid, err := wp.keys().ContentKeyID(ctx, contentID)
+	if err != nil {
+		return nil, err
+	}
+	key, err := wp.keys().ContentKey(ctx, contentID)
+	if err != nil {
+		return nil, err
+	}
+	return []ContentKeySpec{{
+		KeyID: base64.StdEncoding.EncodeToString(kid),
+		Key:   base64.StdEncoding.EncodeToString(key),
+	}}, nil
+}
+
 func getCloudLicenseServiceURL(provider, purpose string) string {
 	if strings.ToLower(purpose) == "key" {
 		switch provider {
@@ -186,13 +323,6 @@ func getCloudLicenseServiceURL(provider, purpose string) string {
 	return ""
 }
 
-func (wp *Proxy) generateSignature(payload []byte) ([]byte, error) {
-	h := sha1.New()
-	h.Write([]byte(payload))
-
-	ciphertext, err := AESCBCEncrypt(wp.PartnerRootKey, wp.PartnerRootIV, h.Sum(nil))
-	if err != nil {
-		return nil, err
-	}
-	return ciphertext, nil
+func (wp *Proxy) generateSignature(ctx context.Context, payload []byte) ([]byte, error) {
+	return wp.signer().Sign(ctx, payload)
 }
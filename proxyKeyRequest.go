@@ -2,13 +2,14 @@ package widevineproxy
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 
-	"github.com/alfg/widevine/proto"
-	protobuf "github.com/golang/protobuf/proto"
+	"github.com/Cooomma/widevine-proxy/pssh"
 )
 
 // GetContentKeyResponse JSON response from Widevine Cloud.
@@ -18,6 +19,9 @@ type ContentKeyResponse struct {
 	DRM         []drm    `json:"drm"`
 	Tracks      []tracks `json:"tracks"`
 	AlreadyUsed bool     `json:"already_used"`
+
+	// PSSH is the Widevine pssh box of the content and the returned key IDs.
+	PSSH *pssh.Box `json:"-"`
 }
 
 type drm struct {
@@ -26,13 +30,14 @@ type drm struct {
 }
 
 type tracks struct {
-	Type  string `json:"type"`
-	KeyID string `json:"key_id"`
-	Key   string `json:"key"`
-	PSSH  []pssh `json:"pssh"`
+	Type              string      `json:"type"`
+	KeyID             string      `json:"key_id"`
+	Key               string      `json:"key"`
+	PSSH              []trackPSSH `json:"pssh"`
+	CryptoPeriodIndex uint32      `json:"crypto_period_index"`
 }
 
-type pssh struct {
+type trackPSSH struct {
 	DRMType string `json:"drm_type"`
 	Data    string `json:"data"`
 }
@@ -43,17 +48,56 @@ type Policy struct {
 	Tracks    []string
 	DRMTypes  []string
 	Policy    string
+
+	// CryptoPeriodIndex and CryptoPeriodCount request the keys of
+	// CryptoPeriodCount crypto periods for key rotation.
+	CryptoPeriodIndex uint32
+	CryptoPeriodCount uint32
+
+	// ProtectionScheme is the encryption scheme signalled in the PSSH, cenc by default.
+	ProtectionScheme pssh.ProtectionScheme
 }
 
 // GetContentKey creates a content key giving a contentID.
 func (wp *Proxy) GetContentKey(contentID string, policy Policy) (*ContentKeyResponse, error) {
+	return wp.GetContentKeyContext(context.Background(), contentID, policy)
+}
+
+// GetContentKeyContext is GetContentKey with a context for the signature and the key request.
+func (wp *Proxy) GetContentKeyContext(ctx context.Context, contentID string, policy Policy) (*ContentKeyResponse, error) {
 	p := wp.setPolicy(contentID, policy)
-	payload, err := json.Marshal(wp.buildCKMessage(p))
+	message, err := wp.buildCKMessage(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	var output *ContentKeyResponse
+	err = wp.retryWithPreviousCredentials(ctx, message, func(message map[string]interface{}) (bool, error) {
+		var err error
+		output, err = wp.postContentKey(ctx, message)
+		return err == nil && output.Status == contentKeyStatusSignatureFailed, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	box, err := wp.buildPSSH(contentID, policy, output.Tracks)
+	if err != nil {
+		return nil, err
+	}
+	output.PSSH = box
+	return output, nil
+}
+
+// postContentKey sends a signed content key request to Widevine Cloud.
+func (wp *Proxy) postContentKey(ctx context.Context, message map[string]interface{}) (*ContentKeyResponse, error) {
+	payload, err := json.Marshal(message)
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", getCloudLicenseServiceURL(wp.Provider, "key"), bytes.NewBuffer(payload))
+	req, err := http.NewRequestWithContext(ctx, "POST", getCloudLicenseServiceURL(wp.Provider, "key"), bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Add("Content-Type", "application/json")
 	response, err := wp.httpCaller.Do(req)
 	if err != nil {
@@ -76,20 +120,18 @@ func (wp *Proxy) GetContentKey(contentID string, policy Policy) (*ContentKeyResp
 	if err := json.Unmarshal(dec, &output); err != nil {
 		return nil, err
 	}
-	// TODO
-	// Build custom PSSH from protobuf.
-	wp.Logger.Debugf("pssh build: %s", wp.buildPSSH(contentID))
 	return output, nil
 }
 
-func (wp *Proxy) buildCKMessage(policy map[string]interface{}) map[string]interface{} {
+func (wp *Proxy) buildCKMessage(ctx context.Context, policy map[string]interface{}) (map[string]interface{}, error) {
 	// Marshal and encode payload.
 	jsonPayload, _ := json.Marshal(policy)
 	b64payload := base64.StdEncoding.EncodeToString([]byte(jsonPayload))
 
-	sign, err := wp.generateSignature(jsonPayload)
+	sign, err := wp.generateSignature(ctx, jsonPayload)
 	if err != nil {
-		return nil
+		wp.Logger.WithField("error", err.Error()).Error("Signature Error")
+		return nil, err
 	}
 	// Create signature and postBody.
 	postBody := map[string]interface{}{
@@ -97,16 +139,36 @@ func (wp *Proxy) buildCKMessage(policy map[string]interface{}) map[string]interf
 		"signature": sign,
 		"signer":    wp.Provider,
 	}
-	return postBody
+	return postBody, nil
 }
 
-func (wp *Proxy) buildPSSH(contentID string) string {
-	wvpssh := &proto.WidevineCencHeader{
-		Provider:  protobuf.String(wp.Provider),
-		ContentId: []byte(contentID),
+func (wp *Proxy) buildPSSH(contentID string, policy Policy, tracks []tracks) (*pssh.Box, error) {
+	data := &pssh.WidevineData{
+		Provider:          wp.Provider,
+		ContentID:         []byte(contentID),
+		ProtectionScheme:  policy.ProtectionScheme,
+		CryptoPeriodIndex: policy.CryptoPeriodIndex,
 	}
-	p, _ := protobuf.Marshal(wvpssh)
-	return base64.StdEncoding.EncodeToString(p)
+	seen := make(map[string]bool)
+	for _, track := range tracks {
+		if track.KeyID == "" || seen[track.KeyID] {
+			continue
+		}
+		seen[track.KeyID] = true
+		kid, err := base64.StdEncoding.DecodeString(track.KeyID)
+		if err != nil {
+			return nil, fmt.Errorf("decode %s track key ID: %v", track.Type, err)
+		}
+		data.KeyIDs = append(data.KeyIDs, kid)
+	}
+
+	box := data.Box(1)
+	b, err := box.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	wp.Logger.Debugf("pssh build: %s", base64.StdEncoding.EncodeToString(b))
+	return box, nil
 }
 
 func (wp *Proxy) setPolicy(contentID string, policy Policy) map[string]interface{} {
@@ -126,5 +188,12 @@ func (wp *Proxy) setPolicy(contentID string, policy Policy) map[string]interface
 		"drm_types":  policy.DRMTypes,
 		"policy":     policy.Policy,
 	}
+	if policy.CryptoPeriodCount > 0 {
+		p["first_crypto_period_index"] = policy.CryptoPeriodIndex
+		p["crypto_period_count"] = policy.CryptoPeriodCount
+	}
+	if policy.ProtectionScheme != 0 {
+		p["protection_scheme"] = strings.ToUpper(policy.ProtectionScheme.String())
+	}
 	return p
 }
@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/Cooomma/widevine-proxy/pssh"
 	"github.com/mattn/go-colorable"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -41,3 +42,29 @@ func TestGetContentKey(t *testing.T) {
 		t.Error()
 	}
 }
+
+func TestBuildPSSH(t *testing.T) {
+	wv := NewWidevineProxy(nil, nil, "widevine_test", FakeKeyGoverner{}, logrus.New())
+	policy := Policy{ProtectionScheme: pssh.SchemeCBCS}
+	trackList := []tracks{
+		{Type: "SD", KeyID: "AAECAwQFBgcICQoLDA0ODw=="},
+		{Type: "HD", KeyID: "EBESExQVFhcYGRobHB0eHw=="},
+		{Type: "AUDIO", KeyID: "AAECAwQFBgcICQoLDA0ODw=="},
+	}
+
+	box, err := wv.buildPSSH("testing", policy, trackList)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(1), box.Version)
+	assert.Equal(t, pssh.WidevineSystemID, box.SystemID)
+	assert.Len(t, box.KeyIDs, 2)
+
+	data, err := pssh.UnmarshalWidevineData(box.Data)
+	assert.NoError(t, err)
+	assert.Equal(t, "widevine_test", data.Provider)
+	assert.Equal(t, []byte("testing"), data.ContentID)
+	assert.Equal(t, pssh.SchemeCBCS, data.ProtectionScheme)
+	assert.Equal(t, box.KeyIDs, data.KeyIDs)
+
+	_, err = wv.buildPSSH("testing", policy, []tracks{{Type: "SD", KeyID: "%%"}})
+	assert.Error(t, err)
+}
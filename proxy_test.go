@@ -2,7 +2,9 @@ package widevineproxy
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -29,18 +31,20 @@ func (FakeKeyGoverner) GenerateContentKeyID(contentID []byte) []byte {
 
 }
 func (FakeKeyGoverner) GenerateContentKey(contentID []byte) []byte {
-	return nil
+	h := sha256.Sum256(contentID)
+	return h[:16]
 }
 func (FakeKeyGoverner) GenerateContentIV(contentID []byte) []byte {
-	return nil
+	h := sha256.Sum256(contentID)
+	return h[16:]
 }
 
-func (FakeKeyGoverner) GenerateContentKeySpec(contentID []byte, policyConfig map[string]string) (*[]ContentKeySpec, error) {
+func (kg FakeKeyGoverner) GenerateContentKeySpec(contentID []byte, policyConfig map[string]string) (*[]ContentKeySpec, error) {
 	cks := []ContentKeySpec{
 		{
-			KeyID:     "base64EncodedString",
-			Key:       "base64EncodedString",
-			IV:        "base64EncodedString",
+			KeyID:     base64.StdEncoding.EncodeToString(kg.GenerateContentKeyID(contentID)),
+			Key:       base64.StdEncoding.EncodeToString(kg.GenerateContentKey(contentID)),
+			IV:        base64.StdEncoding.EncodeToString(kg.GenerateContentIV(contentID)),
 			TrackType: "SD",
 		},
 	}
@@ -96,10 +100,36 @@ func TestGenerateSignature(t *testing.T) {
 
 	wv := NewWidevineProxy(key, iv, "widevine_test", keyGenerator, logger)
 
-	sign, err := wv.generateSignature(jsonPayload)
+	sign, err := wv.generateSignature(context.Background(), jsonPayload)
 	assert.NoError(t, err)
 	expectedSignature, err := base64.StdEncoding.DecodeString("ga80QzRuUM+jnPcoR6UWs5TXrTQ2VgeYiu0FoqCNRH4=")
 	assert.NoError(t, err)
 	assert.Zero(t, bytes.Compare(sign, expectedSignature))
 
 }
+
+func TestLicenseResponseSupportedTracks(t *testing.T) {
+	body := `{
+		"status": "OK",
+		"supported_tracks": [
+			{"type": "SD", "key_id": "AAECAwQFBgcICQoLDA0ODw==", "security_level": 1},
+			{"type": "HD", "key_id": "EBESExQVFhcYGRobHB0eHw==", "security_level": 3,
+			 "required_output_protection": {"hdcp": "HDCP_V2", "disable_analog_output": true}},
+			{"type": "UHD1"}
+		],
+		"pssh_data": {"key_id": ["AAECAwQFBgcICQoLDA0ODw=="], "content_id": "ZmtqM2xqYVNkZmFsa3Izag=="}
+	}`
+
+	var lr LicenseResponse
+	assert.NoError(t, json.Unmarshal([]byte(body), &lr))
+	assert.Len(t, lr.SupportedTracks, 3)
+	assert.Equal(t, "00010203-0405-0607-0809-0a0b0c0d0e0f", lr.SupportedTracks[0].KeyID.UUID())
+	assert.Equal(t, "HDCP_V2", lr.SupportedTracks[1].RequiredOutputProtection.HDCP)
+	assert.True(t, lr.SupportedTracks[1].RequiredOutputProtection.DisableAnalogOutput)
+	assert.Equal(t, "000102030405060708090a0b0c0d0e0f", lr.PsshData.KeyID[0].String())
+
+	assert.Len(t, lr.KeyedTracks(), 2)
+	assert.Equal(t, []string{"SD", "HD"}, lr.KeyedTrackTypes())
+	assert.True(t, lr.HasKeyForTrack("hd"))
+	assert.False(t, lr.HasKeyForTrack("UHD1"))
+}
@@ -0,0 +1,151 @@
+// Package pssh builds and parses ISO BMFF Protection System Specific Header boxes
+// and the Widevine PSSH data they carry.
+package pssh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// SystemID identifies a DRM system.
+type SystemID [16]byte
+
+// WidevineSystemID is the system ID of Widevine, edef8ba9-79d6-4ace-a3c8-27dcd51d21ed.
+var WidevineSystemID = SystemID{0xed, 0xef, 0x8b, 0xa9, 0x79, 0xd6, 0x4a, 0xce, 0xa3, 0xc8, 0x27, 0xdc, 0xd5, 0x1d, 0x21, 0xed}
+
+// String returns the system ID in the canonical 8-4-4-4-12 UUID form.
+func (id SystemID) String() string {
+	h := hex.EncodeToString(id[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// ParseSystemID parses a system ID in UUID form, with or without dashes.
+func ParseSystemID(s string) (SystemID, error) {
+	var id SystemID
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(b) != len(id) {
+		return id, fmt.Errorf("invalid system ID %q", s)
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// Box is a version 0 or version 1 pssh box. Key IDs are only written in version 1 boxes.
+type Box struct {
+	Version  uint8
+	Flags    uint32
+	SystemID SystemID
+	KeyIDs   [][]byte
+	Data     []byte
+}
+
+const boxHeaderSize = 32
+
+// Marshal encodes the box.
+func (b *Box) Marshal() ([]byte, error) {
+	if b.Version > 1 {
+		return nil, fmt.Errorf("unsupported pssh box version %d", b.Version)
+	}
+	size := boxHeaderSize + len(b.Data)
+	if b.Version == 1 {
+		size += 4 + 16*len(b.KeyIDs)
+	}
+
+	out := make([]byte, 0, size)
+	out = appendUint32(out, uint32(size))
+	out = append(out, "pssh"...)
+	out = appendUint32(out, uint32(b.Version)<<24|b.Flags&0xffffff)
+	out = append(out, b.SystemID[:]...)
+	if b.Version == 1 {
+		out = appendUint32(out, uint32(len(b.KeyIDs)))
+		for _, kid := range b.KeyIDs {
+			if len(kid) != 16 {
+				return nil, fmt.Errorf("key ID must be 16 bytes, got %d", len(kid))
+			}
+			out = append(out, kid...)
+		}
+	}
+	out = appendUint32(out, uint32(len(b.Data)))
+	return append(out, b.Data...), nil
+}
+
+// Parse decodes a single pssh box. Trailing bytes after the box are an error.
+func Parse(b []byte) (*Box, error) {
+	box, n, err := parse(b)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(b) {
+		return nil, fmt.Errorf("%d trailing bytes after pssh box", len(b)-n)
+	}
+	return box, nil
+}
+
+// ParseAll decodes concatenated pssh boxes, as found in CENC init data.
+func ParseAll(b []byte) ([]*Box, error) {
+	var boxes []*Box
+	for len(b) > 0 {
+		box, n, err := parse(b)
+		if err != nil {
+			return nil, err
+		}
+		boxes = append(boxes, box)
+		b = b[n:]
+	}
+	return boxes, nil
+}
+
+// IsBox reports whether b starts with a pssh box header.
+func IsBox(b []byte) bool {
+	return len(b) >= boxHeaderSize && bytes.Equal(b[4:8], []byte("pssh"))
+}
+
+func parse(b []byte) (*Box, int, error) {
+	if !IsBox(b) {
+		return nil, 0, fmt.Errorf("not a pssh box")
+	}
+	size := int(binary.BigEndian.Uint32(b))
+	if size < boxHeaderSize || size > len(b) {
+		return nil, 0, fmt.Errorf("invalid pssh box size %d", size)
+	}
+	b = b[:size]
+
+	box := &Box{
+		Version: b[8],
+		Flags:   binary.BigEndian.Uint32(b[8:]) & 0xffffff,
+	}
+	if box.Version > 1 {
+		return nil, 0, fmt.Errorf("unsupported pssh box version %d", box.Version)
+	}
+	copy(box.SystemID[:], b[12:28])
+
+	offset := 28
+	if box.Version == 1 {
+		count := int(binary.BigEndian.Uint32(b[offset:]))
+		offset += 4
+		if count > (size-offset)/16 {
+			return nil, 0, fmt.Errorf("invalid pssh box key ID count %d", count)
+		}
+		for i := 0; i < count; i++ {
+			box.KeyIDs = append(box.KeyIDs, b[offset:offset+16])
+			offset += 16
+		}
+	}
+	if offset+4 > size {
+		return nil, 0, fmt.Errorf("pssh box too short")
+	}
+	dataSize := int(binary.BigEndian.Uint32(b[offset:]))
+	offset += 4
+	if dataSize != size-offset {
+		return nil, 0, fmt.Errorf("invalid pssh box data size %d", dataSize)
+	}
+	box.Data = b[offset:]
+	return box, size, nil
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
@@ -0,0 +1,79 @@
+package pssh
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoxVersion0(t *testing.T) {
+	box := &Box{SystemID: WidevineSystemID, Data: []byte{0x22, 0x02, 'i', 'd'}}
+	b, err := box.Marshal()
+	assert.NoError(t, err)
+	assert.Equal(t, "00000024"+"70737368"+"00000000"+"edef8ba979d64acea3c827dcd51d21ed"+"00000004"+"22026964", hex.EncodeToString(b))
+
+	parsed, err := Parse(b)
+	assert.NoError(t, err)
+	assert.Equal(t, box, parsed)
+}
+
+func TestBoxVersion1(t *testing.T) {
+	kid1, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	kid2, _ := hex.DecodeString("101112131415161718191a1b1c1d1e1f")
+	box := &Box{Version: 1, SystemID: WidevineSystemID, KeyIDs: [][]byte{kid1, kid2}}
+	b, err := box.Marshal()
+	assert.NoError(t, err)
+	assert.Len(t, b, 32+4+32)
+
+	parsed, err := Parse(b)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(1), parsed.Version)
+	assert.Equal(t, [][]byte{kid1, kid2}, parsed.KeyIDs)
+	assert.Empty(t, parsed.Data)
+
+	_, err = (&Box{Version: 1, KeyIDs: [][]byte{{1, 2, 3}}}).Marshal()
+	assert.Error(t, err)
+	_, err = (&Box{Version: 2}).Marshal()
+	assert.Error(t, err)
+}
+
+func TestParseAll(t *testing.T) {
+	a, _ := (&Box{SystemID: WidevineSystemID, Data: []byte("a")}).Marshal()
+	b, _ := (&Box{Version: 1, SystemID: SystemID{1}, KeyIDs: [][]byte{make([]byte, 16)}}).Marshal()
+
+	boxes, err := ParseAll(append(append([]byte{}, a...), b...))
+	assert.NoError(t, err)
+	assert.Len(t, boxes, 2)
+	assert.Equal(t, []byte("a"), boxes[0].Data)
+	assert.Equal(t, SystemID{1}, boxes[1].SystemID)
+
+	_, err = Parse(append(append([]byte{}, a...), b...))
+	assert.Error(t, err)
+}
+
+func TestParseInvalid(t *testing.T) {
+	b, _ := (&Box{Version: 1, SystemID: WidevineSystemID, KeyIDs: [][]byte{make([]byte, 16)}, Data: []byte("data")}).Marshal()
+
+	_, err := Parse(b[:len(b)-1])
+	assert.Error(t, err)
+
+	tooManyKIDs := append([]byte{}, b...)
+	tooManyKIDs[31] = 9
+	_, err = Parse(tooManyKIDs)
+	assert.Error(t, err)
+
+	_, err = Parse([]byte("not a pssh box at all, not at all"))
+	assert.Error(t, err)
+}
+
+func TestSystemID(t *testing.T) {
+	assert.Equal(t, "edef8ba9-79d6-4ace-a3c8-27dcd51d21ed", WidevineSystemID.String())
+
+	id, err := ParseSystemID("EDEF8BA9-79D6-4ACE-A3C8-27DCD51D21ED")
+	assert.NoError(t, err)
+	assert.Equal(t, WidevineSystemID, id)
+
+	_, err = ParseSystemID("edef8ba9")
+	assert.Error(t, err)
+}
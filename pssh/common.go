@@ -0,0 +1,13 @@
+package pssh
+
+// CommonSystemID is the system ID of W3C Common PSSH, 1077efec-c0b2-4d02-ace3-3c1e52e2fb4b.
+var CommonSystemID = SystemID{0x10, 0x77, 0xef, 0xec, 0xc0, 0xb2, 0x4d, 0x02, 0xac, 0xe3, 0x3c, 0x1e, 0x52, 0xe2, 0xfb, 0x4b}
+
+// CommonBox returns the W3C Common PSSH box, a version 1 box listing the key IDs without data.
+func CommonBox(keyIDs [][]byte) *Box {
+	return &Box{
+		Version:  1,
+		SystemID: CommonSystemID,
+		KeyIDs:   keyIDs,
+	}
+}
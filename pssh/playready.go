@@ -0,0 +1,241 @@
+package pssh
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// PlayReadySystemID is the system ID of PlayReady, 9a04f079-9840-4286-ab92-e65be0885f95.
+var PlayReadySystemID = SystemID{0x9a, 0x04, 0xf0, 0x79, 0x98, 0x40, 0x42, 0x86, 0xab, 0x92, 0xe6, 0x5b, 0xe0, 0x88, 0x5f, 0x95}
+
+// PlayReadyVersion is the version of a WRMHEADER.
+type PlayReadyVersion string
+
+// WRMHEADER versions.
+const (
+	PlayReadyV40 PlayReadyVersion = "4.0.0.0"
+	PlayReadyV41 PlayReadyVersion = "4.1.0.0"
+	PlayReadyV42 PlayReadyVersion = "4.2.0.0"
+	PlayReadyV43 PlayReadyVersion = "4.3.0.0"
+)
+
+// PlayReady content key algorithms.
+const (
+	PlayReadyAESCTR = "AESCTR"
+	PlayReadyAESCBC = "AESCBC"
+)
+
+const playReadyHeaderNamespace = "http://schemas.microsoft.com/DRM/2007/03/PlayReadyHeader"
+
+// PlayReadyKey is a key listed in a WRMHEADER. Key is optional and only used for the AESCTR checksum.
+type PlayReadyKey struct {
+	KeyID     []byte
+	Key       []byte
+	Algorithm string
+}
+
+// PlayReadyHeader is a PlayReady header, WRMHEADER 4.0 to 4.3.
+type PlayReadyHeader struct {
+	Version          PlayReadyVersion
+	Keys             []PlayReadyKey
+	LicenseURL       string
+	LicenseUIURL     string
+	CustomAttributes string
+}
+
+// WRMHeader returns the WRMHEADER XML.
+func (h *PlayReadyHeader) WRMHeader() (string, error) {
+	version := h.Version
+	if version == "" {
+		version = PlayReadyV43
+	}
+	if err := h.validate(version); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<WRMHEADER xmlns="%s" version="%s"><DATA>`, playReadyHeaderNamespace, version)
+	switch version {
+	case PlayReadyV40:
+		key := h.Keys[0]
+		kid, checksum, err := playReadyKID(key)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString("<PROTECTINFO><KEYLEN>16</KEYLEN><ALGID>AESCTR</ALGID></PROTECTINFO>")
+		writeElement(&b, "KID", kid)
+		writeElement(&b, "CHECKSUM", checksum)
+	case PlayReadyV41:
+		b.WriteString("<PROTECTINFO>")
+		if err := writeKID(&b, h.Keys[0]); err != nil {
+			return "", err
+		}
+		b.WriteString("</PROTECTINFO>")
+	default:
+		b.WriteString("<PROTECTINFO><KIDS>")
+		for _, key := range h.Keys {
+			if err := writeKID(&b, key); err != nil {
+				return "", err
+			}
+		}
+		b.WriteString("</KIDS></PROTECTINFO>")
+	}
+	writeElement(&b, "LA_URL", h.LicenseURL)
+	writeElement(&b, "LUI_URL", h.LicenseUIURL)
+	if version != PlayReadyV40 {
+		b.WriteString("<DECRYPTORSETUP>ONDEMAND</DECRYPTORSETUP>")
+	}
+	if h.CustomAttributes != "" {
+		b.WriteString("<CUSTOMATTRIBUTES>" + h.CustomAttributes + "</CUSTOMATTRIBUTES>")
+	}
+	b.WriteString("</DATA></WRMHEADER>")
+	return b.String(), nil
+}
+
+func (h *PlayReadyHeader) validate(version PlayReadyVersion) error {
+	switch version {
+	case PlayReadyV40, PlayReadyV41:
+		if len(h.Keys) != 1 {
+			return fmt.Errorf("WRMHEADER %s carries exactly one key, got %d", version, len(h.Keys))
+		}
+	case PlayReadyV42, PlayReadyV43:
+		if len(h.Keys) == 0 {
+			return fmt.Errorf("WRMHEADER %s needs at least one key", version)
+		}
+	default:
+		return fmt.Errorf("unsupported WRMHEADER version %q", version)
+	}
+	for _, key := range h.Keys {
+		switch key.Algorithm {
+		case "", PlayReadyAESCTR:
+		case PlayReadyAESCBC:
+			if version != PlayReadyV43 {
+				return fmt.Errorf("AESCBC needs WRMHEADER 4.3, got %s", version)
+			}
+		default:
+			return fmt.Errorf("unknown PlayReady algorithm %q", key.Algorithm)
+		}
+	}
+	return nil
+}
+
+// Object returns the PlayReady Header Object carrying the WRMHEADER, as used in
+// the PlayReady pssh box and the DASH mspr:pro element.
+func (h *PlayReadyHeader) Object() ([]byte, error) {
+	header, err := h.WRMHeader()
+	if err != nil {
+		return nil, err
+	}
+	var record []byte
+	for _, r := range utf16.Encode([]rune(header)) {
+		record = append(record, byte(r), byte(r>>8))
+	}
+	if len(record) > 0xffff {
+		return nil, fmt.Errorf("WRMHEADER too large: %d bytes", len(record))
+	}
+
+	out := make([]byte, 10, 10+len(record))
+	binary.LittleEndian.PutUint32(out, uint32(10+len(record)))
+	// One record of type 1, rights management header.
+	binary.LittleEndian.PutUint16(out[4:], 1)
+	binary.LittleEndian.PutUint16(out[6:], 1)
+	binary.LittleEndian.PutUint16(out[8:], uint16(len(record)))
+	return append(out, record...), nil
+}
+
+// Box wraps the PlayReady Header Object in a PlayReady pssh box. Version 1 boxes also list the key IDs.
+func (h *PlayReadyHeader) Box(version uint8) (*Box, error) {
+	pro, err := h.Object()
+	if err != nil {
+		return nil, err
+	}
+	box := &Box{
+		Version:  version,
+		SystemID: PlayReadySystemID,
+		Data:     pro,
+	}
+	if version == 1 {
+		for _, key := range h.Keys {
+			box.KeyIDs = append(box.KeyIDs, key.KeyID)
+		}
+	}
+	return box, nil
+}
+
+// PlayReadyKeyID converts a key ID to the little endian GUID byte order PlayReady uses.
+func PlayReadyKeyID(kid []byte) ([]byte, error) {
+	if len(kid) != 16 {
+		return nil, fmt.Errorf("key ID must be 16 bytes, got %d", len(kid))
+	}
+	guid := append([]byte{}, kid...)
+	guid[0], guid[1], guid[2], guid[3] = kid[3], kid[2], kid[1], kid[0]
+	guid[4], guid[5] = kid[5], kid[4]
+	guid[6], guid[7] = kid[7], kid[6]
+	return guid, nil
+}
+
+// playReadyKID returns the base64 GUID of a key and, for AESCTR keys with a key, its checksum.
+func playReadyKID(key PlayReadyKey) (kid, checksum string, err error) {
+	guid, err := PlayReadyKeyID(key.KeyID)
+	if err != nil {
+		return "", "", err
+	}
+	if len(key.Key) > 0 && key.Algorithm != PlayReadyAESCBC {
+		if len(key.Key) != 16 {
+			return "", "", fmt.Errorf("content key must be 16 bytes, got %d", len(key.Key))
+		}
+		block, err := aes.NewCipher(key.Key)
+		if err != nil {
+			return "", "", err
+		}
+		sum := make([]byte, aes.BlockSize)
+		block.Encrypt(sum, guid)
+		checksum = base64.StdEncoding.EncodeToString(sum[:8])
+	}
+	return base64.StdEncoding.EncodeToString(guid), checksum, nil
+}
+
+func writeKID(b *strings.Builder, key PlayReadyKey) error {
+	kid, checksum, err := playReadyKID(key)
+	if err != nil {
+		return err
+	}
+	b.WriteString("<KID")
+	algorithm := key.Algorithm
+	if algorithm == "" {
+		algorithm = PlayReadyAESCTR
+	}
+	writeAttr(b, "ALGID", algorithm)
+	writeAttr(b, "CHECKSUM", checksum)
+	writeAttr(b, "VALUE", kid)
+	b.WriteString("></KID>")
+	return nil
+}
+
+func writeElement(b *strings.Builder, name, value string) {
+	if value == "" {
+		return
+	}
+	b.WriteString("<" + name + ">")
+	b.WriteString(escape(value))
+	b.WriteString("</" + name + ">")
+}
+
+func writeAttr(b *strings.Builder, name, value string) {
+	if value == "" {
+		return
+	}
+	b.WriteString(" " + name + `="` + escape(value) + `"`)
+}
+
+func escape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
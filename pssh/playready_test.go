@@ -0,0 +1,115 @@
+package pssh
+
+import (
+	"crypto/aes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testKID1, _ = hex.DecodeString("00112233445566778899aabbccddeeff")
+	testKID2, _ = hex.DecodeString("ffeeddccbbaa99887766554433221100")
+	testKey, _  = hex.DecodeString("0123456789abcdef0123456789abcdef")
+)
+
+func TestPlayReadyKeyID(t *testing.T) {
+	guid, err := PlayReadyKeyID(testKID1)
+	assert.NoError(t, err)
+	assert.Equal(t, "33221100554477668899aabbccddeeff", hex.EncodeToString(guid))
+
+	_, err = PlayReadyKeyID([]byte{1})
+	assert.Error(t, err)
+}
+
+func TestWRMHeaderVersions(t *testing.T) {
+	guid1, _ := PlayReadyKeyID(testKID1)
+	guid2, _ := PlayReadyKeyID(testKID2)
+	kid1 := base64.StdEncoding.EncodeToString(guid1)
+	kid2 := base64.StdEncoding.EncodeToString(guid2)
+
+	h := &PlayReadyHeader{Version: PlayReadyV40, Keys: []PlayReadyKey{{KeyID: testKID1}}, LicenseURL: "https://pr.example.com/?a=1&b=2"}
+	xml, err := h.WRMHeader()
+	assert.NoError(t, err)
+	assert.Equal(t, `<WRMHEADER xmlns="http://schemas.microsoft.com/DRM/2007/03/PlayReadyHeader" version="4.0.0.0"><DATA>`+
+		`<PROTECTINFO><KEYLEN>16</KEYLEN><ALGID>AESCTR</ALGID></PROTECTINFO><KID>`+kid1+`</KID>`+
+		`<LA_URL>https://pr.example.com/?a=1&amp;b=2</LA_URL></DATA></WRMHEADER>`, xml)
+
+	h = &PlayReadyHeader{Version: PlayReadyV41, Keys: []PlayReadyKey{{KeyID: testKID1}}}
+	xml, err = h.WRMHeader()
+	assert.NoError(t, err)
+	assert.Equal(t, `<WRMHEADER xmlns="http://schemas.microsoft.com/DRM/2007/03/PlayReadyHeader" version="4.1.0.0"><DATA>`+
+		`<PROTECTINFO><KID ALGID="AESCTR" VALUE="`+kid1+`"></KID></PROTECTINFO>`+
+		`<DECRYPTORSETUP>ONDEMAND</DECRYPTORSETUP></DATA></WRMHEADER>`, xml)
+
+	h = &PlayReadyHeader{Version: PlayReadyV43, Keys: []PlayReadyKey{{KeyID: testKID1}, {KeyID: testKID2, Algorithm: PlayReadyAESCBC}}}
+	xml, err = h.WRMHeader()
+	assert.NoError(t, err)
+	assert.Equal(t, `<WRMHEADER xmlns="http://schemas.microsoft.com/DRM/2007/03/PlayReadyHeader" version="4.3.0.0"><DATA>`+
+		`<PROTECTINFO><KIDS><KID ALGID="AESCTR" VALUE="`+kid1+`"></KID><KID ALGID="AESCBC" VALUE="`+kid2+`"></KID></KIDS></PROTECTINFO>`+
+		`<DECRYPTORSETUP>ONDEMAND</DECRYPTORSETUP></DATA></WRMHEADER>`, xml)
+}
+
+func TestWRMHeaderInvalid(t *testing.T) {
+	two := []PlayReadyKey{{KeyID: testKID1}, {KeyID: testKID2}}
+
+	_, err := (&PlayReadyHeader{Version: PlayReadyV40, Keys: two}).WRMHeader()
+	assert.Error(t, err)
+	_, err = (&PlayReadyHeader{Version: PlayReadyV41, Keys: two}).WRMHeader()
+	assert.Error(t, err)
+	_, err = (&PlayReadyHeader{Version: PlayReadyV42}).WRMHeader()
+	assert.Error(t, err)
+	_, err = (&PlayReadyHeader{Version: PlayReadyV42, Keys: []PlayReadyKey{{KeyID: testKID1, Algorithm: PlayReadyAESCBC}}}).WRMHeader()
+	assert.Error(t, err)
+	_, err = (&PlayReadyHeader{Version: "5.0.0.0", Keys: two}).WRMHeader()
+	assert.Error(t, err)
+	_, err = (&PlayReadyHeader{Keys: []PlayReadyKey{{KeyID: testKID1, Key: []byte{1, 2}}}}).WRMHeader()
+	assert.Error(t, err)
+}
+
+func TestWRMHeaderChecksum(t *testing.T) {
+	guid, _ := PlayReadyKeyID(testKID1)
+	block, _ := aes.NewCipher(testKey)
+	sum := make([]byte, 16)
+	block.Encrypt(sum, guid)
+	checksum := base64.StdEncoding.EncodeToString(sum[:8])
+
+	xml, err := (&PlayReadyHeader{Version: PlayReadyV42, Keys: []PlayReadyKey{{KeyID: testKID1, Key: testKey}}}).WRMHeader()
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `CHECKSUM="`+checksum+`"`)
+}
+
+func TestPlayReadyObject(t *testing.T) {
+	h := &PlayReadyHeader{Keys: []PlayReadyKey{{KeyID: testKID1}}}
+	header, _ := h.WRMHeader()
+
+	pro, err := h.Object()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(len(pro)), binary.LittleEndian.Uint32(pro))
+	assert.Equal(t, uint16(1), binary.LittleEndian.Uint16(pro[4:]))
+	assert.Equal(t, uint16(1), binary.LittleEndian.Uint16(pro[6:]))
+	assert.Equal(t, uint16(len(pro)-10), binary.LittleEndian.Uint16(pro[8:]))
+
+	var record []uint16
+	for i := 10; i < len(pro); i += 2 {
+		record = append(record, binary.LittleEndian.Uint16(pro[i:]))
+	}
+	assert.Equal(t, header, string(utf16.Decode(record)))
+
+	box, err := h.Box(1)
+	assert.NoError(t, err)
+	assert.Equal(t, PlayReadySystemID, box.SystemID)
+	assert.Equal(t, [][]byte{testKID1}, box.KeyIDs)
+	assert.Equal(t, pro, box.Data)
+}
+
+func TestCommonBox(t *testing.T) {
+	b, err := CommonBox([][]byte{testKID1, testKID2}).Marshal()
+	assert.NoError(t, err)
+	assert.Equal(t, "00000044"+"70737368"+"01000000"+"1077efecc0b24d02ace33c1e52e2fb4b"+"00000002"+
+		hex.EncodeToString(testKID1)+hex.EncodeToString(testKID2)+"00000000", hex.EncodeToString(b))
+}
@@ -0,0 +1,207 @@
+package pssh
+
+import (
+	"fmt"
+
+	"github.com/Cooomma/widevine-proxy/internal/wire"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ProtectionScheme is the four character code of a common encryption scheme.
+type ProtectionScheme uint32
+
+// Protection schemes of ISO/IEC 23001-7.
+const (
+	SchemeCENC ProtectionScheme = 0x63656e63
+	SchemeCBC1 ProtectionScheme = 0x63626331
+	SchemeCENS ProtectionScheme = 0x63656e73
+	SchemeCBCS ProtectionScheme = 0x63626373
+)
+
+// String returns the four character code, e.g. "cbcs".
+func (s ProtectionScheme) String() string {
+	return string([]byte{byte(s >> 24), byte(s >> 16), byte(s >> 8), byte(s)})
+}
+
+// ParseProtectionScheme parses a four character code, e.g. "cbcs".
+func ParseProtectionScheme(s string) (ProtectionScheme, error) {
+	switch scheme := ProtectionScheme(fourCC(s)); scheme {
+	case SchemeCENC, SchemeCBC1, SchemeCENS, SchemeCBCS:
+		return scheme, nil
+	}
+	return 0, fmt.Errorf("unknown protection scheme %q", s)
+}
+
+func fourCC(s string) uint32 {
+	if len(s) != 4 {
+		return 0
+	}
+	return uint32(s[0])<<24 | uint32(s[1])<<16 | uint32(s[2])<<8 | uint32(s[3])
+}
+
+// WidevineDataType is the type of Widevine PSSH data.
+type WidevineDataType uint32
+
+// Widevine PSSH data types.
+const (
+	TypeSingle      WidevineDataType = 0
+	TypeEntitlement WidevineDataType = 1
+	TypeEntitledKey WidevineDataType = 2
+)
+
+// DefaultEntitlementKeySize is the size of an entitlement key unless stated otherwise.
+const DefaultEntitlementKeySize = 32
+
+// WidevineData is the WidevinePsshData protobuf carried in a Widevine pssh box.
+// The crypto period index is written when key rotation is in use, that is when
+// CryptoPeriodIndex or CryptoPeriodSeconds is set or the data carries entitled keys.
+type WidevineData struct {
+	KeyIDs              [][]byte
+	Provider            string
+	ContentID           []byte
+	Policy              string
+	CryptoPeriodIndex   uint32
+	ProtectionScheme    ProtectionScheme
+	CryptoPeriodSeconds uint32
+	Type                WidevineDataType
+	KeySequence         uint32
+	GroupIDs            [][]byte
+	EntitledKeys        []EntitledKey
+}
+
+// EntitledKey is a content key wrapped by an entitlement key.
+type EntitledKey struct {
+	EntitlementKeyID   []byte
+	KeyID              []byte
+	Key                []byte
+	IV                 []byte
+	EntitlementKeySize uint32
+}
+
+// Marshal encodes the Widevine PSSH data protobuf.
+func (d *WidevineData) Marshal() []byte {
+	var b []byte
+	for _, kid := range d.KeyIDs {
+		b = wire.AppendBytes(b, 2, kid)
+	}
+	if d.Provider != "" {
+		b = wire.AppendBytes(b, 3, []byte(d.Provider))
+	}
+	if len(d.ContentID) > 0 {
+		b = wire.AppendBytes(b, 4, d.ContentID)
+	}
+	if d.Policy != "" {
+		b = wire.AppendBytes(b, 6, []byte(d.Policy))
+	}
+	if d.CryptoPeriodIndex > 0 || d.CryptoPeriodSeconds > 0 || d.Type == TypeEntitledKey {
+		b = wire.AppendVarint(b, 7, uint64(d.CryptoPeriodIndex))
+	}
+	if d.ProtectionScheme != 0 {
+		b = wire.AppendVarint(b, 9, uint64(d.ProtectionScheme))
+	}
+	if d.CryptoPeriodSeconds > 0 {
+		b = wire.AppendVarint(b, 10, uint64(d.CryptoPeriodSeconds))
+	}
+	if d.Type != TypeSingle {
+		b = wire.AppendVarint(b, 11, uint64(d.Type))
+	}
+	if d.KeySequence > 0 {
+		b = wire.AppendVarint(b, 12, uint64(d.KeySequence))
+	}
+	for _, gid := range d.GroupIDs {
+		b = wire.AppendBytes(b, 13, gid)
+	}
+	for _, ek := range d.EntitledKeys {
+		var e []byte
+		e = wire.AppendBytes(e, 1, ek.EntitlementKeyID)
+		e = wire.AppendBytes(e, 2, ek.KeyID)
+		e = wire.AppendBytes(e, 3, ek.Key)
+		e = wire.AppendBytes(e, 4, ek.IV)
+		e = wire.AppendVarint(e, 5, uint64(ek.EntitlementKeySize))
+		b = wire.AppendBytes(b, 14, e)
+	}
+	return b
+}
+
+// UnmarshalWidevineData decodes a Widevine PSSH data protobuf.
+func UnmarshalWidevineData(b []byte) (*WidevineData, error) {
+	d := &WidevineData{}
+	err := wire.Walk(b, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		switch num {
+		case 2:
+			d.KeyIDs = append(d.KeyIDs, b)
+		case 3:
+			d.Provider = string(b)
+		case 4:
+			d.ContentID = b
+		case 6:
+			d.Policy = string(b)
+		case 7:
+			d.CryptoPeriodIndex = uint32(v)
+		case 9:
+			d.ProtectionScheme = ProtectionScheme(v)
+		case 10:
+			d.CryptoPeriodSeconds = uint32(v)
+		case 11:
+			d.Type = WidevineDataType(v)
+		case 12:
+			d.KeySequence = uint32(v)
+		case 13:
+			d.GroupIDs = append(d.GroupIDs, b)
+		case 14:
+			ek := EntitledKey{EntitlementKeySize: DefaultEntitlementKeySize}
+			err := wire.Walk(b, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+				switch num {
+				case 1:
+					ek.EntitlementKeyID = b
+				case 2:
+					ek.KeyID = b
+				case 3:
+					ek.Key = b
+				case 4:
+					ek.IV = b
+				case 5:
+					ek.EntitlementKeySize = uint32(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			d.EntitledKeys = append(d.EntitledKeys, ek)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decode widevine pssh data: %v", err)
+	}
+	return d, nil
+}
+
+// Box wraps the Widevine PSSH data in a pssh box. Version 1 boxes also list the key IDs.
+func (d *WidevineData) Box(version uint8) *Box {
+	box := &Box{
+		Version:  version,
+		SystemID: WidevineSystemID,
+		Data:     d.Marshal(),
+	}
+	if version == 1 {
+		box.KeyIDs = d.KeyIDs
+	}
+	return box
+}
+
+// ParseWidevine decodes Widevine PSSH data either bare or wrapped in a Widevine pssh box.
+func ParseWidevine(b []byte) (*WidevineData, error) {
+	if IsBox(b) {
+		box, err := Parse(b)
+		if err != nil {
+			return nil, err
+		}
+		if box.SystemID != WidevineSystemID {
+			return nil, fmt.Errorf("pssh box system ID %s is not Widevine", box.SystemID)
+		}
+		b = box.Data
+	}
+	return UnmarshalWidevineData(b)
+}
@@ -0,0 +1,81 @@
+package pssh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWidevineData(t *testing.T) {
+	data := &WidevineData{
+		KeyIDs:              [][]byte{[]byte("0123456789abcdef")},
+		Provider:            "widevine_test",
+		ContentID:           []byte("fkj3ljaSdfalkr3j"),
+		ProtectionScheme:    SchemeCBCS,
+		CryptoPeriodIndex:   7,
+		CryptoPeriodSeconds: 10,
+	}
+
+	parsed, err := UnmarshalWidevineData(data.Marshal())
+	assert.NoError(t, err)
+	assert.Equal(t, data, parsed)
+
+	b, err := data.Box(1).Marshal()
+	assert.NoError(t, err)
+	box, err := Parse(b)
+	assert.NoError(t, err)
+	assert.Equal(t, data.KeyIDs, box.KeyIDs)
+
+	parsed, err = ParseWidevine(b)
+	assert.NoError(t, err)
+	assert.Equal(t, data, parsed)
+}
+
+func TestWidevineDataEntitledKeys(t *testing.T) {
+	data := &WidevineData{
+		Type: TypeEntitledKey,
+		EntitledKeys: []EntitledKey{
+			{
+				EntitlementKeyID:   []byte("entitlement-key"),
+				KeyID:              []byte("key-id"),
+				Key:                []byte("wrapped-key"),
+				IV:                 []byte("iv"),
+				EntitlementKeySize: DefaultEntitlementKeySize,
+			},
+		},
+	}
+
+	parsed, err := UnmarshalWidevineData(data.Marshal())
+	assert.NoError(t, err)
+	assert.Equal(t, data, parsed)
+}
+
+func TestWidevineDataFixture(t *testing.T) {
+	// Widevine PSSH data of the license challenge used in the proxy tests.
+	b := []byte{0x22, 0x10, 'f', 'k', 'j', '3', 'l', 'j', 'a', 'S', 'd', 'f', 'a', 'l', 'k', 'r', '3', 'j', 0x48, 0xe3, 0xdc, 0x95, 0x9b, 0x06}
+
+	data, err := ParseWidevine(b)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("fkj3ljaSdfalkr3j"), data.ContentID)
+	assert.Equal(t, SchemeCENC, data.ProtectionScheme)
+	assert.Equal(t, b, data.Marshal())
+}
+
+func TestParseWidevineOtherSystem(t *testing.T) {
+	b, _ := (&Box{SystemID: SystemID{1}}).Marshal()
+	_, err := ParseWidevine(b)
+	assert.Error(t, err)
+}
+
+func TestProtectionScheme(t *testing.T) {
+	assert.Equal(t, "cbcs", SchemeCBCS.String())
+
+	for _, s := range []string{"cenc", "cbc1", "cens", "cbcs"} {
+		scheme, err := ParseProtectionScheme(s)
+		assert.NoError(t, err)
+		assert.Equal(t, s, scheme.String())
+	}
+
+	_, err := ParseProtectionScheme("aes1")
+	assert.Error(t, err)
+}
@@ -0,0 +1,50 @@
+package widevineproxy
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// ContentResolver maps the key IDs and content ID carried in a challenge's Widevine PSSH
+// to the content ID the KeyGoverner knows the content by.
+type ContentResolver interface {
+	ResolveContentID(keyIDs []KeyID, psshContentID []byte) (string, error)
+}
+
+// StaticContentResolver is a ContentResolver from hex encoded key IDs to content IDs.
+type StaticContentResolver map[string]string
+
+// ResolveContentID returns the content of the first known key ID.
+func (r StaticContentResolver) ResolveContentID(keyIDs []KeyID, psshContentID []byte) (string, error) {
+	for _, kid := range keyIDs {
+		if contentID, ok := r[kid.String()]; ok {
+			return contentID, nil
+		}
+	}
+	return "", fmt.Errorf("no content for key IDs %v", keyIDs)
+}
+
+// ResolveContentID extracts the content ID from the Widevine PSSH of a base64 encoded challenge.
+// With a ContentResolver configured, the PSSH key IDs and content ID are looked up through it.
+func (wp *Proxy) ResolveContentID(body string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return "", fmt.Errorf("decode challenge: %v", err)
+	}
+	c, err := DecodeChallenge(b)
+	if err != nil {
+		return "", err
+	}
+	if c.MessageType != MessageTypeLicenseRequest {
+		return "", fmt.Errorf("challenge is not a license request: %s", c.MessageType)
+	}
+	wp.Logger.Debugf("Challenge PSSH: content ID %q, key IDs %v", c.ContentID, c.KeyIDs)
+
+	if wp.ContentResolver != nil {
+		return wp.ContentResolver.ResolveContentID(c.KeyIDs, c.ContentID)
+	}
+	if len(c.ContentID) == 0 {
+		return "", fmt.Errorf("challenge PSSH has no content ID")
+	}
+	return string(c.ContentID), nil
+}
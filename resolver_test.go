@@ -0,0 +1,60 @@
+package widevineproxy
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	"github.com/Cooomma/widevine-proxy/internal/wire"
+	"github.com/Cooomma/widevine-proxy/pssh"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// testChallenge builds a base64 license challenge carrying Widevine PSSH data.
+func testChallenge(data *pssh.WidevineData) string {
+	var cencID, contentID, request, challenge []byte
+	cencID = wire.AppendBytes(cencID, 1, data.Marshal())
+	cencID = wire.AppendVarint(cencID, 2, uint64(LicenseTypeStreaming))
+	contentID = wire.AppendBytes(contentID, 1, cencID)
+	request = wire.AppendBytes(request, 2, contentID)
+	request = wire.AppendVarint(request, 3, uint64(RequestTypeNew))
+	challenge = wire.AppendVarint(challenge, 1, uint64(MessageTypeLicenseRequest))
+	challenge = wire.AppendBytes(challenge, 2, request)
+	return base64.StdEncoding.EncodeToString(challenge)
+}
+
+func TestResolveContentID(t *testing.T) {
+	key, _ := hex.DecodeString(testKey)
+	iv, _ := hex.DecodeString(testIV)
+	wv := NewWidevineProxy(key, iv, "widevine_test", FakeKeyGoverner{}, logrus.New())
+
+	contentID, err := wv.ResolveContentID(testLicenseChallenge)
+	assert.NoError(t, err)
+	assert.Equal(t, "fkj3ljaSdfalkr3j", contentID)
+
+	_, err = wv.ResolveContentID(testChallenge(&pssh.WidevineData{KeyIDs: [][]byte{[]byte("0123456789abcdef")}}))
+	assert.Error(t, err)
+
+	_, err = wv.ResolveContentID("not base64!")
+	assert.Error(t, err)
+}
+
+func TestResolveContentIDWithResolver(t *testing.T) {
+	key, _ := hex.DecodeString(testKey)
+	iv, _ := hex.DecodeString(testIV)
+	wv := NewWidevineProxy(key, iv, "widevine_test", FakeKeyGoverner{}, logrus.New())
+	wv.ContentResolver = StaticContentResolver{
+		hex.EncodeToString([]byte("0123456789abcdef")): "movie-1",
+	}
+
+	challenge := testChallenge(&pssh.WidevineData{
+		KeyIDs: [][]byte{[]byte("fedcba9876543210"), []byte("0123456789abcdef")},
+	})
+	contentID, err := wv.ResolveContentID(challenge)
+	assert.NoError(t, err)
+	assert.Equal(t, "movie-1", contentID)
+
+	_, err = wv.ResolveContentID(testChallenge(&pssh.WidevineData{KeyIDs: [][]byte{[]byte("fedcba9876543210")}}))
+	assert.Error(t, err)
+}
@@ -0,0 +1,173 @@
+package widevineproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Signer signs the requests sent to Widevine Cloud.
+type Signer interface {
+	Sign(ctx context.Context, message []byte) ([]byte, error)
+}
+
+// AESSigner signs with the SHA-1 digest of the message, AES-CBC encrypted with the provider's key and IV.
+// It is the signing scheme of provider credentials.
+type AESSigner struct {
+	Key []byte
+	IV  []byte
+}
+
+// Sign signs the message. The padding of the digest is part of the signature scheme, so it is applied
+// here and the blocks encrypted as they are.
+func (s AESSigner) Sign(ctx context.Context, message []byte) ([]byte, error) {
+	digest := sha1.Sum(message)
+	signature, err := AESCBCEncryptBlocks(s.Key, s.IV, PKCS5Padding(digest[:], aes.BlockSize))
+	if err != nil {
+		return nil, fmt.Errorf("signing: %v", err)
+	}
+	return signature, nil
+}
+
+// RSAPSSSigner signs with RSASSA-PSS and a salt as long as the digest.
+type RSAPSSSigner struct {
+	Key *rsa.PrivateKey
+	// Hash is the digest of the signature, SHA-1 by default.
+	Hash crypto.Hash
+}
+
+// Sign signs the message.
+func (s RSAPSSSigner) Sign(ctx context.Context, message []byte) ([]byte, error) {
+	hash := s.Hash
+	if hash == 0 {
+		hash = crypto.SHA1
+	}
+	if !hash.Available() {
+		return nil, fmt.Errorf("hash %v is not available", hash)
+	}
+	h := hash.New()
+	h.Write(message)
+	return rsa.SignPSS(rand.Reader, s.Key, hash, h.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+}
+
+type signingRequest struct {
+	Message []byte `json:"message"`
+}
+
+type signingResponse struct {
+	Signature []byte `json:"signature"`
+}
+
+// RemoteSigner signs with a signing service holding the key, e.g. a KMS or HSM front end,
+// so the key never enters the proxy. Messages are posted as {"message": <base64>} and
+// signatures read from {"signature": <base64>}, the protocol of SigningHandler.
+type RemoteSigner struct {
+	URL    string
+	Client *http.Client
+	// Header is added to the requests, e.g. the Authorization the signing service requires.
+	Header http.Header
+}
+
+// Sign asks the signing service to sign the message.
+func (s RemoteSigner) Sign(ctx context.Context, message []byte) ([]byte, error) {
+	payload, err := json.Marshal(signingRequest{Message: message})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.URL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range s.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("signing service: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("signing service: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	var signed signingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		return nil, fmt.Errorf("signing service: %v", err)
+	}
+	if len(signed.Signature) == 0 {
+		return nil, fmt.Errorf("signing service: empty signature")
+	}
+	return signed.Signature, nil
+}
+
+// SigningHandler serves a Signer to RemoteSigners. With a local signer it stands in
+// for the signing service in development and tests.
+type SigningHandler struct {
+	Signer Signer
+	// Authorize admits a request before anything is signed, e.g. BearerToken. Anyone it admits can have
+	// license and key requests signed as the provider, so requests are refused when it is nil.
+	Authorize func(r *http.Request) error
+}
+
+func (h *SigningHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.Authorize == nil {
+		http.Error(w, "signing requests are not authorized", http.StatusForbidden)
+		return
+	}
+	if err := h.Authorize(r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var req signingRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "invalid signing request", http.StatusBadRequest)
+		return
+	}
+	signature, err := h.Signer.Sign(r.Context(), req.Message)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(signingResponse{Signature: signature})
+}
+
+// BearerToken authorizes the requests of a SigningHandler or SPEKEHandler carrying the token as "Authorization: Bearer <token>".
+func BearerToken(token string) func(r *http.Request) error {
+	want := []byte("Bearer " + token)
+	return func(r *http.Request) error {
+		if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			return fmt.Errorf("invalid bearer token")
+		}
+		return nil
+	}
+}
+
+// signer returns the Signer of the proxy, an AESSigner of the partner credentials when none is set.
+func (wp *Proxy) signer() Signer {
+	if wp.Signer != nil {
+		return wp.Signer
+	}
+	return AESSigner{Key: wp.PartnerRootKey, IV: wp.PartnerRootIV}
+}
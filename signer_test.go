@@ -0,0 +1,121 @@
+package widevineproxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSigner struct {
+	err error
+}
+
+func (s fakeSigner) Sign(ctx context.Context, message []byte) ([]byte, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return []byte("signed"), nil
+}
+
+func TestAESSigner(t *testing.T) {
+	key, _ := hex.DecodeString(testKey)
+	iv, _ := hex.DecodeString(testIV)
+	ctx := context.Background()
+
+	sign, err := AESSigner{Key: key, IV: iv}.Sign(ctx, []byte(`{"isTest":true,"test":"testing","test2":"testing2","test3":"testing3"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "ga80QzRuUM+jnPcoR6UWs5TXrTQ2VgeYiu0FoqCNRH4=", base64.StdEncoding.EncodeToString(sign))
+
+	// Invalid credentials are errors rather than panics.
+	_, err = AESSigner{Key: key[:10], IV: iv}.Sign(ctx, []byte("message"))
+	assert.Error(t, err)
+	_, err = AESSigner{Key: key, IV: iv[:8]}.Sign(ctx, []byte("message"))
+	assert.Error(t, err)
+}
+
+func TestRSAPSSSigner(t *testing.T) {
+	key := testCertificateKey(t)
+	ctx := context.Background()
+
+	sign, err := RSAPSSSigner{Key: key}.Sign(ctx, []byte("message"))
+	assert.NoError(t, err)
+	digest := sha1.Sum([]byte("message"))
+	assert.NoError(t, rsa.VerifyPSS(&key.PublicKey, crypto.SHA1, digest[:], sign, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}))
+
+	sign, err = RSAPSSSigner{Key: key, Hash: crypto.SHA256}.Sign(ctx, []byte("message"))
+	assert.NoError(t, err)
+	digest256 := sha256.Sum256([]byte("message"))
+	assert.NoError(t, rsa.VerifyPSS(&key.PublicKey, crypto.SHA256, digest256[:], sign, nil))
+}
+
+func TestRemoteSigner(t *testing.T) {
+	key, _ := hex.DecodeString(testKey)
+	iv, _ := hex.DecodeString(testIV)
+	local := AESSigner{Key: key, IV: iv}
+	server := httptest.NewServer(&SigningHandler{Signer: local, Authorize: BearerToken("secret")})
+	defer server.Close()
+	ctx := context.Background()
+
+	remote := RemoteSigner{URL: server.URL, Header: http.Header{"Authorization": {"Bearer secret"}}}
+	want, _ := local.Sign(ctx, []byte("message"))
+	got, err := remote.Sign(ctx, []byte("message"))
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	// Nothing is signed without authorization.
+	_, err = RemoteSigner{URL: server.URL}.Sign(ctx, []byte("message"))
+	assert.EqualError(t, err, "signing service: 401 Unauthorized: invalid bearer token")
+	_, err = RemoteSigner{URL: server.URL, Header: http.Header{"Authorization": {"Bearer other"}}}.Sign(ctx, []byte("message"))
+	assert.EqualError(t, err, "signing service: 401 Unauthorized: invalid bearer token")
+	open := httptest.NewServer(&SigningHandler{Signer: local})
+	defer open.Close()
+	_, err = remote.Sign(ctx, []byte("message"))
+	assert.NoError(t, err)
+	_, err = RemoteSigner{URL: open.URL}.Sign(ctx, []byte("message"))
+	assert.EqualError(t, err, "signing service: 403 Forbidden: signing requests are not authorized")
+
+	failing := httptest.NewServer(&SigningHandler{Signer: fakeSigner{err: errors.New("key disabled")}, Authorize: BearerToken("secret")})
+	defer failing.Close()
+	_, err = RemoteSigner{URL: failing.URL, Header: remote.Header}.Sign(ctx, []byte("message"))
+	assert.EqualError(t, err, "signing service: 500 Internal Server Error: key disabled")
+	assert.Error(t, BearerToken("")(httptest.NewRequest(http.MethodPost, "/", nil)))
+
+	w := httptest.NewRecorder()
+	(&SigningHandler{Signer: local}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestProxySigner(t *testing.T) {
+	key, _ := hex.DecodeString(testKey)
+	iv, _ := hex.DecodeString(testIV)
+	wp := NewWidevineProxy(key, iv, "widevine_test", FakeKeyGoverner{}, logrus.New())
+	ctx := context.Background()
+
+	// Without a Signer the partner credentials sign.
+	assert.Equal(t, AESSigner{Key: key, IV: iv}, wp.signer())
+
+	wp.Signer = fakeSigner{}
+	msg, err := wp.buildLicenseMessage(ctx, "testing", testLicenseChallenge)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("signed"), msg["signature"])
+	msg, err = wp.buildCKMessage(ctx, wp.setPolicy("testing", Policy{Tracks: []string{"SD"}}))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("signed"), msg["signature"])
+
+	wp.Signer = fakeSigner{err: errors.New("key disabled")}
+	_, err = wp.buildLicenseMessage(ctx, "testing", testLicenseChallenge)
+	assert.EqualError(t, err, "key disabled")
+	_, err = wp.GetContentKey("testing", Policy{Tracks: []string{"SD"}})
+	assert.EqualError(t, err, "key disabled")
+}
@@ -0,0 +1,222 @@
+package widevineproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/Cooomma/widevine-proxy/pssh"
+)
+
+// SPEKEVersion is the SPEKE version of SPEKEHandler.
+const SPEKEVersion = "2.0"
+
+// CPIX requests are small; larger bodies are rejected.
+const maxSPEKERequestSize = 1 << 20
+
+// SPEKEHandler is a SPEKE v2 key server: it answers the CPIX requests of packagers with the keys
+// of the proxy and the signaling of the requested DRM systems, with the Widevine PSSH of the provider.
+//
+// Keys are picked by the intended track type of their usage rule: the content key spec of the track type,
+// or the content key when there is none. Licenses only carry the key IDs of the proxy, so requests must use
+// them: a key ID other than the one of its track type is rejected.
+//
+// Key IDs are public, in the manifests and the PSSH, so requests are only answered once Authorize admits
+// them, and only with delivery data unless AllowClearKeys is set.
+type SPEKEHandler struct {
+	Proxy *Proxy
+	// InitData holds the PlayReady settings and the policy configuration of the keys.
+	// The DRM systems and the protection scheme are the ones of the request.
+	InitData InitDataOptions
+	// Authorize admits a request before any key is looked up, e.g. BearerToken. Anyone it admits gets
+	// the content keys, so requests are refused when it is nil.
+	Authorize func(r *http.Request) error
+	// AllowClearKeys answers requests without delivery data with the content keys in the clear,
+	// e.g. for packagers on a trusted network. Such requests are rejected otherwise.
+	AllowClearKeys bool
+}
+
+// spekeRequestError is an error caused by the request rather than the keys.
+type spekeRequestError struct {
+	error
+}
+
+func (h *SPEKEHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.Authorize == nil {
+		http.Error(w, "SPEKE requests are not authorized", http.StatusForbidden)
+		return
+	}
+	if err := h.Authorize(r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if v := r.Header.Get("X-Speke-Version"); v != SPEKEVersion {
+		http.Error(w, fmt.Sprintf("unsupported SPEKE version %q", v), http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSPEKERequestSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxSPEKERequestSize {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	resp, err := h.Proxy.speke(r.Context(), body, h.InitData, h.AllowClearKeys)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.As(err, &spekeRequestError{}) {
+			status = http.StatusBadRequest
+		}
+		h.Proxy.Logger.WithField("error", err.Error()).Error("SPEKE Error")
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("X-Speke-Version", SPEKEVersion)
+	w.Write(resp)
+}
+
+// SPEKE answers a SPEKE v2 CPIX request with the content keys and DRM signaling of its key IDs.
+// Content keys are encrypted to the certificate of the request's delivery data, if any.
+func (wp *Proxy) SPEKE(ctx context.Context, request []byte, opts InitDataOptions) ([]byte, error) {
+	return wp.speke(ctx, request, opts, true)
+}
+
+// speke answers a SPEKE request, with the content keys in the clear only if allowClearKeys is set.
+func (wp *Proxy) speke(ctx context.Context, request []byte, opts InitDataOptions, allowClearKeys bool) ([]byte, error) {
+	req, err := decodeCPIX(request)
+	if err != nil {
+		return nil, spekeRequestError{err}
+	}
+	if req.ContentID == "" {
+		return nil, spekeRequestError{fmt.Errorf("speke: no content ID")}
+	}
+	if req.KeyPeriods != nil {
+		return nil, spekeRequestError{fmt.Errorf("speke: key rotation is not supported")}
+	}
+	if len(req.ContentKeys) == 0 {
+		return nil, spekeRequestError{fmt.Errorf("speke: no content keys requested")}
+	}
+	if req.DeliveryData == nil && !allowClearKeys {
+		return nil, spekeRequestError{fmt.Errorf("speke: no delivery data; content keys are not sent in the clear")}
+	}
+
+	resp := newCPIX(req.ContentID)
+	if req.Version != "" {
+		resp.Version = req.Version
+	}
+	var documentKey, macKey []byte
+	if req.DeliveryData != nil {
+		var recipients []*x509.Certificate
+		for _, data := range req.DeliveryData.DeliveryData {
+			der, err := base64.StdEncoding.DecodeString(data.Certificate)
+			if err != nil {
+				return nil, spekeRequestError{fmt.Errorf("speke: delivery key: %v", err)}
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, spekeRequestError{fmt.Errorf("speke: delivery key: %v", err)}
+			}
+			recipients = append(recipients, cert)
+		}
+		if documentKey, macKey, err = resp.addRecipients(recipients); err != nil {
+			return nil, spekeRequestError{fmt.Errorf("speke: %v", err)}
+		}
+	}
+
+	trackTypes := make(map[string]string)
+	if req.UsageRules != nil {
+		for _, rule := range req.UsageRules.UsageRules {
+			if kid, err := parseCPIXKeyID(rule.KID); err == nil && trackTypes[string(kid)] == "" {
+				trackTypes[string(kid)] = rule.IntendedTrackType
+			}
+		}
+		resp.UsageRules = req.UsageRules
+	}
+
+	lookup := wp.trackKeys(ctx, req.ContentID, opts.PolicyConfig)
+	keys := make(map[string]StoredKey)
+	schemes := make(map[string]pssh.ProtectionScheme)
+	for _, contentKey := range req.ContentKeys {
+		kid, err := parseCPIXKeyID(contentKey.KID)
+		if err != nil {
+			return nil, spekeRequestError{fmt.Errorf("speke: %v", err)}
+		}
+		var scheme pssh.ProtectionScheme
+		if contentKey.CommonEncryptionScheme != "" {
+			if scheme, err = pssh.ParseProtectionScheme(contentKey.CommonEncryptionScheme); err != nil {
+				return nil, spekeRequestError{fmt.Errorf("speke: key %s: %v", contentKey.KID, err)}
+			}
+		}
+
+		trackType := trackTypes[string(kid)]
+		key, err := lookup(trackType)
+		if err != nil {
+			return nil, fmt.Errorf("speke: key %s: %v", contentKey.KID, err)
+		}
+		if !bytes.Equal(key.KeyID, kid) {
+			return nil, spekeRequestError{fmt.Errorf("speke: key %s: the key ID of track type %q is %s", contentKey.KID, trackType, KeyID(key.KeyID).UUID())}
+		}
+		element, err := cpixContentKeyOf(key, scheme, documentKey, macKey)
+		if err != nil {
+			return nil, fmt.Errorf("speke: key %s: %v", contentKey.KID, err)
+		}
+		resp.ContentKeys = append(resp.ContentKeys, element)
+		keys[string(kid)] = key
+		schemes[string(kid)] = scheme
+	}
+
+	for _, system := range req.DRMSystems {
+		kid, err := parseCPIXKeyID(system.KID)
+		if err != nil {
+			return nil, spekeRequestError{fmt.Errorf("speke: %v", err)}
+		}
+		key, ok := keys[string(kid)]
+		if !ok {
+			return nil, spekeRequestError{fmt.Errorf("speke: DRM system of unknown key %s", system.KID)}
+		}
+		drmType, err := spekeDRMType(system.SystemID)
+		if err != nil {
+			return nil, spekeRequestError{err}
+		}
+
+		systemOpts := opts
+		systemOpts.DRMTypes = []string{drmType}
+		systemOpts.ProtectionScheme = schemes[string(kid)]
+		systems, err := wp.initDataSystems(req.ContentID, []pssh.PlayReadyKey{{KeyID: key.KeyID, Key: key.Key}}, systemOpts)
+		if err != nil {
+			return nil, fmt.Errorf("speke: key %s: %v", system.KID, err)
+		}
+		resp.DRMSystems = append(resp.DRMSystems, cpixDRMSystemOf(KeyID(kid).UUID(), systems[0], systemOpts.ProtectionScheme))
+	}
+	return resp.marshal()
+}
+
+func spekeDRMType(systemID string) (string, error) {
+	id, err := pssh.ParseSystemID(systemID)
+	if err != nil {
+		return "", fmt.Errorf("speke: %v", err)
+	}
+	switch id {
+	case pssh.WidevineSystemID:
+		return DRMTypeWidevine, nil
+	case pssh.PlayReadySystemID:
+		return DRMTypePlayReady, nil
+	case pssh.CommonSystemID:
+		return DRMTypeCommon, nil
+	}
+	return "", fmt.Errorf("speke: unsupported DRM system %s", systemID)
+}
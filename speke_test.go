@@ -0,0 +1,166 @@
+package widevineproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Cooomma/widevine-proxy/pssh"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func testSPEKERequest(t *testing.T) string {
+	b, err := ioutil.ReadFile("testdata/speke-request.xml")
+	assert.NoError(t, err)
+	return string(b)
+}
+
+func testSPEKE(h http.Handler, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/speke/v2", strings.NewReader(body))
+	req.Header.Set("X-Speke-Version", SPEKEVersion)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func testSPEKEHandler() *SPEKEHandler {
+	return &SPEKEHandler{
+		Proxy:          NewWidevineProxy(nil, nil, "widevine_test", FakeMultiKeyGoverner{}, logrus.New()),
+		Authorize:      BearerToken("secret"),
+		AllowClearKeys: true,
+	}
+}
+
+func TestSPEKEHandler(t *testing.T) {
+	h := testSPEKEHandler()
+
+	w := testSPEKE(h, testSPEKERequest(t))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, SPEKEVersion, w.Header().Get("X-Speke-Version"))
+	assert.Equal(t, "application/xml", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `<cpix:VideoFilter maxPixels="442368"></cpix:VideoFilter>`)
+
+	// The requested key IDs get the SD and HD keys of the proxy.
+	key, _ := base64.StdEncoding.DecodeString("ASNFZ4mrze8BI0VniavN7w==")
+	parsed, err := ParseCPIX(w.Body.Bytes(), nil)
+	assert.NoError(t, err)
+	assert.Len(t, parsed.Keys, 2)
+	assert.Equal(t, "000102030405060708090a0b0c0d0e0f", KeyID(parsed.Keys[0].KeyID).String())
+	assert.Equal(t, "SD", parsed.Keys[0].TrackType)
+	assert.Equal(t, key, parsed.Keys[0].Key)
+	assert.Equal(t, "101112131415161718191a1b1c1d1e1f", KeyID(parsed.Keys[1].KeyID).String())
+	assert.Equal(t, "HD", parsed.Keys[1].TrackType)
+	assert.Equal(t, key, parsed.Keys[1].Key)
+
+	resp, err := decodeCPIX(w.Body.Bytes())
+	assert.NoError(t, err)
+	assert.Len(t, resp.DRMSystems, 3)
+	assert.Equal(t, pssh.PlayReadySystemID.String(), resp.DRMSystems[1].SystemID)
+	assert.NotEmpty(t, resp.DRMSystems[1].SmoothStreamingProtectionHeaderData)
+
+	b, err := base64.StdEncoding.DecodeString(resp.DRMSystems[0].PSSH)
+	assert.NoError(t, err)
+	data, err := pssh.ParseWidevine(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "widevine_test", data.Provider)
+	assert.Equal(t, []byte("testing"), data.ContentID)
+	assert.Equal(t, pssh.SchemeCBCS, data.ProtectionScheme)
+	assert.Equal(t, [][]byte{parsed.Keys[0].KeyID}, data.KeyIDs)
+
+	tag, err := base64.StdEncoding.DecodeString(resp.DRMSystems[0].HLSSignalingData[0].Data)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(tag), "#EXT-X-KEY:METHOD=SAMPLE-AES,"))
+}
+
+func TestSPEKEHandlerDocumentKey(t *testing.T) {
+	recipientKey := testCertificateKey(t)
+	cert := testRecipientCertificate(t, recipientKey)
+	h := testSPEKEHandler()
+	h.AllowClearKeys = false
+
+	request := strings.Replace(testSPEKERequest(t), "<cpix:ContentKeyList>", `<cpix:DeliveryDataList>
+    <cpix:DeliveryData>
+      <cpix:DeliveryKey><ds:X509Data xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:X509Certificate>`+
+		base64.StdEncoding.EncodeToString(cert.Raw)+`</ds:X509Certificate></ds:X509Data></cpix:DeliveryKey>
+    </cpix:DeliveryData>
+  </cpix:DeliveryDataList>
+  <cpix:ContentKeyList>`, 1)
+	w := testSPEKE(h, request)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NotContains(t, w.Body.String(), "PlainValue")
+
+	parsed, err := ParseCPIX(w.Body.Bytes(), recipientKey)
+	assert.NoError(t, err)
+	key, _ := base64.StdEncoding.DecodeString("ASNFZ4mrze8BI0VniavN7w==")
+	assert.Equal(t, key, parsed.Keys[0].Key)
+}
+
+func TestSPEKEHandlerUnauthorized(t *testing.T) {
+	h := testSPEKEHandler()
+	request := testSPEKERequest(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/speke/v2", strings.NewReader(request))
+	req.Header.Set("X-Speke-Version", SPEKEVersion)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.NotContains(t, w.Body.String(), "ContentKey")
+
+	req = httptest.NewRequest(http.MethodPost, "/speke/v2", strings.NewReader(request))
+	req.Header.Set("X-Speke-Version", SPEKEVersion)
+	req.Header.Set("Authorization", "Bearer other")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	h.Authorize = nil
+	assert.Equal(t, http.StatusForbidden, testSPEKE(h, request).Code)
+
+	// Keys are not sent in the clear unless allowed.
+	h.Authorize = BearerToken("secret")
+	h.AllowClearKeys = false
+	w = testSPEKE(h, request)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.NotContains(t, w.Body.String(), "PlainValue")
+}
+
+func TestSPEKEHandlerErrors(t *testing.T) {
+	h := testSPEKEHandler()
+	request := testSPEKERequest(t)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/speke/v2", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/speke/v2", strings.NewReader(request))
+	req.Header.Set("Authorization", "Bearer secret")
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	for _, body := range []string{
+		"not xml",
+		strings.Replace(request, `contentId="testing"`, "", 1),
+		strings.Replace(request, "9a04f079-9840-4286-ab92-e65be0885f95", "94ce86fb-07ff-4f43-adb8-93d2fa968ca2", 1),
+		strings.Replace(request, "<cpix:ContentKeyList>", `<cpix:ContentKeyPeriodList><cpix:ContentKeyPeriod id="p0" index="0"/></cpix:ContentKeyPeriodList><cpix:ContentKeyList>`, 1),
+		strings.Replace(request, `commonEncryptionScheme="cbcs"`, `commonEncryptionScheme="abcd"`, 1),
+		// Licenses would not carry a key ID of the packager's choosing.
+		strings.Replace(request, "10111213-1415-1617-1819-1a1b1c1d1e1f", "8f0b2c9e-6a3d-4e7f-b1c2-5d9e0a4f6b21", -1),
+	} {
+		assert.Equal(t, http.StatusBadRequest, testSPEKE(h, body).Code, body)
+	}
+
+	w = testSPEKE(h, string(bytes.Repeat([]byte{' '}, maxSPEKERequestSize+1)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// Key lookup failures are server errors.
+	h.Proxy.KeyProvider = fakeKeyProvider{KeyGovernerProvider{FakeKeyGovernerWithoutSpecs{}}, errors.New("key store unavailable")}
+	assert.Equal(t, http.StatusInternalServerError, testSPEKE(h, request).Code)
+}
@@ -0,0 +1,161 @@
+package widevineproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SQLKeyGoverner is a KeyProvider serving the keys of a SQLKeyStore. Set it as the proxy's
+// KeyProvider so request contexts reach the database; its KeyGoverner methods look up without one.
+type SQLKeyGoverner struct {
+	Store *SQLKeyStore
+	// GenerateOnFirstUse creates the keys of a content that has none yet.
+	GenerateOnFirstUse bool
+	// TrackTypes are the tracks keys are generated for on first use. Without track types
+	// only the content key is generated.
+	TrackTypes []string
+	// Timeout bounds each database lookup, within the deadline of the lookup's context.
+	Timeout time.Duration
+	Logger  *logrus.Logger
+}
+
+// NewSQLKeyGoverner creates a KeyGoverner on the store that generates keys on first use.
+func NewSQLKeyGoverner(store *SQLKeyStore, trackTypes []string, logger *logrus.Logger) *SQLKeyGoverner {
+	return &SQLKeyGoverner{
+		Store:              store,
+		GenerateOnFirstUse: true,
+		TrackTypes:         trackTypes,
+		Timeout:            5 * time.Second,
+		Logger:             logger,
+	}
+}
+
+func (kg *SQLKeyGoverner) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if kg.Timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, kg.Timeout)
+}
+
+func (kg *SQLKeyGoverner) key(ctx context.Context, contentID, trackType string) (*StoredKey, error) {
+	if !kg.GenerateOnFirstUse {
+		return kg.Store.Key(ctx, contentID, trackType)
+	}
+	return kg.Store.KeyOrCreate(ctx, contentID, trackType, GenerateStoredKey)
+}
+
+func (kg *SQLKeyGoverner) contentKey(ctx context.Context, contentID []byte) (*StoredKey, error) {
+	ctx, cancel := kg.context(ctx)
+	defer cancel()
+	key, err := kg.key(ctx, string(contentID), "")
+	if err != nil {
+		return nil, fmt.Errorf("content key of %q: %v", contentID, err)
+	}
+	return key, nil
+}
+
+// ContentKeyID returns the key ID of the content key.
+func (kg *SQLKeyGoverner) ContentKeyID(ctx context.Context, contentID []byte) ([]byte, error) {
+	key, err := kg.contentKey(ctx, contentID)
+	if err != nil {
+		return nil, err
+	}
+	return key.KeyID, nil
+}
+
+// ContentKey returns the content key.
+func (kg *SQLKeyGoverner) ContentKey(ctx context.Context, contentID []byte) ([]byte, error) {
+	key, err := kg.contentKey(ctx, contentID)
+	if err != nil {
+		return nil, err
+	}
+	return key.Key, nil
+}
+
+// ContentIV returns the IV of the content key.
+func (kg *SQLKeyGoverner) ContentIV(ctx context.Context, contentID []byte) ([]byte, error) {
+	key, err := kg.contentKey(ctx, contentID)
+	if err != nil {
+		return nil, err
+	}
+	return key.IV, nil
+}
+
+// ContentKeySpecs returns the keys of the tracks of the content.
+func (kg *SQLKeyGoverner) ContentKeySpecs(ctx context.Context, contentID []byte, policyConfig map[string]string) ([]ContentKeySpec, error) {
+	ctx, cancel := kg.context(ctx)
+	defer cancel()
+
+	if kg.GenerateOnFirstUse {
+		for _, trackType := range kg.TrackTypes {
+			if _, err := kg.key(ctx, string(contentID), trackType); err != nil {
+				return nil, fmt.Errorf("%s track: %v", trackType, err)
+			}
+		}
+	}
+	keys, err := kg.Store.Keys(ctx, string(contentID))
+	if err != nil {
+		return nil, err
+	}
+
+	specs := []ContentKeySpec{}
+	for _, key := range keys {
+		if key.TrackType == "" {
+			continue
+		}
+		specs = append(specs, ContentKeySpec{
+			KeyID:     base64.StdEncoding.EncodeToString(key.KeyID),
+			Key:       base64.StdEncoding.EncodeToString(key.Key),
+			IV:        base64.StdEncoding.EncodeToString(key.IV),
+			TrackType: key.TrackType,
+		})
+	}
+	return specs, nil
+}
+
+// logged logs the error of a KeyGoverner lookup, which returns nil instead.
+func (kg *SQLKeyGoverner) logged(b []byte, err error) []byte {
+	if err != nil {
+		kg.Logger.WithField("error", err.Error()).Error("Content Key Lookup Error")
+		return nil
+	}
+	return b
+}
+
+// GenerateContentKeyID returns the key ID of the content key, or nil when it cannot be looked up.
+func (kg *SQLKeyGoverner) GenerateContentKeyID(contentID []byte) []byte {
+	return kg.logged(kg.ContentKeyID(context.Background(), contentID))
+}
+
+// GenerateContentKey returns the content key, or nil when it cannot be looked up.
+func (kg *SQLKeyGoverner) GenerateContentKey(contentID []byte) []byte {
+	return kg.logged(kg.ContentKey(context.Background(), contentID))
+}
+
+// GenerateContentIV returns the IV of the content key, or nil when it cannot be looked up.
+func (kg *SQLKeyGoverner) GenerateContentIV(contentID []byte) []byte {
+	return kg.logged(kg.ContentIV(context.Background(), contentID))
+}
+
+// GenerateContentKeySpec returns the keys of the tracks of the content.
+func (kg *SQLKeyGoverner) GenerateContentKeySpec(contentID []byte, policyConfig map[string]string) (*[]ContentKeySpec, error) {
+	specs, err := kg.ContentKeySpecs(context.Background(), contentID, policyConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &specs, nil
+}
+
+// GenerateStoredKey generates a random key ID, key and IV.
+func GenerateStoredKey() (StoredKey, error) {
+	b := make([]byte, 48)
+	if _, err := rand.Read(b); err != nil {
+		return StoredKey{}, err
+	}
+	return StoredKey{KeyID: b[:16], Key: b[16:32], IV: b[32:]}, nil
+}
@@ -0,0 +1,152 @@
+package widevineproxy
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func testSQLKeyStore(t *testing.T) (*SQLKeyStore, func()) {
+	dir, err := ioutil.TempDir("", "keys")
+	assert.NoError(t, err)
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "keys.db")+"?_busy_timeout=5000&_foreign_keys=1")
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	assert.NoError(t, MigrateSQLKeyStore(ctx, db, DialectSQLite))
+	// Migrating again is a no-op.
+	assert.NoError(t, MigrateSQLKeyStore(ctx, db, DialectSQLite))
+
+	store, err := NewSQLKeyStore(ctx, db, DialectSQLite)
+	assert.NoError(t, err)
+	return store, func() {
+		store.Close()
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSQLKeyStore(t *testing.T) {
+	store, cleanup := testSQLKeyStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	_, err := store.Key(ctx, "movie", "")
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	key := StoredKey{TrackType: "SD", KeyID: []byte("0123456789abcdef"), Key: []byte("fedcba9876543210"), IV: []byte("01234567")}
+	assert.NoError(t, store.PutKey(ctx, "movie", key))
+	assert.Error(t, store.PutKey(ctx, "movie", key))
+	assert.EqualError(t, store.PutKey(ctx, "movie", StoredKey{KeyID: []byte("short")}), "key ID must be 16 bytes, got 5")
+
+	got, err := store.Key(ctx, "movie", "SD")
+	assert.NoError(t, err)
+	assert.Equal(t, &key, got)
+
+	period := StoredKey{TrackType: "SD", KeyID: []byte("period0123456789"), Key: []byte("fedcba9876543210"), IV: []byte("01234567")}
+	assert.NoError(t, store.PutCryptoPeriodKey(ctx, "movie", 7, period))
+	got, err = store.CryptoPeriodKey(ctx, "movie", "SD", 7)
+	assert.NoError(t, err)
+	assert.Equal(t, &period, got)
+	_, err = store.CryptoPeriodKey(ctx, "movie", "SD", 8)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	keys, err := store.Keys(ctx, "movie")
+	assert.NoError(t, err)
+	assert.Equal(t, []StoredKey{key}, keys)
+}
+
+func TestSQLKeyStoreKeyOrCreateConcurrent(t *testing.T) {
+	store, cleanup := testSQLKeyStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	keys := make([]*StoredKey, 10)
+	errs := make([]error, len(keys))
+	for i := range keys {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			keys[i], errs[i] = store.KeyOrCreate(ctx, "movie", "HD", GenerateStoredKey)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range keys {
+		assert.NoError(t, errs[i])
+		if assert.NotNil(t, keys[i]) {
+			assert.True(t, bytes.Equal(keys[0].KeyID, keys[i].KeyID))
+			assert.True(t, bytes.Equal(keys[0].Key, keys[i].Key))
+		}
+	}
+	stored, err := store.Keys(ctx, "movie")
+	assert.NoError(t, err)
+	assert.Len(t, stored, 1)
+}
+
+func TestSQLKeyGoverner(t *testing.T) {
+	store, cleanup := testSQLKeyStore(t)
+	defer cleanup()
+
+	kg := NewSQLKeyGoverner(store, []string{"SD", "HD", "AUDIO"}, logrus.New())
+	kid := kg.GenerateContentKeyID([]byte("movie"))
+	assert.Len(t, kid, 16)
+	assert.Equal(t, kid, kg.GenerateContentKeyID([]byte("movie")))
+	assert.Len(t, kg.GenerateContentKey([]byte("movie")), 16)
+	assert.Len(t, kg.GenerateContentIV([]byte("movie")), 16)
+
+	specs, err := kg.GenerateContentKeySpec([]byte("movie"), nil)
+	assert.NoError(t, err)
+	assert.Len(t, *specs, 3)
+	for _, spec := range *specs {
+		b, _ := base64.StdEncoding.DecodeString(spec.KeyID)
+		assert.Len(t, b, 16)
+		assert.NotEqual(t, kid, b)
+	}
+
+	// Lookup only.
+	kg.GenerateOnFirstUse = false
+	assert.Nil(t, kg.GenerateContentKey([]byte("series")))
+	specs, err = kg.GenerateContentKeySpec([]byte("series"), nil)
+	assert.NoError(t, err)
+	assert.Empty(t, *specs)
+}
+
+func TestSQLKeyGovernerKeyProvider(t *testing.T) {
+	store, cleanup := testSQLKeyStore(t)
+	defer cleanup()
+
+	var kp KeyProvider = NewSQLKeyGoverner(store, []string{"SD", "HD"}, logrus.New())
+	ctx := context.Background()
+	kid, err := kp.ContentKeyID(ctx, []byte("movie"))
+	assert.NoError(t, err)
+	assert.Len(t, kid, 16)
+	specs, err := kp.ContentKeySpecs(ctx, []byte("movie"), nil)
+	assert.NoError(t, err)
+	assert.Len(t, specs, 2)
+
+	// The request context reaches the database.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = kp.ContentKey(canceled, []byte("series"))
+	assert.Error(t, err)
+	_, err = kp.ContentKeySpecs(canceled, []byte("series"), nil)
+	assert.Error(t, err)
+
+	wp := NewWidevineProxy(nil, nil, "widevine_test", nil, logrus.New())
+	wp.KeyProvider = kp
+	systems, err := wp.InitDataContext(ctx, "movie", InitDataOptions{DRMTypes: []string{DRMTypeCommon}})
+	assert.NoError(t, err)
+	assert.Len(t, systems[0].KeyIDs, 2)
+}
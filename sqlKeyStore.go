@@ -0,0 +1,459 @@
+package widevineproxy
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrKeyNotFound is returned by key stores that have no key for a content.
+var ErrKeyNotFound = errors.New("key not found")
+
+// SQLDialect selects the placeholders and column types of the SQL key store.
+type SQLDialect string
+
+// Supported SQL dialects.
+const (
+	DialectSQLite   SQLDialect = "sqlite"
+	DialectMySQL    SQLDialect = "mysql"
+	DialectPostgres SQLDialect = "postgres"
+)
+
+func (d SQLDialect) binaryType(size int) string {
+	switch d {
+	case DialectPostgres:
+		return "BYTEA"
+	case DialectMySQL:
+		return fmt.Sprintf("VARBINARY(%d)", size)
+	}
+	return "BLOB"
+}
+
+// rebind rewrites ? placeholders to $n for Postgres.
+func (d SQLDialect) rebind(query string) string {
+	if d != DialectPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// insertContent returns the statement adding a content unless it exists, typed by the column rather than
+// by a select list, which Postgres would type as text.
+func (d SQLDialect) insertContent() string {
+	if d == DialectMySQL {
+		return `INSERT INTO contents (content_id, created_at) VALUES (?, ?) ON DUPLICATE KEY UPDATE content_id = content_id`
+	}
+	return `INSERT INTO contents (content_id, created_at) VALUES (?, ?) ON CONFLICT (content_id) DO NOTHING`
+}
+
+// sqlMigration is a schema change that is safe to apply again, see MigrateSQLKeyStore: with IF NOT EXISTS
+// or, where the dialect has none, a query counting what it creates.
+type sqlMigration struct {
+	// statement is empty when the migration only records the version for the dialect.
+	statement string
+	// applied counts the objects the statement creates; the statement is skipped when it finds any.
+	applied string
+}
+
+// sqlMigrations are applied in order; the schema of a migration is never changed once released.
+func sqlMigrations(d SQLDialect) []sqlMigration {
+	var addKEKVersion, widenContentKey sqlMigration
+	addKEKVersion.statement = `ALTER TABLE content_keys ADD COLUMN kek_version INTEGER NOT NULL DEFAULT 0`
+	if d == DialectMySQL {
+		addKEKVersion.applied = `SELECT COUNT(*) FROM information_schema.columns
+			WHERE table_schema = DATABASE() AND table_name = 'content_keys' AND column_name = 'kek_version'`
+		widenContentKey.statement = `ALTER TABLE content_keys MODIFY content_key VARBINARY(64) NOT NULL`
+	}
+	return []sqlMigration{
+		{statement: `CREATE TABLE IF NOT EXISTS contents (
+			content_id VARCHAR(255) NOT NULL PRIMARY KEY,
+			created_at TIMESTAMP NOT NULL
+		)`},
+		{statement: fmt.Sprintf(`CREATE TABLE IF NOT EXISTS content_keys (
+			key_id %s NOT NULL PRIMARY KEY,
+			content_key %s NOT NULL,
+			iv %s NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)`, d.binaryType(16), d.binaryType(16), d.binaryType(16))},
+		{statement: fmt.Sprintf(`CREATE TABLE IF NOT EXISTS tracks (
+			content_id VARCHAR(255) NOT NULL REFERENCES contents (content_id),
+			track_type VARCHAR(32) NOT NULL,
+			key_id %s NOT NULL UNIQUE REFERENCES content_keys (key_id),
+			PRIMARY KEY (content_id, track_type)
+		)`, d.binaryType(16))},
+		{statement: fmt.Sprintf(`CREATE TABLE IF NOT EXISTS crypto_periods (
+			content_id VARCHAR(255) NOT NULL REFERENCES contents (content_id),
+			track_type VARCHAR(32) NOT NULL,
+			period_index BIGINT NOT NULL,
+			key_id %s NOT NULL UNIQUE REFERENCES content_keys (key_id),
+			PRIMARY KEY (content_id, track_type, period_index)
+		)`, d.binaryType(16))},
+		// Envelope encryption: wrapped keys are longer, version 0 marks unwrapped keys.
+		addKEKVersion,
+		widenContentKey,
+	}
+}
+
+// MigrateSQLKeyStore creates or upgrades the key store schema. The applied version is kept in schema_migrations.
+// Each migration runs in a transaction. MySQL commits schema changes implicitly, so a failed run can leave
+// a migration applied but not recorded; the migrations are written to be applied again harmlessly.
+func MigrateSQLKeyStore(ctx context.Context, db *sql.DB, dialect SQLDialect) error {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL PRIMARY KEY)`); err != nil {
+		return fmt.Errorf("create schema_migrations: %v", err)
+	}
+	var version int
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return fmt.Errorf("read schema version: %v", err)
+	}
+
+	migrations := sqlMigrations(dialect)
+	for v := version + 1; v <= len(migrations); v++ {
+		if err := applySQLMigration(ctx, db, dialect, v, migrations[v-1]); err != nil {
+			return fmt.Errorf("migration %d: %v", v, err)
+		}
+	}
+	return nil
+}
+
+// applySQLMigration applies migration m as version v, unless its applied query finds it done, and records v.
+func applySQLMigration(ctx context.Context, db *sql.DB, dialect SQLDialect, v int, m sqlMigration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statement := m.statement
+	if m.applied != "" {
+		var n int
+		if err := tx.QueryRowContext(ctx, m.applied).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			statement = ""
+		}
+	}
+	if statement != "" {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, dialect.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), v); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// StoredKey is a content key of a track. The content key of a title has an empty track type.
+type StoredKey struct {
+	TrackType string
+	KeyID     []byte
+	Key       []byte
+	IV        []byte
+}
+
+// SQLKeyStore keeps content keys in a database/sql database. Statements are prepared once
+// on the pool and transactions are kept short, so the store is safe for concurrent use.
+type SQLKeyStore struct {
+	// Envelope wraps the keys written to the database and unwraps them when read.
+	// Without an Envelope keys are stored unwrapped.
+	Envelope *Envelope
+
+	db *sql.DB
+
+	selectKey       *sql.Stmt
+	selectKeys      *sql.Stmt
+	selectPeriodKey *sql.Stmt
+	insertContent   *sql.Stmt
+	insertKey       *sql.Stmt
+	insertTrack     *sql.Stmt
+	insertPeriod    *sql.Stmt
+	selectStaleKeys *sql.Stmt
+	updateKey       *sql.Stmt
+}
+
+// NewSQLKeyStore prepares the statements of the store. The schema must be migrated first, see MigrateSQLKeyStore.
+func NewSQLKeyStore(ctx context.Context, db *sql.DB, dialect SQLDialect) (*SQLKeyStore, error) {
+	s := &SQLKeyStore{db: db}
+	for _, stmt := range []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&s.selectKey, `SELECT t.track_type, k.key_id, k.content_key, k.iv, k.kek_version FROM tracks t
+			JOIN content_keys k ON k.key_id = t.key_id WHERE t.content_id = ? AND t.track_type = ?`},
+		{&s.selectKeys, `SELECT t.track_type, k.key_id, k.content_key, k.iv, k.kek_version FROM tracks t
+			JOIN content_keys k ON k.key_id = t.key_id WHERE t.content_id = ? ORDER BY t.track_type`},
+		{&s.selectPeriodKey, `SELECT p.track_type, k.key_id, k.content_key, k.iv, k.kek_version FROM crypto_periods p
+			JOIN content_keys k ON k.key_id = p.key_id WHERE p.content_id = ? AND p.track_type = ? AND p.period_index = ?`},
+		{&s.insertContent, dialect.insertContent()},
+		{&s.insertKey, `INSERT INTO content_keys (key_id, content_key, iv, kek_version, created_at) VALUES (?, ?, ?, ?, ?)`},
+		{&s.insertTrack, `INSERT INTO tracks (content_id, track_type, key_id) VALUES (?, ?, ?)`},
+		{&s.insertPeriod, `INSERT INTO crypto_periods (content_id, track_type, period_index, key_id) VALUES (?, ?, ?, ?)`},
+		{&s.selectStaleKeys, `SELECT key_id, content_key, kek_version FROM content_keys
+			WHERE kek_version < ? ORDER BY key_id LIMIT ?`},
+		{&s.updateKey, `UPDATE content_keys SET content_key = ?, kek_version = ? WHERE key_id = ? AND kek_version = ?`},
+	} {
+		prepared, err := db.PrepareContext(ctx, dialect.rebind(stmt.query))
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("prepare key store: %v", err)
+		}
+		*stmt.stmt = prepared
+	}
+	return s, nil
+}
+
+// Close closes the prepared statements. The database is left open.
+func (s *SQLKeyStore) Close() error {
+	for _, stmt := range []*sql.Stmt{s.selectKey, s.selectKeys, s.selectPeriodKey, s.insertContent,
+		s.insertKey, s.insertTrack, s.insertPeriod, s.selectStaleKeys, s.updateKey} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return nil
+}
+
+// Key returns the key of a track of the content, or ErrKeyNotFound.
+func (s *SQLKeyStore) Key(ctx context.Context, contentID, trackType string) (*StoredKey, error) {
+	return s.scanKey(s.selectKey.QueryRowContext(ctx, contentID, trackType))
+}
+
+// Keys returns the keys of every track of the content, the content key included.
+func (s *SQLKeyStore) Keys(ctx context.Context, contentID string) ([]StoredKey, error) {
+	rows, err := s.selectKeys.QueryContext(ctx, contentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []StoredKey
+	for rows.Next() {
+		key, err := s.scanKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+// CryptoPeriodKey returns the key of a crypto period of a track, or ErrKeyNotFound.
+func (s *SQLKeyStore) CryptoPeriodKey(ctx context.Context, contentID, trackType string, index uint32) (*StoredKey, error) {
+	return s.scanKey(s.selectPeriodKey.QueryRowContext(ctx, contentID, trackType, int64(index)))
+}
+
+// PutKey stores the key of a track of the content.
+func (s *SQLKeyStore) PutKey(ctx context.Context, contentID string, key StoredKey) error {
+	if err := validateStoredKey(key); err != nil {
+		return err
+	}
+	return s.insert(ctx, contentID, key, func(tx *sql.Tx) error {
+		_, err := tx.StmtContext(ctx, s.insertTrack).ExecContext(ctx, contentID, key.TrackType, key.KeyID)
+		return err
+	})
+}
+
+// PutCryptoPeriodKey stores the key of a crypto period of a track.
+func (s *SQLKeyStore) PutCryptoPeriodKey(ctx context.Context, contentID string, index uint32, key StoredKey) error {
+	if err := validateStoredKey(key); err != nil {
+		return err
+	}
+	return s.insert(ctx, contentID, key, func(tx *sql.Tx) error {
+		_, err := tx.StmtContext(ctx, s.insertPeriod).ExecContext(ctx, contentID, key.TrackType, int64(index), key.KeyID)
+		return err
+	})
+}
+
+// KeyOrCreate returns the key of a track, storing the one generate returns when there is none yet.
+// Concurrent callers all get the key that was stored first.
+func (s *SQLKeyStore) KeyOrCreate(ctx context.Context, contentID, trackType string, generate func() (StoredKey, error)) (*StoredKey, error) {
+	return getOrCreate(func() (*StoredKey, error) {
+		return s.Key(ctx, contentID, trackType)
+	}, func() error {
+		key, err := generate()
+		if err != nil {
+			return err
+		}
+		key.TrackType = trackType
+		return s.PutKey(ctx, contentID, key)
+	})
+}
+
+// CryptoPeriodKeyOrCreate returns the key of a crypto period, storing the one generate returns when there is none yet.
+func (s *SQLKeyStore) CryptoPeriodKeyOrCreate(ctx context.Context, contentID, trackType string, index uint32, generate func() (StoredKey, error)) (*StoredKey, error) {
+	return getOrCreate(func() (*StoredKey, error) {
+		return s.CryptoPeriodKey(ctx, contentID, trackType, index)
+	}, func() error {
+		key, err := generate()
+		if err != nil {
+			return err
+		}
+		key.TrackType = trackType
+		return s.PutCryptoPeriodKey(ctx, contentID, index, key)
+	})
+}
+
+// getOrCreate relies on the primary keys for uniqueness: an insert losing the race fails,
+// and the key of the winner is read back.
+func getOrCreate(get func() (*StoredKey, error), create func() error) (*StoredKey, error) {
+	var createErr error
+	for attempt := 0; attempt < 3; attempt++ {
+		key, err := get()
+		if err != ErrKeyNotFound {
+			return key, err
+		}
+		if createErr = create(); createErr == nil {
+			return get()
+		}
+	}
+	return nil, createErr
+}
+
+func (s *SQLKeyStore) insert(ctx context.Context, contentID string, key StoredKey, link func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	contentKey, version, err := s.wrap(key.Key, key.KeyID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	now := time.Now().UTC()
+	if _, err := tx.StmtContext(ctx, s.insertContent).ExecContext(ctx, contentID, now); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("insert content %q: %v", contentID, err)
+	}
+	if _, err := tx.StmtContext(ctx, s.insertKey).ExecContext(ctx, key.KeyID, contentKey, key.IV, version, now); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("insert key %x: %v", key.KeyID, err)
+	}
+	if err := link(tx); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("insert %q key of content %q: %v", key.TrackType, contentID, err)
+	}
+	return tx.Commit()
+}
+
+func (s *SQLKeyStore) wrap(key, keyID []byte) ([]byte, uint32, error) {
+	if s.Envelope == nil {
+		return key, 0, nil
+	}
+	wrapped, err := s.Envelope.Wrap(key, keyID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("wrap key: %v", err)
+	}
+	return wrapped, s.Envelope.Current, nil
+}
+
+func (s *SQLKeyStore) unwrap(key, keyID []byte, version uint32) ([]byte, error) {
+	if version == 0 {
+		return key, nil
+	}
+	if s.Envelope == nil {
+		return nil, fmt.Errorf("key is wrapped with KEK %d but the store has no envelope", version)
+	}
+	return s.Envelope.Unwrap(key, keyID)
+}
+
+func (s *SQLKeyStore) scanKey(row interface{ Scan(...interface{}) error }) (*StoredKey, error) {
+	var key StoredKey
+	var version uint32
+	if err := row.Scan(&key.TrackType, &key.KeyID, &key.Key, &key.IV, &version); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrKeyNotFound
+		}
+		return nil, err
+	}
+	unwrapped, err := s.unwrap(key.Key, key.KeyID, version)
+	if err != nil {
+		return nil, fmt.Errorf("key %x: %v", key.KeyID, err)
+	}
+	key.Key = unwrapped
+	return &key, nil
+}
+
+// RewrapKeys re-wraps every key wrapped with a KEK older than the current one of the Envelope, unwrapped
+// keys included, and returns the number of keys re-wrapped. Old KEKs can be retired afterwards.
+// Keys of newer KEKs are left alone, so stores with different current KEKs do not re-wrap each other's
+// keys back and forth.
+func (s *SQLKeyStore) RewrapKeys(ctx context.Context) (int, error) {
+	if s.Envelope == nil {
+		return 0, fmt.Errorf("the store has no envelope")
+	}
+	type staleKey struct {
+		keyID, key []byte
+		version    uint32
+	}
+
+	rewrapped := 0
+	for {
+		rows, err := s.selectStaleKeys.QueryContext(ctx, s.Envelope.Current, 100)
+		if err != nil {
+			return rewrapped, err
+		}
+		var batch []staleKey
+		for rows.Next() {
+			var k staleKey
+			if err := rows.Scan(&k.keyID, &k.key, &k.version); err != nil {
+				rows.Close()
+				return rewrapped, err
+			}
+			batch = append(batch, k)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return rewrapped, err
+		}
+		if len(batch) == 0 {
+			return rewrapped, nil
+		}
+
+		for _, k := range batch {
+			key, err := s.unwrap(k.key, k.keyID, k.version)
+			if err != nil {
+				return rewrapped, fmt.Errorf("key %x: %v", k.keyID, err)
+			}
+			wrapped, version, err := s.wrap(key, k.keyID)
+			if err != nil {
+				return rewrapped, err
+			}
+			// A key re-wrapped concurrently no longer matches its old version and is skipped.
+			res, err := s.updateKey.ExecContext(ctx, wrapped, version, k.keyID, k.version)
+			if err != nil {
+				return rewrapped, fmt.Errorf("key %x: %v", k.keyID, err)
+			}
+			if n, err := res.RowsAffected(); err == nil && n > 0 {
+				rewrapped++
+			}
+		}
+	}
+}
+
+func validateStoredKey(key StoredKey) error {
+	if len(key.KeyID) != 16 {
+		return fmt.Errorf("key ID must be 16 bytes, got %d", len(key.KeyID))
+	}
+	if len(key.Key) != 16 {
+		return fmt.Errorf("key must be 16 bytes, got %d", len(key.Key))
+	}
+	if len(key.IV) != 8 && len(key.IV) != 16 {
+		return fmt.Errorf("IV must be 8 or 16 bytes, got %d", len(key.IV))
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+//go:build mysql
+// +build mysql
+
+package widevineproxy
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSQLKeyStoreMySQL runs with -tags mysql against the database of WIDEVINE_MYSQL_DSN,
+// e.g. widevine:secret@tcp(localhost:3306)/widevine.
+func TestSQLKeyStoreMySQL(t *testing.T) {
+	dsn := os.Getenv("WIDEVINE_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("WIDEVINE_MYSQL_DSN is not set")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	testSQLKeyStoreDialect(t, db, DialectMySQL)
+}
@@ -0,0 +1,107 @@
+package widevineproxy
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testSQLKeyStoreDialect runs the key store against a database of the dialect. Its contents are unique to
+// the run, so it can run against a shared database.
+func testSQLKeyStoreDialect(t *testing.T, db *sql.DB, dialect SQLDialect) {
+	ctx := context.Background()
+	assert.NoError(t, MigrateSQLKeyStore(ctx, db, dialect))
+	assert.NoError(t, MigrateSQLKeyStore(ctx, db, dialect))
+	if dialect == DialectMySQL {
+		// A failed MySQL run leaves migrations applied but not recorded; they apply again harmlessly.
+		_, err := db.ExecContext(ctx, `DELETE FROM schema_migrations`)
+		assert.NoError(t, err)
+		assert.NoError(t, MigrateSQLKeyStore(ctx, db, dialect))
+	}
+	store, err := NewSQLKeyStore(ctx, db, dialect)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer store.Close()
+	contentID := fmt.Sprintf("%s-%d", dialect, time.Now().UnixNano())
+
+	// The second key finds the content in place.
+	var keys []StoredKey
+	for _, trackType := range []string{"SD", "HD"} {
+		key, err := GenerateStoredKey()
+		assert.NoError(t, err)
+		key.TrackType = trackType
+		assert.NoError(t, store.PutKey(ctx, contentID, key), string(dialect))
+		keys = append([]StoredKey{key}, keys...)
+	}
+	got, err := store.Keys(ctx, contentID)
+	assert.NoError(t, err)
+	assert.Equal(t, keys, got)
+
+	period, err := GenerateStoredKey()
+	assert.NoError(t, err)
+	period.TrackType = "SD"
+	assert.NoError(t, store.PutCryptoPeriodKey(ctx, contentID, 1<<31+5, period))
+	gotPeriod, err := store.CryptoPeriodKey(ctx, contentID, "SD", 1<<31+5)
+	assert.NoError(t, err)
+	assert.Equal(t, &period, gotPeriod)
+
+	var wg sync.WaitGroup
+	created := make([]*StoredKey, 5)
+	for i := range created {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			created[i], err = store.KeyOrCreate(ctx, contentID, "AUDIO", GenerateStoredKey)
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	for _, key := range created {
+		if assert.NotNil(t, key) {
+			assert.True(t, bytes.Equal(created[0].Key, key.Key))
+		}
+	}
+
+	store.Envelope, err = NewEnvelope(EnvelopeAESGCM, 1, map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)})
+	assert.NoError(t, err)
+	wrapped, err := GenerateStoredKey()
+	assert.NoError(t, err)
+	wrapped.TrackType = "UHD1"
+	assert.NoError(t, store.PutKey(ctx, contentID, wrapped))
+	gotWrapped, err := store.Key(ctx, contentID, "UHD1")
+	assert.NoError(t, err)
+	assert.Equal(t, &wrapped, gotWrapped)
+}
+
+func TestSQLKeyStoreSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "keys.db")+"?_busy_timeout=5000&_foreign_keys=1")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	testSQLKeyStoreDialect(t, db, DialectSQLite)
+
+	// A migration its applied query finds done is only recorded.
+	ctx := context.Background()
+	assert.NoError(t, applySQLMigration(ctx, db, DialectSQLite, 100, sqlMigration{
+		statement: `CREATE TABLE contents (content_id INTEGER)`,
+		applied:   `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'contents'`,
+	}))
+	var version int
+	assert.NoError(t, db.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_migrations`).Scan(&version))
+	assert.Equal(t, 100, version)
+	assert.Error(t, applySQLMigration(ctx, db, DialectSQLite, 101, sqlMigration{statement: `CREATE TABLE contents (content_id INTEGER)`}))
+}
@@ -1,8 +1,11 @@
 package widevineproxy
 
 import (
+	"crypto/rsa"
+	"fmt"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -53,11 +56,25 @@ type Proxy struct {
 	PartnerRootIV       []byte
 	Provider            string
 	ContentKeyGenerator KeyGoverner
-	httpCaller          *http.Client
-	Logger              *logrus.Logger
+	// KeyProvider supplies the keys instead of the ContentKeyGenerator when set.
+	KeyProvider KeyProvider
+	// Signer signs requests instead of the PartnerRootKey and PartnerRootIV when set.
+	Signer          Signer
+	ContentResolver ContentResolver
+	// RootCertificate verifies the service certificates served to CDMs.
+	RootCertificate *DrmCertificate
+	// ServiceCertificate is served to service certificate requests instead of asking Widevine.
+	// Set it before serving; SetServiceCertificate swaps it while serving.
+	ServiceCertificate *SignedDrmCertificate
+	// ServicePrivateKey decrypts the client identification of privacy mode challenges.
+	ServicePrivateKey    *rsa.PrivateKey
+	serviceCertificateMu sync.RWMutex
+	httpCaller           *http.Client
+	Logger               *logrus.Logger
 }
 
 // NewWidevineProxy creates an instance for grant widevine license with Widevine Cloud-based services.
+// The credentials are not checked; NewWidevineProxyWithCredentials validates them first.
 func NewWidevineProxy(key, iv []byte, provider string, keyGenerator KeyGoverner, logger *logrus.Logger) *Proxy {
 	client := &http.Client{
 		Timeout: time.Second * 10,
@@ -78,3 +95,15 @@ func NewWidevineProxy(key, iv []byte, provider string, keyGenerator KeyGoverner,
 		httpCaller:          client,
 	}
 }
+
+// NewWidevineProxyWithCredentials creates a Proxy after checking the credentials are an AES-256 key and
+// a 16 byte IV and the provider name is well formed, so bad credentials fail here rather than at the first license.
+func NewWidevineProxyWithCredentials(credentials ProviderCredentials, provider string, keyGenerator KeyGoverner, logger *logrus.Logger) (*Proxy, error) {
+	if err := ValidateProvider(provider); err != nil {
+		return nil, err
+	}
+	if err := credentials.Validate(); err != nil {
+		return nil, fmt.Errorf("provider %s: %v", provider, err)
+	}
+	return NewWidevineProxy(credentials.Key, credentials.IV, provider, keyGenerator, logger), nil
+}